@@ -0,0 +1,304 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Prefix starts every API key, so keys are easy to tell from access tokens and to spot in leaked text
+const Prefix = "grk_"
+
+// Scopes limit what an API key may do. Logins are not limited.
+const (
+	ScopeGreetings  = "greetings"
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+)
+
+// Scopes lists all known scopes
+var Scopes = []string{ScopeGreetings, ScopeUsersRead, ScopeUsersWrite}
+
+const (
+	keyPrefix     = "api-key:"
+	userKeyPrefix = "user-api-keys:"
+
+	fieldUserID   = "user_id"
+	fieldName     = "name"
+	fieldHash     = "hash"
+	fieldScopes   = "scopes"
+	fieldCreated  = "created"
+	fieldExpires  = "expires"
+	fieldLastUsed = "last_used"
+
+	idBytes     = 5
+	secretBytes = 32
+)
+
+// touchScript updates the last use of an API key, unless it has been revoked or has expired in the meantime. It
+// returns 0 when the key is gone.
+var touchScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("HSET", KEYS[1], "` + fieldLastUsed + `", ARGV[1])
+	return 1
+end
+return 0`)
+
+// ErrInvalid reports an API key that is malformed, unknown, revoked or expired
+var ErrInvalid = errors.New("invalid API key")
+
+var idEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Key describes an API key. The key itself is known only to its holder; the store keeps its hash.
+type Key struct {
+	ID       string
+	UserID   uint64
+	Name     string
+	Scopes   []string
+	Created  time.Time
+	Expires  time.Time // Zero if the key never expires
+	LastUsed time.Time // Zero if the key was never used
+}
+
+// Prefix returns the public start of the key, by which its holder can tell it apart from other keys
+func (k *Key) Prefix() string {
+	return Prefix + k.ID
+}
+
+// HasScope reports whether the key grants a scope
+func (k *Key) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// Store keeps the API keys of all users in Redis, where every service that accepts them can check them
+type Store struct {
+	redis *redis.Client
+}
+
+// Make creates an API key Store
+func Make(redis *redis.Client) *Store {
+	return &Store{redis: redis}
+}
+
+// Create issues a new API key and returns it together with its description. The key can not be recovered later.
+func (s *Store) Create(ctx context.Context, key *Key) (string, error) {
+	rawID := make([]byte, idBytes)
+	rawSecret := make([]byte, secretBytes)
+	if _, err := rand.Read(rawID); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	if _, err := rand.Read(rawSecret); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+
+	key.ID = strings.ToLower(idEncoding.EncodeToString(rawID))
+	secret := key.Prefix() + "_" + base64.RawURLEncoding.EncodeToString(rawSecret)
+
+	var expires int64
+	if !key.Expires.IsZero() {
+		expires = key.Expires.UnixMilli()
+	}
+
+	redisKey := keyPrefix + key.ID
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisKey,
+			fieldUserID, key.UserID,
+			fieldName, key.Name,
+			fieldHash, hash(secret),
+			fieldScopes, strings.Join(key.Scopes, " "),
+			fieldCreated, key.Created.UnixMilli(),
+			fieldExpires, expires,
+			fieldLastUsed, 0)
+		if !key.Expires.IsZero() {
+			pipe.ExpireAt(ctx, redisKey, key.Expires)
+		}
+		pipe.SAdd(ctx, userKeyPrefix+strconv.FormatUint(key.UserID, 10), key.ID)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create API key %v: %w", key.ID, err)
+	}
+	return secret, nil
+}
+
+// Verify checks an API key and records its use
+func (s *Store) Verify(ctx context.Context, secret string, now time.Time) (*Key, error) {
+	rest, ok := strings.CutPrefix(secret, Prefix)
+	if !ok {
+		return nil, ErrInvalid
+	}
+	id, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, ErrInvalid
+	}
+
+	fields, err := s.redis.HGetAll(ctx, keyPrefix+id).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API key %v: %w", id, err)
+	}
+	if len(fields) == 0 || subtle.ConstantTimeCompare([]byte(fields[fieldHash]), []byte(hash(secret))) != 1 {
+		return nil, ErrInvalid
+	}
+
+	key, err := decode(id, fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API key %v: %w", id, err)
+	}
+	// Redis expires the key too, but only within its own precision
+	if !key.Expires.IsZero() && !now.Before(key.Expires) {
+		return nil, ErrInvalid
+	}
+
+	// The last use is only informative, so racing updates may overwrite each other. A key revoked since it was read
+	// must not be brought back without its expiry.
+	touched, err := touchScript.Run(ctx, s.redis, []string{keyPrefix + id}, now.UnixMilli()).Int()
+	if err != nil {
+		return nil, fmt.Errorf("failed to record use of API key %v: %w", id, err)
+	}
+	if touched == 0 {
+		return nil, ErrInvalid
+	}
+	key.LastUsed = now
+	return key, nil
+}
+
+// List returns the live API keys of a user, dropping the ones that expired
+func (s *Store) List(ctx context.Context, userID uint64) ([]*Key, error) {
+	userKey := userKeyPrefix + strconv.FormatUint(userID, 10)
+
+	ids, err := s.redis.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys of user %v: %w", userID, err)
+	}
+
+	keys := make([]*Key, 0, len(ids))
+	for _, id := range ids {
+		fields, err := s.redis.HGetAll(ctx, keyPrefix+id).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API key %v: %w", id, err)
+		}
+		if len(fields) == 0 {
+			if err := s.redis.SRem(ctx, userKey, id).Err(); err != nil {
+				return nil, fmt.Errorf("failed to drop expired API key %v: %w", id, err)
+			}
+			continue
+		}
+
+		key, err := decode(id, fields)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API key %v: %w", id, err)
+		}
+		keys = append(keys, key)
+	}
+
+	slices.SortFunc(keys, func(a, b *Key) int { return a.Created.Compare(b.Created) })
+	return keys, nil
+}
+
+// Revoke removes an API key of a user. It reports whether the user had such a key.
+func (s *Store) Revoke(ctx context.Context, userID uint64, id string) (bool, error) {
+	userKey := userKeyPrefix + strconv.FormatUint(userID, 10)
+
+	// Keys of other users must not be revocable through a guessed ID
+	owned, err := s.redis.SIsMember(ctx, userKey, id).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API key %v: %w", id, err)
+	}
+	if !owned {
+		return false, nil
+	}
+
+	var deleted *redis.IntCmd
+	_, err = s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, keyPrefix+id)
+		pipe.SRem(ctx, userKey, id)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API key %v: %w", id, err)
+	}
+	return deleted.Val() > 0, nil
+}
+
+// RevokeAll removes all API keys of a user and returns how many were live
+func (s *Store) RevokeAll(ctx context.Context, userID uint64) (int, error) {
+	userKey := userKeyPrefix + strconv.FormatUint(userID, 10)
+
+	ids, err := s.redis.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke API keys of user %v: %w", userID, err)
+	}
+
+	keys := []string{userKey}
+	for _, id := range ids {
+		keys = append(keys, keyPrefix+id)
+	}
+
+	deleted, err := s.redis.Del(ctx, keys...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke API keys of user %v: %w", userID, err)
+	}
+	// The user set itself is one of the deleted keys
+	if deleted > 0 {
+		deleted--
+	}
+	return int(deleted), nil
+}
+
+func decode(id string, fields map[string]string) (*Key, error) {
+	userID, err := strconv.ParseUint(fields[fieldUserID], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad %v: %w", fieldUserID, err)
+	}
+	created, err := parseMillis(fields[fieldCreated])
+	if err != nil {
+		return nil, fmt.Errorf("bad %v: %w", fieldCreated, err)
+	}
+	expires, err := parseMillis(fields[fieldExpires])
+	if err != nil {
+		return nil, fmt.Errorf("bad %v: %w", fieldExpires, err)
+	}
+	lastUsed, err := parseMillis(fields[fieldLastUsed])
+	if err != nil {
+		return nil, fmt.Errorf("bad %v: %w", fieldLastUsed, err)
+	}
+
+	return &Key{
+		ID:       id,
+		UserID:   userID,
+		Name:     fields[fieldName],
+		Scopes:   strings.Fields(fields[fieldScopes]),
+		Created:  created,
+		Expires:  expires,
+		LastUsed: lastUsed,
+	}, nil
+}
+
+// parseMillis parses a Unix time in milliseconds, where 0 stands for the zero time
+func parseMillis(s string) (time.Time, error) {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ms == 0 {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(ms), nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Reasons to reject an access token. Errors of AuthReader wrap one of these unless verification itself failed, e.g.
+// because Redis is down.
+var (
+	// ErrNoToken reports a request without an access token
+	ErrNoToken = errors.New("no access token")
+	// ErrTokenMalformed reports a token that can not be parsed or lacks required claims
+	ErrTokenMalformed = errors.New("malformed token")
+	// ErrTokenSignature reports a token that is not signed by a trusted key
+	ErrTokenSignature = errors.New("invalid token signature")
+	// ErrTokenExpired reports a correctly signed token that is past its expiry
+	ErrTokenExpired = errors.New("token expired")
+	// ErrTokenRevoked reports a correctly signed, live token whose login has ended
+	ErrTokenRevoked = errors.New("login ended")
+	// ErrTokenAudience reports a valid token that was issued for another audience, e.g. to an OIDC client
+	ErrTokenAudience = errors.New("token for another audience")
+)
+
+// Audience is the aud claim of the tokens for the API of the services themselves. Tokens issued to OIDC clients name
+// the client instead.
+const Audience = "distributed-greeter"
+
+// TokenDetails describes the tokens of a login
+type TokenDetails struct {
+	UserID uint64
+
+	// Access token
+	AccessToken   string
+	AccessUUID    string
+	AccessExpires int64
+
+	// Refresh token
+	RefreshToken   string
+	RefreshUUID    string
+	RefreshExpires int64
+}
+
+// AuthWriter issues tokens and records the logins they belong to. Logins are recorded in Redis under the UUIDs of
+// their tokens.
+type AuthWriter struct {
+	Redis *redis.Client
+
+	ATSigner Signer
+	ATExpiry time.Duration
+
+	RTSigner Signer
+	RTExpiry time.Duration
+}
+
+// CreateToken makes a new token of the API of the services for a given user
+func (aw *AuthWriter) CreateToken(ctx context.Context, userID uint64) (*TokenDetails, error) {
+	return aw.CreateClientToken(ctx, userID, Audience, "")
+}
+
+// CreateClientToken makes a new token for a given user that is valid only at audience and grants only scope, unless
+// that is empty
+func (aw *AuthWriter) CreateClientToken(ctx context.Context, userID uint64, audience, scope string) (*TokenDetails, error) {
+	td := &TokenDetails{UserID: userID}
+	now := time.Now()
+
+	var err error
+
+	td.AccessExpires = now.Add(aw.ATExpiry).Unix()
+	td.AccessUUID = uuid.NewString()
+	atClaims := jwt.MapClaims{
+		"access_uuid": td.AccessUUID,
+		"user_id":     userID,
+		"aud":         audience,
+		"iat":         now.Unix(),
+		"exp":         td.AccessExpires,
+	}
+	if scope != "" {
+		atClaims["scope"] = scope
+	}
+	td.AccessToken, err = aw.ATSigner.Sign(ctx, atClaims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign access token: %w", err)
+	}
+
+	td.RefreshExpires = now.Add(aw.RTExpiry).Unix()
+	td.RefreshUUID = uuid.NewString()
+	td.RefreshToken, err = aw.RTSigner.Sign(ctx, jwt.MapClaims{
+		"refresh_uuid": td.RefreshUUID,
+		"user_id":      userID,
+		"aud":          audience,
+		"iat":          now.Unix(),
+		"exp":          td.RefreshExpires,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign refresh token: %w", err)
+	}
+
+	return td, nil
+}
+
+// CreateAuth records the login of the tokens
+func (aw *AuthWriter) CreateAuth(ctx context.Context, td *TokenDetails) error {
+	now := time.Now()
+	userID := strconv.FormatUint(td.UserID, 10)
+
+	_, err := aw.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, td.AccessUUID, userID, time.Unix(td.AccessExpires, 0).Sub(now))
+		pipe.Set(ctx, td.RefreshUUID, userID, time.Unix(td.RefreshExpires, 0).Sub(now))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record login %v: %w", td.AccessUUID, err)
+	}
+	return nil
+}
+
+// AuthReader verifies access tokens
+type AuthReader struct {
+	Redis *redis.Client
+	Keys  Keys
+}
+
+// ReadAuth verifies an access token and returns its claims if its login is still on
+func (ar *AuthReader) ReadAuth(ctx context.Context, tokenStr string) (map[string]interface{}, error) {
+	claims, err := ar.parse(ctx, tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	atUUID := claims["access_uuid"].(string)
+	err = ar.Redis.Get(ctx, atUUID).Err()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrTokenRevoked
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read login %v: %w", atUUID, err)
+	}
+
+	return claims, nil
+}
+
+// ReadExpiredAuth verifies an access token like ReadAuth, but accepts it after its expiry and does not check its login.
+// Only first-party tokens are accepted. Used to end the login of the token itself once it has expired.
+func (ar *AuthReader) ReadExpiredAuth(ctx context.Context, tokenStr string) (map[string]interface{}, error) {
+	claims, err := ar.parse(ctx, tokenStr)
+	if errors.Is(err, ErrTokenExpired) {
+		// The signature was checked before the expiry
+		claims, err = ar.parse(ctx, tokenStr, jwt.WithoutClaimsValidation())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !HasAudience(claims, Audience) {
+		return nil, ErrTokenAudience
+	}
+	return claims, nil
+}
+
+// parse verifies an access token and classifies why it is rejected
+func (ar *AuthReader) parse(ctx context.Context, tokenStr string, opts ...jwt.ParserOption) (jwt.MapClaims, error) {
+	opts = append(opts, jwt.WithValidMethods(ar.Keys.Methods()))
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, ar.Keys.Keyfunc(ctx), opts...)
+	switch {
+	case err == nil:
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return nil, fmt.Errorf("%w: %w", ErrTokenMalformed, err)
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, ErrUnknownKey):
+		return nil, fmt.Errorf("%w: %w", ErrTokenSignature, err)
+	case errors.Is(err, jwt.ErrTokenUnverifiable):
+		// The keys could not be read
+		return nil, err
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return nil, fmt.Errorf("%w: %w", ErrTokenExpired, err)
+	default:
+		return nil, fmt.Errorf("%w: %w", ErrTokenMalformed, err)
+	}
+
+	if _, ok := claims["access_uuid"].(string); !ok {
+		return nil, fmt.Errorf("%w: no %v claim", ErrTokenMalformed, "access_uuid")
+	}
+	return claims, nil
+}
+
+// HasAudience reports whether the claims of a verified token name the audience
+func HasAudience(claims map[string]interface{}, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
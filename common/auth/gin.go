@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/problem"
+)
+
+// ContextKey under which the JWT claims are stored in the request Context
+const ContextKey = "auth.Authorization"
+
+// Cookies and header of browser logins. The access and refresh cookies are HttpOnly. The CSRF cookie is readable by
+// the page, which must echo it in the CSRF header of every state-changing request.
+const (
+	AccessCookie  = "access_token"
+	RefreshCookie = "refresh_token"
+	CSRFCookie    = "csrf_token"
+	CSRFHeader    = "X-CSRF-Token"
+)
+
+// MakeHandler makes a middleware function that authenticates requests by their access token. The token is taken
+// from the Authorization header, base64 encoded, or else from the access cookie. Requests authenticated by cookie
+// must also pass the CSRF check.
+func MakeHandler(ar *AuthReader) gin.HandlerFunc {
+	return makeHandler(ar.ReadAuth)
+}
+
+// MakeExpiredHandler makes a middleware function like MakeHandler, but which also accepts expired and revoked tokens.
+// Only fit for ending the login of the token itself.
+func MakeExpiredHandler(ar *AuthReader) gin.HandlerFunc {
+	return makeHandler(ar.ReadExpiredAuth)
+}
+
+func makeHandler(read func(ctx context.Context, token string) (map[string]interface{}, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, fromCookie, err := AccessToken(c.Request)
+		if err != nil {
+			Challenge(c, err)
+			return
+		}
+
+		claims, err := read(c.Request.Context(), token)
+		if err != nil {
+			Challenge(c, err)
+			return
+		}
+
+		if fromCookie && !CheckCSRF(c.Request) {
+			p := problem.New(http.StatusForbidden, problem.CodeForbidden, "CSRF token mismatch")
+			p.Instance = c.Request.URL.Path
+			p.RequestID = logging.RequestID(c.Request.Context())
+			problem.Abort(c, p)
+			return
+		}
+
+		c.Set(ContextKey, claims)
+	}
+}
+
+// Challenge rejects a request whose access token failed verification. Clients learn why from the error of the
+// WWW-Authenticate header: the RFC 6750 invalid_token is refined into one error per reason, so that e.g. an expired
+// token can be refreshed while a revoked one needs a new login. Failures of the verification itself are not the
+// fault of the client and get a 500.
+func Challenge(c *gin.Context, err error) {
+	var code, description string
+	switch {
+	case errors.Is(err, ErrNoToken):
+		// RFC 6750 asks for no error when the request carries no credentials
+	case errors.Is(err, ErrTokenMalformed):
+		code, description = "malformed_token", "The access token is malformed"
+	case errors.Is(err, ErrTokenSignature):
+		code, description = "invalid_signature", "The access token signature is invalid"
+	case errors.Is(err, ErrTokenExpired):
+		code, description = "expired_token", "The access token expired"
+	case errors.Is(err, ErrTokenRevoked):
+		code, description = "revoked_token", "The login of the access token has ended"
+	case errors.Is(err, ErrTokenAudience):
+		code, description = "invalid_audience", "The access token is not for this API"
+	default:
+		c.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	challenge := "Bearer"
+	if code != "" {
+		challenge = fmt.Sprintf(`Bearer error="%v", error_description="%v"`, code, description)
+	}
+	c.Header("WWW-Authenticate", challenge)
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+// AccessToken returns the access token of a request and whether it came from the access cookie
+func AccessToken(r *http.Request) (token string, fromCookie bool, err error) {
+	if encoded, ok := BearerToken(r); ok {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", false, fmt.Errorf("%w: %w", ErrTokenMalformed, err)
+		}
+		return string(decoded), false, nil
+	}
+
+	cookie, err := r.Cookie(AccessCookie)
+	if err != nil || cookie.Value == "" {
+		return "", false, ErrNoToken
+	}
+	return cookie.Value, true, nil
+}
+
+// BearerToken returns the credentials of a request that uses the Bearer scheme
+func BearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, ok && token != ""
+}
+
+// CheckCSRF performs the double-submit check: unless the request is safe, its CSRF header must match its CSRF
+// cookie. Other sites can make the browser send the cookie, but can not read it to set the header.
+func CheckCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	cookie, err := r.Cookie(CSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(CSRFHeader)
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWK is a public key as described by RFC 7517. Only RSA and Ed25519 keys are supported.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+func publicJWK(kid, alg string, public crypto.PublicKey) (JWK, error) {
+	jwk := JWK{Kid: kid, Use: "sig", Alg: alg}
+
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64.EncodeToString(key.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = b64.EncodeToString(key)
+	default:
+		return JWK{}, fmt.Errorf("unsupported key type %T", public)
+	}
+	return jwk, nil
+}
+
+// PublicKey decodes the key
+func (jwk *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch {
+	case jwk.Kty == "RSA" && jwk.Alg == AlgRS256:
+		n, err := b64.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("bad modulus in key %v: %w", jwk.Kid, err)
+		}
+		e, err := b64.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("bad exponent in key %v: %w", jwk.Kid, err)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("bad exponent in key %v", jwk.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519" && jwk.Alg == AlgEdDSA:
+		x, err := b64.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad public key %v", jwk.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key %v: kty %v, alg %v", jwk.Kid, jwk.Kty, jwk.Alg)
+	}
+}
+
+// jwksKey is a verification key fetched from a JWKS endpoint
+type jwksKey struct {
+	alg    string
+	public crypto.PublicKey
+}
+
+// JWKSClient verifies tokens with the keys published at a JWKS endpoint. The keys are cached by kid and refetched
+// periodically, or sooner when a token names an unknown kid, which is how a rotation is noticed before the next
+// refresh.
+type JWKSClient struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+	now     func() time.Time
+
+	// Lower bound between fetches forced by unknown kids, so forged kids can not flood the endpoint
+	minInterval time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]*jwksKey
+	fetchedAt time.Time
+	fetching  *jwksFetch
+}
+
+// jwksFetch is a fetch of the keys in progress. Lookups that need its result wait for done and then read err.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// MakeJWKSClient creates a client for the JWKS endpoint at url
+func MakeJWKSClient(url string, refresh time.Duration) *JWKSClient {
+	return &JWKSClient{
+		url:         url,
+		refresh:     refresh,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		now:         time.Now,
+		minInterval: 5 * time.Second,
+	}
+}
+
+// WithClock replaces the clock of the client. Used by tests.
+func (jc *JWKSClient) WithClock(now func() time.Time) *JWKSClient {
+	jc.now = now
+	return jc
+}
+
+// Keyfunc implements Keys
+func (jc *JWKSClient) Keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, err := kidOf(token)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := jc.find(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.alg != token.Method.Alg() {
+			return nil, fmt.Errorf("%w: key %v is for %v, not %v", ErrUnknownKey, kid, key.alg, token.Method.Alg())
+		}
+		return key.public, nil
+	}
+}
+
+// Methods implements Keys
+func (jc *JWKSClient) Methods() []string {
+	return []string{AlgRS256, AlgEdDSA}
+}
+
+// find looks up a key, fetching the keys when they are stale or the kid is unknown. The lock is not held during the
+// fetch, so a slow endpoint delays only the lookups that have no cached key to fall back on. Concurrent lookups share
+// a single fetch.
+func (jc *JWKSClient) find(ctx context.Context, kid string) (*jwksKey, error) {
+	jc.mu.Lock()
+
+	since := jc.now().Sub(jc.fetchedAt)
+
+	key, known := jc.keys[kid]
+	stale := jc.keys == nil || since >= jc.refresh
+	if known && !stale {
+		jc.mu.Unlock()
+		return key, nil
+	}
+
+	f := jc.fetching
+	switch {
+	case f != nil && known:
+		// Another lookup is refreshing the keys, meanwhile the cached one will do
+		jc.mu.Unlock()
+		return key, nil
+
+	case f != nil:
+		jc.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+	case stale || since >= jc.minInterval:
+		f = &jwksFetch{done: make(chan struct{})}
+		jc.fetching = f
+		// Set before the attempt so a failing endpoint is not hammered either
+		jc.fetchedAt = jc.now()
+		jc.mu.Unlock()
+
+		// Other lookups wait for this fetch, so it must not end with the request that started it
+		keys, err := jc.fetch(context.WithoutCancel(ctx))
+
+		jc.mu.Lock()
+		if err == nil {
+			jc.keys = keys
+		}
+		jc.fetching = nil
+		f.err = err
+		close(f.done)
+		jc.mu.Unlock()
+
+	default:
+		jc.mu.Unlock()
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKey, kid)
+	}
+
+	jc.mu.Lock()
+	key, known = jc.keys[kid]
+	jc.mu.Unlock()
+
+	switch {
+	case known:
+		// Keep verifying with the cached keys while the endpoint is down
+		return key, nil
+	case f.err != nil:
+		return nil, f.err
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKey, kid)
+	}
+}
+
+// fetch reads the keys from the endpoint
+func (jc *JWKSClient) fetch(ctx context.Context) (map[string]*jwksKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jc.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := jc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS from %v: %w", jc.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS from %v: status %v", jc.url, resp.StatusCode)
+	}
+
+	var set JWKSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("bad JWKS from %v: %w", jc.url, err)
+	}
+
+	keys := make(map[string]*jwksKey, len(set.Keys))
+	for i := range set.Keys {
+		jwk := &set.Keys[i]
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		public, err := jwk.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[jwk.Kid] = &jwksKey{alg: jwk.Alg, public: public}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,354 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	keysKey    = "signing:keys"
+	rotateLock = "signing:rotate"
+
+	// Where releases before the dedicated key store kept the keys, on the Redis every service shares
+	sharedKeysKey    = "jwks:keys"
+	sharedRotateLock = "jwks:rotate"
+
+	rsaBits = 2048
+
+	// How long the ring trusts its copy of the keys before it rereads them
+	keysCacheTTL = 30 * time.Second
+
+	// How often an unknown kid may force a reread of the keys
+	missReloadInterval = time.Second
+)
+
+// storedKey is the Redis record of a signing key
+type storedKey struct {
+	Alg     string `json:"alg"`
+	Created int64  `json:"created"`
+	Key     []byte `json:"key"` // PKCS #8 DER
+}
+
+// ringKey is a parsed signing key
+type ringKey struct {
+	kid     string
+	alg     string
+	created time.Time
+	private crypto.Signer
+}
+
+// KeyRing signs tokens with asymmetric keys that it rotates on schedule. The private keys are kept in Redis, so every
+// replica of the signing service shares them. Anyone who reads that Redis can sign tokens, so it must be one that only
+// the signing service has credentials for. The verifying services get the public keys from JWKS. A key that is
+// rotated out stops signing but stays published for the overlap period, so tokens it already signed remain verifiable
+// until they expire. The overlap must therefore be at least the lifetime of the longest lived token.
+type KeyRing struct {
+	redis    *redis.Client
+	alg      string
+	rotation time.Duration
+	overlap  time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	keys     []*ringKey // Newest first
+	loadedAt time.Time
+	missAt   time.Time
+}
+
+// MakeKeyRing creates a KeyRing that signs with the given algorithm and keeps its keys in a Redis private to the
+// signing service
+func MakeKeyRing(redis *redis.Client, alg string, rotation, overlap time.Duration) (*KeyRing, error) {
+	if _, err := methodOf(alg); err != nil {
+		return nil, err
+	}
+	if rotation <= 0 {
+		return nil, fmt.Errorf("key rotation period must be positive, got %v", rotation)
+	}
+	return &KeyRing{redis: redis, alg: alg, rotation: rotation, overlap: overlap, now: time.Now}, nil
+}
+
+// WithClock replaces the clock of the ring. Used by tests.
+func (kr *KeyRing) WithClock(now func() time.Time) *KeyRing {
+	kr.now = now
+	return kr
+}
+
+// Alg returns the algorithm the ring signs with
+func (kr *KeyRing) Alg() string {
+	return kr.alg
+}
+
+// Sign implements Signer. Signs with the newest key, first rotating it if it is due.
+func (kr *KeyRing) Sign(ctx context.Context, claims jwt.Claims) (string, error) {
+	key, err := kr.current(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	method, err := methodOf(key.alg)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Keyfunc implements Keys
+func (kr *KeyRing) Keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, err := kidOf(token)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := kr.find(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.alg != token.Method.Alg() {
+			return nil, fmt.Errorf("%w: key %v is for %v, not %v", ErrUnknownKey, kid, key.alg, token.Method.Alg())
+		}
+		return key.private.Public(), nil
+	}
+}
+
+// Methods implements Keys
+func (kr *KeyRing) Methods() []string {
+	return []string{AlgRS256, AlgEdDSA}
+}
+
+// JWKS returns the public keys of the ring
+func (kr *KeyRing) JWKS(ctx context.Context) (*JWKSet, error) {
+	keys, err := kr.load(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &JWKSet{Keys: make([]JWK, 0, len(keys))}
+	for _, key := range keys {
+		jwk, err := publicJWK(key.kid, key.alg, key.private.Public())
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+// Rotate adds a new signing key and drops the expired ones
+func (kr *KeyRing) Rotate(ctx context.Context) error {
+	now := kr.now()
+
+	kid := uuid.NewString()
+	rec, err := newStoredKey(kr.alg, now)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if err := kr.redis.HSet(ctx, keysKey, kid, data).Err(); err != nil {
+		return fmt.Errorf("failed to store signing key %v: %w", kid, err)
+	}
+
+	// Drop the keys whose overlap has ended
+	recs, err := kr.redis.HKeys(ctx, keysKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read signing keys: %w", err)
+	}
+	keys, err := kr.load(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	var expired []string
+	for _, id := range recs {
+		if findKey(keys, id) == nil {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) > 0 {
+		if err := kr.redis.HDel(ctx, keysKey, expired...).Err(); err != nil {
+			return fmt.Errorf("failed to drop expired signing keys: %w", err)
+		}
+	}
+	return nil
+}
+
+// DropSharedKeys deletes the signing keys that earlier releases kept on the Redis shared with the verifying services.
+// They could be read by those services, so they are not fit to sign with. Reports whether there were any.
+func DropSharedKeys(ctx context.Context, shared *redis.Client) (bool, error) {
+	n, err := shared.Del(ctx, sharedKeysKey, sharedRotateLock).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to drop shared signing keys: %w", err)
+	}
+	return n > 0, nil
+}
+
+// current returns the key to sign with
+func (kr *KeyRing) current(ctx context.Context) (*ringKey, error) {
+	keys, err := kr.load(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 && kr.now().Sub(keys[0].created) < kr.rotation {
+		return keys[0], nil
+	}
+
+	// Only one replica rotates. The others keep signing with the old key until they see the new one.
+	locked, err := kr.redis.SetNX(ctx, rotateLock, 1, 30*time.Second).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock key rotation: %w", err)
+	}
+	if locked {
+		defer kr.redis.Del(ctx, rotateLock)
+		if err := kr.Rotate(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err = kr.load(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing key yet, key rotation in progress")
+	}
+	return keys[0], nil
+}
+
+// find returns the key with a given ID, rereading the keys if it is not known yet
+func (kr *KeyRing) find(ctx context.Context, kid string) (*ringKey, error) {
+	keys, err := kr.load(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	if key := findKey(keys, kid); key != nil {
+		return key, nil
+	}
+
+	kr.mu.Lock()
+	now := kr.now()
+	reload := now.Sub(kr.missAt) >= missReloadInterval
+	if reload {
+		kr.missAt = now
+	}
+	kr.mu.Unlock()
+
+	if reload {
+		keys, err = kr.load(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		if key := findKey(keys, kid); key != nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnknownKey, kid)
+}
+
+// load returns the unexpired keys of the ring, newest first
+func (kr *KeyRing) load(ctx context.Context, force bool) ([]*ringKey, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if !force && kr.keys != nil && kr.now().Sub(kr.loadedAt) < keysCacheTTL {
+		return kr.keys, nil
+	}
+
+	recs, err := kr.redis.HGetAll(ctx, keysKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing keys: %w", err)
+	}
+
+	keys := make([]*ringKey, 0, len(recs))
+	for kid, data := range recs {
+		key, err := parseStoredKey(kid, data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].created.After(keys[j].created) })
+
+	// A key is retired when its successor is created and expires once the overlap after that has passed
+	now := kr.now()
+	for i := 1; i < len(keys); i++ {
+		if now.Sub(keys[i-1].created) > kr.overlap {
+			keys = keys[:i]
+			break
+		}
+	}
+
+	kr.keys = keys
+	kr.loadedAt = kr.now()
+	return keys, nil
+}
+
+func findKey(keys []*ringKey, kid string) *ringKey {
+	for _, key := range keys {
+		if key.kid == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+func newStoredKey(alg string, created time.Time) (*storedKey, error) {
+	var private crypto.Signer
+	var err error
+
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaBits)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm %v", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return &storedKey{Alg: alg, Created: created.Unix(), Key: der}, nil
+}
+
+func parseStoredKey(kid, data string) (*ringKey, error) {
+	var rec storedKey
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return nil, fmt.Errorf("bad signing key %v: %w", kid, err)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(rec.Key)
+	if err != nil {
+		return nil, fmt.Errorf("bad signing key %v: %w", kid, err)
+	}
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("bad signing key %v: %T can not sign", kid, parsed)
+	}
+
+	return &ringKey{kid: kid, alg: rec.Alg, created: time.Unix(rec.Created, 0), private: private}, nil
+}
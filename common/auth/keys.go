@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// ErrUnknownKey reports a token signed with a key that is not, or no longer, trusted
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// Signer signs token claims
+type Signer interface {
+	Sign(ctx context.Context, claims jwt.Claims) (string, error)
+}
+
+// Keys resolves the keys that verify tokens
+type Keys interface {
+	// Keyfunc returns the jwt.Keyfunc that finds the key of a token
+	Keyfunc(ctx context.Context) jwt.Keyfunc
+
+	// Methods lists the accepted signing algorithms. Tokens that claim others are rejected before key lookup.
+	Methods() []string
+}
+
+// HMACKey signs and verifies tokens with a shared secret. Every holder of the secret can mint tokens, so prefer a
+// KeyRing.
+type HMACKey struct {
+	Secret string
+}
+
+// Sign implements Signer
+func (hk *HMACKey) Sign(ctx context.Context, claims jwt.Claims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(hk.Secret))
+}
+
+// Keyfunc implements Keys
+func (hk *HMACKey) Keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		return []byte(hk.Secret), nil
+	}
+}
+
+// Methods implements Keys
+func (hk *HMACKey) Methods() []string {
+	return []string{AlgHS256}
+}
+
+// RotatingHMACKey is an HMACKey whose secret can be rotated while in use. It signs with the newest secret. For a grace
+// period after a rotation it also accepts the previous secret, so that tokens signed just before stay valid. The grace
+// period should therefore outlast the tokens.
+type RotatingHMACKey struct {
+	grace time.Duration
+	now   func() time.Time
+
+	mu        sync.RWMutex
+	secret    string
+	previous  string
+	rotatedAt time.Time
+}
+
+// MakeRotatingHMACKey creates a RotatingHMACKey that starts with the given secret
+func MakeRotatingHMACKey(secret string, grace time.Duration) *RotatingHMACKey {
+	return &RotatingHMACKey{grace: grace, now: time.Now, secret: secret}
+}
+
+// WithClock replaces the clock of the key. Used by tests.
+func (rk *RotatingHMACKey) WithClock(now func() time.Time) *RotatingHMACKey {
+	rk.now = now
+	return rk
+}
+
+// Rotate replaces the secret. Rotating to the current secret changes nothing.
+func (rk *RotatingHMACKey) Rotate(secret string) {
+	rk.mu.Lock()
+	defer rk.mu.Unlock()
+
+	if secret == rk.secret {
+		return
+	}
+	rk.previous, rk.secret, rk.rotatedAt = rk.secret, secret, rk.now()
+}
+
+// Sign implements Signer
+func (rk *RotatingHMACKey) Sign(ctx context.Context, claims jwt.Claims) (string, error) {
+	rk.mu.RLock()
+	secret := rk.secret
+	rk.mu.RUnlock()
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+}
+
+// Keyfunc implements Keys
+func (rk *RotatingHMACKey) Keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		rk.mu.RLock()
+		defer rk.mu.RUnlock()
+
+		if rk.previous == "" || rk.now().Sub(rk.rotatedAt) > rk.grace {
+			return []byte(rk.secret), nil
+		}
+		return jwt.VerificationKeySet{Keys: []jwt.VerificationKey{[]byte(rk.secret), []byte(rk.previous)}}, nil
+	}
+}
+
+// Methods implements Keys
+func (rk *RotatingHMACKey) Methods() []string {
+	return []string{AlgHS256}
+}
+
+// methodOf returns the signing method of an asymmetric algorithm
+func methodOf(alg string) (jwt.SigningMethod, error) {
+	switch alg {
+	case AlgRS256:
+		return jwt.SigningMethodRS256, nil
+	case AlgEdDSA:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %v", alg)
+	}
+}
+
+// kidOf returns the key ID in the header of a token
+func kidOf(token *jwt.Token) (string, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		return "", fmt.Errorf("%w: no kid in token header", ErrUnknownKey)
+	}
+	return kid, nil
+}
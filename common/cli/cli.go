@@ -0,0 +1,260 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rinswind/distributed-greeter/common/conf"
+)
+
+// Exit codes of the service binaries. They let init containers and CI checks tell a configuration that needs a fix
+// from a failure that may go away on a retry.
+const (
+	ExitOK      = 0
+	ExitFailure = 1 // the command failed, e.g. the DB was unreachable
+	ExitUsage   = 2 // the command line is wrong
+	ExitConfig  = 3 // the configuration is invalid
+)
+
+// Version is the version of the binary, set at build time with
+//
+//	-ldflags "-X github.com/rinswind/distributed-greeter/common/cli.Version=<version>"
+var Version = "dev"
+
+// Env is what a command runs with
+type Env struct {
+	// Flags override the configuration, pass them to the ReadConfig of the service
+	Flags *conf.Flags
+	Args  []string
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Command is a subcommand of a service binary
+type Command struct {
+	// Name is one or more words, e.g. "config print"
+	Name string
+	// Args describes the positional arguments in the usage, e.g. "[FILE]"
+	Args string
+	// MaxArgs is the number of positional arguments the command accepts
+	MaxArgs int
+	Summary string
+	Run     func(ctx context.Context, env *Env) error
+}
+
+// App is the command line of a service binary
+type App struct {
+	Name string
+	// Config is a pointer to the configuration struct of the service. Its fields get a flag each in every command.
+	Config interface{}
+	// Default names the command that runs when there are no arguments
+	Default  string
+	Commands []Command
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// UsageError reports a wrong command line. Commands return it for bad arguments.
+type UsageError struct {
+	msg string
+}
+
+// Usagef creates a UsageError
+func Usagef(format string, args ...interface{}) error {
+	return &UsageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// Error implements error
+func (ue *UsageError) Error() string {
+	return ue.msg
+}
+
+// ExitCode maps the error of a command to the exit code of the process
+func ExitCode(err error) int {
+	var usageErr *UsageError
+	var confErrs conf.Errors
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return ExitOK
+	case errors.As(err, &usageErr):
+		return ExitUsage
+	case errors.As(err, &confErrs):
+		return ExitConfig
+	default:
+		return ExitFailure
+	}
+}
+
+// Run runs the command named by args and returns the exit code of the process
+func (app *App) Run(ctx context.Context, args []string) int {
+	if len(args) == 0 {
+		args = strings.Fields(app.Default)
+	}
+
+	switch {
+	case len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help"):
+		return app.help(args[1:])
+	case len(args) == 1 && args[0] == "version":
+		app.version()
+		return ExitOK
+	}
+
+	cmd, rest := app.find(args)
+	if cmd == nil {
+		fmt.Fprintf(app.Stderr, "unknown command %q\n\n", strings.Join(args, " "))
+		app.usage(app.Stderr)
+		return ExitUsage
+	}
+
+	env := &Env{Stdin: app.Stdin, Stdout: app.Stdout, Stderr: app.Stderr}
+	fs := app.flagSet(cmd, env)
+	fs.SetOutput(app.Stderr)
+
+	if err := fs.Parse(rest); err != nil {
+		// The flag set printed the problem along with the help
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+
+	var err error
+	env.Args = fs.Args()
+	if len(env.Args) > cmd.MaxArgs {
+		err = Usagef("too many arguments: %v", strings.Join(env.Args, " "))
+	} else {
+		err = cmd.Run(ctx, env)
+	}
+
+	var usageErr *UsageError
+	switch {
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(app.Stderr, "%v\n\n", err)
+		fs.Usage()
+	case err != nil:
+		fmt.Fprintln(app.Stderr, err)
+	}
+	return ExitCode(err)
+}
+
+// find returns the command with the most words that start args, and the args that follow them
+func (app *App) find(args []string) (*Command, []string) {
+	var found *Command
+	var rest []string
+	for i := range app.Commands {
+		cmd := &app.Commands[i]
+		words := strings.Fields(cmd.Name)
+		if len(words) > len(args) || (found != nil && len(words) <= len(strings.Fields(found.Name))) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == strings.Join(words, " ") {
+			found, rest = cmd, args[len(words):]
+		}
+	}
+	return found, rest
+}
+
+func (app *App) flagSet(cmd *Command, env *Env) *flag.FlagSet {
+	fs := flag.NewFlagSet(app.Name+" "+cmd.Name, flag.ContinueOnError)
+	env.Flags = conf.NewFlags(fs, app.Config)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %v %v [FLAGS] %v\n\n%v\n\nFlags:\n", app.Name, cmd.Name, cmd.Args, cmd.Summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// help prints the usage of the app, or of the command named by args
+func (app *App) help(args []string) int {
+	if len(args) == 0 {
+		app.usage(app.Stdout)
+		return ExitOK
+	}
+
+	cmd, rest := app.find(args)
+	if cmd == nil || len(rest) > 0 {
+		fmt.Fprintf(app.Stderr, "unknown command %q\n\n", strings.Join(args, " "))
+		app.usage(app.Stderr)
+		return ExitUsage
+	}
+	fs := app.flagSet(cmd, &Env{})
+	fs.SetOutput(app.Stdout)
+	fs.Usage()
+	return ExitOK
+}
+
+func (app *App) usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %v [COMMAND] [FLAGS] [ARGS]\n\nCommands:\n", app.Name)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range app.Commands {
+		summary := cmd.Summary
+		if cmd.Name == app.Default {
+			summary += " (default)"
+		}
+		fmt.Fprintf(tw, "  %v %v\t%v\n", cmd.Name, cmd.Args, summary)
+	}
+	fmt.Fprintf(tw, "  help [COMMAND]\tShow the help of a command\n")
+	fmt.Fprintf(tw, "  version\tPrint the version\n")
+	tw.Flush()
+
+	fmt.Fprintf(w, `
+Every command takes a flag for each setting that has an env var, e.g. --http-port for HTTP_PORT. Flags take
+precedence over the env, the secret dirs and the configuration file. Run "%v help COMMAND" to list them.
+
+Exit codes: %v success, %v failure, %v wrong usage, %v invalid configuration
+`, app.Name, ExitOK, ExitFailure, ExitUsage, ExitConfig)
+}
+
+func (app *App) version() {
+	fmt.Fprintf(app.Stdout, "%v %v", app.Name, Version)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				fmt.Fprintf(app.Stdout, " (%v)", s.Value)
+			}
+		}
+		fmt.Fprintf(app.Stdout, " %v", info.GoVersion)
+	}
+	fmt.Fprintln(app.Stdout)
+}
+
+// ConfigCommands are the "config validate" and "config print" commands. inspect reads the configuration of the
+// service and returns its settings, along with its problems if it is invalid.
+func ConfigCommands(inspect func(fl *conf.Flags) ([]conf.Setting, error)) []Command {
+	return []Command{
+		{
+			Name:    "config validate",
+			Summary: "Check the configuration and report all of its problems",
+			Run: func(ctx context.Context, env *Env) error {
+				if _, err := inspect(env.Flags); err != nil {
+					return err
+				}
+				fmt.Fprintln(env.Stdout, "The configuration is valid")
+				return nil
+			},
+		},
+		{
+			Name:    "config print",
+			Summary: "Print the effective configuration with the source of each value, secrets redacted",
+			Run: func(ctx context.Context, env *Env) error {
+				settings, err := inspect(env.Flags)
+				if printErr := conf.Print(env.Stdout, settings); printErr != nil {
+					return printErr
+				}
+				return err
+			},
+		},
+	}
+}
@@ -0,0 +1,68 @@
+package conf
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/sethvargo/go-envconfig"
+)
+
+// Flags are the command line settings of a service. They take precedence over all other sources.
+//
+// Every field of the configuration that can be set with an env var can be set with a flag named after it, e.g.
+// DB_ENDPOINT with --db-endpoint. Secrets are left out, since the command line of a process is visible to others.
+type Flags struct {
+	// File replaces CONFIG_FILE when set
+	File string
+
+	values map[string]string
+	names  map[string]string
+}
+
+// NewFlags registers the flags of a configuration struct in a flag set. cfg is a pointer to the struct, only its type
+// is used.
+func NewFlags(fs *flag.FlagSet, cfg interface{}) *Flags {
+	fl := &Flags{values: map[string]string{}, names: map[string]string{}}
+
+	fs.StringVar(&fl.File, "config", "", "the configuration file (default $CONFIG_FILE or config.yaml)")
+	for _, f := range fields(cfg) {
+		if f.envKey == "" || f.secret {
+			continue
+		}
+
+		envKey := f.envKey
+		name := strings.ToLower(strings.ReplaceAll(envKey, "_", "-"))
+		fl.names[envKey] = name
+		fs.Func(name, fmt.Sprintf("sets %v (%v %v)", f.path, f.value.Type(), envKey), func(val string) error {
+			fl.values[envKey] = val
+			return nil
+		})
+	}
+	return fl
+}
+
+// ConfigFile returns the name of the configuration file, given by --config or CONFIG_FILE. Flags may be nil.
+func (fl *Flags) ConfigFile() string {
+	if fl != nil && fl.File != "" {
+		return fl.File
+	}
+	return File()
+}
+
+// LoadFlags applies the flags that were set. Flags may be nil, e.g. when the service reads its configuration
+// without a command line.
+func (l *Loader) LoadFlags(fl *Flags) {
+	if fl == nil || len(fl.values) == 0 {
+		return
+	}
+
+	l.track(func() {
+		if err := envconfig.ProcessWith(context.Background(), l.cfg, envconfig.MapLookuper(fl.values)); err != nil {
+			l.errs = append(l.errs, Problem{Source: "flags", Reason: err.Error()})
+		}
+	}, func(f field) string {
+		return "flag --" + fl.names[f.envKey]
+	})
+}
@@ -0,0 +1,280 @@
+package conf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/sethvargo/go-envconfig"
+	"gopkg.in/yaml.v2"
+)
+
+// Problem is a rejected configuration value together with the source that set it
+type Problem struct {
+	// Field is the path of the value, e.g. "Db.Endpoint". Empty when a whole source failed to load.
+	Field string
+	// Source names where the value came from, e.g. "file config.yaml", "env DB_ENDPOINT" or
+	// "secret /var/secrets/db/endpoint"
+	Source string
+	Reason string
+}
+
+// Errors reports every problem of a configuration at once, so that they can all be fixed in one go
+type Errors []Problem
+
+// Error implements error
+func (errs Errors) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid configuration, %v problem(s):", len(errs))
+	for _, p := range errs {
+		b.WriteString("\n  ")
+		if p.Field != "" {
+			b.WriteString(p.Field + ": ")
+		}
+		fmt.Fprintf(&b, "%v (from %v)", p.Reason, p.Source)
+	}
+	return b.String()
+}
+
+// Loader fills a configuration struct from layered sources, remembering which source set each field last. Problems
+// are collected rather than returned, so that all of them can be reported at once.
+type Loader struct {
+	cfg     interface{}
+	sources map[string]string
+	errs    Errors
+}
+
+// NewLoader creates a Loader that fills cfg, a pointer to a struct
+func NewLoader(cfg interface{}) *Loader {
+	return &Loader{cfg: cfg, sources: map[string]string{}}
+}
+
+// field is a leaf of the configuration struct
+type field struct {
+	path   string
+	envKey string
+	secret bool
+	value  reflect.Value
+}
+
+// fields lists the leaves of a configuration struct with the env vars that set them
+func fields(cfg interface{}) []field {
+	var fields []field
+
+	var walk func(v reflect.Value, path, envPrefix string)
+	walk = func(v reflect.Value, path, envPrefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if !sf.IsExported() {
+				continue
+			}
+			fieldPath := sf.Name
+			if path != "" {
+				fieldPath = path + "." + sf.Name
+			}
+
+			envName, envOpts, _ := strings.Cut(sf.Tag.Get("env"), ",")
+			if sf.Type.Kind() == reflect.Struct {
+				prefix := envPrefix
+				for _, opt := range strings.Split(envOpts, ",") {
+					if p, ok := strings.CutPrefix(opt, "prefix="); ok {
+						prefix += p
+					}
+				}
+				walk(v.Field(i), fieldPath, prefix)
+				continue
+			}
+
+			var envKey string
+			if envName != "" {
+				envKey = envPrefix + envName
+			}
+			secret := sf.Tag.Get("secret") == "true"
+			fields = append(fields, field{path: fieldPath, envKey: envKey, secret: secret, value: v.Field(i)})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "", "")
+	return fields
+}
+
+// track runs a load step and attributes the fields it changed to a source
+func (l *Loader) track(load func(), source func(f field) string) {
+	tracked := fields(l.cfg)
+	before := make([]interface{}, len(tracked))
+	for i, f := range tracked {
+		before[i] = copyValue(f.value)
+	}
+
+	load()
+
+	for i, f := range tracked {
+		if !reflect.DeepEqual(before[i], f.value.Interface()) {
+			l.sources[f.path] = source(f)
+		}
+	}
+}
+
+func copyValue(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Slice && !v.IsNil() {
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(c, v)
+		return c.Interface()
+	}
+	return v.Interface()
+}
+
+// source describes where the current value of a field came from
+func (l *Loader) source(path string) string {
+	if src, ok := l.sources[path]; ok {
+		return src
+	}
+	for _, f := range fields(l.cfg) {
+		if f.path == path && f.envKey != "" {
+			return "default, set with env " + f.envKey
+		}
+	}
+	return "default"
+}
+
+// Fail records a problem with the current value of a field
+func (l *Loader) Fail(path, format string, args ...interface{}) {
+	l.errs = append(l.errs, Problem{Field: path, Source: l.source(path), Reason: fmt.Sprintf(format, args...)})
+}
+
+// Require records a problem if a field is not set
+func (l *Loader) Require(path string, set bool) {
+	if !set {
+		l.Fail(path, "is required")
+	}
+}
+
+// OneOf records a problem if a field is not one of the allowed values. An allowed "" means the field may be left out.
+func (l *Loader) OneOf(path, val string, allowed ...string) {
+	var named []string
+	for _, a := range allowed {
+		if val == a {
+			return
+		}
+		if a != "" {
+			named = append(named, a)
+		}
+	}
+	l.Fail(path, "is %q, must be one of %v", val, strings.Join(named, ", "))
+}
+
+// Err returns the problems found so far, if any
+func (l *Loader) Err() error {
+	if len(l.errs) == 0 {
+		return nil
+	}
+	return l.errs
+}
+
+// Sources returns the source of every field that a source set, by field path
+func (l *Loader) Sources() map[string]string {
+	return l.sources
+}
+
+// File returns the name of the configuration file, which is given by CONFIG_FILE
+func File() string {
+	if file := os.Getenv("CONFIG_FILE"); file != "" {
+		return file
+	}
+	return "config.yaml"
+}
+
+type dirLookup struct {
+	path string
+	hits map[string]string
+}
+
+func (dl *dirLookup) Lookup(key string) (string, bool) {
+	kebabKey := strings.ReplaceAll(key, "_", "-")
+	names := []string{
+		key,
+		strings.ToLower(key),
+		kebabKey,
+		strings.ToLower(kebabKey),
+	}
+
+	for _, name := range names {
+		file := path.Join(dl.path, name)
+		val, err := os.ReadFile(file)
+		if err == nil {
+			dl.hits[key] = file
+			return string(val), true
+		}
+	}
+	return "", false
+}
+
+// LoadDir reads a directory of secrets, one file per env var. Missing directories are fine, as not every
+// deployment mounts every secret.
+func (l *Loader) LoadDir(dir string) {
+	if dir == "" {
+		return
+	}
+
+	lookup := &dirLookup{path: dir, hits: map[string]string{}}
+	l.track(func() {
+		if err := envconfig.ProcessWith(context.Background(), l.cfg, lookup); err != nil {
+			l.errs = append(l.errs, Problem{Source: "secret dir " + dir, Reason: err.Error()})
+		}
+	}, func(f field) string {
+		return "secret " + lookup.hits[f.envKey]
+	})
+}
+
+// LoadYaml reads a YAML file. The file must exist.
+func (l *Loader) LoadYaml(file string) {
+	source := "file " + file
+
+	f, err := os.Open(file)
+	if err != nil {
+		l.errs = append(l.errs, Problem{Source: source, Reason: err.Error()})
+		return
+	}
+	defer f.Close()
+
+	l.track(func() {
+		decoder := yaml.NewDecoder(f)
+		if err := decoder.Decode(l.cfg); err != nil {
+			l.errs = append(l.errs, Problem{Source: source, Reason: err.Error()})
+		}
+	}, func(field) string {
+		return source
+	})
+}
+
+// LoadEnv reads the env vars named by the env tags of the configuration struct
+func (l *Loader) LoadEnv() {
+	l.track(func() {
+		if err := envconfig.Process(context.Background(), l.cfg); err != nil {
+			l.errs = append(l.errs, Problem{Source: "env", Reason: err.Error()})
+		}
+	}, func(f field) string {
+		return "env " + f.envKey
+	})
+}
+
+// ExpandTemplate fills a field with the values of args, e.g. a Dsn with the parts of the Db section
+func (l *Loader) ExpandTemplate(path string, expand *string, args interface{}) {
+	tmpl, err := template.New(path).Option("missingkey=error").Parse(*expand)
+	if err != nil {
+		l.Fail(path, "bad template: %v", err)
+		return
+	}
+
+	buff := bytes.NewBufferString("")
+	if err := tmpl.Execute(buff, args); err != nil {
+		l.Fail(path, "bad template: %v", err)
+		return
+	}
+	*expand = buff.String()
+}
@@ -0,0 +1,47 @@
+package conf
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// Replaces the values of secret fields
+const redacted = "<redacted>"
+
+// Setting is a resolved configuration value together with the layer that supplied it
+type Setting struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+	// Source is "default", "file <CONFIG_FILE>", "secret <config dir file>" or "env <var>"
+	Source string `json:"source"`
+}
+
+// Settings lists every field of a configuration struct in declaration order, with the sources recorded by its Loader.
+// Fields tagged `secret:"true"` are redacted.
+func Settings(cfg interface{}, sources map[string]string) []Setting {
+	var settings []Setting
+	for _, f := range fields(cfg) {
+		value := fmt.Sprint(f.value.Interface())
+		if f.secret && !f.value.IsZero() {
+			value = redacted
+		}
+
+		source, ok := sources[f.path]
+		if !ok {
+			source = "default"
+		}
+		settings = append(settings, Setting{Field: f.path, Value: value, Source: source})
+	}
+	return settings
+}
+
+// Print writes settings as an aligned table
+func Print(w io.Writer, settings []Setting) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tVALUE\tSOURCE")
+	for _, s := range settings {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", s.Field, s.Value, s.Source)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,146 @@
+package conf
+
+import (
+	"strings"
+	"time"
+)
+
+// The sections below are shared by the services. They are meant to be embedded in a configuration struct with an env
+// prefix, e.g.
+//
+//	Db conf.Db `yaml:"Db" env:",prefix=DB_"`
+//
+// Their Validate methods take the path of the section, so that problems name the field as it appears in the struct.
+
+// Http configures the public endpoint
+type Http struct {
+	Port     int    `yaml:"Port" env:"PORT,overwrite"`
+	CertFile string `yaml:"CertFile" env:"CERT_FILE,overwrite"`
+}
+
+// Validate records the problems of the section
+func (s *Http) Validate(l *Loader, path string) {
+	l.Require(path+".Port", s.Port > 0)
+}
+
+// Db configures the SQL DB. Dsn is a template over the other fields. The password of each connection comes from the
+// provider selected in Auth, see the dbauth package. ReadTimeout and WriteTimeout bound each query and each change
+// made by a store, zero leaves them bounded only by the request.
+type Db struct {
+	Dsn      string `yaml:"Dsn" env:"DSN,overwrite" secret:"true"`
+	Driver   string `yaml:"Driver" env:"DRIVER,overwrite"`
+	Endpoint string `yaml:"Endpoint" env:"ENDPOINT,overwrite"`
+	Name     string `yaml:"Name" env:"NAME,overwrite"`
+	User     string `yaml:"User" env:"USER,overwrite"`
+	Password string `yaml:"Password" env:"PASSWORD,overwrite" secret:"true"`
+	Auth     DbAuth `yaml:"Auth" env:",prefix=AUTH_"`
+
+	ReadTimeout  time.Duration `yaml:"ReadTimeout" env:"READ_TIMEOUT,overwrite"`
+	WriteTimeout time.Duration `yaml:"WriteTimeout" env:"WRITE_TIMEOUT,overwrite"`
+}
+
+// DbAuth selects the provider of the DB password. Provider is static when empty, the other fields are used only by
+// the providers that need them.
+type DbAuth struct {
+	Provider string `yaml:"Provider" env:"PROVIDER,overwrite"`
+	File     string `yaml:"File" env:"FILE,overwrite"`
+	Resource string `yaml:"Resource" env:"RESOURCE,overwrite"`
+	ClientID string `yaml:"ClientID" env:"CLIENT_ID,overwrite"`
+}
+
+// Validate records the problems of the section, e.g. that the selected provider lacks what it needs to connect. An
+// unknown provider is reported when the service creates it, since providers can be registered by the service.
+func (s *Db) Validate(l *Loader, path string) {
+	l.Require(path+".Dsn", s.Dsn != "")
+	l.OneOf(path+".Driver", s.Driver, "mysql", "postgres", "sqlite")
+	if s.ReadTimeout < 0 {
+		l.Fail(path+".ReadTimeout", "is %v, must not be negative", s.ReadTimeout)
+	}
+	if s.WriteTimeout < 0 {
+		l.Fail(path+".WriteTimeout", "is %v, must not be negative", s.WriteTimeout)
+	}
+	if s.Driver == "sqlite" {
+		// The DB is a local file named by the Dsn, without users
+		return
+	}
+	l.Require(path+".Endpoint", s.Endpoint != "")
+	l.Require(path+".Name", s.Name != "")
+	l.Require(path+".User", s.User != "")
+	switch s.Auth.Provider {
+	case "", "static":
+		l.Require(path+".Password", s.Password != "")
+	case "file":
+		l.Require(path+".Auth.File", s.Auth.File != "")
+	}
+}
+
+// Expand fills the Dsn template
+func (s *Db) Expand(l *Loader, path string) {
+	l.ExpandTemplate(path+".Dsn", &s.Dsn, s)
+}
+
+// Redis configures the Redis client. Dsn is a template over the other fields.
+type Redis struct {
+	Dsn      string `yaml:"Dsn" env:"DSN,overwrite" secret:"true"`
+	Endpoint string `yaml:"Endpoint" env:"ENDPOINT,overwrite"`
+	Db       int    `yaml:"Db" env:"DB,overwrite"`
+	User     string `yaml:"User" env:"USER,overwrite"`
+	Password string `yaml:"Password" env:"PASSWORD,overwrite" secret:"true"`
+	TLS      bool   `yaml:"TLS" env:"TLS,overwrite"`
+}
+
+// Validate records the problems of the section
+func (s *Redis) Validate(l *Loader, path string) {
+	l.Require(path+".Dsn", s.Dsn != "")
+	l.Require(path+".Endpoint", s.Endpoint != "")
+}
+
+// Expand fills the Dsn template
+func (s *Redis) Expand(l *Loader, path string) {
+	l.ExpandTemplate(path+".Dsn", &s.Dsn, s)
+}
+
+// Reload configures how the secret dirs are watched for rotated secrets
+type Reload struct {
+	PollInterval time.Duration `yaml:"PollInterval" env:"POLL_INTERVAL,overwrite"`
+	Grace        time.Duration `yaml:"Grace" env:"GRACE,overwrite"`
+}
+
+// Validate records the problems of the section
+func (s *Reload) Validate(l *Loader, path string) {
+	if s.PollInterval < 0 {
+		l.Fail(path+".PollInterval", "is %v, must not be negative", s.PollInterval)
+	}
+	if s.Grace < 0 {
+		l.Fail(path+".Grace", "is %v, must not be negative", s.Grace)
+	}
+}
+
+// Log configures logging
+type Log struct {
+	Format string `yaml:"Format" env:"FORMAT,overwrite"`
+	Level  string `yaml:"Level" env:"LEVEL,overwrite"`
+}
+
+// Validate records the problems of the section
+func (s *Log) Validate(l *Loader, path string) {
+	l.OneOf(path+".Format", strings.ToLower(s.Format), "", "json", "text")
+	l.OneOf(path+".Level", strings.ToLower(s.Level), "", "debug", "info", "warn", "error")
+}
+
+// Admin configures the admin endpoint, which is disabled when Port is 0
+type Admin struct {
+	Port       int  `yaml:"Port" env:"PORT,overwrite"`
+	ShowConfig bool `yaml:"ShowConfig" env:"SHOW_CONFIG,overwrite"`
+}
+
+// Tracing configures the export of traces
+type Tracing struct {
+	Exporter string `yaml:"Exporter" env:"EXPORTER,overwrite"`
+	Endpoint string `yaml:"Endpoint" env:"ENDPOINT,overwrite"`
+}
+
+// Validate records the problems of the section
+func (s *Tracing) Validate(l *Loader, path string) {
+	l.OneOf(path+".Exporter", s.Exporter, "", "none", "stdout", "otlp")
+}
@@ -0,0 +1,184 @@
+package conf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How long a burst of file events may last, e.g. while the files of a secret are replaced one by one
+const settleDelay = 100 * time.Millisecond
+
+// Watcher re-reads a configuration when the files in its secret dirs change, e.g. when Kubernetes updates a mounted
+// secret. Changes are noticed through fsnotify and, since not every kind of volume delivers its events, by polling as
+// well. A configuration that fails validation is logged and skipped, the subscribers only see valid ones.
+type Watcher[T any] struct {
+	dirs []string
+	poll time.Duration
+	read func() (T, error)
+
+	mu      sync.Mutex
+	current T
+	digest  string
+	subs    []func(old, cfg T)
+}
+
+// NewWatcher creates a Watcher that rereads a configuration with read. Empty dirs are skipped.
+func NewWatcher[T any](current T, read func() (T, error), poll time.Duration, dirs ...string) *Watcher[T] {
+	w := &Watcher[T]{poll: poll, read: read, current: current}
+	for _, dir := range dirs {
+		if dir != "" {
+			w.dirs = append(w.dirs, dir)
+		}
+	}
+	w.digest = digestDirs(w.dirs)
+	return w
+}
+
+// Subscribe registers a function to call with the old and the new configuration after every change. Subscribers are
+// called one at a time.
+func (w *Watcher[T]) Subscribe(fn func(old, cfg T)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subs = append(w.subs, fn)
+}
+
+// Current returns the latest valid configuration
+func (w *Watcher[T]) Current() T {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// Check re-reads the configuration if the files in the secret dirs changed since the last check. Subscribers are
+// notified if the new configuration is valid and differs from the current one.
+func (w *Watcher[T]) Check() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	digest := digestDirs(w.dirs)
+	if digest == w.digest {
+		return nil
+	}
+	w.digest = digest
+
+	cfg, err := w.read()
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(cfg, w.current) {
+		return nil
+	}
+
+	old := w.current
+	w.current = cfg
+	for _, fn := range w.subs {
+		fn(old, cfg)
+	}
+	return nil
+}
+
+// Run watches the secret dirs until the context ends. A poll interval of 0 polls only when fsnotify is unavailable.
+func (w *Watcher[T]) Run(ctx context.Context) {
+	if len(w.dirs) == 0 {
+		return
+	}
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	poll := w.poll
+
+	fw, err := w.notify()
+	if err == nil {
+		defer fw.Close()
+		events, errs = fw.Events, fw.Errors
+	} else {
+		if poll <= 0 {
+			poll = time.Minute
+		}
+		slog.Warn("Watching config dirs by polling only", "error", err, "interval", poll)
+	}
+
+	var ticks <-chan time.Time
+	if poll > 0 {
+		ticker := time.NewTicker(poll)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-errs:
+			slog.Warn("Failed to watch config dirs", "error", err)
+			continue
+		case <-ticks:
+		case <-events:
+			settle := time.After(settleDelay)
+			for settled := false; !settled; {
+				select {
+				case <-ctx.Done():
+					return
+				case <-events:
+				case <-settle:
+					settled = true
+				}
+			}
+		}
+
+		if err := w.Check(); err != nil {
+			slog.Error("Rejected reloaded configuration, keeping the current one", "error", err)
+		}
+	}
+}
+
+func (w *Watcher[T]) notify() (*fsnotify.Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range w.dirs {
+		if err := fw.Add(dir); err != nil {
+			fw.Close()
+			return nil, err
+		}
+	}
+	return fw, nil
+}
+
+// digestDirs hashes the names and contents of the files in some dirs. Hidden entries are skipped, e.g. the "..data"
+// link through which Kubernetes swaps the files of a secret.
+func digestDirs(dirs []string) string {
+	h := sha256.New()
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			h.Write([]byte("missing " + dir + "\n"))
+			continue
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			file := path.Join(dir, e.Name())
+			data, err := os.ReadFile(file)
+			if err != nil {
+				// A dir, or a file that went away in the middle of an update
+				continue
+			}
+			h.Write([]byte(file + "\n"))
+			h.Write(data)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
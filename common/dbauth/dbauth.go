@@ -0,0 +1,108 @@
+package dbauth
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rinswind/distributed-greeter/common/conf"
+)
+
+// Provider supplies the password of new DB connections. Providers are asked for every connection, so that they can
+// hand out rotated passwords and fresh tokens.
+type Provider interface {
+	Password(ctx context.Context) (string, error)
+}
+
+// Factory creates a Provider from the DB config section
+type Factory func(cfg conf.Db) (Provider, error)
+
+// The provider used when the config names none
+const defaultProvider = "static"
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{}
+)
+
+func init() {
+	Register(defaultProvider, newStatic)
+	Register("file", newFile)
+	Register("azure-msi", newAzureMSI)
+}
+
+// Register makes a provider available under a name, e.g. for another cloud or a fake one in tests. Registering a name
+// again replaces its factory.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[name] = factory
+}
+
+// New creates the provider named by the DB config section
+func New(cfg conf.Db) (Provider, error) {
+	name := cfg.Auth.Provider
+	if name == "" {
+		name = defaultProvider
+	}
+
+	mu.RLock()
+	factory, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown DB auth provider %q, must be one of %v", name, strings.Join(Names(), ", "))
+	}
+	return factory(cfg)
+}
+
+// Names lists the registered providers
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// static authenticates with the password in the config
+type static struct {
+	password string
+}
+
+func newStatic(cfg conf.Db) (Provider, error) {
+	return &static{password: cfg.Password}, nil
+}
+
+// Password implements Provider
+func (s *static) Password(ctx context.Context) (string, error) {
+	return s.password, nil
+}
+
+// file authenticates with the contents of a file, which is reread for every connection so that a rotated password
+// takes effect without a reload
+type file struct {
+	path string
+}
+
+func newFile(cfg conf.Db) (Provider, error) {
+	if cfg.Auth.File == "" {
+		return nil, fmt.Errorf("DB auth provider file needs a file")
+	}
+	return &file{path: cfg.Auth.File}, nil
+}
+
+// Password implements Provider
+func (f *file) Password(ctx context.Context) (string, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read DB password: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,127 @@
+package dbauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rinswind/distributed-greeter/common/conf"
+)
+
+// How long before its expiry a token is replaced, so that it does not expire while a connection authenticates
+const tokenMargin = 5 * time.Minute
+
+// TokenSource fetches access tokens, e.g. of the managed identity of a cloud VM
+type TokenSource interface {
+	Token(ctx context.Context) (token string, expires time.Time, err error)
+}
+
+// TokenProvider is a Provider that authenticates with the tokens of a TokenSource. A token is reused until shortly
+// before it expires.
+type TokenProvider struct {
+	source TokenSource
+	now    func() time.Time
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewTokenProvider creates a TokenProvider
+func NewTokenProvider(source TokenSource) *TokenProvider {
+	return &TokenProvider{source: source, now: time.Now}
+}
+
+// WithClock replaces the clock of the provider. Used by tests.
+func (tp *TokenProvider) WithClock(now func() time.Time) *TokenProvider {
+	tp.now = now
+	return tp
+}
+
+// Password implements Provider
+func (tp *TokenProvider) Password(ctx context.Context) (string, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	if tp.token != "" && tp.now().Add(tokenMargin).Before(tp.expires) {
+		return tp.token, nil
+	}
+
+	token, expires, err := tp.source.Token(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get DB access token: %w", err)
+	}
+	tp.token, tp.expires = token, expires
+	return token, nil
+}
+
+const (
+	// The instance metadata endpoint that hands out the tokens of the managed identity of an Azure VM
+	azureTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+	// The resource of Azure Database for MySQL and PostgreSQL
+	azureDBResource = "https://ossrdbms-aad.database.windows.net"
+)
+
+// AzureMSI fetches tokens of an Azure managed identity. ClientID selects a user-assigned identity, leave it empty for
+// the system-assigned one.
+type AzureMSI struct {
+	Endpoint string
+	Resource string
+	ClientID string
+	Client   *http.Client
+}
+
+func newAzureMSI(cfg conf.Db) (Provider, error) {
+	resource := cfg.Auth.Resource
+	if resource == "" {
+		resource = azureDBResource
+	}
+	return NewTokenProvider(&AzureMSI{
+		Endpoint: azureTokenEndpoint,
+		Resource: resource,
+		ClientID: cfg.Auth.ClientID,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}), nil
+}
+
+// Token implements TokenSource
+func (am *AzureMSI) Token(ctx context.Context) (string, time.Time, error) {
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {am.Resource}}
+	if am.ClientID != "" {
+		query.Set("client_id", am.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, am.Endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := am.Client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("token endpoint returned %v", resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", time.Time{}, fmt.Errorf("bad token response: %w", err)
+	}
+	expiresOn, err := strconv.ParseInt(body.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("bad token expiry %q: %w", body.ExpiresOn, err)
+	}
+	return body.AccessToken, time.Unix(expiresOn, 0), nil
+}
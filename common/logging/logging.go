@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// FormatJSON renders log records as JSON objects
+	FormatJSON = "json"
+	// FormatText renders log records as key=value pairs
+	FormatText = "text"
+)
+
+var level = new(slog.LevelVar)
+
+// Setup installs the default structured logger. Records logged through the standard "log" package are routed to it
+// as well.
+func Setup(format, lvl string) error {
+	if err := SetLevel(lvl); err != nil {
+		return err
+	}
+
+	logger, err := New(os.Stdout, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
+	gin.DebugPrintRouteFunc = func(method, path, handler string, handlers int) {
+		slog.Debug("Route", "method", method, "path", path, "handler", handler)
+	}
+	return nil
+}
+
+// New makes a logger writing to w that honors the current log level
+func New(w io.Writer, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level, AddSource: true}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	case FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %v", format)
+	}
+
+	return slog.New(&contextHandler{handler}), nil
+}
+
+// Level returns the current log level
+func Level() slog.Level {
+	return level.Level()
+}
+
+// SetLevel changes the log level, e.g. to "debug", "info", "warn" or "error"
+func SetLevel(lvl string) error {
+	if lvl == "" {
+		lvl = slog.LevelInfo.String()
+	}
+
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return fmt.Errorf("bad log level %v: %w", lvl, err)
+	}
+	level.Set(l)
+	return nil
+}
+
+// contextHandler decorates every record with the request ID and trace found in the context
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
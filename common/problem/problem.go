@@ -0,0 +1,94 @@
+package problem
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContentType is the media type of problem details responses
+const ContentType = "application/problem+json"
+
+// Code is a stable, machine-readable error code. Clients should branch on codes rather than on titles or details.
+type Code string
+
+const (
+	// CodeInvalidRequest means the request body violates the REST API contract
+	CodeInvalidRequest Code = "invalid_request"
+	// CodeInvalidParameter means a path or query parameter is malformed
+	CodeInvalidParameter Code = "invalid_parameter"
+	// CodeValidationFailed means well-formed input broke the rules of the service. InvalidParams lists the offending fields.
+	CodeValidationFailed Code = "validation_failed"
+	// CodeUnauthorized means the caller could not be authenticated
+	CodeUnauthorized Code = "unauthorized"
+	// CodeForbidden means the caller is authenticated but may not access the resource
+	CodeForbidden Code = "forbidden"
+	// CodeNotFound means the addressed resource does not exist
+	CodeNotFound Code = "not_found"
+	// CodeConflict means the request clashes with the current state of the resource
+	CodeConflict Code = "conflict"
+	// CodePreconditionRequired means the request must name the version of the resource it changes in If-Match
+	CodePreconditionRequired Code = "precondition_required"
+	// CodePreconditionFailed means the resource is no longer at the version named in If-Match
+	CodePreconditionFailed Code = "precondition_failed"
+	// CodeUnsupportedMediaType means the request body is not in a format the resource accepts
+	CodeUnsupportedMediaType Code = "unsupported_media_type"
+	// CodeRateLimited means the caller made too many attempts and must wait for the Retry-After period
+	CodeRateLimited Code = "rate_limited"
+	// CodeAccountLocked means the account is temporarily locked and may be retried after the Retry-After period
+	CodeAccountLocked Code = "account_locked"
+	// CodeEmailNotVerified means the account must verify its email address before it can log in
+	CodeEmailNotVerified Code = "email_not_verified"
+	// CodeInternal means the service failed to process a valid request
+	CodeInternal Code = "internal"
+	// CodeTimeout means a backend of the service did not answer in time. The request may be retried.
+	CodeTimeout Code = "timeout"
+)
+
+// Problem models RFC 7807 problem details, extended with a stable error code and the ID of the failed request
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	Code          Code           `json:"code"`
+	RequestID     string         `json:"request_id,omitempty"`
+	InvalidParams []InvalidParam `json:"invalid_params,omitempty"`
+}
+
+// InvalidParam explains why a single request field was rejected
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// New makes a Problem with a formatted detail message
+func New(status int, code Code, format string, args ...interface{}) *Problem {
+	return &Problem{
+		Type:   TypeURI(code),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: fmt.Sprintf(format, args...),
+		Code:   code,
+	}
+}
+
+// TypeURI returns the problem type URI identifying a code
+func TypeURI(code Code) string {
+	return "urn:distributed-greeter:problem:" + string(code)
+}
+
+// Error implements error
+func (p *Problem) Error() string {
+	return fmt.Sprintf("%v %v: %v", p.Status, p.Code, p.Detail)
+}
+
+// Abort sends the Problem as the response and stops the handler chain
+func Abort(c *gin.Context, p *Problem) {
+	c.Header("Content-Type", ContentType)
+	c.AbortWithStatusJSON(p.Status, p)
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/conf"
+	"github.com/rinswind/distributed-greeter/common/dbauth"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+)
+
+// NewRedis creates a Redis client from its expanded config section and checks that Redis is reachable
+func NewRedis(ctx context.Context, cfg conf.Redis, hooks ...redis.Hook) (*redis.Client, error) {
+	opts, err := redis.ParseURL(cfg.Dsn)
+	if err != nil {
+		return nil, fmt.Errorf("bad Redis DSN: %w", err)
+	}
+	if cfg.TLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	client := redis.NewClient(opts)
+	for _, hook := range hooks {
+		client.AddHook(hook)
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to reach Redis at %v: %w", cfg.Endpoint, err)
+	}
+	return client, nil
+}
+
+// NewDB opens a DB pool from its expanded config section, with the password of the auth provider the section selects.
+// The driver must be registered. Like sql.Open it does not connect yet.
+func NewDB(cfg conf.Db) (*sqldb.DB, error) {
+	creds, err := dbauth.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sqldb.Open(cfg.Driver, cfg.Dsn, creds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DB %v at %v: %w", cfg.Name, cfg.Endpoint, err)
+	}
+	return db, nil
+}
+
+// ReconnectDB switches a DB pool to a changed config section, e.g. after its credentials were rotated
+func ReconnectDB(ctx context.Context, db *sqldb.DB, cfg conf.Db) error {
+	creds, err := dbauth.New(cfg)
+	if err != nil {
+		return err
+	}
+	return db.Reconnect(ctx, cfg.Dsn, creds)
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/conf"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+)
+
+// How long the endpoints may take to finish their requests when the service stops
+const shutdownTimeout = 10 * time.Second
+
+// Runner runs a service: it creates the clients the service shares with the others, serves the endpoints the service
+// registers and runs its background tasks. It stops when an endpoint fails or the process gets SIGINT or SIGTERM, and
+// then releases everything in reverse order.
+type Runner struct {
+	name string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	servers []*http.Server
+	tasks   []func(ctx context.Context)
+	closers []func()
+}
+
+// NewRunner creates the Runner of a named service
+func NewRunner(name string) *Runner {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	return &Runner{name: name, ctx: ctx, cancel: cancel}
+}
+
+// Context returns the context of the service, which ends when the service stops
+func (r *Runner) Context() context.Context {
+	return r.ctx
+}
+
+// Redis creates a Redis client of the service. It is closed when the service stops.
+func (r *Runner) Redis(cfg conf.Redis, hooks ...redis.Hook) (*redis.Client, error) {
+	slog.Info("Resolved Redis endpoint", "endpoint", cfg.Endpoint)
+	client, err := NewRedis(r.ctx, cfg, hooks...)
+	if err != nil {
+		return nil, err
+	}
+	r.OnStop(func() { client.Close() })
+	return client, nil
+}
+
+// DB opens the DB pool of the service. It is closed when the service stops.
+func (r *Runner) DB(cfg conf.Db) (*sqldb.DB, error) {
+	slog.Info("Resolved DB endpoint", "driver", cfg.Driver, "endpoint", cfg.Endpoint, "auth", cfg.Auth.Provider)
+	db, err := NewDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.OnStop(func() { db.Close() })
+	return db, nil
+}
+
+// Serve registers an endpoint to serve on a port
+func (r *Runner) Serve(name string, port int, handler http.Handler) {
+	addr := fmt.Sprintf(":%v", port)
+	slog.Info("Resolved endpoint", "name", name, "endpoint", addr)
+	r.servers = append(r.servers, &http.Server{Addr: addr, Handler: handler})
+}
+
+// Go registers a task to run in the background until the service stops, e.g. a conf.Watcher
+func (r *Runner) Go(task func(ctx context.Context)) {
+	r.tasks = append(r.tasks, task)
+}
+
+// OnStop registers a function to call when the service stops. They are called in reverse order of registration.
+func (r *Runner) OnStop(fn func()) {
+	r.closers = append(r.closers, fn)
+}
+
+// Run starts the tasks and the endpoints and blocks until the service stops. Returns the error of the endpoint that
+// failed, or nil when the service was asked to stop.
+func (r *Runner) Run() error {
+	defer r.Close()
+
+	var tasks sync.WaitGroup
+	for _, task := range r.tasks {
+		tasks.Add(1)
+		go func() {
+			defer tasks.Done()
+			task(r.ctx)
+		}()
+	}
+	defer tasks.Wait()
+
+	failed := make(chan error, len(r.servers))
+	for _, srv := range r.servers {
+		go func() {
+			if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				failed <- fmt.Errorf("endpoint %v failed: %w", srv.Addr, err)
+			}
+		}()
+	}
+	slog.Info("Started service", "service", r.name)
+
+	var err error
+	select {
+	case <-r.ctx.Done():
+		slog.Info("Stopping service", "service", r.name)
+	case err = <-failed:
+		slog.Error("Stopping service", "service", r.name, "error", err)
+	}
+	r.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range r.servers {
+		if shutdownErr := srv.Shutdown(ctx); shutdownErr != nil {
+			slog.Warn("Failed to stop endpoint gracefully", "endpoint", srv.Addr, "error", shutdownErr)
+		}
+	}
+	return err
+}
+
+// Close calls the OnStop functions. Run calls it when it returns, the service calls it only when it fails before Run.
+func (r *Runner) Close() {
+	r.cancel()
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		r.closers[i]()
+	}
+	r.closers = nil
+}
@@ -0,0 +1,210 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	sessionPrefix     = "session:"
+	userSessionPrefix = "user-sessions:"
+
+	fieldUserID    = "user_id"
+	fieldRefreshID = "refresh_id"
+	fieldCreated   = "created"
+	fieldLastUsed  = "last_used"
+	fieldUserAgent = "user_agent"
+	fieldIP        = "ip"
+)
+
+// touchScript updates the last use of a session, unless it has been revoked or has expired in the meantime
+var touchScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HSET", KEYS[1], "` + fieldLastUsed + `", ARGV[1])
+end
+return 0`)
+
+// Session describes a login. Its ID is the access UUID under which the login records its authentication in Redis.
+type Session struct {
+	ID        string
+	RefreshID string
+	UserID    uint64
+	Created   time.Time
+	LastUsed  time.Time
+	UserAgent string
+	IP        string
+}
+
+// Store keeps the sessions of all users in Redis, next to the authentication records of the logins
+type Store struct {
+	redis *redis.Client
+}
+
+// Make creates a session Store
+func Make(redis *redis.Client) *Store {
+	return &Store{redis: redis}
+}
+
+// Create records a session that lasts until expires
+func (s *Store) Create(ctx context.Context, session *Session, expires time.Time) error {
+	key := sessionPrefix + session.ID
+	userKey := userSessionPrefix + strconv.FormatUint(session.UserID, 10)
+	ttl := time.Until(expires)
+
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			fieldUserID, session.UserID,
+			fieldRefreshID, session.RefreshID,
+			fieldCreated, session.Created.UnixMilli(),
+			fieldLastUsed, session.LastUsed.UnixMilli(),
+			fieldUserAgent, session.UserAgent,
+			fieldIP, session.IP)
+		pipe.Expire(ctx, key, ttl)
+		pipe.SAdd(ctx, userKey, session.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create session %v: %w", session.ID, err)
+	}
+	return nil
+}
+
+// Touch records that a session was used at the given time
+func (s *Store) Touch(ctx context.Context, id string, now time.Time) error {
+	err := touchScript.Run(ctx, s.redis, []string{sessionPrefix + id}, now.UnixMilli()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to touch session %v: %w", id, err)
+	}
+	return nil
+}
+
+// Get reads a session, returning nil if it does not exist
+func (s *Store) Get(ctx context.Context, id string) (*Session, error) {
+	fields, err := s.redis.HGetAll(ctx, sessionPrefix+id).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session %v: %w", id, err)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	session, err := decode(id, fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session %v: %w", id, err)
+	}
+	return session, nil
+}
+
+// List returns the live sessions of a user, dropping the ones that expired
+func (s *Store) List(ctx context.Context, userID uint64) ([]*Session, error) {
+	userKey := userSessionPrefix + strconv.FormatUint(userID, 10)
+
+	ids, err := s.redis.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions of user %v: %w", userID, err)
+	}
+
+	sessions := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		session, err := s.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if session == nil {
+			if err := s.redis.SRem(ctx, userKey, id).Err(); err != nil {
+				return nil, fmt.Errorf("failed to drop expired session %v: %w", id, err)
+			}
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// Revoke ends a session by removing it together with the authentication records of its tokens. It reports whether
+// there was anything to revoke.
+func (s *Store) Revoke(ctx context.Context, id string) (bool, error) {
+	session, err := s.Get(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	keys := []string{id, sessionPrefix + id}
+	if session != nil && session.RefreshID != "" {
+		keys = append(keys, session.RefreshID)
+	}
+
+	var deleted *redis.IntCmd
+	_, err = s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, keys...)
+		if session != nil {
+			pipe.SRem(ctx, userSessionPrefix+strconv.FormatUint(session.UserID, 10), id)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke session %v: %w", id, err)
+	}
+	return deleted.Val() > 0, nil
+}
+
+// RevokeAll ends all sessions of a user and returns how many were live
+func (s *Store) RevokeAll(ctx context.Context, userID uint64) (int, error) {
+	sessions, err := s.List(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, session := range sessions {
+		ok, err := s.Revoke(ctx, session.ID)
+		if err != nil {
+			return revoked, err
+		}
+		if ok {
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func decode(id string, fields map[string]string) (*Session, error) {
+	userID, err := strconv.ParseUint(fields[fieldUserID], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad %v: %w", fieldUserID, err)
+	}
+	created, err := parseMillis(fields[fieldCreated])
+	if err != nil {
+		return nil, fmt.Errorf("bad %v: %w", fieldCreated, err)
+	}
+	lastUsed, err := parseMillis(fields[fieldLastUsed])
+	if err != nil {
+		return nil, fmt.Errorf("bad %v: %w", fieldLastUsed, err)
+	}
+
+	return &Session{
+		ID:        id,
+		RefreshID: fields[fieldRefreshID],
+		UserID:    userID,
+		Created:   created,
+		LastUsed:  lastUsed,
+		UserAgent: fields[fieldUserAgent],
+		IP:        fields[fieldIP],
+	}, nil
+}
+
+func parseMillis(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, errors.New("missing")
+	}
+	millis, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(millis), nil
+}
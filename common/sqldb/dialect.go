@@ -0,0 +1,151 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Dialect covers what the SQL of the supported DBs differs in. Stores write their queries with ? placeholders and
+// the column types that all DBs accept, and take the rest from the Dialect of their DB.
+type Dialect interface {
+	// Name is the name of the driver, e.g. "mysql"
+	Name() string
+
+	// Rebind rewrites the ? placeholders of a query for the DB
+	Rebind(query string) string
+
+	// AutoIncrementKey is the column definition of an integer primary key that the DB generates
+	AutoIncrementKey() string
+
+	// Upsert is the clause that completes an INSERT so that a row with the same key is updated instead. The columns
+	// in update take the values of the INSERT. When is a condition on the existing row, qualified with the table
+	// name, under which it is updated, or "" to update it always. A row that is left as it was counts as no row
+	// affected.
+	Upsert(key string, update []string, when string) string
+
+	// InsertID runs an INSERT of a row with an AutoIncrementKey and returns the generated key. The query is rebound.
+	InsertID(ctx context.Context, q Querier, query, key string, args ...interface{}) (uint64, error)
+
+	// SyncKey moves the generator of an AutoIncrementKey past the keys that were inserted explicitly, e.g. by an
+	// import, so that the next generated key is free
+	SyncKey(ctx context.Context, q Querier, table, key string) error
+
+	// IsDuplicate reports whether err is a violation of a primary or unique key
+	IsDuplicate(err error) bool
+}
+
+// Querier is a sql.DB or a sql.Tx
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+var dialects = map[string]Dialect{}
+
+// RegisterDialect makes a Dialect available for its driver
+func RegisterDialect(dialect Dialect) {
+	mu.Lock()
+	defer mu.Unlock()
+	dialects[dialect.Name()] = dialect
+}
+
+// DialectOf returns the Dialect of a driver
+func DialectOf(driverName string) (Dialect, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if dialect, ok := dialects[driverName]; ok {
+		return dialect, nil
+	}
+	names := make([]string, 0, len(dialects))
+	for name := range dialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("no SQL dialect for driver %q, must be one of %v", driverName, strings.Join(names, ", "))
+}
+
+// Queries runs queries written with ? placeholders on a DB of any Dialect
+type Queries struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewQueries creates the Queries of a DB
+func NewQueries(db *sql.DB, dialect Dialect) *Queries {
+	return &Queries{db: db, dialect: dialect}
+}
+
+// Dialect returns the Dialect of the DB
+func (q *Queries) Dialect() Dialect {
+	return q.dialect
+}
+
+// ExecContext runs a statement
+func (q *Queries) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return q.db.ExecContext(ctx, q.dialect.Rebind(query), args...)
+}
+
+// QueryContext runs a query
+func (q *Queries) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return q.db.QueryContext(ctx, q.dialect.Rebind(query), args...)
+}
+
+// QueryRowContext runs a query that returns at most one row
+func (q *Queries) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return q.db.QueryRowContext(ctx, q.dialect.Rebind(query), args...)
+}
+
+// InsertID runs an INSERT and returns the generated key, see Dialect.InsertID
+func (q *Queries) InsertID(ctx context.Context, query, key string, args ...interface{}) (uint64, error) {
+	return q.dialect.InsertID(ctx, q.db, q.dialect.Rebind(query), key, args...)
+}
+
+// BeginTx starts a transaction
+func (q *Queries) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := q.db.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx: tx, dialect: q.dialect}, nil
+}
+
+// Tx is a transaction of Queries
+type Tx struct {
+	tx      *sql.Tx
+	dialect Dialect
+}
+
+// ExecContext runs a statement
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return tx.tx.ExecContext(ctx, tx.dialect.Rebind(query), args...)
+}
+
+// QueryContext runs a query
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.tx.QueryContext(ctx, tx.dialect.Rebind(query), args...)
+}
+
+// QueryRowContext runs a query that returns at most one row
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return tx.tx.QueryRowContext(ctx, tx.dialect.Rebind(query), args...)
+}
+
+// InsertID runs an INSERT and returns the generated key, see Dialect.InsertID
+func (tx *Tx) InsertID(ctx context.Context, query, key string, args ...interface{}) (uint64, error) {
+	return tx.dialect.InsertID(ctx, tx.tx, tx.dialect.Rebind(query), key, args...)
+}
+
+// Commit commits the transaction
+func (tx *Tx) Commit() error {
+	return tx.tx.Commit()
+}
+
+// Rollback aborts the transaction
+func (tx *Tx) Rollback() error {
+	return tx.tx.Rollback()
+}
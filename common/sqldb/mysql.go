@@ -0,0 +1,72 @@
+package sqldb
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func init() {
+	RegisterDialect(MySQL)
+	RegisterPasswordFunc("mysql", func(dsn, password string) (string, error) {
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return "", err
+		}
+		cfg.Passwd = password
+		return cfg.FormatDSN(), nil
+	})
+}
+
+// mysqlDuplicateEntry is the MySQL error number of unique key violations
+const mysqlDuplicateEntry = 1062
+
+// MySQL is the Dialect of MySQL and MariaDB
+var MySQL Dialect = mysqlDialect{}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+func (mysqlDialect) Rebind(query string) string {
+	return query
+}
+
+func (mysqlDialect) AutoIncrementKey() string {
+	return "int NOT NULL AUTO_INCREMENT PRIMARY KEY"
+}
+
+func (mysqlDialect) Upsert(key string, update []string, when string) string {
+	set := make([]string, len(update))
+	for i, col := range update {
+		if when == "" {
+			set[i] = col + "=VALUES(" + col + ")"
+		} else {
+			set[i] = col + "=IF(" + when + ", VALUES(" + col + "), " + col + ")"
+		}
+	}
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+}
+
+func (mysqlDialect) InsertID(ctx context.Context, q Querier, query, key string, args ...interface{}) (uint64, error) {
+	res, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return uint64(id), err
+}
+
+// SyncKey is not needed, MySQL moves AUTO_INCREMENT past the keys that are inserted explicitly
+func (mysqlDialect) SyncKey(ctx context.Context, q Querier, table, key string) error {
+	return nil
+}
+
+func (mysqlDialect) IsDuplicate(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
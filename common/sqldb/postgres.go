@@ -0,0 +1,101 @@
+package sqldb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+func init() {
+	RegisterDialect(Postgres)
+	RegisterPasswordFunc("postgres", func(dsn, password string) (string, error) {
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			u, err := url.Parse(dsn)
+			if err != nil {
+				return "", err
+			}
+			u.User = url.UserPassword(u.User.Username(), password)
+			return u.String(), nil
+		}
+
+		// A later key replaces an earlier one in a key/value DSN
+		quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(password)
+		return dsn + " password='" + quoted + "'", nil
+	})
+}
+
+// postgresUniqueViolation is the Postgres error code of unique key violations
+const postgresUniqueViolation = "23505"
+
+// Postgres is the Dialect of PostgreSQL
+var Postgres Dialect = postgresDialect{}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+// Rebind numbers the placeholders. Queries have no ? other than placeholders.
+func (postgresDialect) Rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (postgresDialect) AutoIncrementKey() string {
+	return "integer GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY"
+}
+
+func (postgresDialect) Upsert(key string, update []string, when string) string {
+	return upsertOnConflict(key, update, when)
+}
+
+func (postgresDialect) InsertID(ctx context.Context, q Querier, query, key string, args ...interface{}) (uint64, error) {
+	return insertReturning(ctx, q, query, key, args...)
+}
+
+func (postgresDialect) SyncKey(ctx context.Context, q Querier, table, key string) error {
+	_, err := q.ExecContext(ctx, fmt.Sprintf(
+		"SELECT setval(pg_get_serial_sequence('%[1]v', '%[2]v'), COALESCE((SELECT MAX(%[2]v) FROM %[1]v), 0) + 1, false)",
+		table, key))
+	return err
+}
+
+func (postgresDialect) IsDuplicate(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == postgresUniqueViolation
+}
+
+// upsertOnConflict is the upsert of Postgres and SQLite
+func upsertOnConflict(key string, update []string, when string) string {
+	set := make([]string, len(update))
+	for i, col := range update {
+		set[i] = col + "=excluded." + col
+	}
+	clause := "ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(set, ", ")
+	if when != "" {
+		clause += " WHERE " + when
+	}
+	return clause
+}
+
+// insertReturning is the InsertID of the DBs that support INSERT ... RETURNING
+func insertReturning(ctx context.Context, q Querier, query, key string, args ...interface{}) (uint64, error) {
+	var id uint64
+	err := q.QueryRowContext(ctx, query+" RETURNING "+key, args...).Scan(&id)
+	return id, err
+}
@@ -0,0 +1,149 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+)
+
+// The idle connection limit of database/sql when none is set
+const defaultMaxIdle = 2
+
+// Credentials supply the password of each new connection, e.g. a token of a managed identity that expires
+type Credentials interface {
+	Password(ctx context.Context) (string, error)
+}
+
+// PasswordFunc sets the password in a DSN of a driver
+type PasswordFunc func(dsn, password string) (string, error)
+
+var (
+	mu        sync.RWMutex
+	passwords = map[string]PasswordFunc{}
+)
+
+// RegisterPasswordFunc makes Credentials usable with a driver
+func RegisterPasswordFunc(driverName string, fn PasswordFunc) {
+	mu.Lock()
+	defer mu.Unlock()
+	passwords[driverName] = fn
+}
+
+// DB is a sql.DB whose DSN can be replaced while it is in use, e.g. when the credentials of the DB are rotated
+type DB struct {
+	*sql.DB
+
+	connector *connector
+	maxIdle   int
+	dialect   Dialect
+}
+
+// Open creates a DB for a registered driver. When creds is not nil the password they supply replaces the one in the
+// DSN of every new connection, which needs a PasswordFunc for the driver. Like sql.Open it does not connect yet.
+func Open(driverName, dsn string, creds Credentials) (*DB, error) {
+	probe, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := probe.Driver()
+	probe.Close()
+
+	c := &connector{driver: drv, dsn: dsn, creds: creds}
+	if creds != nil {
+		mu.RLock()
+		c.setPassword = passwords[driverName]
+		mu.RUnlock()
+		if c.setPassword == nil {
+			return nil, fmt.Errorf("driver %v does not support credentials", driverName)
+		}
+	}
+	dialect, _ := DialectOf(driverName)
+	return &DB{DB: sql.OpenDB(c), connector: c, maxIdle: defaultMaxIdle, dialect: dialect}, nil
+}
+
+// Dialect returns the Dialect of the driver, nil if it has none
+func (db *DB) Dialect() Dialect {
+	return db.dialect
+}
+
+// SetMaxIdleConns shadows sql.DB.SetMaxIdleConns to remember the limit across a Reconnect
+func (db *DB) SetMaxIdleConns(n int) {
+	db.maxIdle = n
+	db.DB.SetMaxIdleConns(n)
+}
+
+// Reconnect switches the pool to a new DSN and credentials. They are tried first, so that bad ones leave the pool as
+// it was. The idle connections are then closed and the next queries connect with the new DSN. Connections in use
+// finish on their old session, which the DB keeps when a password changes.
+func (db *DB) Reconnect(ctx context.Context, dsn string, creds Credentials) error {
+	if creds != nil && db.connector.setPassword == nil {
+		return fmt.Errorf("the DB was opened without credentials")
+	}
+
+	conn, err := db.connector.connect(ctx, dsn, creds)
+	if err != nil {
+		return fmt.Errorf("failed to connect with the new DSN: %w", err)
+	}
+	conn.Close()
+
+	db.connector.set(dsn, creds)
+	db.DB.SetMaxIdleConns(-1)
+	db.DB.SetMaxIdleConns(db.maxIdle)
+	return nil
+}
+
+// connector opens connections with the current DSN and credentials
+type connector struct {
+	driver      driver.Driver
+	setPassword PasswordFunc
+
+	mu    sync.RWMutex
+	dsn   string
+	creds Credentials
+}
+
+// Connect implements driver.Connector
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	dsn, creds := c.current()
+	return c.connect(ctx, dsn, creds)
+}
+
+// Driver implements driver.Connector
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+func (c *connector) connect(ctx context.Context, dsn string, creds Credentials) (driver.Conn, error) {
+	if creds != nil {
+		password, err := creds.Password(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if dsn, err = c.setPassword(dsn, password); err != nil {
+			return nil, err
+		}
+	}
+
+	if dc, ok := c.driver.(driver.DriverContext); ok {
+		conn, err := dc.OpenConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return conn.Connect(ctx)
+	}
+	return c.driver.Open(dsn)
+}
+
+func (c *connector) current() (string, Credentials) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dsn, c.creds
+}
+
+func (c *connector) set(dsn string, creds Credentials) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dsn, c.creds = dsn, creds
+}
@@ -0,0 +1,62 @@
+package sqldb
+
+import (
+	"context"
+	"errors"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+func init() {
+	RegisterDialect(SQLite)
+	RegisterPasswordFunc("sqlite", func(dsn, password string) (string, error) {
+		if password != "" {
+			return "", errors.New("SQLite DBs have no passwords")
+		}
+		return dsn, nil
+	})
+}
+
+// SQLite is the Dialect of SQLite, for local runs and tests. Its DSN is a file, e.g.
+//
+//	file:greeter.db?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)
+//
+// Foreign keys are enforced only when the DSN turns them on.
+var SQLite Dialect = sqliteDialect{}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) Rebind(query string) string {
+	return query
+}
+
+func (sqliteDialect) AutoIncrementKey() string {
+	return "INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+func (sqliteDialect) Upsert(key string, update []string, when string) string {
+	return upsertOnConflict(key, update, when)
+}
+
+func (sqliteDialect) InsertID(ctx context.Context, q Querier, query, key string, args ...interface{}) (uint64, error) {
+	return insertReturning(ctx, q, query, key, args...)
+}
+
+// SyncKey is not needed, SQLite moves AUTOINCREMENT past the keys that are inserted explicitly
+func (sqliteDialect) SyncKey(ctx context.Context, q Querier, table, key string) error {
+	return nil
+}
+
+func (sqliteDialect) IsDuplicate(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code()
+	return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
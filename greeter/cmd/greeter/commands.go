@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rinswind/distributed-greeter/common/cli"
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/service"
+	"github.com/rinswind/distributed-greeter/greeter/internal/config"
+	"github.com/rinswind/distributed-greeter/greeter/internal/users"
+)
+
+// migrate creates the schema of the DB. serve does it as well, this lets an init container do it before any replica
+// starts.
+func migrate(ctx context.Context, env *cli.Env) error {
+	store, closeDB, err := openUsers(env)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	if err := store.Init(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintln(env.Stdout, "The DB schema is up to date")
+	return nil
+}
+
+// exportUsers writes the users to the file in the args, or to stdout
+func exportUsers(ctx context.Context, env *cli.Env) error {
+	store, closeDB, err := openUsers(env)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	out := env.Stdout
+	if len(env.Args) == 1 {
+		f, err := os.OpenFile(env.Args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	count, err := store.Export(ctx, out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(env.Stderr, "Exported %v users\n", count)
+	return nil
+}
+
+// importUsers adds the users in the file in the args, or in stdin
+func importUsers(ctx context.Context, env *cli.Env) error {
+	var in io.Reader = env.Stdin
+	if len(env.Args) == 1 {
+		f, err := os.Open(env.Args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	store, closeDB, err := openUsers(env)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	imported, skipped, err := store.Import(ctx, in)
+	fmt.Fprintf(env.Stderr, "Imported %v users, skipped %v existing ones\n", imported, skipped)
+	return err
+}
+
+// openUsers creates a Users store on the DB of the configuration, without Redis
+func openUsers(env *cli.Env) (*users.Store, func(), error) {
+	cfg, err := config.ReadConfig(env.Flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := logging.Setup(cfg.Log.Format, cfg.Log.Level); err != nil {
+		return nil, nil, err
+	}
+
+	db, err := service.NewDB(cfg.Db)
+	if err != nil {
+		return nil, nil, err
+	}
+	timeouts := users.Timeouts{Read: cfg.Db.ReadTimeout, Write: cfg.Db.WriteTimeout}
+	return users.Make(db.DB, db.Dialect(), nil, timeouts), func() { db.Close() }, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/rinswind/distributed-greeter/common/apikeys"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/cli"
+	"github.com/rinswind/distributed-greeter/common/conf"
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/service"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+	"github.com/rinswind/distributed-greeter/common/tracing"
+	"github.com/rinswind/distributed-greeter/greeter/internal/config"
+	"github.com/rinswind/distributed-greeter/greeter/internal/server"
+	"github.com/rinswind/distributed-greeter/greeter/internal/users"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    "greeter",
+		Config:  &config.Config{},
+		Default: "serve",
+		Commands: append([]cli.Command{
+			{Name: "serve", Summary: "Serve the greeter endpoints until SIGINT or SIGTERM", Run: serve},
+			{Name: "migrate", Summary: "Create or update the DB schema, e.g. from an init container", Run: migrate},
+			{Name: "users export", Args: "[FILE]", MaxArgs: 1, Summary: "Write all users as JSON lines to FILE or stdout", Run: exportUsers},
+			{Name: "users import", Args: "[FILE]", MaxArgs: 1, Summary: "Add the users of an export from FILE or stdin, skipping existing ones", Run: importUsers},
+		}, cli.ConfigCommands(config.Inspect)...),
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	os.Exit(app.Run(context.Background(), os.Args[1:]))
+}
+
+// serve runs the service
+func serve(ctx context.Context, env *cli.Env) error {
+	cfg, err := config.ReadConfig(env.Flags)
+	if err != nil {
+		return err
+	}
+
+	// Setup logging
+	err = logging.Setup(cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		return err
+	}
+
+	runner := service.NewRunner("greeter")
+	defer runner.Close()
+
+	// Setup tracing
+	slog.Info("Resolved trace exporter", "exporter", cfg.Tracing.Exporter)
+	shutdownTracing, err := tracing.Setup(runner.Context(), "greeter", cfg.Tracing.Exporter, cfg.Tracing.Endpoint)
+	if err != nil {
+		return err
+	}
+	runner.OnStop(func() { shutdownTracing(context.Background()) })
+
+	// Create the Redis and DB clients
+	redis, err := runner.Redis(cfg.Redis, tracing.RedisHook{})
+	if err != nil {
+		return err
+	}
+	db, err := runner.DB(cfg.Db)
+	if err != nil {
+		return err
+	}
+
+	// Create and init the Users store
+	users := users.Make(db.DB, db.Dialect(), redis, users.Timeouts{Read: cfg.Db.ReadTimeout, Write: cfg.Db.WriteTimeout})
+	err = users.Init(runner.Context())
+	if err != nil {
+		return err
+	}
+	err = users.Listen(runner.Context())
+	if err != nil {
+		return err
+	}
+
+	// Create the auth session manager. Tokens are verified with the keys published by the login service, or with the
+	// shared secret when it does not publish any.
+	var atKeys auth.Keys
+	var atSecret *auth.RotatingHMACKey
+	if cfg.AccessToken.JWKSURL != "" {
+		slog.Info("Resolved JWKS endpoint", "endpoint", cfg.AccessToken.JWKSURL)
+		atKeys = auth.MakeJWKSClient(cfg.AccessToken.JWKSURL, cfg.AccessToken.JWKSRefresh)
+	} else {
+		atSecret = auth.MakeRotatingHMACKey(cfg.AccessToken.AccessTokenSecret, cfg.Reload.Grace)
+		atKeys = atSecret
+	}
+	authReader := &auth.AuthReader{
+		Redis: redis,
+		Keys:  atKeys}
+
+	// Watch the secret dirs to reconnect the DB and accept the new token secret
+	watcher := config.NewWatcher(cfg)
+	watcher.Subscribe(func(old, cfg *config.Config) {
+		if cfg.Db != old.Db {
+			if err := service.ReconnectDB(context.Background(), db, cfg.Db); err != nil {
+				slog.Error("Failed to reconnect to the DB, keeping the old credentials", "error", err)
+			}
+		}
+		if atSecret != nil {
+			atSecret.Rotate(cfg.AccessToken.AccessTokenSecret)
+		}
+		if cfg.Redis != old.Redis {
+			slog.Warn("Redis settings changed, restart to apply them")
+		}
+		slog.Info("Reloaded configuration")
+	})
+	runner.Go(watcher.Run)
+
+	// Register the admin endpoint
+	if cfg.Admin.Port != 0 {
+		adminEndpoint := server.AdminEndpoint{}
+		if cfg.Admin.ShowConfig {
+			adminEndpoint.Settings = func() []conf.Setting { return watcher.Current().Settings() }
+		}
+		runner.Serve("admin", cfg.Admin.Port, adminEndpoint.Router())
+	}
+
+	// Register the greeter endpoint
+	greeterEndpoint := server.GreeterEndpoint{
+		AuthReader: authReader,
+		Users:      users,
+		Sessions:   sessions.Make(redis),
+		APIKeys:    apikeys.Make(redis)}
+	runner.Serve("greeter", cfg.Http.Port, greeterEndpoint.Router())
+
+	return runner.Run()
+}
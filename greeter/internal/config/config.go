@@ -1,60 +1,108 @@
 package config
 
 import (
-	"os"
+	"time"
+
+	"github.com/rinswind/distributed-greeter/common/conf"
 )
 
 type Config struct {
-	Http struct {
-		Port     int    `yaml:"Port" env:"HTTP_PORT,overwrite"`
-		CertFile string `yaml:"CertFile" env:"HTTP_CERT_FILE,overwrite"`
-	} `yaml:"Http"`
-
-	Db struct {
-		Dsn      string `yaml:"Dsn" env:"DSN,overwrite"`
-		Driver   string `yaml:"Driver" env:"DRIVER,overwite`
-		Endpoint string `yaml:"Endpoint" env:"ENDPOINT,overwrite"`
-		Name     string `yaml:"Name" env:"NAME,overwrite"`
-		User     string `yaml:"User" env:"USER,overwrite"`
-		Password string `yaml:"Password" env:"PASSWORD,overwrite"`
-	} `yaml:"Db" env:",prefix=DB_"`
-	DbConfigDir string `yaml:"DbConfigDir"`
-
-	Redis struct {
-		Dsn      string `yaml:"Dsn" env:"DSN,overwrite"`
-		Endpoint string `yaml:"Endpoint" env:"ENDPOINT,overwrite"`
-		Db       int    `yaml:"Db" env:"DB,overwrite"`
-		User     string `yaml:"User" env:"User,overwrite"`
-		Password string `yaml:"Password" env:"PASSWORD,overwrite"`
-		TLS      bool   `yaml:"TLS" env:"TLS,overwrite"`
-	} `yaml:"Redis" env:",prefix=REDIS_"`
-	RedisConfigDir string `yaml:"RedisConfigDir"`
+	Http conf.Http `yaml:"Http" env:",prefix=HTTP_"`
+
+	Db          conf.Db `yaml:"Db" env:",prefix=DB_"`
+	DbConfigDir string  `yaml:"DbConfigDir"`
+
+	Redis          conf.Redis `yaml:"Redis" env:",prefix=REDIS_"`
+	RedisConfigDir string     `yaml:"RedisConfigDir"`
 
 	AccessToken struct {
-		AccessTokenSecret  string `yaml:"AccessTokenSecret" env:"ACCESS_TOKEN_SECRET",overwrite`
-		RefreshTokenSecret string `yaml:"RefreshTokenSecret" env:"REFRESH_TOKEN_SECRET",overwrite`
+		AccessTokenSecret string `yaml:"AccessTokenSecret" env:"ACCESS_TOKEN_SECRET,overwrite" secret:"true"`
+
+		JWKSURL     string        `yaml:"JWKSURL" env:"JWKS_URL,overwrite"`
+		JWKSRefresh time.Duration `yaml:"JWKSRefresh" env:"JWKS_REFRESH,overwrite"`
 	} `yaml:"AccessToken" env:",prefix=AT_"`
 	AccessTokenConfigDir string `yaml:"AccessTokenConfigDir"`
+
+	Reload conf.Reload `yaml:"Reload" env:",prefix=RELOAD_"`
+
+	Log conf.Log `yaml:"Log" env:",prefix=LOG_"`
+
+	Admin conf.Admin `yaml:"Admin" env:",prefix=ADMIN_"`
+
+	Tracing conf.Tracing `yaml:"Tracing" env:",prefix=TRACING_"`
+
+	// sources names the layer that supplied each field, by field path
+	sources map[string]string
+	// flags are the command line settings, kept to apply them again on reload
+	flags *conf.Flags
 }
 
-func ReadConfig() *Config {
-	configFile := os.Getenv("CONFIG_FILE")
-	if configFile == "" {
-		configFile = "config.yaml"
+// ReadConfig reads the configuration from the file named by --config or CONFIG_FILE, the secret dirs it names, the env
+// and the flags, in that order of precedence. flags may be nil. All problems found on the way are reported together as
+// conf.Errors.
+func ReadConfig(flags *conf.Flags) (*Config, error) {
+	cfg, err := read(flags)
+	if err != nil {
+		return nil, err
 	}
+	return cfg, nil
+}
+
+// read is ReadConfig that also returns the configuration when it is invalid, e.g. for printing it along with its
+// problems
+func read(flags *conf.Flags) (*Config, error) {
+	cfg := Config{flags: flags}
+	l := conf.NewLoader(&cfg)
 
-	var cfg Config
+	l.LoadYaml(flags.ConfigFile())
 
-	loadYaml(&cfg, configFile)
+	l.LoadDir(cfg.DbConfigDir)
+	l.LoadDir(cfg.RedisConfigDir)
+	l.LoadDir(cfg.AccessTokenConfigDir)
 
-	loadDir(&cfg, cfg.DbConfigDir)
-	loadDir(&cfg, cfg.RedisConfigDir)
-	loadDir(&cfg, cfg.AccessTokenConfigDir)
+	l.LoadEnv()
+	l.LoadFlags(flags)
 
-	loadEnv(&cfg)
+	cfg.validate(l)
 
-	expandTemplate(&cfg.Db.Dsn, &cfg.Db)
-	expandTemplate(&cfg.Redis.Dsn, &cfg.Redis)
+	cfg.Db.Expand(l, "Db")
+	cfg.Redis.Expand(l, "Redis")
+
+	cfg.sources = l.Sources()
+	return &cfg, l.Err()
+}
+
+// NewWatcher creates a Watcher of the secret dirs of a configuration returned by ReadConfig
+func NewWatcher(cfg *Config) *conf.Watcher[*Config] {
+	reread := func() (*Config, error) { return ReadConfig(cfg.flags) }
+	return conf.NewWatcher(cfg, reread, cfg.Reload.PollInterval,
+		cfg.DbConfigDir, cfg.RedisConfigDir, cfg.AccessTokenConfigDir)
+}
+
+// Settings lists the settings of the configuration with the sources that supplied them. Secrets are redacted.
+func (cfg *Config) Settings() []conf.Setting {
+	return conf.Settings(cfg, cfg.sources)
+}
+
+// Inspect reads the configuration like ReadConfig and returns its settings, also when it is invalid
+func Inspect(flags *conf.Flags) ([]conf.Setting, error) {
+	cfg, err := read(flags)
+	return cfg.Settings(), err
+}
+
+// validate checks that the settings fit together, e.g. that the selected DB driver has what it needs to connect
+func (cfg *Config) validate(l *conf.Loader) {
+	cfg.Http.Validate(l, "Http")
+	cfg.Db.Validate(l, "Db")
+	cfg.Redis.Validate(l, "Redis")
+
+	if cfg.AccessToken.JWKSURL == "" {
+		l.Require("AccessToken.AccessTokenSecret", cfg.AccessToken.AccessTokenSecret != "")
+	} else {
+		l.Require("AccessToken.JWKSRefresh", cfg.AccessToken.JWKSRefresh > 0)
+	}
 
-	return &cfg
+	cfg.Reload.Validate(l, "Reload")
+	cfg.Log.Validate(l, "Log")
+	cfg.Tracing.Validate(l, "Tracing")
 }
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/conf"
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/problem"
+)
+
+// AdminEndpoint serves operational routes. It listens on a separate interface that must not be exposed by the
+// ingress.
+type AdminEndpoint struct {
+	// Settings returns the settings of the running configuration. Leave nil to not serve them.
+	Settings func() []conf.Setting
+}
+
+// Router builds the HTTP handler of the admin endpoint
+func (ae *AdminEndpoint) Router() *gin.Engine {
+	router := gin.New()
+	router.Use(logging.RequestIDMiddleware(), logging.Middleware(), logging.Recovery())
+
+	router.GET("/log/level", handleGetLogLevel)
+	router.PUT("/log/level", handleSetLogLevel)
+
+	if ae.Settings != nil {
+		router.GET("/config", ae.handleGetConfig)
+	}
+
+	return router
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// GET /log/level
+func handleGetLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, &logLevel{Level: logging.Level().String()})
+}
+
+// PUT /log/level
+func handleSetLogLevel(c *gin.Context) {
+	var lvl logLevel
+	if err := c.ShouldBindJSON(&lvl); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "%v", err))
+		return
+	}
+
+	if err := logging.SetLevel(lvl.Level); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "%v", err))
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Changed log level", "level", logging.Level())
+	c.JSON(http.StatusOK, &logLevel{Level: logging.Level().String()})
+}
+
+type configView struct {
+	Settings []conf.Setting `json:"settings"`
+}
+
+// GET /config
+func (ae *AdminEndpoint) handleGetConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, &configView{Settings: ae.Settings()})
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/apikeys"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+)
+
+// authenticate makes the middleware that rejects unauthenticated requests. A request carries either the access token
+// of a login, whose session use is recorded, or an API key. Access tokens issued to OIDC clients are rejected.
+func authenticate(ar *auth.AuthReader, store *sessions.Store, keys *apikeys.Store) gin.HandlerFunc {
+	authHandler := auth.MakeHandler(ar)
+
+	return func(c *gin.Context) {
+		if bearer, ok := auth.BearerToken(c.Request); ok && strings.HasPrefix(bearer, apikeys.Prefix) {
+			authenticateKey(c, keys, bearer)
+			return
+		}
+
+		authHandler(c)
+		if c.IsAborted() {
+			return
+		}
+		if !auth.HasAudience(claims(c), auth.Audience) {
+			auth.Challenge(c, auth.ErrTokenAudience)
+			return
+		}
+
+		// The session is only informative, so a failure to track it must not fail the request
+		if id, ok := sessionID(c); ok {
+			if err := store.Touch(c.Request.Context(), id, time.Now()); err != nil {
+				slog.WarnContext(c.Request.Context(), "Failed to record session use", "login_id", id, "error", err)
+			}
+		}
+	}
+}
+
+// authenticateKey authenticates a request by API key. The key stands in for the claims of an access token.
+func authenticateKey(c *gin.Context, keys *apikeys.Store, secret string) {
+	key, err := keys.Verify(c.Request.Context(), secret, time.Now())
+	if errors.Is(err, apikeys.ErrInvalid) {
+		c.Error(err)
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token", error_description="The API key is invalid"`)
+		abort(c, problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid API key"))
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to check API key"))
+		return
+	}
+
+	// Match the JSON decoding of the user_id claim of access tokens
+	c.Set(auth.ContextKey, map[string]interface{}{
+		"user_id":    float64(key.UserID),
+		"api_key_id": key.ID,
+		"scopes":     key.Scopes,
+	})
+}
+
+// requireScope makes the middleware that rejects API keys without a scope. Logins are not limited by scopes.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scopes, limited := claims(c)["scopes"].([]string)
+		if limited && !slices.Contains(scopes, scope) {
+			abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, "API key lacks scope %v", scope))
+		}
+	}
+}
+
+// claims returns the claims stored by the auth middleware
+func claims(c *gin.Context) map[string]interface{} {
+	val, _ := c.Get(auth.ContextKey)
+	claims, _ := val.(map[string]interface{})
+	return claims
+}
+
+// sessionID returns the login ID of the authenticated request
+func sessionID(c *gin.Context) (string, bool) {
+	id, ok := claims(c)["access_uuid"].(string)
+	return id, ok
+}
+
+// authorizeUser responds with an error unless the request is authenticated as the given user, by login or API key
+func authorizeUser(c *gin.Context, id uint64) bool {
+	// JSON numbers decode as float64
+	userID, ok := claims(c)["user_id"].(float64)
+	if !ok || uint64(userID) != id {
+		abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, "Not allowed to access user %v", id))
+		return false
+	}
+	return true
+}
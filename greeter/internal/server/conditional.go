@@ -0,0 +1,62 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+// MergePatchType is the media type of JSON Merge Patch documents, RFC 7386
+const MergePatchType = "application/merge-patch+json"
+
+// etag is the entity tag of a version of a user. The representation of a user changes only with its version, so the
+// tag is strong.
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// matchesIfMatch reports whether an If-Match header selects a version. If-Match compares the tags strongly, so weak
+// tags never match.
+func matchesIfMatch(header string, version uint64) bool {
+	tag := etag(version)
+	for _, t := range strings.Split(header, ",") {
+		if t = strings.TrimSpace(t); t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesIfNoneMatch reports whether an If-None-Match header selects a version. If-None-Match compares the tags
+// weakly.
+func matchesIfNoneMatch(header string, version uint64) bool {
+	tag := etag(version)
+	for _, t := range strings.Split(header, ",") {
+		if t = strings.TrimPrefix(strings.TrimSpace(t), "W/"); t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// mergePatch applies a JSON Merge Patch to a decoded JSON document, as in RFC 7386. Members of the patch replace the
+// ones of the target, null members remove them and objects are merged recursively. A patch that is not an object
+// replaces the target as a whole.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+		} else {
+			targetObj[name] = mergePatch(targetObj[name], value)
+		}
+	}
+	return targetObj
+}
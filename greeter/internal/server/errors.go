@@ -0,0 +1,37 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/greeter/internal/users"
+)
+
+// abort sends an RFC 7807 error response tagged with the ID of the failed request
+func abort(c *gin.Context, p *problem.Problem) {
+	p.Instance = c.Request.URL.Path
+	p.RequestID = logging.RequestID(c.Request.Context())
+	problem.Abort(c, p)
+}
+
+// abortStore sends the error response matching a failure of the users store
+func abortStore(c *gin.Context, err error, format string, args ...interface{}) {
+	c.Error(err)
+
+	switch {
+	case errors.Is(err, users.ErrNotFound):
+		abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, format, args...))
+	case errors.Is(err, users.ErrVersionMismatch):
+		abort(c, problem.New(http.StatusPreconditionFailed, problem.CodePreconditionFailed, format, args...))
+	case errors.Is(err, users.ErrConflict):
+		abort(c, problem.New(http.StatusConflict, problem.CodeConflict, format, args...))
+	case errors.Is(err, context.DeadlineExceeded):
+		abort(c, problem.New(http.StatusServiceUnavailable, problem.CodeTimeout, format, args...))
+	default:
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, format, args...))
+	}
+}
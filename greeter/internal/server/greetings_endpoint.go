@@ -1,37 +1,46 @@
 package server
 
 import (
-	"fmt"
+	"bytes"
+	"encoding/json"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
-	ginauth "github.com/rinswind/auth-go/gin"
-	"github.com/rinswind/auth-go/tokens"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/rinswind/distributed-greeter/common/apikeys"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+	"github.com/rinswind/distributed-greeter/common/tracing"
 	"github.com/rinswind/distributed-greeter/greeter/internal/messages"
 	"github.com/rinswind/distributed-greeter/greeter/internal/users"
 )
 
 // GreeterEndpoint is the greeter REST endpoint
 type GreeterEndpoint struct {
-	Iface      string
-	AuthReader *tokens.AuthReader
-	Users      *users.Store
+	AuthReader *auth.AuthReader
+	Users      users.Repository
+	Sessions   *sessions.Store
+	APIKeys    *apikeys.Store
 }
 
-// Run starts the rest endpoint
-func (ge *GreeterEndpoint) Run() {
-	router := gin.Default()
-	authHandler := ginauth.MakeHandler(ge.AuthReader)
-	router.Use(gin.HandlerFunc(authHandler))
+// Router builds the HTTP handler of the rest endpoint
+func (ge *GreeterEndpoint) Router() *gin.Engine {
+	router := gin.New()
+	router.Use(logging.RequestIDMiddleware(), tracing.Middleware(), logging.Middleware(), logging.Recovery())
 
-	router.GET("/users/:uid", ge.handleUserInfo)
-	router.PUT("/users/:uid", ge.handleUserUpdate)
+	router.Use(authenticate(ge.AuthReader, ge.Sessions, ge.APIKeys))
 
-	router.GET("/greetings", handleGreetingLangs)
-	router.POST("/greetings", ge.handleGreeting)
+	router.GET("/users/:uid", requireScope(apikeys.ScopeUsersRead), ge.handleUserInfo)
+	router.PUT("/users/:uid", requireScope(apikeys.ScopeUsersWrite), ge.handleUserUpdate)
+	router.PATCH("/users/:uid", requireScope(apikeys.ScopeUsersWrite), ge.handleUserPatch)
 
-	router.Run(ge.Iface)
+	router.GET("/greetings", requireScope(apikeys.ScopeGreetings), handleGreetingLangs)
+	router.POST("/greetings", requireScope(apikeys.ScopeGreetings), ge.handleGreeting)
+
+	return router
 }
 
 // GET /greetings
@@ -59,18 +68,27 @@ func (ge *GreeterEndpoint) handleGreeting(c *gin.Context) {
 	if err := c.ShouldBindJSON(&msgReq); err != nil {
 		c.Error(err)
 		// Report full details when the REST API contract is violated
-		c.JSON(http.StatusBadRequest, gin.H{"error": err})
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "%v", err))
 		return
 	}
 
-	user, err := ge.Users.GetUser(msgReq.ID)
+	if !authorizeUser(c, msgReq.ID) {
+		return
+	}
+
+	greeter, ok := messages.Greeters[msgReq.Language]
+	if !ok {
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Unsupported language %q", msgReq.Language))
+		return
+	}
+
+	user, err := ge.Users.GetUser(c.Request.Context(), msgReq.ID)
 	if err != nil {
-		c.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("Failed to find user %v", msgReq.ID)})
+		abortStore(c, err, "Failed to find user %v", msgReq.ID)
 		return
 	}
 
-	msg := messages.Greeters[msgReq.Language](user.Name)
+	msg := greeter(user.Name)
 
 	type Message struct {
 		ID       uint64 `json:"user_id"`
@@ -82,40 +100,38 @@ func (ge *GreeterEndpoint) handleGreeting(c *gin.Context) {
 	c.JSON(http.StatusOK, &message)
 }
 
+// userInfo is the representation of a user. Its ETag is the version of the user.
+type userInfo struct {
+	ID       uint64 `json:"user_id"`
+	Name     string `json:"user_name"`
+	Language string `json:"user_language"`
+}
+
 // GET /users/:uid
 func (ge *GreeterEndpoint) handleUserInfo(c *gin.Context) {
-	uidParam := c.Param("uid")
-	uid, err := strconv.ParseUint(uidParam, 10, 64)
-	if err != nil {
-		c.Error(err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Errorf("%v not a valid user ID", uidParam)})
+	uid, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, uid) {
 		return
 	}
 
-	user, err := ge.Users.GetUser(uid)
+	user, err := ge.Users.GetUser(c.Request.Context(), uid)
 	if err != nil {
-		c.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("Failed to find user %v", uid)})
+		abortStore(c, err, "Failed to find user %v", uid)
 		return
 	}
 
-	type UserInfo struct {
-		ID       uint64 `json:"user_id"`
-		Name     string `json:"user_name"`
-		Language string `json:"user_language"`
+	c.Header("ETag", etag(user.Version))
+	if header := c.GetHeader("If-None-Match"); header != "" && matchesIfNoneMatch(header, user.Version) {
+		c.Status(http.StatusNotModified)
+		return
 	}
-
-	userInfo := UserInfo{ID: user.ID, Name: user.Name, Language: user.Language}
-	c.JSON(http.StatusOK, &userInfo)
+	c.JSON(http.StatusOK, &userInfo{ID: user.ID, Name: user.Name, Language: user.Language})
 }
 
 // PUT /users/:uid
 func (ge *GreeterEndpoint) handleUserUpdate(c *gin.Context) {
-	uidParam := c.Param("uid")
-	uid, err := strconv.ParseUint(uidParam, 10, 64)
-	if err != nil {
-		c.Error(err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Errorf("%v not a valid user ID", uidParam)})
+	uid, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, uid) {
 		return
 	}
 
@@ -123,27 +139,122 @@ func (ge *GreeterEndpoint) handleUserUpdate(c *gin.Context) {
 		Language string `json:"user_language"`
 	}
 
-	var userInfo UserInfo
-	if err := c.ShouldBindJSON(&userInfo); err != nil {
+	var info UserInfo
+	if err := c.ShouldBindJSON(&info); err != nil {
 		c.Error(err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "%v", err))
 		return
 	}
 
-	user, err := ge.Users.GetUser(uid)
-	if err != nil {
+	user, ok := ge.userToUpdate(c, uid)
+	if !ok {
+		return
+	}
+
+	user.Language = info.Language
+	ge.updateUser(c, user)
+}
+
+// PATCH /users/:uid
+func (ge *GreeterEndpoint) handleUserPatch(c *gin.Context) {
+	uid, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, uid) {
+		return
+	}
+
+	if c.ContentType() != MergePatchType {
+		c.Header("Accept-Patch", MergePatchType)
+		abort(c, problem.New(http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType,
+			"Failed to update user %v: the patch must be %v", uid, MergePatchType))
+		return
+	}
+
+	var patch interface{}
+	if err := c.ShouldBindBodyWith(&patch, binding.JSON); err != nil {
 		c.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("Failed to find user %v", uid)})
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "%v", err))
 		return
 	}
 
-	user = &users.User{ID: uid, Name: user.Name, Language: userInfo.Language}
-	err = ge.Users.UpdateUser(user)
-	if err != nil {
+	user, ok := ge.userToUpdate(c, uid)
+	if !ok {
+		return
+	}
+
+	// Patch the representation the client sees, then read the result back like a full update
+	var current interface{}
+	data, _ := json.Marshal(&userInfo{ID: user.ID, Name: user.Name, Language: user.Language})
+	_ = json.Unmarshal(data, &current)
+	data, _ = json.Marshal(mergePatch(current, patch))
+
+	var patched userInfo
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patched); err != nil {
 		c.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("Failed to update user %v", user)})
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to update user %v: %v", uid, err))
+		return
+	}
+	if patched.ID != user.ID || patched.Name != user.Name {
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest,
+			"Failed to update user %v: user_id and user_name can not be changed", uid))
 		return
 	}
 
-	c.Status(http.StatusOK)
+	user.Language = patched.Language
+	ge.updateUser(c, user)
+}
+
+// userToUpdate reads a user for a change, which must name the version it is made from in If-Match
+func (ge *GreeterEndpoint) userToUpdate(c *gin.Context, uid uint64) (*users.User, bool) {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		abort(c, problem.New(http.StatusPreconditionRequired, problem.CodePreconditionRequired,
+			"Failed to update user %v: If-Match must name the version to change", uid))
+		return nil, false
+	}
+
+	user, err := ge.Users.GetUser(c.Request.Context(), uid)
+	if err != nil {
+		abortStore(c, err, "Failed to find user %v", uid)
+		return nil, false
+	}
+
+	if !matchesIfMatch(header, user.Version) {
+		c.Header("ETag", etag(user.Version))
+		abort(c, problem.New(http.StatusPreconditionFailed, problem.CodePreconditionFailed,
+			"Failed to update user %v: it is at version %v", uid, user.Version))
+		return nil, false
+	}
+	return user, true
+}
+
+// updateUser stores a changed user, as long as no other change got in since it was read, and responds with the new
+// version
+func (ge *GreeterEndpoint) updateUser(c *gin.Context, user *users.User) {
+	if user.Language == "" {
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to update user %v: user_language is required", user.ID))
+		return
+	}
+
+	err := ge.Users.UpdateUser(c.Request.Context(), user)
+	if err != nil {
+		abortStore(c, err, "Failed to update user %v", user.ID)
+		return
+	}
+
+	c.Header("ETag", etag(user.Version))
+	c.JSON(http.StatusOK, &userInfo{ID: user.ID, Name: user.Name, Language: user.Language})
+}
+
+// userIDParam parses the :uid path parameter, responding with an error if it is malformed
+func userIDParam(c *gin.Context) (uint64, bool) {
+	uidParam := c.Param("uid")
+	uid, err := strconv.ParseUint(uidParam, 10, 64)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidParameter, "%v not a valid user ID", uidParam))
+		return 0, false
+	}
+	return uid, true
 }
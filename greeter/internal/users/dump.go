@@ -0,0 +1,75 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/rinswind/distributed-greeter/common/tracing"
+)
+
+// record is a user in a dump, one JSON object per line
+type record struct {
+	ID       uint64 `json:"id"`
+	Name     string `json:"name"`
+	Language string `json:"language"`
+}
+
+// Export writes all users as JSON lines, ordered by ID
+func (s *Store) Export(ctx context.Context, w io.Writer) (int, error) {
+	ctx, span := tracing.StartDB(ctx, "users.Export")
+	defer span.End()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, language FROM users ORDER BY id")
+	if err != nil {
+		return 0, tracing.Fail(span, fmt.Errorf("failed to export users: %w", dbError(ctx, err)))
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	count := 0
+	for rows.Next() {
+		var rec record
+		if err := rows.Scan(&rec.ID, &rec.Name, &rec.Language); err != nil {
+			return count, tracing.Fail(span, fmt.Errorf("failed to export users: %w", dbError(ctx, err)))
+		}
+		if err := enc.Encode(rec); err != nil {
+			return count, fmt.Errorf("failed to export user %v: %w", rec.ID, err)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, tracing.Fail(span, fmt.Errorf("failed to export users: %w", dbError(ctx, err)))
+	}
+	return count, nil
+}
+
+// Import adds the users of an Export. Users that exist already are skipped, so that an import can be repeated after
+// a failure.
+func (s *Store) Import(ctx context.Context, r io.Reader) (imported, skipped int, err error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	for line := 1; ; line++ {
+		var rec record
+		if err := dec.Decode(&rec); errors.Is(err, io.EOF) {
+			return imported, skipped, nil
+		} else if err != nil {
+			return imported, skipped, fmt.Errorf("failed to import user %v: %w", line, err)
+		}
+		if rec.ID == 0 || rec.Name == "" || rec.Language == "" {
+			return imported, skipped, fmt.Errorf("failed to import user %v: id, name and language are required", line)
+		}
+
+		err := s.CreateUser(ctx, &User{ID: rec.ID, Name: rec.Name, Language: rec.Language})
+		switch {
+		case errors.Is(err, ErrUserExists):
+			skipped++
+		case err != nil:
+			return imported, skipped, err
+		default:
+			imported++
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound reports that a user does not exist
+	ErrNotFound = errors.New("user not found")
+
+	// ErrConflict reports that a change clashes with the users already in the store
+	ErrConflict = errors.New("user conflict")
+
+	// ErrUserExists reports an attempt to add a user that is already in the store
+	ErrUserExists = fmt.Errorf("user exists: %w", ErrConflict)
+
+	// ErrVersionMismatch reports a change to a version of a user that is no longer the stored one
+	ErrVersionMismatch = fmt.Errorf("user changed meanwhile: %w", ErrConflict)
+)
+
+// dbError marks a failure of the DB as a timeout or a cancellation when the context of the operation is done, since
+// the drivers report that in their own terms
+func dbError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %w", ctxErr, err)
+	}
+	return err
+}
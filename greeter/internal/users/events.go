@@ -1,7 +1,12 @@
 package users
 
 import (
+	"context"
 	"encoding/json"
+
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 // EventType is the type of user events
@@ -19,6 +24,12 @@ type Event struct {
 	Type int    `json:"type"`
 	ID   uint64 `json:"user_id"`
 	Name string `json:"user_name"`
+
+	// RequestID is the ID of the request that caused the event
+	RequestID string `json:"request_id,omitempty"`
+
+	// Trace carries the trace context of the operation that caused the event
+	Trace map[string]string `json:"trace,omitempty"`
 }
 
 // Unmarshal converts a string to an Event
@@ -26,6 +37,14 @@ func (e *Event) Unmarshal(str string) error {
 	return json.Unmarshal([]byte(str), e)
 }
 
+// Context continues the request and trace carried by the Event
+func (e *Event) Context(ctx context.Context) context.Context {
+	if e.RequestID != "" {
+		ctx = logging.WithRequestID(ctx, e.RequestID)
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(e.Trace))
+}
+
 // StringToEventType parses a string to an EventType
 // func StringToEventType(str string) (EventType, error) {
 // 	switch str {
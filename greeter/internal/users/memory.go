@@ -0,0 +1,73 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Memory is a Repository that keeps the users in the process, for tests and demos. It is safe for concurrent use and
+// is lost on exit.
+type Memory struct {
+	mu    sync.RWMutex
+	users map[uint64]User
+}
+
+// MakeMemory creates an empty Memory
+func MakeMemory() *Memory {
+	return &Memory{users: make(map[uint64]User)}
+}
+
+// CreateUser adds a new user at version 1
+func (m *Memory) CreateUser(ctx context.Context, newUser *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[newUser.ID]; ok {
+		return fmt.Errorf("failed to create user %v: %w", newUser.ID, ErrUserExists)
+	}
+	newUser.Version = 1
+	m.users[newUser.ID] = *newUser
+	return nil
+}
+
+// GetUser finds a user
+func (m *Memory) GetUser(ctx context.Context, id uint64) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return nil, fmt.Errorf("failed to get user %v: %w", id, ErrNotFound)
+	}
+	return &user, nil
+}
+
+// UpdateUser replaces a user record that is still at newUser.Version and advances newUser.Version
+func (m *Memory) UpdateUser(ctx context.Context, newUser *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[newUser.ID]
+	if !ok {
+		return fmt.Errorf("failed to update user %v: %w", newUser.ID, ErrNotFound)
+	}
+	if user.Version != newUser.Version {
+		return fmt.Errorf("failed to update user %v at version %v: %w", newUser.ID, newUser.Version, ErrVersionMismatch)
+	}
+	newUser.Version++
+	m.users[newUser.ID] = *newUser
+	return nil
+}
+
+// DeleteUser deletes a user by ID
+func (m *Memory) DeleteUser(ctx context.Context, id uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[id]; !ok {
+		return fmt.Errorf("failed to delete user %v: %w", id, ErrNotFound)
+	}
+	delete(m.users, id)
+	return nil
+}
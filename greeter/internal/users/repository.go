@@ -0,0 +1,20 @@
+package users
+
+import (
+	"context"
+)
+
+// Repository keeps the user preferences. Store keeps them in a SQL DB, Memory in the process.
+type Repository interface {
+	CreateUser(ctx context.Context, newUser *User) error
+	GetUser(ctx context.Context, id uint64) (*User, error)
+	// UpdateUser replaces a user that is still at newUser.Version and advances newUser.Version, or fails with
+	// ErrVersionMismatch
+	UpdateUser(ctx context.Context, newUser *User) error
+	DeleteUser(ctx context.Context, id uint64) error
+}
+
+var (
+	_ Repository = (*Store)(nil)
+	_ Repository = (*Memory)(nil)
+)
@@ -3,10 +3,14 @@ package users
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+	"github.com/rinswind/distributed-greeter/common/tracing"
 	"github.com/rinswind/distributed-greeter/greeter/internal/messages"
 )
 
@@ -19,94 +23,210 @@ type User struct {
 	ID       uint64
 	Name     string
 	Language string
+
+	// Version counts the changes of the user, starting at 1. An update applies only to the version it was made from.
+	Version uint64
+}
+
+// Timeouts bound the operations of a Store on top of the context they are called with. Zero leaves them bounded only
+// by that context.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
 }
 
 // Store is a user preferences store
 type Store struct {
-	db    *sql.DB
-	redis *redis.Client
+	db       *sqldb.Queries
+	redis    *redis.Client
+	timeouts Timeouts
 }
 
-// Make create a new Store
-func Make(db *sql.DB, redis *redis.Client) *Store {
-	return &Store{db: db, redis: redis}
+// Make create a new Store on a DB of the given dialect
+func Make(db *sql.DB, dialect sqldb.Dialect, redis *redis.Client, timeouts Timeouts) *Store {
+	return &Store{db: sqldb.NewQueries(db, dialect), redis: redis, timeouts: timeouts}
 }
 
-func (s *Store) Init() error {
-	_, err := s.db.Exec(
+// Init creates the schema if needed. It is not bounded by the Timeouts, since a migration can take long.
+func (s *Store) Init(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx,
 		`CREATE TABLE IF NOT EXISTS users (
 		id int NOT NULL,
 		name varchar(100) NOT NULL,
 		language varchar(40) NOT NULL,
+		version int NOT NULL DEFAULT 1,
 		PRIMARY KEY (id))`)
 
 	if err != nil {
-		return fmt.Errorf("failed to init schema: %v", err)
+		return fmt.Errorf("failed to init schema: %w", err)
+	}
+
+	// Tables created before the users had versions lack the column, and not all DBs can add it only if it is missing
+	if _, err := s.db.ExecContext(ctx, "SELECT version FROM users WHERE 1=0"); err == nil {
+		return nil
+	}
+	_, err = s.db.ExecContext(ctx, "ALTER TABLE users ADD COLUMN version int NOT NULL DEFAULT 1")
+	if err != nil {
+		return fmt.Errorf("failed to add user versions to schema: %w", err)
 	}
 	return nil
 }
 
-// Listen starts listening for User events
-func (s *Store) Listen() error {
-	userEvents := s.redis.Subscribe(context.Background(), usersChannel)
-	_, err := userEvents.Receive(context.Background())
+// Listen starts listening for User events until ctx is done. The events are processed on contexts derived from ctx,
+// so that processing is cancelled as well.
+func (s *Store) Listen(ctx context.Context) error {
+	userEvents := s.redis.Subscribe(ctx, usersChannel)
+	_, err := userEvents.Receive(ctx)
 	if err != nil {
-		return err
+		userEvents.Close()
+		return fmt.Errorf("failed to subscribe to %v: %w", usersChannel, err)
 	}
 
+	// Closing the subscription closes its channel, which ends the loop below
+	go func() {
+		<-ctx.Done()
+		userEvents.Close()
+	}()
+
 	go func() {
 		for msg := range userEvents.Channel() {
 			event := &Event{}
 			err := event.Unmarshal(msg.Payload)
 			if err != nil {
-				log.Print(err)
-				return
+				// A bad message must not stop the events that follow it
+				slog.Error("Failed to decode user event", "payload", msg.Payload, "error", err)
+				continue
 			}
 
-			log.Printf("User event: %v", event)
+			ctx, span := tracing.StartConsumer(event.Context(ctx), usersChannel)
+			slog.InfoContext(ctx, "User event", "type", event.Type, "user_id", event.ID, "user_name", event.Name)
 
 			switch event.Type {
 			case int(Created):
 				user := &User{ID: event.ID, Name: event.Name, Language: messages.DefaultLanguage}
-				err = s.CreateUser(user)
+				err = s.CreateUser(ctx, user)
 			case int(Deleted):
-				err = s.DeleteUser(event.ID)
+				err = s.DeleteUser(ctx, event.ID)
 			}
 
 			if err != nil {
-				log.Printf("Failed to process user event %v: %v", event, err)
+				slog.ErrorContext(ctx, "Failed to process user event", "type", event.Type, "user_id", event.ID, "error", tracing.Fail(span, dbError(ctx, err)))
 			}
+			span.End()
 		}
 	}()
 
 	return nil
 }
 
-// CreateUser adds a new user
-func (s *Store) CreateUser(newUser *User) error {
-	_, err := s.db.Exec("INSERT INTO users (id, name, language) VALUES (?, ?, ?)", newUser.ID, newUser.Name, newUser.Language)
-	return err
+// CreateUser adds a new user at version 1
+func (s *Store) CreateUser(ctx context.Context, newUser *User) error {
+	ctx, span := tracing.StartDB(ctx, "users.CreateUser")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, "INSERT INTO users (id, name, language, version) VALUES (?, ?, ?, 1)", newUser.ID, newUser.Name, newUser.Language)
+	if s.db.Dialect().IsDuplicate(err) {
+		return fmt.Errorf("failed to create user %v: %w", newUser.ID, ErrUserExists)
+	}
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to create user %v: %w", newUser.ID, dbError(ctx, err)))
+	}
+	newUser.Version = 1
+	return nil
 }
 
 // GetUser finds a user
-func (s *Store) GetUser(id uint64) (*User, error) {
-	// TODO Differentiate between user not found and SQL or I/O errors
+func (s *Store) GetUser(ctx context.Context, id uint64) (*User, error) {
+	ctx, span := tracing.StartDB(ctx, "users.GetUser")
+	defer span.End()
+	ctx, cancel := s.read(ctx)
+	defer cancel()
+
 	var user User
-	err := s.db.QueryRow("SELECT id, name, language FROM users WHERE id=?", id).Scan(&user.ID, &user.Name, &user.Language)
+	err := s.db.QueryRowContext(ctx, "SELECT id, name, language, version FROM users WHERE id=?", id).
+		Scan(&user.ID, &user.Name, &user.Language, &user.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get user %v: %w", id, ErrNotFound)
+	}
 	if err != nil {
-		return nil, err
+		return nil, tracing.Fail(span, fmt.Errorf("failed to get user %v: %w", id, dbError(ctx, err)))
 	}
 	return &user, nil
 }
 
-// UpdateUser updates a user record
-func (s *Store) UpdateUser(newUser *User) error {
-	_, err := s.db.Exec("UPDATE users SET name=?, language=? WHERE id=?", newUser.Name, newUser.Language, newUser.ID)
-	return err
+// UpdateUser replaces a user record that is still at newUser.Version and advances newUser.Version. A user that was
+// changed meanwhile is ErrVersionMismatch.
+func (s *Store) UpdateUser(ctx context.Context, newUser *User) error {
+	ctx, span := tracing.StartDB(ctx, "users.UpdateUser")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET name=?, language=?, version=version+1 WHERE id=? AND version=?",
+		newUser.Name, newUser.Language, newUser.ID, newUser.Version)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to update user %v: %w", newUser.ID, dbError(ctx, err)))
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to update user %v: %w", newUser.ID, dbError(ctx, err)))
+	}
+	if updated > 0 {
+		newUser.Version++
+		return nil
+	}
+
+	// Every update changes the version, so no row was affected because the user is missing or at another version
+	var found int
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE id=?", newUser.ID).Scan(&found)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to update user %v: %w", newUser.ID, dbError(ctx, err)))
+	}
+	if found == 0 {
+		return fmt.Errorf("failed to update user %v: %w", newUser.ID, ErrNotFound)
+	}
+	return fmt.Errorf("failed to update user %v at version %v: %w", newUser.ID, newUser.Version, ErrVersionMismatch)
 }
 
 // DeleteUser deletes a used by ID
-func (s *Store) DeleteUser(id uint64) error {
-	_, err := s.db.Exec("DELETE FROM users WHERE id=?", id)
-	return err
+func (s *Store) DeleteUser(ctx context.Context, id uint64) error {
+	ctx, span := tracing.StartDB(ctx, "users.DeleteUser")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE id=?", id)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to delete user %v: %w", id, dbError(ctx, err)))
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to delete user %v: %w", id, dbError(ctx, err)))
+	}
+	if deleted == 0 {
+		return fmt.Errorf("failed to delete user %v: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// read bounds a query by the Read timeout
+func (s *Store) read(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s.timeouts.Read)
+}
+
+// write bounds a change by the Write timeout
+func (s *Store) write(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s.timeouts.Write)
+}
+
+// withTimeout bounds ctx by a timeout, unless the timeout is zero
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
 }
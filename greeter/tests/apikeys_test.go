@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/apikeys"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+	"github.com/rinswind/distributed-greeter/greeter/internal/server"
+	"github.com/rinswind/distributed-greeter/greeter/internal/users"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+
+	db, mock, err := sqlmock.New()
+	checkError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	keys := apikeys.Make(rdb)
+	ge := server.GreeterEndpoint{
+		AuthReader: &auth.AuthReader{Redis: rdb, Keys: &auth.HMACKey{Secret: "at"}},
+		Users:      users.Make(db, sqldb.MySQL, rdb, users.Timeouts{}),
+		Sessions:   sessions.Make(rdb),
+		APIKeys:    keys}
+	router := ge.Router()
+
+	call := func(method, path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	greeter := &apikeys.Key{UserID: 7, Name: "batch", Scopes: []string{apikeys.ScopeGreetings}, Created: time.Now(),
+		Expires: time.Now().Add(time.Hour)}
+	secret, err := keys.Create(ctx, greeter)
+	checkError(t, err)
+
+	resp := call(http.MethodGet, "/greetings", secret)
+	assertTrue(t, "scoped key accepted", resp.Code == http.StatusOK)
+
+	resp = call(http.MethodGet, "/users/7", secret)
+	assertProblem(t, resp, http.StatusForbidden, problem.CodeForbidden)
+
+	resp = call(http.MethodGet, "/greetings", secret[:len(secret)-1])
+	assertProblem(t, resp, http.StatusUnauthorized, problem.CodeUnauthorized)
+	assertTrue(t, "mangled key challenged", strings.HasPrefix(resp.Header().Get("WWW-Authenticate"), `Bearer error="invalid_token"`))
+
+	// A key with the scope reaches the store
+	reader := &apikeys.Key{UserID: 7, Name: "report", Scopes: []string{apikeys.ScopeUsersRead}, Created: time.Now()}
+	readerSecret, err := keys.Create(ctx, reader)
+	checkError(t, err)
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "language", "version"}).AddRow(7, "tobo", "en", 1))
+	resp = call(http.MethodGet, "/users/7", readerSecret)
+	assertTrue(t, "users:read key accepted", resp.Code == http.StatusOK)
+	checkError(t, mock.ExpectationsWereMet())
+
+	// A key only reaches the user it belongs to
+	resp = call(http.MethodGet, "/users/8", readerSecret)
+	assertProblem(t, resp, http.StatusForbidden, problem.CodeForbidden)
+	checkError(t, mock.ExpectationsWereMet())
+
+	list, err := keys.List(ctx, 7)
+	checkError(t, err)
+	assertTrue(t, "use recorded", len(list) == 2 && !list[0].LastUsed.IsZero() && !list[1].LastUsed.IsZero())
+
+	revoked, err := keys.Revoke(ctx, 7, greeter.ID)
+	checkError(t, err)
+	assertTrue(t, "key revoked", revoked)
+
+	resp = call(http.MethodGet, "/greetings", secret)
+	assertTrue(t, "revoked key rejected", resp.Code == http.StatusUnauthorized)
+}
@@ -0,0 +1,41 @@
+package tests
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rinswind/distributed-greeter/common/auth"
+)
+
+func TestCookieAuth(t *testing.T) {
+	router, mock, authz := setupGreeter(t)
+
+	token, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authz, "Bearer "))
+	checkError(t, err)
+
+	call := func(method, path, body, csrf string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: auth.AccessCookie, Value: string(token)})
+		req.AddCookie(&http.Cookie{Name: auth.CSRFCookie, Value: "csrf"})
+		if csrf != "" {
+			req.Header.Set(auth.CSRFHeader, csrf)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	assertTrue(t, "safe request without CSRF token", call(http.MethodGet, "/greetings", "", "") == http.StatusOK)
+	assertTrue(t, "missing CSRF token", call(http.MethodPost, "/greetings", `{"user_id": 7, "language": "en"}`, "") == http.StatusForbidden)
+	assertTrue(t, "forged CSRF token", call(http.MethodPost, "/greetings", `{"user_id": 7, "language": "en"}`, "forged") == http.StatusForbidden)
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "language", "version"}).AddRow(7, "tobo", "en", 1))
+	assertTrue(t, "matching CSRF token", call(http.MethodPost, "/greetings", `{"user_id": 7, "language": "en"}`, "csrf") == http.StatusOK)
+	checkError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rinswind/distributed-greeter/common/conf"
+	"github.com/rinswind/distributed-greeter/common/dbauth"
+	"github.com/rinswind/distributed-greeter/common/service"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+)
+
+// recordingDriver records the DSNs it is asked to connect with
+type recordingDriver struct {
+	mu   sync.Mutex
+	dsns []string
+}
+
+func (d *recordingDriver) Open(dsn string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dsns = append(d.dsns, dsn)
+	return recordingConn{}, nil
+}
+
+func (d *recordingDriver) last() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dsns[len(d.dsns)-1]
+}
+
+type recordingConn struct{}
+
+func (recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (recordingConn) Close() error {
+	return nil
+}
+
+func (recordingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+var recording = &recordingDriver{}
+
+func init() {
+	sql.Register("recording", recording)
+	sqldb.RegisterPasswordFunc("recording", func(dsn, password string) (string, error) {
+		return dsn + ";password=" + password, nil
+	})
+}
+
+// fakeProvider hands out a new password for every connection
+type fakeProvider struct {
+	calls int
+}
+
+func (fp *fakeProvider) Password(ctx context.Context) (string, error) {
+	fp.calls++
+	return "token-" + strconv.Itoa(fp.calls), nil
+}
+
+func TestDbAuthProvider(t *testing.T) {
+	fake := &fakeProvider{}
+	dbauth.Register("fake", func(cfg conf.Db) (dbauth.Provider, error) {
+		assertTrue(t, "provider gets the config", cfg.Auth.Resource == "fake-resource")
+		return fake, nil
+	})
+
+	cfg := conf.Db{
+		Dsn:    "user=db-user",
+		Driver: "recording",
+		Auth:   conf.DbAuth{Provider: "fake", Resource: "fake-resource"}}
+	db, err := service.NewDB(cfg)
+	checkError(t, err)
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxIdleConns(0)
+
+	checkError(t, db.Ping())
+	assertTrue(t, "first token", recording.last() == "user=db-user;password=token-1")
+	checkError(t, db.Ping())
+	assertTrue(t, "token per connection", recording.last() == "user=db-user;password=token-2")
+
+	// Switching to the static provider uses the configured password
+	cfg.Auth.Provider = ""
+	cfg.Password = "static-password"
+	checkError(t, service.ReconnectDB(context.Background(), db, cfg))
+	checkError(t, db.Ping())
+	assertTrue(t, "static password", recording.last() == "user=db-user;password=static-password")
+
+	cfg.Auth.Provider = "no-such-provider"
+	_, err = service.NewDB(cfg)
+	assertTrue(t, "unknown provider", err != nil && strings.Contains(err.Error(), "fake, file, static"))
+}
+
+// fakeTokens hands out tokens that expire after an hour
+type fakeTokens struct {
+	now   *time.Time
+	calls int
+}
+
+func (ft *fakeTokens) Token(ctx context.Context) (string, time.Time, error) {
+	ft.calls++
+	return "token", ft.now.Add(time.Hour), nil
+}
+
+func TestDbAuthTokenProvider(t *testing.T) {
+	now := time.Now()
+	tokens := &fakeTokens{now: &now}
+	tp := dbauth.NewTokenProvider(tokens).WithClock(func() time.Time { return now })
+
+	_, err := tp.Password(context.Background())
+	checkError(t, err)
+	now = now.Add(30 * time.Minute)
+	_, err = tp.Password(context.Background())
+	checkError(t, err)
+	assertTrue(t, "token reused", tokens.calls == 1)
+
+	now = now.Add(28 * time.Minute)
+	_, err = tp.Password(context.Background())
+	checkError(t, err)
+	assertTrue(t, "token renewed before expiry", tokens.calls == 2)
+}
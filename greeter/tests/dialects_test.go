@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+	"github.com/rinswind/distributed-greeter/greeter/internal/users"
+)
+
+// forEachDialect runs a test against an empty DB of each dialect. SQLite always runs, MySQL and Postgres run when
+// TEST_MYSQL_DSN or TEST_POSTGRES_DSN name a DB whose tables the test may drop.
+func forEachDialect(t *testing.T, test func(t *testing.T, db *sql.DB, dialect sqldb.Dialect)) {
+	dsns := map[string]string{
+		"sqlite":   "file:" + filepath.Join(t.TempDir(), "greeter.db") + "?_pragma=busy_timeout(5000)",
+		"mysql":    os.Getenv("TEST_MYSQL_DSN"),
+		"postgres": os.Getenv("TEST_POSTGRES_DSN"),
+	}
+
+	for _, driver := range []string{"sqlite", "mysql", "postgres"} {
+		t.Run(driver, func(t *testing.T) {
+			if dsns[driver] == "" {
+				t.Skipf("Set TEST_%v_DSN to run against %v", map[string]string{"mysql": "MYSQL", "postgres": "POSTGRES"}[driver], driver)
+			}
+
+			db, err := sqldb.Open(driver, dsns[driver], nil)
+			checkError(t, err)
+			t.Cleanup(func() { db.Close() })
+
+			_, err = db.Exec("DROP TABLE IF EXISTS users")
+			checkError(t, err)
+			test(t, db.DB, db.Dialect())
+		})
+	}
+}
+
+func TestStoreConformance(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, db *sql.DB, dialect sqldb.Dialect) {
+		ctx := context.Background()
+		store := users.Make(db, dialect, nil, users.Timeouts{})
+
+		// The schema can be created again
+		checkError(t, store.Init(ctx))
+		checkError(t, store.Init(ctx))
+
+		checkError(t, store.CreateUser(ctx, &users.User{ID: 7, Name: "tobo", Language: "en"}))
+		err := store.CreateUser(ctx, &users.User{ID: 7, Name: "obot", Language: "bg"})
+		assertTrue(t, "duplicate user is ErrUserExists", errors.Is(err, users.ErrUserExists))
+
+		user, err := store.GetUser(ctx, 7)
+		checkError(t, err)
+		assertTrue(t, "user read back", *user == users.User{ID: 7, Name: "tobo", Language: "en", Version: 1})
+		_, err = store.GetUser(ctx, 8)
+		assertTrue(t, "missing user is ErrNotFound", errors.Is(err, users.ErrNotFound))
+
+		// An unchanged user still gets a new version, and a stale one is not a missing one
+		checkError(t, store.UpdateUser(ctx, user))
+		assertTrue(t, "version advanced", user.Version == 2)
+		user.Language = "bg"
+		checkError(t, store.UpdateUser(ctx, user))
+		err = store.UpdateUser(ctx, &users.User{ID: 7, Name: "tobo", Language: "fr", Version: 2})
+		assertTrue(t, "stale update is ErrVersionMismatch", errors.Is(err, users.ErrVersionMismatch))
+		user, err = store.GetUser(ctx, 7)
+		checkError(t, err)
+		assertTrue(t, "stale update dropped", user.Language == "bg" && user.Version == 3)
+		err = store.UpdateUser(ctx, &users.User{ID: 8, Name: "obot", Language: "en", Version: 1})
+		assertTrue(t, "update of missing user is ErrNotFound", errors.Is(err, users.ErrNotFound))
+
+		var dump bytes.Buffer
+		count, err := store.Export(ctx, &dump)
+		checkError(t, err)
+		assertTrue(t, "exported", count == 1)
+
+		checkError(t, store.DeleteUser(ctx, 7))
+		err = store.DeleteUser(ctx, 7)
+		assertTrue(t, "delete of missing user is ErrNotFound", errors.Is(err, users.ErrNotFound))
+
+		imported, skipped, err := store.Import(ctx, &dump)
+		checkError(t, err)
+		assertTrue(t, "imported", imported == 1 && skipped == 0)
+		user, err = store.GetUser(ctx, 7)
+		checkError(t, err)
+		assertTrue(t, "user restored", user.Language == "bg")
+	})
+}
+
+func TestStoreVersionMigration(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, db *sql.DB, dialect sqldb.Dialect) {
+		ctx := context.Background()
+
+		// A table from before the users had versions
+		_, err := db.Exec("CREATE TABLE users (id int NOT NULL, name varchar(100) NOT NULL, language varchar(40) NOT NULL, PRIMARY KEY (id))")
+		checkError(t, err)
+		_, err = db.Exec(dialect.Rebind("INSERT INTO users (id, name, language) VALUES (?, ?, ?)"), 7, "tobo", "en")
+		checkError(t, err)
+
+		store := users.Make(db, dialect, nil, users.Timeouts{})
+		checkError(t, store.Init(ctx))
+		checkError(t, store.Init(ctx))
+
+		user, err := store.GetUser(ctx, 7)
+		checkError(t, err)
+		assertTrue(t, "existing user at version 1", user.Version == 1)
+	})
+}
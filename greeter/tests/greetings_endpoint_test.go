@@ -0,0 +1,304 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/apikeys"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+	"github.com/rinswind/distributed-greeter/greeter/internal/server"
+	"github.com/rinswind/distributed-greeter/greeter/internal/users"
+)
+
+func TestGreeterRoutes(t *testing.T) {
+	userCols := []string{"id", "name", "language", "version"}
+	selectUser := "SELECT (.+) FROM users WHERE id=?"
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header map[string]string
+		anon   bool
+		expect func(mock sqlmock.Sqlmock)
+		status int
+		code   problem.Code
+	}{
+		{name: "unauthenticated", method: http.MethodGet, path: "/greetings", anon: true, status: http.StatusUnauthorized},
+		{name: "languages", method: http.MethodGet, path: "/greetings", status: http.StatusOK},
+
+		{name: "greet bad body", method: http.MethodPost, path: "/greetings", body: `{"user_id": "x"}`,
+			status: http.StatusBadRequest, code: problem.CodeInvalidRequest},
+		{name: "greet bad language", method: http.MethodPost, path: "/greetings", body: `{"user_id": 7, "language": "xx"}`,
+			status: http.StatusBadRequest, code: problem.CodeInvalidRequest},
+		{name: "greet missing user", method: http.MethodPost, path: "/greetings", body: `{"user_id": 7, "language": "en"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols))
+			},
+			status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "greet other user", method: http.MethodPost, path: "/greetings", body: `{"user_id": 8, "language": "en"}`,
+			status: http.StatusForbidden, code: problem.CodeForbidden},
+		{name: "greet", method: http.MethodPost, path: "/greetings", body: `{"user_id": 7, "language": "en"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "en", 1))
+			},
+			status: http.StatusOK},
+
+		{name: "user info bad id", method: http.MethodGet, path: "/users/abc",
+			status: http.StatusBadRequest, code: problem.CodeInvalidParameter},
+		{name: "user info missing user", method: http.MethodGet, path: "/users/7",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols))
+			},
+			status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "user info db failure", method: http.MethodGet, path: "/users/7",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnError(errors.New("connection lost"))
+			},
+			status: http.StatusInternalServerError, code: problem.CodeInternal},
+		{name: "user info other user", method: http.MethodGet, path: "/users/8",
+			status: http.StatusForbidden, code: problem.CodeForbidden},
+		{name: "user info", method: http.MethodGet, path: "/users/7",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "en", 1))
+			},
+			status: http.StatusOK},
+
+		{name: "user update bad id", method: http.MethodPut, path: "/users/abc", body: `{"user_language": "fr"}`,
+			status: http.StatusBadRequest, code: problem.CodeInvalidParameter},
+		{name: "user update bad body", method: http.MethodPut, path: "/users/7", body: `[]`,
+			status: http.StatusBadRequest, code: problem.CodeInvalidRequest},
+		{name: "user update missing user", method: http.MethodPut, path: "/users/7", body: `{"user_language": "fr"}`,
+			header: map[string]string{"If-Match": `"1"`},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnError(sql.ErrNoRows)
+			},
+			status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "user update unconditional", method: http.MethodPut, path: "/users/7", body: `{"user_language": "fr"}`,
+			status: http.StatusPreconditionRequired, code: problem.CodePreconditionRequired},
+		{name: "user update stale", method: http.MethodPut, path: "/users/7", body: `{"user_language": "fr"}`,
+			header: map[string]string{"If-Match": `"1"`},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "en", 2))
+			},
+			status: http.StatusPreconditionFailed, code: problem.CodePreconditionFailed},
+		{name: "user update race", method: http.MethodPut, path: "/users/7", body: `{"user_language": "fr"}`,
+			header: map[string]string{"If-Match": `"1"`},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "en", 1))
+				mock.ExpectExec("UPDATE users SET (.+) WHERE id=?").WithArgs("tobo", "fr", 7, 1).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT COUNT").WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			},
+			status: http.StatusPreconditionFailed, code: problem.CodePreconditionFailed},
+		{name: "user update other user", method: http.MethodPut, path: "/users/8", body: `{"user_language": "fr"}`,
+			header: map[string]string{"If-Match": `"1"`},
+			status: http.StatusForbidden, code: problem.CodeForbidden},
+		{name: "user update", method: http.MethodPut, path: "/users/7", body: `{"user_language": "fr"}`,
+			header: map[string]string{"If-Match": `"1"`},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "en", 1))
+				mock.ExpectExec("UPDATE users SET (.+) WHERE id=?").WithArgs("tobo", "fr", 7, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			status: http.StatusOK},
+
+		{name: "user patch other user", method: http.MethodPatch, path: "/users/8", body: `{"user_language": "fr"}`,
+			header: map[string]string{"Content-Type": server.MergePatchType, "If-Match": `"1"`},
+			status: http.StatusForbidden, code: problem.CodeForbidden},
+		{name: "user patch not a merge patch", method: http.MethodPatch, path: "/users/7", body: `{"user_language": "fr"}`,
+			header: map[string]string{"If-Match": `"1"`},
+			status: http.StatusUnsupportedMediaType, code: problem.CodeUnsupportedMediaType},
+		{name: "user patch unconditional", method: http.MethodPatch, path: "/users/7", body: `{"user_language": "fr"}`,
+			header: map[string]string{"Content-Type": server.MergePatchType},
+			status: http.StatusPreconditionRequired, code: problem.CodePreconditionRequired},
+		{name: "user patch read-only field", method: http.MethodPatch, path: "/users/7", body: `{"user_name": "obot"}`,
+			header: map[string]string{"Content-Type": server.MergePatchType, "If-Match": `"1"`},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "en", 1))
+			},
+			status: http.StatusBadRequest, code: problem.CodeInvalidRequest},
+		{name: "user patch unknown field", method: http.MethodPatch, path: "/users/7", body: `{"user_color": "red"}`,
+			header: map[string]string{"Content-Type": server.MergePatchType, "If-Match": `"1"`},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "en", 1))
+			},
+			status: http.StatusBadRequest, code: problem.CodeInvalidRequest},
+		{name: "user patch removed language", method: http.MethodPatch, path: "/users/7", body: `{"user_language": null}`,
+			header: map[string]string{"Content-Type": server.MergePatchType, "If-Match": `"1"`},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "en", 1))
+			},
+			status: http.StatusBadRequest, code: problem.CodeInvalidRequest},
+		{name: "user patch", method: http.MethodPatch, path: "/users/7", body: `{"user_language": "fr"}`,
+			header: map[string]string{"Content-Type": server.MergePatchType, "If-Match": `"1"`},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectUser).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "en", 1))
+				mock.ExpectExec("UPDATE users SET (.+) WHERE id=?").WithArgs("tobo", "fr", 7, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			status: http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			router, mock, authz := setupGreeter(t)
+			if tc.expect != nil {
+				tc.expect(mock)
+			}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			for name, value := range tc.header {
+				req.Header.Set(name, value)
+			}
+			if !tc.anon {
+				req.Header.Set("Authorization", authz)
+			}
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			if resp.Code != tc.status {
+				t.Fatalf("Expected status %v, got %v: %v", tc.status, resp.Code, resp.Body.String())
+			}
+			if tc.code != "" {
+				assertProblem(t, resp, tc.status, tc.code)
+			}
+			checkError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func setupGreeter(t *testing.T) (http.Handler, sqlmock.Sqlmock, string) {
+	db, mock, err := sqlmock.New()
+	checkError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	router, authz := setupGreeterWith(t, users.Make(db, sqldb.MySQL, nil, users.Timeouts{}))
+	return router, mock, authz
+}
+
+// setupGreeterWith builds a GreeterEndpoint on top of a users Repository and returns it with the authorization header
+// of user 7
+func setupGreeterWith(t *testing.T, repo users.Repository) (http.Handler, string) {
+	gin.SetMode(gin.TestMode)
+
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	key := &auth.HMACKey{Secret: "at"}
+	authWriter := &auth.AuthWriter{Redis: rdb, ATSigner: key, ATExpiry: time.Minute, RTSigner: key, RTExpiry: time.Minute}
+	token, err := authWriter.CreateToken(context.Background(), 7)
+	checkError(t, err)
+	checkError(t, authWriter.CreateAuth(context.Background(), token))
+
+	ge := server.GreeterEndpoint{
+		AuthReader: &auth.AuthReader{Redis: rdb, Keys: key},
+		Users:      repo,
+		Sessions:   sessions.Make(rdb),
+		APIKeys:    apikeys.Make(rdb)}
+
+	return ge.Router(), "Bearer " + base64.StdEncoding.EncodeToString([]byte(token.AccessToken))
+}
+
+func TestGreeterTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	checkError(t, err)
+	t.Cleanup(func() { db.Close() })
+	router, authz := setupGreeterWith(t, users.Make(db, sqldb.MySQL, nil, users.Timeouts{Read: 10 * time.Millisecond}))
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WithArgs(7).WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "language", "version"}).AddRow(7, "tobo", "en", 1))
+
+	req := httptest.NewRequest(http.MethodGet, "/users/7", nil)
+	req.Header.Set("Authorization", authz)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assertProblem(t, resp, http.StatusServiceUnavailable, problem.CodeTimeout)
+}
+
+func TestGreeterMemory(t *testing.T) {
+	ctx := context.Background()
+	store := users.MakeMemory()
+	checkError(t, store.CreateUser(ctx, &users.User{ID: 7, Name: "tobo", Language: "en"}))
+	router, authz := setupGreeterWith(t, store)
+
+	serve := func(method, path, body string, header map[string]string, out interface{}) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		req.Header.Set("Authorization", authz)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if out != nil && resp.Code == http.StatusOK {
+			checkError(t, json.Unmarshal(resp.Body.Bytes(), out))
+		}
+		return resp
+	}
+
+	var message struct {
+		Message string `json:"message"`
+	}
+	resp := serve(http.MethodPost, "/greetings", `{"user_id": 7, "language": "en"}`, nil, &message)
+	assertTrue(t, "greeting", resp.Code == http.StatusOK && strings.Contains(message.Message, "tobo"))
+
+	// Changes name the version they are made from
+	resp = serve(http.MethodGet, "/users/7", "", nil, nil)
+	assertTrue(t, "user info", resp.Code == http.StatusOK && resp.Header().Get("ETag") == `"1"`)
+	resp = serve(http.MethodGet, "/users/7", "", map[string]string{"If-None-Match": `W/"1"`}, nil)
+	assertTrue(t, "unmodified user", resp.Code == http.StatusNotModified && resp.Body.Len() == 0)
+
+	resp = serve(http.MethodPut, "/users/7", `{"user_language": "fr"}`, map[string]string{"If-Match": `"1"`}, nil)
+	assertTrue(t, "language update", resp.Code == http.StatusOK && resp.Header().Get("ETag") == `"2"`)
+	resp = serve(http.MethodPut, "/users/7", `{"user_language": "bg"}`, map[string]string{"If-Match": `"1"`}, nil)
+	assertProblem(t, resp, http.StatusPreconditionFailed, problem.CodePreconditionFailed)
+	assertTrue(t, "current version", resp.Header().Get("ETag") == `"2"`)
+
+	var info struct {
+		Name     string `json:"user_name"`
+		Language string `json:"user_language"`
+	}
+	resp = serve(http.MethodPatch, "/users/7", `{"user_language": "de"}`,
+		map[string]string{"Content-Type": server.MergePatchType, "If-Match": `"2"`}, &info)
+	assertTrue(t, "language patch", resp.Code == http.StatusOK && resp.Header().Get("ETag") == `"3"`)
+	assertTrue(t, "patched user", info.Name == "tobo" && info.Language == "de")
+
+	resp = serve(http.MethodPatch, "/users/7", `{"user_language": "en"}`, map[string]string{"If-Match": `"3"`}, nil)
+	assertProblem(t, resp, http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType)
+	assertTrue(t, "accepted patch type", resp.Header().Get("Accept-Patch") == server.MergePatchType)
+
+	resp = serve(http.MethodGet, "/users/7", "", map[string]string{"If-None-Match": `"1", "2"`}, &info)
+	assertTrue(t, "language updated", resp.Code == http.StatusOK && info.Language == "de")
+
+	checkError(t, store.DeleteUser(ctx, 7))
+	resp = serve(http.MethodGet, "/users/7", "", nil, nil)
+	assertTrue(t, "deleted user", resp.Code == http.StatusNotFound)
+	err := store.UpdateUser(ctx, &users.User{ID: 7, Name: "tobo", Language: "en", Version: 3})
+	assertTrue(t, "update of deleted user", errors.Is(err, users.ErrNotFound))
+}
+
+func assertProblem(t *testing.T, resp *httptest.ResponseRecorder, status int, code problem.Code) {
+	assertTrue(t, "problem content type", resp.Header().Get("Content-Type") == problem.ContentType)
+
+	var p problem.Problem
+	checkError(t, json.Unmarshal(resp.Body.Bytes(), &p))
+	assertTrue(t, "problem status", p.Status == status)
+	assertTrue(t, "problem code", p.Code == code)
+	assertTrue(t, "problem type", p.Type == problem.TypeURI(code))
+	assertTrue(t, "problem request ID", p.RequestID != "" && p.RequestID == resp.Header().Get("X-Request-ID"))
+}
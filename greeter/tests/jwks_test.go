@@ -0,0 +1,205 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+	"github.com/rinswind/distributed-greeter/greeter/internal/server"
+)
+
+func TestJWKSVerification(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	// The login service side: signs with a key ring and publishes it
+	ring, err := auth.MakeKeyRing(rdb, auth.AlgEdDSA, time.Hour, time.Hour)
+	checkError(t, err)
+	ring.WithClock(clock)
+
+	fetches := 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		set, err := ring.JWKS(r.Context())
+		checkError(t, err)
+		checkError(t, json.NewEncoder(w).Encode(set))
+	}))
+	t.Cleanup(jwks.Close)
+
+	authWriter := &auth.AuthWriter{
+		Redis:    rdb,
+		ATSigner: ring,
+		ATExpiry: time.Hour,
+		RTSigner: &auth.HMACKey{Secret: "rt"},
+		RTExpiry: time.Hour}
+	login := func(signer auth.Signer) string {
+		aw := *authWriter
+		aw.ATSigner = signer
+		token, err := aw.CreateToken(ctx, 7)
+		checkError(t, err)
+		checkError(t, aw.CreateAuth(ctx, token))
+		return "Bearer " + base64.StdEncoding.EncodeToString([]byte(token.AccessToken))
+	}
+
+	// The greeter side: knows nothing but the JWKS URL
+	ge := server.GreeterEndpoint{
+		AuthReader: &auth.AuthReader{
+			Redis: rdb,
+			Keys:  auth.MakeJWKSClient(jwks.URL, 24*time.Hour).WithClock(clock)},
+		Sessions: sessions.Make(rdb)}
+	router := ge.Router()
+
+	greet := func(authz string) int {
+		req := httptest.NewRequest(http.MethodGet, "/greetings", nil)
+		req.Header.Set("Authorization", authz)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	first := login(ring)
+	assertTrue(t, "first key verifies", greet(first) == http.StatusOK)
+	assertTrue(t, "keys are cached", greet(first) == http.StatusOK && fetches == 1)
+
+	// A token from an unknown issuer is rejected, without refetching right away
+	other, err := auth.MakeKeyRing(redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}), auth.AlgEdDSA, time.Hour, time.Hour)
+	checkError(t, err)
+	assertTrue(t, "unknown key rejected", greet(login(other)) == http.StatusUnauthorized)
+	assertTrue(t, "unknown key refetch limited", fetches == 1)
+
+	// After a rotation the new kid forces a refetch, and the old key still verifies during the overlap
+	now = now.Add(time.Hour + time.Second)
+	second := login(ring)
+	assertTrue(t, "rotated key verifies", greet(second) == http.StatusOK)
+	assertTrue(t, "rotated key refetched", fetches == 2)
+	assertTrue(t, "old key verifies", greet(first) == http.StatusOK)
+
+	// Tokens issued to OIDC clients are for the login service, not for the greeter
+	client, err := authWriter.CreateClientToken(ctx, 7, "app", "openid")
+	checkError(t, err)
+	checkError(t, authWriter.CreateAuth(ctx, client))
+	assertTrue(t, "client token rejected", greet("Bearer "+base64.StdEncoding.EncodeToString([]byte(client.AccessToken))) == http.StatusUnauthorized)
+}
+
+func TestJWKSSlowEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	ring, err := auth.MakeKeyRing(rdb, auth.AlgEdDSA, time.Hour, time.Hour)
+	checkError(t, err)
+	ring.WithClock(clock)
+
+	// Every fetch after the first hangs until released
+	var fetches atomic.Int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			started <- struct{}{}
+			<-release
+		}
+		set, err := ring.JWKS(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(jwks.Close)
+	// Runs before the server is closed, so a failing test does not hang on the handler
+	unblock := sync.OnceFunc(func() { close(release) })
+	t.Cleanup(unblock)
+
+	authWriter := &auth.AuthWriter{
+		Redis:    rdb,
+		ATSigner: ring,
+		ATExpiry: time.Hour,
+		RTSigner: &auth.HMACKey{Secret: "rt"},
+		RTExpiry: time.Hour}
+	login := func() string {
+		token, err := authWriter.CreateToken(ctx, 7)
+		checkError(t, err)
+		checkError(t, authWriter.CreateAuth(ctx, token))
+		return "Bearer " + base64.StdEncoding.EncodeToString([]byte(token.AccessToken))
+	}
+
+	ge := server.GreeterEndpoint{
+		AuthReader: &auth.AuthReader{
+			Redis: rdb,
+			Keys:  auth.MakeJWKSClient(jwks.URL, 24*time.Hour).WithClock(clock)},
+		Sessions: sessions.Make(rdb)}
+	router := ge.Router()
+
+	greet := func(authz string) int {
+		req := httptest.NewRequest(http.MethodGet, "/greetings", nil)
+		req.Header.Set("Authorization", authz)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	first := login()
+	assertTrue(t, "first key verifies", greet(first) == http.StatusOK)
+
+	// After a rotation several requests with the new kid wait on the hanging refetch
+	now = now.Add(time.Hour + time.Second)
+	second := login()
+
+	const waiting = 4
+	codes := make([]int, waiting)
+	var wg sync.WaitGroup
+	for i := range waiting {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = greet(second)
+		}()
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refetch not started")
+	}
+
+	// Meanwhile the cached key keeps verifying
+	cached := make(chan int, 1)
+	go func() { cached <- greet(first) }()
+	select {
+	case code := <-cached:
+		assertTrue(t, "cached key verifies during refetch", code == http.StatusOK)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cached key blocked by refetch")
+	}
+
+	unblock()
+	wg.Wait()
+
+	for _, code := range codes {
+		assertTrue(t, "rotated key verifies after refetch", code == http.StatusOK)
+	}
+	assertTrue(t, "refetch shared", fetches.Load() == 2)
+}
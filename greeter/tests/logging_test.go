@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/logging"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	router := gin.New()
+	router.Use(logging.RequestIDMiddleware())
+	router.GET("/", func(c *gin.Context) { seen = logging.RequestID(c.Request.Context()) })
+
+	// Propagate the caller's ID
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(logging.RequestIDHeader, "caller-id")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assertTrue(t, "request ID propagated to handler", seen == "caller-id")
+	assertTrue(t, "request ID echoed", resp.Header().Get(logging.RequestIDHeader) == "caller-id")
+
+	// Generate a fresh ID
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assertTrue(t, "request ID generated", seen != "" && seen != "caller-id")
+	assertTrue(t, "generated ID echoed", resp.Header().Get(logging.RequestIDHeader) == seen)
+}
+
+func TestLogLevel(t *testing.T) {
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	checkError(t, logging.Setup(logging.FormatJSON, "warn"))
+	assertTrue(t, "initial level", logging.Level() == slog.LevelWarn)
+
+	checkError(t, logging.SetLevel("debug"))
+	assertTrue(t, "changed level", logging.Level() == slog.LevelDebug)
+
+	assertTrue(t, "bad level rejected", logging.SetLevel("loud") != nil)
+	assertTrue(t, "level kept", logging.Level() == slog.LevelDebug)
+
+	assertTrue(t, "bad format rejected", logging.Setup("xml", "info") != nil)
+}
+
+func TestLogRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, logging.FormatJSON)
+	checkError(t, err)
+
+	ctx := logging.WithRequestID(context.Background(), "log-id")
+	logger.InfoContext(ctx, "hello")
+
+	var rec map[string]interface{}
+	checkError(t, json.Unmarshal(buf.Bytes(), &rec))
+	assertTrue(t, "request_id attached", rec["request_id"] == "log-id")
+}
@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+	"github.com/rinswind/distributed-greeter/greeter/internal/config"
+	"github.com/rinswind/distributed-greeter/greeter/internal/server"
+)
+
+func TestConfigReload(t *testing.T) {
+	setupFile(t, "config.yaml", `
+Http:
+  Port: 9090
+
+Db:
+  Dsn: "{{ .User }}:{{ .Password }}@tcp({{ .Endpoint }})/{{ .Name }}"
+  Driver: mysql
+  Name: yaml-db-name
+  User: yaml-db-user
+  Endpoint: yaml-db-endpoint:3306
+DbConfigDir: db-creds
+
+Redis:
+  Dsn: "redis://{{ .Endpoint }}"
+  Endpoint: yaml-redis-endpoint
+
+AccessTokenConfigDir: at-creds
+
+Reload:
+  PollInterval: 10ms
+`)
+
+	setupDir(t, "db-creds", map[string]string{"db_password": "old-db-password"})
+	setupDir(t, "at-creds", map[string]string{"at_access_token_secret": "old-at-secret"})
+
+	cfg, err := config.ReadConfig(nil)
+	checkError(t, err)
+
+	changes := make(chan [2]*config.Config, 10)
+	watcher := config.NewWatcher(cfg)
+	watcher.Subscribe(func(old, cfg *config.Config) {
+		changes <- [2]*config.Config{old, cfg}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stopped := make(chan struct{})
+	go func() {
+		watcher.Run(ctx)
+		close(stopped)
+	}()
+
+	// Nothing changed yet
+	checkError(t, watcher.Check())
+	assertTrue(t, "no change", len(changes) == 0)
+
+	checkError(t, os.WriteFile("db-creds/db_password", []byte("new-db-password"), 0600))
+
+	select {
+	case change := <-changes:
+		old, cfg := change[0], change[1]
+		assertTrue(t, "old config passed along", old.Db.Password == "old-db-password")
+		assertTrue(t, "new password", cfg.Db.Password == "new-db-password")
+		assertTrue(t, "new dsn", cfg.Db.Dsn == "yaml-db-user:new-db-password@tcp(yaml-db-endpoint:3306)/yaml-db-name")
+		assertTrue(t, "unchanged secret", cfg.AccessToken.AccessTokenSecret == "old-at-secret")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the changed secret to be reloaded")
+	}
+	assertTrue(t, "current config", watcher.Current().Db.Password == "new-db-password")
+
+	// An invalid change is skipped, the current configuration stays
+	cancel()
+	<-stopped
+	checkError(t, os.WriteFile("at-creds/at_access_token_secret", []byte(""), 0600))
+	assertTrue(t, "invalid change rejected", watcher.Check() != nil)
+	assertTrue(t, "no subscriber call", len(changes) == 0)
+	assertTrue(t, "current config kept", watcher.Current().AccessToken.AccessTokenSecret == "old-at-secret")
+}
+
+func TestRotatedSecret(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	secret := auth.MakeRotatingHMACKey("old-secret", 15*time.Minute).WithClock(clock)
+
+	login := func(signer auth.Signer) string {
+		aw := &auth.AuthWriter{Redis: rdb, ATSigner: signer, ATExpiry: time.Hour, RTSigner: signer, RTExpiry: time.Hour}
+		token, err := aw.CreateToken(ctx, 7)
+		checkError(t, err)
+		checkError(t, aw.CreateAuth(ctx, token))
+		return "Bearer " + base64.StdEncoding.EncodeToString([]byte(token.AccessToken))
+	}
+
+	ge := server.GreeterEndpoint{
+		AuthReader: &auth.AuthReader{Redis: rdb, Keys: secret},
+		Sessions:   sessions.Make(rdb)}
+	router := ge.Router()
+
+	greet := func(authz string) int {
+		req := httptest.NewRequest(http.MethodGet, "/greetings", nil)
+		req.Header.Set("Authorization", authz)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	before := login(&auth.HMACKey{Secret: "old-secret"})
+	assertTrue(t, "old secret verifies", greet(before) == http.StatusOK)
+
+	secret.Rotate("new-secret")
+	after := login(&auth.HMACKey{Secret: "new-secret"})
+	assertTrue(t, "new secret verifies", greet(after) == http.StatusOK)
+	assertTrue(t, "old secret verifies during grace", greet(before) == http.StatusOK)
+	assertTrue(t, "other secret rejected", greet(login(&auth.HMACKey{Secret: "other-secret"})) == http.StatusUnauthorized)
+
+	now = now.Add(16 * time.Minute)
+	assertTrue(t, "new secret still verifies", greet(after) == http.StatusOK)
+	assertTrue(t, "old secret rejected after grace", greet(before) == http.StatusUnauthorized)
+}
@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-sql-driver/mysql"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+	"github.com/rinswind/distributed-greeter/greeter/internal/users"
+)
+
+func TestStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	ioErr := errors.New("connection lost")
+
+	db, mock, err := sqlmock.New()
+	checkError(t, err)
+	defer db.Close()
+	store := users.Make(db, sqldb.MySQL, nil, users.Timeouts{})
+
+	mock.ExpectExec("INSERT INTO users").WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	err = store.CreateUser(ctx, &users.User{ID: 7, Name: "tobo", Language: "en"})
+	assertTrue(t, "duplicate user is ErrUserExists", errors.Is(err, users.ErrUserExists))
+	assertTrue(t, "duplicate user is ErrConflict", errors.Is(err, users.ErrConflict))
+
+	mock.ExpectQuery("SELECT (.+) FROM users").WillReturnRows(sqlmock.NewRows([]string{"id", "name", "language", "version"}))
+	_, err = store.GetUser(ctx, 7)
+	assertTrue(t, "missing user is ErrNotFound", errors.Is(err, users.ErrNotFound))
+
+	mock.ExpectQuery("SELECT (.+) FROM users").WillReturnError(ioErr)
+	_, err = store.GetUser(ctx, 7)
+	assertTrue(t, "I/O failure is inspectable", errors.Is(err, ioErr))
+	assertTrue(t, "I/O failure is not ErrNotFound", !errors.Is(err, users.ErrNotFound))
+
+	mock.ExpectExec("UPDATE users").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COUNT").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	err = store.UpdateUser(ctx, &users.User{ID: 7, Name: "tobo", Language: "fr"})
+	assertTrue(t, "update of missing user is ErrNotFound", errors.Is(err, users.ErrNotFound))
+
+	mock.ExpectExec("UPDATE users").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COUNT").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	err = store.UpdateUser(ctx, &users.User{ID: 7, Name: "tobo", Language: "en", Version: 1})
+	assertTrue(t, "update of changed user is ErrVersionMismatch", errors.Is(err, users.ErrVersionMismatch))
+	assertTrue(t, "update of changed user is ErrConflict", errors.Is(err, users.ErrConflict))
+
+	mock.ExpectExec("UPDATE users").WithArgs("tobo", "fr", 7, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	user := &users.User{ID: 7, Name: "tobo", Language: "fr", Version: 1}
+	checkError(t, store.UpdateUser(ctx, user))
+	assertTrue(t, "update advances the version", user.Version == 2)
+
+	mock.ExpectExec("DELETE FROM users").WillReturnResult(sqlmock.NewResult(0, 0))
+	err = store.DeleteUser(ctx, 7)
+	assertTrue(t, "delete of missing user is ErrNotFound", errors.Is(err, users.ErrNotFound))
+
+	checkError(t, mock.ExpectationsWereMet())
+}
+
+func TestStoreTimeouts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	checkError(t, err)
+	defer db.Close()
+	store := users.Make(db, sqldb.MySQL, nil, users.Timeouts{Read: 10 * time.Millisecond, Write: time.Second})
+
+	// A slow read fails on its own timeout
+	mock.ExpectQuery("SELECT (.+) FROM users").WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "language", "version"}).AddRow(7, "tobo", "en", 1))
+	start := time.Now()
+	_, err = store.GetUser(context.Background(), 7)
+	assertTrue(t, "slow read is DeadlineExceeded", errors.Is(err, context.DeadlineExceeded))
+	assertTrue(t, "slow read gives up early", time.Since(start) < time.Second/2)
+
+	// A cancelled request cancels its write
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = store.UpdateUser(ctx, &users.User{ID: 7, Name: "tobo", Language: "fr"})
+	assertTrue(t, "write of cancelled request is Canceled", errors.Is(err, context.Canceled))
+}
+
+func TestStoreDump(t *testing.T) {
+	ctx := context.Background()
+
+	db, mock, err := sqlmock.New()
+	checkError(t, err)
+	defer db.Close()
+	store := users.Make(db, sqldb.MySQL, nil, users.Timeouts{})
+
+	mock.ExpectQuery("SELECT id, name, language FROM users ORDER BY id").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "name", "language"}).AddRow(1, "tobo", "en").AddRow(2, "obot", "bg"))
+	var dump bytes.Buffer
+	count, err := store.Export(ctx, &dump)
+	checkError(t, err)
+	assertTrue(t, "exported", count == 2)
+	assertTrue(t, "json lines", dump.String() == `{"id":1,"name":"tobo","language":"en"}`+"\n"+`{"id":2,"name":"obot","language":"bg"}`+"\n")
+
+	mock.ExpectExec("INSERT INTO users").WithArgs(1, "tobo", "en").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO users").WithArgs(2, "obot", "bg").WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	imported, skipped, err := store.Import(ctx, &dump)
+	checkError(t, err)
+	assertTrue(t, "imported", imported == 1 && skipped == 1)
+
+	_, _, err = store.Import(ctx, strings.NewReader(`{"id":3,"name":"tobo"}`))
+	assertTrue(t, "incomplete user rejected", err != nil && strings.Contains(err.Error(), "user 1"))
+
+	checkError(t, mock.ExpectationsWereMet())
+}
+
+func TestStoreListenSkipsBadEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	checkError(t, err)
+	defer db.Close()
+
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	defer rdb.Close()
+
+	store := users.Make(db, sqldb.MySQL, rdb, users.Timeouts{})
+	checkError(t, store.Listen(ctx))
+
+	// The event after a bad one is still processed
+	mock.ExpectExec("INSERT INTO users").WithArgs(7, "tobo", "en").WillReturnResult(sqlmock.NewResult(7, 1))
+	checkError(t, rdb.Publish(ctx, "/users", "not an event").Err())
+	checkError(t, rdb.Publish(ctx, "/users", `{"type": 0, "user_id": 7, "user_name": "tobo"}`).Err())
+
+	deadline := time.Now().Add(time.Second)
+	for mock.ExpectationsWereMet() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkError(t, mock.ExpectationsWereMet())
+}
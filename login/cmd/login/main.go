@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/rinswind/distributed-greeter/common/apikeys"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/cli"
+	"github.com/rinswind/distributed-greeter/common/conf"
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/service"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+	"github.com/rinswind/distributed-greeter/common/tracing"
+	"github.com/rinswind/distributed-greeter/login/internal/config"
+	"github.com/rinswind/distributed-greeter/login/internal/notify"
+	"github.com/rinswind/distributed-greeter/login/internal/oidc"
+	"github.com/rinswind/distributed-greeter/login/internal/onetime"
+	"github.com/rinswind/distributed-greeter/login/internal/server"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+	"github.com/rinswind/distributed-greeter/login/internal/users"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    "login",
+		Config:  &config.Config{},
+		Default: "serve",
+		Commands: append([]cli.Command{
+			{Name: "serve", Summary: "Serve the login endpoints until SIGINT or SIGTERM", Run: serve},
+			{Name: "migrate", Summary: "Create or update the DB schema, e.g. from an init container", Run: migrate},
+			{Name: "users export", Args: "[FILE]", MaxArgs: 1, Summary: "Write all users as JSON lines to FILE or stdout", Run: exportUsers},
+			{Name: "users import", Args: "[FILE]", MaxArgs: 1, Summary: "Add the users of an export from FILE or stdin, skipping existing ones", Run: importUsers},
+		}, cli.ConfigCommands(config.Inspect)...),
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	os.Exit(app.Run(context.Background(), os.Args[1:]))
+}
+
+// serve runs the service
+func serve(ctx context.Context, env *cli.Env) error {
+	cfg, err := config.ReadConfig(env.Flags)
+	if err != nil {
+		return err
+	}
+
+	// Setup logging
+	err = logging.Setup(cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		return err
+	}
+
+	runner := service.NewRunner("login")
+	defer runner.Close()
+
+	// Setup tracing
+	slog.Info("Resolved trace exporter", "exporter", cfg.Tracing.Exporter)
+	shutdownTracing, err := tracing.Setup(runner.Context(), "login", cfg.Tracing.Exporter, cfg.Tracing.Endpoint)
+	if err != nil {
+		return err
+	}
+	runner.OnStop(func() { shutdownTracing(context.Background()) })
+
+	// Create the Redis and DB clients
+	redis, err := runner.Redis(cfg.Redis, tracing.RedisHook{})
+	if err != nil {
+		return err
+	}
+	db, err := runner.DB(cfg.Db)
+	if err != nil {
+		return err
+	}
+
+	// Create and init the DB
+	users := users.Make(db.DB, db.Dialect(), redis, users.Timeouts{
+		Read:    cfg.Db.ReadTimeout,
+		Write:   cfg.Db.WriteTimeout,
+		Publish: cfg.Events.PublishTimeout,
+	})
+	err = users.Init(runner.Context())
+	if err != nil {
+		return err
+	}
+
+	// Create the signup validator
+	validator, err := validation.New(
+		validation.UsernameRules{
+			MinLength: cfg.Validation.Username.MinLength,
+			MaxLength: cfg.Validation.Username.MaxLength,
+			Pattern:   cfg.Validation.Username.Pattern,
+			Reserved:  cfg.Validation.Username.Reserved,
+		},
+		validation.PasswordRules{
+			MinLength:    cfg.Validation.Password.MinLength,
+			MaxLength:    cfg.Validation.Password.MaxLength,
+			BreachedList: cfg.Validation.Password.BreachedList,
+		})
+	if err != nil {
+		return err
+	}
+
+	// Create the brute-force guard
+	guard := throttle.Make(redis, throttle.Limits{
+		Window:          cfg.BruteForce.Window,
+		Delay:           cfg.BruteForce.Delay,
+		MaxDelay:        cfg.BruteForce.MaxDelay,
+		MaxUserFailures: cfg.BruteForce.MaxUserFailures,
+		MaxIPFailures:   cfg.BruteForce.MaxIPFailures,
+		Lockout:         cfg.BruteForce.Lockout,
+	})
+
+	// Create the notifier
+	slog.Info("Resolved notification sink", "sink", cfg.Notify.Sink)
+	notifier, err := notify.New(notify.Config{
+		Sink:         cfg.Notify.Sink,
+		File:         cfg.Notify.File,
+		SMTPEndpoint: cfg.Notify.SMTP.Endpoint,
+		SMTPUser:     cfg.Notify.SMTP.User,
+		SMTPPassword: cfg.Notify.SMTP.Password,
+		SMTPFrom:     cfg.Notify.SMTP.From,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Create the access token keys
+	slog.Info("Resolved token signing algorithm", "algorithm", cfg.AccessToken.SigningAlgorithm)
+	var atSigner auth.Signer
+	var atKeys auth.Keys
+	var keyRing *auth.KeyRing
+	var atSecret *auth.RotatingHMACKey
+	if cfg.AccessToken.SigningAlgorithm == auth.AlgHS256 {
+		atSecret = auth.MakeRotatingHMACKey(cfg.AccessToken.AccessTokenSecret, cfg.Reload.Grace)
+		atSigner, atKeys = atSecret, atSecret
+	} else {
+		keysRedis, err := runner.Redis(cfg.SigningKeys, tracing.RedisHook{})
+		if err != nil {
+			return err
+		}
+		keyRing, err = auth.MakeKeyRing(
+			keysRedis, cfg.AccessToken.SigningAlgorithm, cfg.AccessToken.KeyRotation, cfg.AccessToken.KeyOverlap)
+		if err != nil {
+			return err
+		}
+		atSigner, atKeys = keyRing, keyRing
+
+		dropped, err := auth.DropSharedKeys(runner.Context(), redis)
+		if err != nil {
+			return err
+		}
+		if dropped {
+			slog.Warn("Dropped the signing keys readable by the greeter, tokens they signed are no longer valid")
+		}
+	}
+
+	// Create the Auth token handlers
+	authReader := auth.AuthReader{
+		Redis: redis,
+		Keys:  atKeys}
+
+	rtSecret := auth.MakeRotatingHMACKey(cfg.AccessToken.RefreshTokenSecret, cfg.Reload.Grace)
+	authWriter := auth.AuthWriter{
+		Redis:    redis,
+		ATSigner: atSigner,
+		ATExpiry: time.Minute * time.Duration(cfg.AccessToken.AccessTokenExpiry),
+		RTSigner: rtSecret,
+		RTExpiry: time.Minute * time.Duration(cfg.AccessToken.RefreshTokenExpiry)}
+
+	// Watch the secret dirs to reconnect the DB and sign with the new token secrets
+	watcher := config.NewWatcher(cfg)
+	watcher.Subscribe(func(old, cfg *config.Config) {
+		if cfg.Db != old.Db {
+			if err := service.ReconnectDB(context.Background(), db, cfg.Db); err != nil {
+				slog.Error("Failed to reconnect to the DB, keeping the old credentials", "error", err)
+			}
+		}
+		if atSecret != nil {
+			atSecret.Rotate(cfg.AccessToken.AccessTokenSecret)
+		}
+		rtSecret.Rotate(cfg.AccessToken.RefreshTokenSecret)
+		if cfg.Redis != old.Redis || cfg.SigningKeys != old.SigningKeys {
+			slog.Warn("Redis settings changed, restart to apply them")
+		}
+		slog.Info("Reloaded configuration")
+	})
+	runner.Go(watcher.Run)
+
+	// Create the cookie settings of browser logins
+	var cookies *server.CookieSettings
+	if cfg.Cookies.Enabled {
+		cookies, err = server.NewCookieSettings(cfg.Cookies.Domain, cfg.Cookies.Path, cfg.Cookies.Secure, cfg.Cookies.SameSite)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Register the admin endpoint
+	if cfg.Admin.Port != 0 {
+		adminEndpoint := server.AdminEndpoint{Guard: guard, Users: users}
+		if cfg.Admin.ShowConfig {
+			adminEndpoint.Settings = func() []conf.Setting { return watcher.Current().Settings() }
+		}
+		runner.Serve("admin", cfg.Admin.Port, adminEndpoint.Router())
+	}
+
+	// Register the REST endpoint
+	le := server.LoginEndpoint{
+		AuthReader: &authReader,
+		AuthWriter: &authWriter,
+		Users:      users,
+		Sessions:   sessions.Make(redis),
+		Validator:  validator,
+		Guard:      guard,
+		Notifier:   notifier,
+		Resets:     onetime.Make(redis, "password-reset", cfg.PasswordReset.TokenExpiry),
+		ResetLink:  cfg.PasswordReset.Link,
+		Challenges: onetime.Make(redis, "mfa-challenge", cfg.MFA.ChallengeExpiry),
+		MFAIssuer:  cfg.MFA.Issuer,
+		KeyRing:    keyRing,
+		OIDCIssuer: cfg.OIDC.Issuer,
+		OIDCCodes:  oidc.Make(redis, cfg.OIDC.CodeExpiry),
+
+		APIKeys:         apikeys.Make(redis),
+		APIKeyExpiry:    cfg.APIKeys.Expiry,
+		APIKeyMaxExpiry: cfg.APIKeys.MaxExpiry,
+
+		Cookies: cookies,
+
+		Verifications:        onetime.Make(redis, "email-verification", cfg.Email.VerificationExpiry),
+		VerificationLink:     cfg.Email.VerificationLink,
+		Resends:              throttle.MakeCooldown(redis, "email-resend", cfg.Email.ResendInterval),
+		RequireVerifiedEmail: cfg.Email.RequireVerified,
+	}
+	runner.Serve("login", cfg.Http.Port, le.Router())
+
+	return runner.Run()
+}
@@ -1,62 +1,259 @@
 package config
 
 import (
-	"os"
+	"strings"
+	"time"
+
+	"github.com/rinswind/distributed-greeter/common/conf"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
 )
 
 type Config struct {
-	Http struct {
-		Port     int    `yaml:"Port" env:"PORT,overwrite"`
-		CertFile string `yaml:"CertFile" env:"CERT_FILE,overwrite"`
-	} `yaml:"Http" env:",prefix=HTTP_"`
-
-	Db struct {
-		Dsn      string `yaml:"Dsn" env:"DSN,overwrite"`
-		Driver   string `yaml:"Driver" env:"DRIVER,overwite`
-		Endpoint string `yaml:"Endpoint" env:"ENDPOINT,overwrite"`
-		Name     string `yaml:"Name" env:"NAME,overwrite"`
-		User     string `yaml:"User" env:"USER,overwrite"`
-		Password string `yaml:"Password" env:"PASSWORD,overwrite"`
-	} `yaml:"Db" env:",prefix=DB_"`
-	DbConfigDir string `yaml:"DbConfigDir"`
-
-	Redis struct {
-		Dsn      string `yaml:"Dsn" env:"DSN,overwrite"`
-		Endpoint string `yaml:"Endpoint" env:"ENDPOINT,overwrite"`
-		Db       int    `yaml:"Db" env:"DB,overwrite"`
-		User     string `yaml:"User" env:"User,overwrite"`
-		Password string `yaml:"Password" env:"PASSWORD,overwrite"`
-		TLS      bool   `yaml:"TLS" env:"TLS,overwrite"`
-	} `yaml:"Redis" env:",prefix=REDIS_"`
-	RedisConfigDir string `yaml:"RedisConfigDir"`
+	Http conf.Http `yaml:"Http" env:",prefix=HTTP_"`
+
+	Db          conf.Db `yaml:"Db" env:",prefix=DB_"`
+	DbConfigDir string  `yaml:"DbConfigDir"`
+
+	Redis          conf.Redis `yaml:"Redis" env:",prefix=REDIS_"`
+	RedisConfigDir string     `yaml:"RedisConfigDir"`
+
+	Events struct {
+		PublishTimeout time.Duration `yaml:"PublishTimeout" env:"PUBLISH_TIMEOUT,overwrite"`
+	} `yaml:"Events" env:",prefix=EVENTS_"`
 
 	AccessToken struct {
-		AccessTokenSecret  string `yaml:"AccessTokenSecret" env:"ACCESS_TOKEN_SECRET",overwrite`
-		AccessTokenExpiry  int    `yaml:"AccessTokenExpiry" env:"ACCESS_TOKEN_EXPIRY",overwrite`
-		RefreshTokenSecret string `yaml:"RefreshTokenSecret" env:"REFRESH_TOKEN_SECRET",overwrite`
-		RefreshTokenExpiry int    `yaml:"RefreshTokenExpiry" env:"REFRESH_TOKEN_EXPIRY",overwrite`
+		AccessTokenSecret  string `yaml:"AccessTokenSecret" env:"ACCESS_TOKEN_SECRET,overwrite" secret:"true"`
+		AccessTokenExpiry  int    `yaml:"AccessTokenExpiry" env:"ACCESS_TOKEN_EXPIRY,overwrite"`
+		RefreshTokenSecret string `yaml:"RefreshTokenSecret" env:"REFRESH_TOKEN_SECRET,overwrite" secret:"true"`
+		RefreshTokenExpiry int    `yaml:"RefreshTokenExpiry" env:"REFRESH_TOKEN_EXPIRY,overwrite"`
+
+		SigningAlgorithm string        `yaml:"SigningAlgorithm" env:"SIGNING_ALGORITHM,overwrite"`
+		KeyRotation      time.Duration `yaml:"KeyRotation" env:"KEY_ROTATION,overwrite"`
+		KeyOverlap       time.Duration `yaml:"KeyOverlap" env:"KEY_OVERLAP,overwrite"`
 	} `yaml:"AccessToken" env:",prefix=AT_"`
 	AccessTokenConfigDir string `yaml:"AccessTokenConfigDir"`
+
+	// SigningKeys is the Redis that keeps the private keys of RS256 and EdDSA. The greeter must not be able to read it.
+	SigningKeys          conf.Redis `yaml:"SigningKeys" env:",prefix=SIGNING_KEYS_"`
+	SigningKeysConfigDir string     `yaml:"SigningKeysConfigDir"`
+
+	Reload conf.Reload `yaml:"Reload" env:",prefix=RELOAD_"`
+
+	Validation struct {
+		Username struct {
+			MinLength int      `yaml:"MinLength" env:"MIN_LENGTH,overwrite"`
+			MaxLength int      `yaml:"MaxLength" env:"MAX_LENGTH,overwrite"`
+			Pattern   string   `yaml:"Pattern" env:"PATTERN,overwrite"`
+			Reserved  []string `yaml:"Reserved" env:"RESERVED,overwrite"`
+		} `yaml:"Username" env:",prefix=USERNAME_"`
+		Password struct {
+			MinLength    int    `yaml:"MinLength" env:"MIN_LENGTH,overwrite"`
+			MaxLength    int    `yaml:"MaxLength" env:"MAX_LENGTH,overwrite"`
+			BreachedList string `yaml:"BreachedList" env:"BREACHED_LIST,overwrite"`
+		} `yaml:"Password" env:",prefix=PASSWORD_"`
+	} `yaml:"Validation" env:",prefix=VALIDATION_"`
+
+	BruteForce struct {
+		Window          time.Duration `yaml:"Window" env:"WINDOW,overwrite"`
+		Delay           time.Duration `yaml:"Delay" env:"DELAY,overwrite"`
+		MaxDelay        time.Duration `yaml:"MaxDelay" env:"MAX_DELAY,overwrite"`
+		MaxUserFailures int           `yaml:"MaxUserFailures" env:"MAX_USER_FAILURES,overwrite"`
+		MaxIPFailures   int           `yaml:"MaxIPFailures" env:"MAX_IP_FAILURES,overwrite"`
+		Lockout         time.Duration `yaml:"Lockout" env:"LOCKOUT,overwrite"`
+	} `yaml:"BruteForce" env:",prefix=BRUTE_FORCE_"`
+
+	PasswordReset struct {
+		TokenExpiry time.Duration `yaml:"TokenExpiry" env:"TOKEN_EXPIRY,overwrite"`
+		Link        string        `yaml:"Link" env:"LINK,overwrite"`
+	} `yaml:"PasswordReset" env:",prefix=PASSWORD_RESET_"`
+
+	Email struct {
+		VerificationExpiry time.Duration `yaml:"VerificationExpiry" env:"VERIFICATION_EXPIRY,overwrite"`
+		VerificationLink   string        `yaml:"VerificationLink" env:"VERIFICATION_LINK,overwrite"`
+		ResendInterval     time.Duration `yaml:"ResendInterval" env:"RESEND_INTERVAL,overwrite"`
+		RequireVerified    bool          `yaml:"RequireVerified" env:"REQUIRE_VERIFIED,overwrite"`
+	} `yaml:"Email" env:",prefix=EMAIL_"`
+
+	MFA struct {
+		Issuer          string        `yaml:"Issuer" env:"ISSUER,overwrite"`
+		ChallengeExpiry time.Duration `yaml:"ChallengeExpiry" env:"CHALLENGE_EXPIRY,overwrite"`
+	} `yaml:"MFA" env:",prefix=MFA_"`
+
+	Cookies struct {
+		Enabled  bool   `yaml:"Enabled" env:"ENABLED,overwrite"`
+		Domain   string `yaml:"Domain" env:"DOMAIN,overwrite"`
+		Path     string `yaml:"Path" env:"PATH,overwrite"`
+		Secure   bool   `yaml:"Secure" env:"SECURE,overwrite"`
+		SameSite string `yaml:"SameSite" env:"SAME_SITE,overwrite"`
+	} `yaml:"Cookies" env:",prefix=COOKIES_"`
+
+	APIKeys struct {
+		Expiry    time.Duration `yaml:"Expiry" env:"EXPIRY,overwrite"`
+		MaxExpiry time.Duration `yaml:"MaxExpiry" env:"MAX_EXPIRY,overwrite"`
+	} `yaml:"APIKeys" env:",prefix=API_KEYS_"`
+
+	OIDC struct {
+		Issuer     string        `yaml:"Issuer" env:"ISSUER,overwrite"`
+		CodeExpiry time.Duration `yaml:"CodeExpiry" env:"CODE_EXPIRY,overwrite"`
+	} `yaml:"OIDC" env:",prefix=OIDC_"`
+
+	Notify struct {
+		Sink string `yaml:"Sink" env:"SINK,overwrite"`
+		File string `yaml:"File" env:"FILE,overwrite"`
+		SMTP struct {
+			Endpoint string `yaml:"Endpoint" env:"ENDPOINT,overwrite"`
+			User     string `yaml:"User" env:"USER,overwrite"`
+			Password string `yaml:"Password" env:"PASSWORD,overwrite" secret:"true"`
+			From     string `yaml:"From" env:"FROM,overwrite"`
+		} `yaml:"SMTP" env:",prefix=SMTP_"`
+	} `yaml:"Notify" env:",prefix=NOTIFY_"`
+
+	Log conf.Log `yaml:"Log" env:",prefix=LOG_"`
+
+	Admin conf.Admin `yaml:"Admin" env:",prefix=ADMIN_"`
+
+	Tracing conf.Tracing `yaml:"Tracing" env:",prefix=TRACING_"`
+
+	// sources names the layer that supplied each field, by field path
+	sources map[string]string
+	// flags are the command line settings, kept to apply them again on reload
+	flags *conf.Flags
+}
+
+// ReadConfig reads the configuration from the file named by --config or CONFIG_FILE, the secret dirs it names, the env
+// and the flags, in that order of precedence. flags may be nil. All problems found on the way are reported together as
+// conf.Errors.
+func ReadConfig(flags *conf.Flags) (*Config, error) {
+	cfg, err := read(flags)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// read is ReadConfig that also returns the configuration when it is invalid, e.g. for printing it along with its
+// problems
+func read(flags *conf.Flags) (*Config, error) {
+	cfg := Config{flags: flags}
+	l := conf.NewLoader(&cfg)
+
+	l.LoadYaml(flags.ConfigFile())
+
+	l.LoadDir(cfg.DbConfigDir)
+	l.LoadDir(cfg.RedisConfigDir)
+	l.LoadDir(cfg.AccessTokenConfigDir)
+	l.LoadDir(cfg.SigningKeysConfigDir)
+
+	l.LoadEnv()
+	l.LoadFlags(flags)
+
+	cfg.validate(l)
+
+	cfg.Db.Expand(l, "Db")
+	cfg.Redis.Expand(l, "Redis")
+	if cfg.signsWithKeys() {
+		cfg.SigningKeys.Expand(l, "SigningKeys")
+		if cfg.SigningKeys.Dsn != "" && cfg.SigningKeys.Dsn == cfg.Redis.Dsn {
+			l.Fail("SigningKeys.Dsn", "must not be the Redis shared with the greeter")
+		}
+	}
+
+	cfg.sources = l.Sources()
+	return &cfg, l.Err()
+}
+
+// NewWatcher creates a Watcher of the secret dirs of a configuration returned by ReadConfig
+func NewWatcher(cfg *Config) *conf.Watcher[*Config] {
+	reread := func() (*Config, error) { return ReadConfig(cfg.flags) }
+	return conf.NewWatcher(cfg, reread, cfg.Reload.PollInterval,
+		cfg.DbConfigDir, cfg.RedisConfigDir, cfg.AccessTokenConfigDir, cfg.SigningKeysConfigDir)
+}
+
+// Settings lists the settings of the configuration with the sources that supplied them. Secrets are redacted.
+func (cfg *Config) Settings() []conf.Setting {
+	return conf.Settings(cfg, cfg.sources)
 }
 
-func ReadConfig() *Config {
-	configFile := os.Getenv("CONFIG_FILE")
-	if configFile == "" {
-		configFile = "config.yaml"
+// Inspect reads the configuration like ReadConfig and returns its settings, also when it is invalid
+func Inspect(flags *conf.Flags) ([]conf.Setting, error) {
+	cfg, err := read(flags)
+	return cfg.Settings(), err
+}
+
+// signsWithKeys reports whether the access tokens are signed with asymmetric keys
+func (cfg *Config) signsWithKeys() bool {
+	return cfg.AccessToken.SigningAlgorithm == "RS256" || cfg.AccessToken.SigningAlgorithm == "EdDSA"
+}
+
+// validate checks that the settings fit together, e.g. that the selected DB driver has what it needs to connect
+func (cfg *Config) validate(l *conf.Loader) {
+	cfg.Http.Validate(l, "Http")
+	cfg.Db.Validate(l, "Db")
+	cfg.Redis.Validate(l, "Redis")
+	if cfg.Events.PublishTimeout < 0 {
+		l.Fail("Events.PublishTimeout", "is %v, must not be negative", cfg.Events.PublishTimeout)
+	}
+
+	at := &cfg.AccessToken
+	l.Require("AccessToken.AccessTokenExpiry", at.AccessTokenExpiry > 0)
+	l.Require("AccessToken.RefreshTokenSecret", at.RefreshTokenSecret != "")
+	l.Require("AccessToken.RefreshTokenExpiry", at.RefreshTokenExpiry > 0)
+	l.OneOf("AccessToken.SigningAlgorithm", at.SigningAlgorithm, "HS256", "RS256", "EdDSA")
+	switch at.SigningAlgorithm {
+	case "HS256":
+		l.Require("AccessToken.AccessTokenSecret", at.AccessTokenSecret != "")
+		if cfg.OIDC.Issuer != "" {
+			l.Fail("OIDC.Issuer", "needs an asymmetric AccessToken.SigningAlgorithm")
+		}
+		if cfg.AccessTokenConfigDir != "" && cfg.Reload.Grace < time.Duration(at.AccessTokenExpiry)*time.Minute {
+			l.Fail("Reload.Grace", "is %v, must outlast the access tokens signed with a rotated secret", cfg.Reload.Grace)
+		}
+	case "RS256", "EdDSA":
+		cfg.SigningKeys.Validate(l, "SigningKeys")
+		l.Require("AccessToken.KeyRotation", at.KeyRotation > 0)
+		if at.KeyOverlap < time.Duration(at.AccessTokenExpiry)*time.Minute {
+			l.Fail("AccessToken.KeyOverlap", "is %v, must outlast the access tokens", at.KeyOverlap)
+		}
 	}
 
-	var cfg Config
+	if cfg.Cookies.Enabled {
+		l.OneOf("Cookies.SameSite", strings.ToLower(cfg.Cookies.SameSite), "", "strict", "lax", "none")
+		if strings.EqualFold(cfg.Cookies.SameSite, "none") && !cfg.Cookies.Secure {
+			l.Fail("Cookies.Secure", "is required by SameSite None")
+		}
+	}
 
-	loadYaml(&cfg, configFile)
+	if cfg.OIDC.Issuer != "" {
+		l.Require("OIDC.CodeExpiry", cfg.OIDC.CodeExpiry > 0)
+	}
 
-	loadDir(&cfg, cfg.DbConfigDir)
-	loadDir(&cfg, cfg.RedisConfigDir)
-	loadDir(&cfg, cfg.AccessTokenConfigDir)
+	// Longer values would not fit in the DB columns
+	if max := cfg.Validation.Username.MaxLength; max > validation.ColumnUsernameLength {
+		l.Fail("Validation.Username.MaxLength", "is %v, must be at most %v", max, validation.ColumnUsernameLength)
+	}
+	if max := cfg.Validation.Password.MaxLength; max > validation.ColumnPasswordLength {
+		l.Fail("Validation.Password.MaxLength", "is %v, must be at most %v", max, validation.ColumnPasswordLength)
+	}
 
-	loadEnv(&cfg)
+	l.Require("PasswordReset.TokenExpiry", cfg.PasswordReset.TokenExpiry > 0)
+	l.Require("Email.VerificationExpiry", cfg.Email.VerificationExpiry > 0)
+	l.Require("MFA.ChallengeExpiry", cfg.MFA.ChallengeExpiry > 0)
+	// Keys made without an expiry of their own would be born expired, or be rejected by the maximum
+	l.Require("APIKeys.Expiry", cfg.APIKeys.Expiry > 0)
+	if max := cfg.APIKeys.MaxExpiry; max < 0 || max > 0 && cfg.APIKeys.Expiry > max {
+		l.Fail("APIKeys.MaxExpiry", "is %v, must not be negative or shorter than APIKeys.Expiry", max)
+	}
 
-	expandTemplate(&cfg.Db.Dsn, &cfg.Db)
-	expandTemplate(&cfg.Redis.Dsn, &cfg.Redis)
+	l.OneOf("Notify.Sink", strings.ToLower(cfg.Notify.Sink), "", "log", "file", "smtp")
+	switch strings.ToLower(cfg.Notify.Sink) {
+	case "file":
+		l.Require("Notify.File", cfg.Notify.File != "")
+	case "smtp":
+		l.Require("Notify.SMTP.Endpoint", cfg.Notify.SMTP.Endpoint != "")
+		l.Require("Notify.SMTP.From", cfg.Notify.SMTP.From != "")
+	}
 
-	return &cfg
+	cfg.Reload.Validate(l, "Reload")
+	cfg.Log.Validate(l, "Log")
+	cfg.Tracing.Validate(l, "Tracing")
 }
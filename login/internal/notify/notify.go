@@ -0,0 +1,144 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SinkSMTP delivers messages through an SMTP server
+	SinkSMTP = "smtp"
+	// SinkFile appends messages to a file as JSON lines
+	SinkFile = "file"
+	// SinkLog writes messages to the service log
+	SinkLog = "log"
+)
+
+// Message is a notification for a user
+type Message struct {
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	Sent    time.Time `json:"sent"`
+}
+
+// Notifier delivers messages to users
+type Notifier interface {
+	Notify(ctx context.Context, msg *Message) error
+}
+
+// Config selects and configures a Notifier
+type Config struct {
+	Sink string
+	File string
+
+	SMTPEndpoint string
+	SMTPUser     string
+	SMTPPassword string
+	SMTPFrom     string
+}
+
+// New creates the Notifier selected by cfg.Sink
+func New(cfg Config) (Notifier, error) {
+	switch strings.ToLower(cfg.Sink) {
+	case "", SinkLog:
+		return &LogNotifier{}, nil
+	case SinkFile:
+		if cfg.File == "" {
+			return nil, fmt.Errorf("notifier sink %v needs a file", SinkFile)
+		}
+		return &FileNotifier{Path: cfg.File}, nil
+	case SinkSMTP:
+		if cfg.SMTPEndpoint == "" || cfg.SMTPFrom == "" {
+			return nil, fmt.Errorf("notifier sink %v needs an endpoint and a sender", SinkSMTP)
+		}
+		return &SMTPNotifier{Endpoint: cfg.SMTPEndpoint, User: cfg.SMTPUser, Password: cfg.SMTPPassword, From: cfg.SMTPFrom}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier sink %v", cfg.Sink)
+	}
+}
+
+// LogNotifier writes messages to the service log. Meant for development only, as messages carry secrets.
+type LogNotifier struct{}
+
+// Notify implements Notifier
+func (ln *LogNotifier) Notify(ctx context.Context, msg *Message) error {
+	slog.InfoContext(ctx, "Notification", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// FileNotifier appends messages to a file, one JSON object per line. Meant for development and tests.
+type FileNotifier struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Notify implements Notifier
+func (fn *FileNotifier) Notify(ctx context.Context, msg *Message) error {
+	if msg.Sent.IsZero() {
+		msg.Sent = time.Now().UTC()
+	}
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+
+	f, err := os.OpenFile(fn.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open notification file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write notification to %v: %w", fn.Path, err)
+	}
+	return nil
+}
+
+// SMTPNotifier mails messages through an SMTP server
+type SMTPNotifier struct {
+	Endpoint string
+	User     string
+	Password string
+	From     string
+}
+
+// Notify implements Notifier
+func (sn *SMTPNotifier) Notify(ctx context.Context, msg *Message) error {
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return fmt.Errorf("refusing to mail %q: line breaks in headers", msg.To)
+	}
+
+	var auth smtp.Auth
+	if sn.User != "" {
+		host, _, err := net.SplitHostPort(sn.Endpoint)
+		if err != nil {
+			return fmt.Errorf("bad SMTP endpoint %v: %w", sn.Endpoint, err)
+		}
+		auth = smtp.PlainAuth("", sn.User, sn.Password, host)
+	}
+
+	var mail strings.Builder
+	fmt.Fprintf(&mail, "From: %v\r\n", sn.From)
+	fmt.Fprintf(&mail, "To: %v\r\n", msg.To)
+	fmt.Fprintf(&mail, "Subject: %v\r\n", msg.Subject)
+	fmt.Fprintf(&mail, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	mail.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	if err := smtp.SendMail(sn.Endpoint, auth, sn.From, []string{msg.To}, []byte(mail.String())); err != nil {
+		return fmt.Errorf("failed to mail %v: %w", msg.To, err)
+	}
+	return nil
+}
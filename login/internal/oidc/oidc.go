@@ -0,0 +1,234 @@
+// Package oidc holds the protocol pieces of the OpenID Connect provider: authorization codes, PKCE, client secrets,
+// the discovery document and the ID token claims. Only the authorization code flow with PKCE is supported.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported scopes. Every request must include openid.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+)
+
+// Code is an OAuth 2.0 error code, reported to clients in the error parameter
+type Code string
+
+// Error codes of RFC 6749
+const (
+	CodeInvalidRequest          Code = "invalid_request"
+	CodeInvalidClient           Code = "invalid_client"
+	CodeInvalidGrant            Code = "invalid_grant"
+	CodeInvalidScope            Code = "invalid_scope"
+	CodeUnsupportedGrantType    Code = "unsupported_grant_type"
+	CodeUnsupportedResponseType Code = "unsupported_response_type"
+	CodeAccessDenied            Code = "access_denied"
+	CodeServerError             Code = "server_error"
+)
+
+// Error is the body of a failed token request
+type Error struct {
+	Code        Code   `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// codeBytes is the amount of randomness in authorization codes and client secrets
+const codeBytes = 32
+
+// ErrInvalidCode reports an authorization code that is unknown, expired or already redeemed
+var ErrInvalidCode = errors.New("invalid or expired authorization code")
+
+// Grant is what a user consented to at the authorization endpoint, pending the exchange of its code for tokens
+type Grant struct {
+	ClientID      string `json:"client_id"`
+	RedirectURI   string `json:"redirect_uri"`
+	Scope         string `json:"scope"`
+	Nonce         string `json:"nonce,omitempty"`
+	CodeChallenge string `json:"code_challenge"`
+
+	UserID   uint64 `json:"user_id"`
+	UserName string `json:"user_name"`
+	AuthTime int64  `json:"auth_time"`
+
+	// The browser of the user, recorded on the login session
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+}
+
+// Codes issues the single-use authorization codes. Redis keeps only code hashes.
+type Codes struct {
+	redis  *redis.Client
+	expiry time.Duration
+}
+
+// Make creates the authorization code store
+func Make(redis *redis.Client, expiry time.Duration) *Codes {
+	return &Codes{redis: redis, expiry: expiry}
+}
+
+// Issue creates a code for a grant
+func (cs *Codes) Issue(ctx context.Context, grant *Grant) (string, error) {
+	code, err := randomString()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate authorization code: %w", err)
+	}
+
+	data, err := json.Marshal(grant)
+	if err != nil {
+		return "", err
+	}
+	if err := cs.redis.Set(ctx, codeKey(code), data, cs.expiry).Err(); err != nil {
+		return "", fmt.Errorf("failed to issue authorization code: %w", err)
+	}
+	return code, nil
+}
+
+// Redeem consumes a code and returns its grant
+func (cs *Codes) Redeem(ctx context.Context, code string) (*Grant, error) {
+	data, err := cs.redis.GetDel(ctx, codeKey(code)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrInvalidCode
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+
+	var grant Grant
+	if err := json.Unmarshal(data, &grant); err != nil {
+		return nil, fmt.Errorf("bad authorization code record: %w", err)
+	}
+	return &grant, nil
+}
+
+func codeKey(code string) string {
+	return "oidc-code:" + HashSecret(code)
+}
+
+// VerifyPKCE checks a code verifier against the S256 challenge of RFC 7636
+func VerifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// NewSecret generates a client ID or secret
+func NewSecret() (string, error) {
+	return randomString()
+}
+
+// HashSecret hashes a client secret for storage. Secrets are random, so a plain hash is enough.
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// SecretMatches checks a client secret against its stored hash
+func SecretMatches(secret, hash string) bool {
+	return hash != "" && subtle.ConstantTimeCompare([]byte(HashSecret(secret)), []byte(hash)) == 1
+}
+
+func randomString() (string, error) {
+	raw := make([]byte, codeBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// ParseScope splits a scope parameter and checks that it asks for OpenID Connect and nothing unknown
+func ParseScope(scope string) ([]string, bool) {
+	scopes := strings.Fields(scope)
+	openID := false
+	for _, s := range scopes {
+		switch s {
+		case ScopeOpenID:
+			openID = true
+		case ScopeProfile:
+		default:
+			return nil, false
+		}
+	}
+	return scopes, openID
+}
+
+// Discovery is the OpenID Provider Metadata served at /.well-known/openid-configuration
+type Discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// Endpoint paths, relative to the issuer
+const (
+	PathDiscovery = "/.well-known/openid-configuration"
+	PathJWKS      = "/.well-known/jwks.json"
+	PathAuthorize = "/oidc/authorize"
+	PathToken     = "/oidc/token"
+	PathUserinfo  = "/oidc/userinfo"
+)
+
+// NewDiscovery describes a provider at issuer that signs ID tokens with algs
+func NewDiscovery(issuer string, algs []string) *Discovery {
+	issuer = strings.TrimSuffix(issuer, "/")
+	return &Discovery{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + PathAuthorize,
+		TokenEndpoint:                     issuer + PathToken,
+		UserinfoEndpoint:                  issuer + PathUserinfo,
+		JWKSURI:                           issuer + PathJWKS,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  algs,
+		ScopesSupported:                   []string{ScopeOpenID, ScopeProfile},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "user_id", "user_name"},
+	}
+}
+
+// IDTokenClaims builds the claims of the ID token of a grant
+func IDTokenClaims(issuer string, grant *Grant, issued, expires time.Time) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"iss":       strings.TrimSuffix(issuer, "/"),
+		"sub":       strconv.FormatUint(grant.UserID, 10),
+		"aud":       grant.ClientID,
+		"iat":       issued.Unix(),
+		"exp":       expires.Unix(),
+		"auth_time": grant.AuthTime,
+		"user_id":   grant.UserID,
+		"user_name": grant.UserName,
+	}
+	if grant.Nonce != "" {
+		claims["nonce"] = grant.Nonce
+	}
+	return claims
+}
@@ -0,0 +1,94 @@
+package onetime
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// tokenBytes is the amount of randomness in a token
+const tokenBytes = 32
+
+// ErrInvalid reports a token that is unknown, expired or already redeemed
+var ErrInvalid = errors.New("invalid or expired token")
+
+// Tokens issues single-use, time-limited tokens that stand for a subject, e.g. a user ID. Redis keeps only token
+// hashes, so a leaked database does not leak usable tokens.
+type Tokens struct {
+	redis  *redis.Client
+	prefix string
+	expiry time.Duration
+}
+
+// Make creates Tokens of one purpose. The prefix separates the Redis keys of different purposes.
+func Make(redis *redis.Client, prefix string, expiry time.Duration) *Tokens {
+	return &Tokens{redis: redis, prefix: prefix, expiry: expiry}
+}
+
+// Issue creates a token for subject, invalidating the previous token of the subject
+func (t *Tokens) Issue(ctx context.Context, subject string) (string, error) {
+	raw := make([]byte, tokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate %v token: %w", t.prefix, err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	subjectKey := t.prefix + ":subject:" + subject
+	prev, err := t.redis.Get(ctx, subjectKey).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return "", fmt.Errorf("failed to issue %v token: %w", t.prefix, err)
+	}
+
+	_, err = t.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if prev != "" {
+			pipe.Del(ctx, t.prefix+":token:"+prev)
+		}
+		pipe.Set(ctx, t.prefix+":token:"+hash(token), subject, t.expiry)
+		pipe.Set(ctx, subjectKey, hash(token), t.expiry)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to issue %v token: %w", t.prefix, err)
+	}
+	return token, nil
+}
+
+// Peek returns the subject of a token without consuming it
+func (t *Tokens) Peek(ctx context.Context, token string) (string, error) {
+	subject, err := t.redis.Get(ctx, t.prefix+":token:"+hash(token)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrInvalid
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %v token: %w", t.prefix, err)
+	}
+	return subject, nil
+}
+
+// Redeem consumes a token and returns its subject
+func (t *Tokens) Redeem(ctx context.Context, token string) (string, error) {
+	subject, err := t.redis.GetDel(ctx, t.prefix+":token:"+hash(token)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrInvalid
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to redeem %v token: %w", t.prefix, err)
+	}
+
+	if err := t.redis.Del(ctx, t.prefix+":subject:"+subject).Err(); err != nil {
+		return "", fmt.Errorf("failed to redeem %v token: %w", t.prefix, err)
+	}
+	return subject, nil
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
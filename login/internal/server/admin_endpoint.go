@@ -0,0 +1,178 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/conf"
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/oidc"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+	"github.com/rinswind/distributed-greeter/login/internal/users"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
+)
+
+// AdminEndpoint serves operational routes. It listens on a separate interface that must not be exposed by the
+// ingress.
+type AdminEndpoint struct {
+	Guard *throttle.Guard
+	Users users.Repository
+
+	// Settings returns the settings of the running configuration. Leave nil to not serve them.
+	Settings func() []conf.Setting
+}
+
+// Router builds the HTTP handler of the admin endpoint
+func (ae *AdminEndpoint) Router() *gin.Engine {
+	router := gin.New()
+	router.Use(logging.RequestIDMiddleware(), logging.Middleware(), logging.Recovery())
+
+	router.GET("/log/level", handleGetLogLevel)
+	router.PUT("/log/level", handleSetLogLevel)
+
+	if ae.Settings != nil {
+		router.GET("/config", ae.handleGetConfig)
+	}
+
+	router.DELETE("/lockouts/:name", ae.handleUnlock)
+
+	router.POST("/oidc/clients", ae.handleCreateClient)
+	router.DELETE("/oidc/clients/:id", ae.handleDeleteClient)
+
+	return router
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// GET /log/level
+func handleGetLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, &logLevel{Level: logging.Level().String()})
+}
+
+// PUT /log/level
+func handleSetLogLevel(c *gin.Context) {
+	var lvl logLevel
+	if err := c.ShouldBindJSON(&lvl); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "%v", err))
+		return
+	}
+
+	if err := logging.SetLevel(lvl.Level); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "%v", err))
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Changed log level", "level", logging.Level())
+	c.JSON(http.StatusOK, &logLevel{Level: logging.Level().String()})
+}
+
+type configView struct {
+	Settings []conf.Setting `json:"settings"`
+}
+
+// GET /config
+func (ae *AdminEndpoint) handleGetConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, &configView{Settings: ae.Settings()})
+}
+
+// DELETE /lockouts/:name
+func (ae *AdminEndpoint) handleUnlock(c *gin.Context) {
+	name := c.Param("name")
+
+	unlocked, err := ae.Guard.Unlock(c.Request.Context(), validation.CanonicalUsername(name))
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to unlock %v", name))
+		return
+	}
+	if !unlocked {
+		abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, "No lockout of %v", name))
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Unlocked user", "user_name", name)
+	c.Status(http.StatusOK)
+}
+
+// POST /oidc/clients
+func (ae *AdminEndpoint) handleCreateClient(c *gin.Context) {
+	type ClientRequest struct {
+		Name         string   `json:"name" binding:"required"`
+		RedirectURIs []string `json:"redirect_uris" binding:"required,min=1"`
+
+		// Public clients get no secret
+		Public bool `json:"public"`
+	}
+
+	var req ClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to register client: %v", err))
+		return
+	}
+
+	// Redirect URIs are compared exactly, so they must be complete and free of fragments
+	for _, uri := range req.RedirectURIs {
+		parsed, err := url.Parse(uri)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidParameter, "Failed to register client: bad redirect URI %v", uri))
+			return
+		}
+	}
+
+	id, err := oidc.NewSecret()
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to register client %v", req.Name))
+		return
+	}
+
+	client := &users.Client{ID: id, Name: req.Name, RedirectURIs: req.RedirectURIs}
+
+	var secret string
+	if !req.Public {
+		secret, err = oidc.NewSecret()
+		if err != nil {
+			c.Error(err)
+			abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to register client %v", req.Name))
+			return
+		}
+		client.SecretHash = oidc.HashSecret(secret)
+	}
+
+	if err := ae.Users.CreateClient(c.Request.Context(), client); err != nil {
+		abortStore(c, err, "Failed to register client %v", req.Name)
+		return
+	}
+
+	type ClientInfo struct {
+		ClientID     string   `json:"client_id"`
+		ClientSecret string   `json:"client_secret,omitempty"`
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+	}
+
+	// The secret is shown only here, the store keeps just its hash
+	slog.InfoContext(c.Request.Context(), "Registered OIDC client", "client_id", client.ID, "name", client.Name)
+	c.JSON(http.StatusCreated, &ClientInfo{ClientID: client.ID, ClientSecret: secret, Name: client.Name, RedirectURIs: client.RedirectURIs})
+}
+
+// DELETE /oidc/clients/:id
+func (ae *AdminEndpoint) handleDeleteClient(c *gin.Context) {
+	id := c.Param("id")
+
+	if err := ae.Users.DeleteClient(c.Request.Context(), id); err != nil {
+		abortStore(c, err, "Failed to delete client %v", id)
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Deleted OIDC client", "client_id", id)
+	c.Status(http.StatusOK)
+}
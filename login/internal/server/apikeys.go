@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/apikeys"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
+)
+
+// apiKeyInfo describes an API key without the key itself
+type apiKeyInfo struct {
+	ID       string     `json:"api_key_id"`
+	Prefix   string     `json:"prefix"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires_at,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+func makeAPIKeyInfo(key *apikeys.Key) apiKeyInfo {
+	info := apiKeyInfo{ID: key.ID, Prefix: key.Prefix(), Name: key.Name, Scopes: key.Scopes, Created: key.Created.UTC()}
+	if !key.Expires.IsZero() {
+		expires := key.Expires.UTC()
+		info.Expires = &expires
+	}
+	if !key.LastUsed.IsZero() {
+		lastUsed := key.LastUsed.UTC()
+		info.LastUsed = &lastUsed
+	}
+	return info
+}
+
+// POST /users/:uid/api-keys
+func (le *LoginEndpoint) handleCreateAPIKey(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	type KeyRequest struct {
+		Name    string     `json:"name"`
+		Scopes  []string   `json:"scopes"`
+		Expires *time.Time `json:"expires_at"`
+	}
+
+	var req KeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to create API key: %v", err))
+		return
+	}
+
+	now := time.Now()
+	expires := now.Add(le.APIKeyExpiry)
+	if req.Expires != nil {
+		expires = *req.Expires
+	}
+
+	var errs validation.Errors
+	if strings.TrimSpace(req.Name) == "" {
+		errs = append(errs, validation.FieldError{Field: "name", Code: validation.CodeRequired, Message: "is required"})
+	}
+	if len(req.Scopes) == 0 {
+		errs = append(errs, validation.FieldError{Field: "scopes", Code: validation.CodeRequired, Message: "is required"})
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apikeys.Scopes, scope) {
+			errs = append(errs, validation.FieldError{Field: "scopes", Code: validation.CodeInvalid,
+				Message: fmt.Sprintf("has unknown scope %v, known are %v", scope, strings.Join(apikeys.Scopes, ", "))})
+		}
+	}
+	if !expires.After(now) {
+		errs = append(errs, validation.FieldError{Field: "expires_at", Code: validation.CodeInvalid, Message: "must be in the future"})
+	}
+	if le.APIKeyMaxExpiry > 0 && expires.After(now.Add(le.APIKeyMaxExpiry)) {
+		errs = append(errs, validation.FieldError{Field: "expires_at", Code: validation.CodeInvalid,
+			Message: fmt.Sprintf("must be within %v", le.APIKeyMaxExpiry)})
+	}
+	if len(errs) > 0 {
+		abortValidation(c, errs, "Failed to create API key for user %v", id)
+		return
+	}
+
+	key := &apikeys.Key{UserID: id, Name: req.Name, Scopes: slices.Compact(slices.Sorted(slices.Values(req.Scopes))), Created: now, Expires: expires}
+	secret, err := le.APIKeys.Create(c.Request.Context(), key)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to create API key for user %v", id))
+		return
+	}
+
+	type NewKey struct {
+		apiKeyInfo
+
+		// Key is shown only here, the store keeps just its hash
+		Key string `json:"api_key"`
+	}
+
+	c.JSON(http.StatusCreated, &NewKey{apiKeyInfo: makeAPIKeyInfo(key), Key: secret})
+}
+
+// GET /users/:uid/api-keys
+func (le *LoginEndpoint) handleListAPIKeys(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	list, err := le.APIKeys.List(c.Request.Context(), id)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to list API keys of user %v", id))
+		return
+	}
+
+	type Keys struct {
+		Keys []apiKeyInfo `json:"api_keys"`
+	}
+
+	keys := Keys{Keys: make([]apiKeyInfo, len(list))}
+	for i, key := range list {
+		keys.Keys[i] = makeAPIKeyInfo(key)
+	}
+	c.JSON(http.StatusOK, &keys)
+}
+
+// DELETE /users/:uid/api-keys/:kid
+func (le *LoginEndpoint) handleRevokeAPIKey(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+	keyID := c.Param("kid")
+
+	revoked, err := le.APIKeys.Revoke(c.Request.Context(), id, keyID)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to revoke API key %v", keyID))
+		return
+	}
+	if !revoked {
+		abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, "No API key %v", keyID))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+	"github.com/rinswind/distributed-greeter/login/internal/oidc"
+)
+
+// authenticate makes the middleware that rejects unauthenticated requests and records the use of their session.
+// Access tokens issued to OIDC clients are rejected.
+func authenticate(ar *auth.AuthReader, store *sessions.Store) gin.HandlerFunc {
+	return authenticateFor(ar, store, func(claims map[string]interface{}) bool {
+		return auth.HasAudience(claims, auth.Audience)
+	})
+}
+
+// authenticateUserinfo makes the middleware of the OIDC userinfo endpoint, which also accepts the access tokens issued
+// to OIDC clients for the openid scope
+func authenticateUserinfo(ar *auth.AuthReader, store *sessions.Store) gin.HandlerFunc {
+	return authenticateFor(ar, store, func(claims map[string]interface{}) bool {
+		scope, _ := claims["scope"].(string)
+		return auth.HasAudience(claims, auth.Audience) || slices.Contains(strings.Fields(scope), oidc.ScopeOpenID)
+	})
+}
+
+// authenticateFor makes the middleware that rejects unauthenticated requests and the tokens that accept rejects
+func authenticateFor(ar *auth.AuthReader, store *sessions.Store, accept func(claims map[string]interface{}) bool) gin.HandlerFunc {
+	authHandler := auth.MakeHandler(ar)
+
+	return func(c *gin.Context) {
+		authHandler(c)
+		if c.IsAborted() {
+			return
+		}
+		if !accept(claims(c)) {
+			auth.Challenge(c, auth.ErrTokenAudience)
+			return
+		}
+
+		// The session is only informative, so a failure to track it must not fail the request
+		if id, ok := sessionID(c); ok {
+			if err := store.Touch(c.Request.Context(), id, time.Now()); err != nil {
+				slog.WarnContext(c.Request.Context(), "Failed to record session use", "login_id", id, "error", err)
+			}
+		}
+	}
+}
+
+// claims returns the JWT claims stored by the auth middleware
+func claims(c *gin.Context) map[string]interface{} {
+	val, _ := c.Get(auth.ContextKey)
+	claims, _ := val.(map[string]interface{})
+	return claims
+}
+
+// sessionID returns the login ID of the authenticated request
+func sessionID(c *gin.Context) (string, bool) {
+	id, ok := claims(c)["access_uuid"].(string)
+	return id, ok
+}
+
+// authorizeUser responds with an error unless the request is authenticated as the given user
+func authorizeUser(c *gin.Context, id uint64) bool {
+	// JSON numbers decode as float64
+	userID, ok := claims(c)["user_id"].(float64)
+	if !ok || uint64(userID) != id {
+		abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, "Not allowed to access user %v", id))
+		return false
+	}
+	return true
+}
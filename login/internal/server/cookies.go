@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/problem"
+)
+
+// CookieSettings configure the cookies that carry the tokens of browser logins
+type CookieSettings struct {
+	Domain   string
+	Path     string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// NewCookieSettings creates CookieSettings. sameSite is one of Strict, Lax or None.
+func NewCookieSettings(domain, path string, secure bool, sameSite string) (*CookieSettings, error) {
+	cs := &CookieSettings{Domain: domain, Path: path, Secure: secure}
+
+	switch strings.ToLower(sameSite) {
+	case "strict":
+		cs.SameSite = http.SameSiteStrictMode
+	case "lax", "":
+		cs.SameSite = http.SameSiteLaxMode
+	case "none":
+		// Browsers drop SameSite=None cookies that are not Secure
+		if !secure {
+			return nil, fmt.Errorf("SameSite None requires Secure cookies")
+		}
+		cs.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("unknown SameSite mode %v", sameSite)
+	}
+
+	if cs.Path == "" {
+		cs.Path = "/"
+	}
+	return cs, nil
+}
+
+// setLoginCookies hands the tokens of a login to the browser and returns the CSRF token that goes with them. All
+// cookies last as long as the refresh token, so a login can still be ended after its access token expires.
+func (le *LoginEndpoint) setLoginCookies(c *gin.Context, token *auth.TokenDetails) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate CSRF token: %w", err)
+	}
+	csrf := base64.RawURLEncoding.EncodeToString(raw)
+
+	expires := time.Unix(token.RefreshExpires, 0)
+	le.setCookie(c, auth.AccessCookie, token.AccessToken, expires, true)
+	le.setCookie(c, auth.RefreshCookie, token.RefreshToken, expires, true)
+	le.setCookie(c, auth.CSRFCookie, csrf, expires, false)
+	return csrf, nil
+}
+
+// clearLoginCookies removes the cookies of a browser login
+func (le *LoginEndpoint) clearLoginCookies(c *gin.Context) {
+	for _, name := range []string{auth.AccessCookie, auth.RefreshCookie, auth.CSRFCookie} {
+		le.setCookie(c, name, "", time.Unix(0, 0), name != auth.CSRFCookie)
+	}
+}
+
+func (le *LoginEndpoint) setCookie(c *gin.Context, name, value string, expires time.Time, httpOnly bool) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   le.Cookies.Domain,
+		Path:     le.Cookies.Path,
+		Expires:  expires,
+		Secure:   le.Cookies.Secure,
+		HttpOnly: httpOnly,
+		SameSite: le.Cookies.SameSite,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(c.Writer, cookie)
+}
+
+// DELETE /logins
+func (le *LoginEndpoint) handleLogoutBrowser(c *gin.Context) {
+	token, fromCookie, err := auth.AccessToken(c.Request)
+	ok := err == nil
+
+	// Without the CSRF check other sites could log users out
+	if ok && fromCookie && !auth.CheckCSRF(c.Request) {
+		abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, "CSRF token mismatch"))
+		return
+	}
+
+	// Whatever else happens, the browser must be left without the login
+	le.clearLoginCookies(c)
+	if !ok || !fromCookie {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	// The token may have expired, but a valid signature still proves which login to end
+	claims, err := le.AuthReader.ReadExpiredAuth(c.Request.Context(), token)
+	if err != nil {
+		c.Error(err)
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if id, ok := claims["access_uuid"].(string); ok {
+		if _, err := le.Sessions.Revoke(c.Request.Context(), id); err != nil {
+			c.Error(err)
+			abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to delete authentication %v", id))
+			return
+		}
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/notify"
+	"github.com/rinswind/distributed-greeter/login/internal/onetime"
+	"github.com/rinswind/distributed-greeter/login/internal/users"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
+)
+
+// PUT /users/:uid/email
+func (le *LoginEndpoint) handleSetEmail(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	type EmailChange struct {
+		Email string `json:"user_email"`
+	}
+
+	var change EmailChange
+	if err := c.ShouldBindJSON(&change); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to change email of user %v: %v", id, err))
+		return
+	}
+
+	address, err := le.Validator.ValidateEmail(validation.FieldUserEmail, change.Email)
+	if err != nil {
+		abortValidation(c, err, "Failed to change email of user %v", id)
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// Changing the address sends a mail too, so it is limited like the resends
+	if err := le.Resends.Take(ctx, strconv.FormatUint(id, 10)); err != nil {
+		abortThrottle(c, err, "Failed to change email of user %v", id)
+		return
+	}
+
+	if err := le.Users.SetEmail(ctx, id, address); err != nil {
+		abortStore(c, err, "Failed to change email of user %v", id)
+		return
+	}
+	if err := le.sendVerification(ctx, id, address); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to send verification to user %v", id))
+		return
+	}
+
+	c.JSON(http.StatusOK, &emailInfo{Email: address, Verified: false})
+}
+
+// POST /users/:uid/email/verification
+func (le *LoginEndpoint) handleResendVerification(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	email, err := le.Users.GetEmail(ctx, id)
+	if err != nil {
+		abortStore(c, err, "Failed to find email of user %v", id)
+		return
+	}
+	if email.Verified {
+		abort(c, problem.New(http.StatusConflict, problem.CodeConflict, "Email of user %v is already verified", id))
+		return
+	}
+
+	if err := le.Resends.Take(ctx, strconv.FormatUint(id, 10)); err != nil {
+		abortThrottle(c, err, "Failed to resend verification to user %v", id)
+		return
+	}
+	if err := le.sendVerification(ctx, id, email.Address); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to send verification to user %v", id))
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// POST /email-verifications/confirm
+func (le *LoginEndpoint) handleConfirmEmail(c *gin.Context) {
+	type EmailConfirmation struct {
+		Token string `json:"token"`
+	}
+
+	var confirm EmailConfirmation
+	if err := c.ShouldBindJSON(&confirm); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to verify email: %v", err))
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	invalid := func(err error) {
+		c.Error(err)
+		p := problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "Failed to verify email")
+		p.InvalidParams = []problem.InvalidParam{{Name: validation.FieldToken, Code: validation.CodeInvalid, Reason: "is invalid or expired"}}
+		abort(c, p)
+	}
+
+	subject, err := le.Verifications.Redeem(ctx, confirm.Token)
+	if errors.Is(err, onetime.ErrInvalid) {
+		invalid(err)
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to verify email"))
+		return
+	}
+
+	id, address, err := parseVerificationSubject(subject)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to verify email"))
+		return
+	}
+
+	// A token mailed to an address the user has since replaced must not verify the new one
+	err = le.Users.VerifyEmail(ctx, id, address)
+	if errors.Is(err, users.ErrNotFound) {
+		invalid(err)
+		return
+	}
+	if err != nil {
+		abortStore(c, err, "Failed to verify email of user %v", id)
+		return
+	}
+
+	slog.InfoContext(ctx, "Verified email", "user_id", id)
+	c.JSON(http.StatusOK, &emailInfo{Email: address, Verified: true})
+}
+
+// emailInfo is the email of a user as shown by the REST API
+type emailInfo struct {
+	Email    string `json:"user_email"`
+	Verified bool   `json:"email_verified"`
+}
+
+// sendVerification mails a verification token to an address of a user
+func (le *LoginEndpoint) sendVerification(ctx context.Context, id uint64, address string) error {
+	token, err := le.Verifications.Issue(ctx, fmt.Sprintf("%v:%v", id, address))
+	if err != nil {
+		return err
+	}
+
+	msg := &notify.Message{
+		To:      address,
+		Subject: "Verify your email address",
+		Body:    fmt.Sprintf("Confirm that this is your address with this link:\n\n%v%v\n", le.VerificationLink, token),
+	}
+	return le.Notifier.Notify(ctx, msg)
+}
+
+// parseVerificationSubject splits the subject of a verification token into the user ID and the address
+func parseVerificationSubject(subject string) (uint64, string, error) {
+	idStr, address, ok := strings.Cut(subject, ":")
+	if !ok {
+		return 0, "", fmt.Errorf("malformed verification subject %v", subject)
+	}
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("malformed verification subject %v: %w", subject, err)
+	}
+	return id, address, nil
+}
+
+// checkVerified reports whether a user may log in as far as its email is concerned
+func (le *LoginEndpoint) checkVerified(ctx context.Context, user *users.User) (bool, error) {
+	if !le.RequireVerifiedEmail {
+		return true, nil
+	}
+
+	email, err := le.Users.GetEmail(ctx, user.ID)
+	if errors.Is(err, users.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return email.Verified, nil
+}
+
+// contactAddress returns the verified address of a user, if there is one. Mails to unverified addresses could
+// hand an account to whoever typed in the address.
+func (le *LoginEndpoint) contactAddress(ctx context.Context, user *users.User) (string, bool, error) {
+	email, err := le.Users.GetEmail(ctx, user.ID)
+	if errors.Is(err, users.ErrNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return email.Address, email.Verified, nil
+}
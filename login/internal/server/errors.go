@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+	"github.com/rinswind/distributed-greeter/login/internal/users"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
+)
+
+// abort sends an RFC 7807 error response tagged with the ID of the failed request
+func abort(c *gin.Context, p *problem.Problem) {
+	p.Instance = c.Request.URL.Path
+	p.RequestID = logging.RequestID(c.Request.Context())
+	problem.Abort(c, p)
+}
+
+// abortStore sends the error response matching a failure of the users store
+func abortStore(c *gin.Context, err error, format string, args ...interface{}) {
+	c.Error(err)
+
+	switch {
+	case errors.Is(err, users.ErrNotFound):
+		abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, format, args...))
+	case errors.Is(err, users.ErrConflict):
+		abort(c, problem.New(http.StatusConflict, problem.CodeConflict, format, args...))
+	case errors.Is(err, context.DeadlineExceeded):
+		abort(c, problem.New(http.StatusServiceUnavailable, problem.CodeTimeout, format, args...))
+	default:
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, format, args...))
+	}
+}
+
+// abortValidation sends the error response listing the fields rejected by a validation.Validator
+func abortValidation(c *gin.Context, err error, format string, args ...interface{}) {
+	c.Error(err)
+
+	var fieldErrs validation.Errors
+	if !errors.As(err, &fieldErrs) {
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, format, args...))
+		return
+	}
+
+	p := problem.New(http.StatusBadRequest, problem.CodeValidationFailed, format, args...)
+	for _, fe := range fieldErrs {
+		p.InvalidParams = append(p.InvalidParams, problem.InvalidParam{Name: fe.Field, Code: fe.Code, Reason: fe.Message})
+	}
+	abort(c, p)
+}
+
+// abortThrottle sends the error response matching a login rejected by a throttle.Guard
+func abortThrottle(c *gin.Context, err error, format string, args ...interface{}) {
+	c.Error(err)
+
+	var retryErr *throttle.RetryError
+	if !errors.As(err, &retryErr) {
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, format, args...))
+		return
+	}
+
+	code := problem.CodeRateLimited
+	if errors.Is(err, throttle.ErrLocked) {
+		code = problem.CodeAccountLocked
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryErr.RetryAfter.Seconds()))))
+	abort(c, problem.New(http.StatusTooManyRequests, code, format, args...))
+}
@@ -1,40 +1,146 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	ginauth "github.com/rinswind/auth-go/gin"
-	"github.com/rinswind/auth-go/tokens"
+	"github.com/rinswind/distributed-greeter/common/apikeys"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+	"github.com/rinswind/distributed-greeter/common/tracing"
+	"github.com/rinswind/distributed-greeter/login/internal/notify"
+	"github.com/rinswind/distributed-greeter/login/internal/oidc"
+	"github.com/rinswind/distributed-greeter/login/internal/onetime"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
 	"github.com/rinswind/distributed-greeter/login/internal/users"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
 )
 
 // LoginEndpoint is the REST endpoint for the login service
 type LoginEndpoint struct {
-	Iface      string
-	AuthReader *tokens.AuthReader
-	AuthWriter *tokens.AuthWriter
-	Users      *users.Store
+	AuthReader *auth.AuthReader
+	AuthWriter *auth.AuthWriter
+	Users      users.Repository
+	Sessions   *sessions.Store
+	Validator  *validation.Validator
+	Guard      *throttle.Guard
+	Notifier   notify.Notifier
+
+	// Resets issues the password reset tokens, which are mailed with ResetLink prepended if it is set
+	Resets    *onetime.Tokens
+	ResetLink string
+
+	// Verifications issues the email verification tokens, which are mailed with VerificationLink prepended if it is
+	// set. Resends limits how often a user can have them mailed. RequireVerifiedEmail keeps users from logging in
+	// until they verify their address.
+	Verifications        *onetime.Tokens
+	VerificationLink     string
+	Resends              *throttle.Cooldown
+	RequireVerifiedEmail bool
+
+	// Challenges issues the tokens that carry a login from the password to the second factor. MFAIssuer names the
+	// service in authenticator apps.
+	Challenges *onetime.Tokens
+	MFAIssuer  string
+
+	// KeyRing holds the keys that sign the access tokens. Their public halves are published for the other services
+	// to verify with. Nil when the tokens are signed with a shared secret.
+	KeyRing *auth.KeyRing
+
+	// OIDCIssuer is the external URL of the service. When set, and the tokens are signed by a KeyRing, the service
+	// is also an OpenID Connect provider whose authorization codes are issued by OIDCCodes.
+	OIDCIssuer string
+	OIDCCodes  *oidc.Codes
+
+	// APIKeys holds the keys of machine clients. Keys expire after APIKeyExpiry unless their creator sets another
+	// time, which may be at most APIKeyMaxExpiry away if that is set.
+	APIKeys         *apikeys.Store
+	APIKeyExpiry    time.Duration
+	APIKeyMaxExpiry time.Duration
+
+	// Cookies, when set, make logins hand their tokens to browsers in cookies instead of the response body
+	Cookies *CookieSettings
 }
 
-// Run starts the rest endpoint
-func (le *LoginEndpoint) Run() {
-	router := gin.Default()
+// Router builds the HTTP handler of the rest endpoint
+func (le *LoginEndpoint) Router() *gin.Engine {
+	router := gin.New()
+	router.Use(logging.RequestIDMiddleware(), tracing.Middleware(), logging.Middleware(), logging.Recovery())
 
-	authHandler := ginauth.MakeHandler(le.AuthReader)
+	authHandler := authenticate(le.AuthReader, le.Sessions)
 
 	// TODO: must secure the API call, must not secure the user ID (https?)
 	router.POST("/users", le.handleCreateUser)
 	router.GET("/users/:uid", authHandler, le.handleUserInfo)
 	router.DELETE("/users/:uid", authHandler, le.handleUserDelete)
 
+	router.PUT("/users/:uid/password", authHandler, le.handleChangePassword)
+
+	router.PUT("/users/:uid/email", authHandler, le.handleSetEmail)
+	router.POST("/users/:uid/email/verification", authHandler, le.handleResendVerification)
+	router.POST("/email-verifications/confirm", le.handleConfirmEmail)
+
+	router.POST("/password-resets", le.handleRequestReset)
+	router.POST("/password-resets/confirm", le.handleConfirmReset)
+
+	router.POST("/users/:uid/totp", authHandler, le.handleEnrollTOTP)
+	router.GET("/users/:uid/totp/qr", authHandler, le.handleTOTPQR)
+	router.POST("/users/:uid/totp/confirm", authHandler, le.handleConfirmTOTP)
+	router.DELETE("/users/:uid/totp", authHandler, le.handleDisableTOTP)
+
+	router.POST("/users/:uid/api-keys", authHandler, le.handleCreateAPIKey)
+	router.GET("/users/:uid/api-keys", authHandler, le.handleListAPIKeys)
+	router.DELETE("/users/:uid/api-keys/:kid", authHandler, le.handleRevokeAPIKey)
+
+	router.GET("/users/:uid/logins", authHandler, le.handleListLogins)
+	router.DELETE("/users/:uid/logins", authHandler, le.handleRevokeLogins)
+	router.DELETE("/users/:uid/logins/:uuid", authHandler, le.handleRevokeLogin)
+
 	// TODO: must secure the API call, must not secure the user ID (https?)
 	router.POST("/logins", le.handleLogin)
-	router.DELETE("/logins/:uuid", authHandler, le.handleLogout)
+	router.POST("/logins/mfa", le.handleLoginMFA)
+	// Logging out with an expired token must still clean up its login
+	router.DELETE("/logins/:uuid", auth.MakeExpiredHandler(le.AuthReader), le.handleLogout)
+	if le.Cookies != nil {
+		router.DELETE("/logins", le.handleLogoutBrowser)
+	}
+
+	if le.KeyRing != nil {
+		router.GET(oidc.PathJWKS, le.handleJWKS)
+	}
+
+	if le.KeyRing != nil && le.OIDCIssuer != "" {
+		router.GET(oidc.PathDiscovery, le.handleDiscovery)
+		router.GET(oidc.PathAuthorize, le.handleAuthorize)
+		router.POST(oidc.PathAuthorize, le.handleAuthorizeLogin)
+		router.POST(oidc.PathToken, le.handleToken)
+		router.GET(oidc.PathUserinfo, authenticateUserinfo(le.AuthReader, le.Sessions), le.handleUserinfo)
+	}
 
-	router.Run(le.Iface)
+	return router
+}
+
+// GET /.well-known/jwks.json
+func (le *LoginEndpoint) handleJWKS(c *gin.Context) {
+	set, err := le.KeyRing.JWKS(c.Request.Context())
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to read signing keys"))
+		return
+	}
+
+	// Verifiers cache the keys anyway, and refetch on an unknown kid
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, set)
 }
 
 // POST /users
@@ -42,77 +148,296 @@ func (le *LoginEndpoint) handleCreateUser(c *gin.Context) {
 	type UserCreds struct {
 		Name     string `json:"user_name"`
 		Password string `json:"user_password"`
+		Email    string `json:"user_email"`
 	}
 
 	var userCreds UserCreds
 	if err := c.ShouldBindJSON(&userCreds); err != nil {
 		c.Error(err)
 		// Report full details when the REST API contract is violated
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to create user %v: %v", userCreds.Name, err)})
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to create user %v: %v", userCreds.Name, err))
 		return
 	}
 
-	userid, err := le.Users.CreateUser(userCreds.Name, userCreds.Password)
+	name, err := le.Validator.Validate(userCreds.Name, userCreds.Password)
 	if err != nil {
+		abortValidation(c, err, "Failed to create user %v", userCreds.Name)
+		return
+	}
+
+	// The address is optional, unless logins require a verified one
+	var email string
+	if userCreds.Email != "" || le.RequireVerifiedEmail {
+		email, err = le.Validator.ValidateEmail(validation.FieldUserEmail, userCreds.Email)
+		if err != nil {
+			abortValidation(c, err, "Failed to create user %v", userCreds.Name)
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+
+	userid, err := le.Users.CreateUser(ctx, name, userCreds.Password)
+	if errors.Is(err, users.ErrUserExists) {
 		c.Error(err)
+		p := problem.New(http.StatusConflict, problem.CodeConflict, "Failed to create user %v", name)
+		p.InvalidParams = []problem.InvalidParam{{Name: validation.FieldUserName, Code: validation.CodeTaken, Reason: "is already taken"}}
+		abort(c, p)
+		return
+	}
+	if err != nil {
 		// Report sparse details when the deeper processing fails
-		// TODO But what if the REST API does describe things like uniqueness of the user name?
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to create user: %v", userCreds.Name)})
+		abortStore(c, err, "Failed to create user %v", userCreds.Name)
 		return
 	}
 
+	// The user exists by now, so a failure to mail it is left for a resend
+	if email != "" {
+		err := le.Users.SetEmail(ctx, userid, email)
+		if err == nil {
+			err = le.Resends.Take(ctx, strconv.FormatUint(userid, 10))
+		}
+		if err == nil {
+			err = le.sendVerification(ctx, userid, email)
+		}
+		if err != nil {
+			c.Error(err)
+			slog.WarnContext(ctx, "Failed to send email verification", "user_id", userid, "error", err)
+		}
+	}
+
 	type UserInfo struct {
-		ID   uint64 `json:"user_id"`
-		Name string `json:"user_name"`
+		ID    uint64 `json:"user_id"`
+		Name  string `json:"user_name"`
+		Email string `json:"user_email,omitempty"`
 	}
 
-	userInfo := UserInfo{ID: userid, Name: userCreds.Name}
+	userInfo := UserInfo{ID: userid, Name: name, Email: email}
 	c.JSON(http.StatusOK, &userInfo)
 }
 
 // GET /users/:uid
 func (le *LoginEndpoint) handleUserInfo(c *gin.Context) {
-	idParam := c.Param("uid")
-	id, err := strconv.ParseUint(idParam, 10, 64)
-	if err != nil {
-		c.Error(fmt.Errorf("Failed to parse uid %v: %v", idParam, err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to parse uid %v: %v", idParam, err)})
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
 		return
 	}
 
-	user, err := le.Users.GetUserByID(id)
+	ctx := c.Request.Context()
+
+	user, err := le.Users.GetUserByID(ctx, id)
 	if err != nil {
-		c.Error(err)
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Failed to find user %v", id)})
+		abortStore(c, err, "Failed to find user %v", id)
+		return
+	}
+
+	email, err := le.Users.GetEmail(ctx, id)
+	if err != nil && !errors.Is(err, users.ErrNotFound) {
+		abortStore(c, err, "Failed to find user %v", id)
 		return
 	}
 
 	type UserInfo struct {
-		ID   uint64 `json:"user_id"`
-		Name string `json:"user_name"`
+		ID            uint64 `json:"user_id"`
+		Name          string `json:"user_name"`
+		Email         string `json:"user_email,omitempty"`
+		EmailVerified bool   `json:"email_verified"`
 	}
 
 	userInfo := UserInfo{ID: user.ID, Name: user.Name}
+	if email != nil {
+		userInfo.Email = email.Address
+		userInfo.EmailVerified = email.Verified
+	}
 	c.JSON(http.StatusOK, &userInfo)
 }
 
 // DELETE /users/:uid
 func (le *LoginEndpoint) handleUserDelete(c *gin.Context) {
-	idParam := c.Param("uid")
-	id, err := strconv.ParseUint(idParam, 10, 64)
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	err := le.Users.DeleteUserByID(c.Request.Context(), id)
+	if err != nil {
+		abortStore(c, err, "Failed to delete user %v", id)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// PUT /users/:uid/password
+func (le *LoginEndpoint) handleChangePassword(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	type PasswordChange struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	var change PasswordChange
+	if err := c.ShouldBindJSON(&change); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to change password of user %v: %v", id, err))
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	user, err := le.Users.GetUserByID(ctx, id)
+	if err != nil {
+		abortStore(c, err, "Failed to change password of user %v", id)
+		return
+	}
+
+	// A stolen session must not be a way around the brute-force protection of the login
+	userKey := validation.CanonicalUsername(user.Name)
+	clientIP := c.ClientIP()
+	attempt, err := le.Guard.Attempt(ctx, userKey, clientIP)
+	if err != nil {
+		abortThrottle(c, err, "Failed to change password of user %v", id)
+		return
+	}
+	if user.Password != change.CurrentPassword {
+		if err := attempt.Fail(ctx); err != nil {
+			c.Error(err)
+		}
+		p := problem.New(http.StatusForbidden, problem.CodeForbidden, "Failed to change password of user %v", id)
+		p.InvalidParams = []problem.InvalidParam{{Name: validation.FieldCurrentPassword, Code: validation.CodeIncorrect, Reason: "does not match"}}
+		abort(c, p)
+		return
+	}
+	if err := attempt.Release(ctx); err != nil {
+		c.Error(err)
+	}
+
+	if err := le.Validator.ValidatePassword(validation.FieldNewPassword, change.NewPassword); err != nil {
+		abortValidation(c, err, "Failed to change password of user %v", id)
+		return
+	}
+
+	if err := le.Users.UpdatePassword(ctx, id, change.NewPassword); err != nil {
+		abortStore(c, err, "Failed to change password of user %v", id)
+		return
+	}
+
+	slog.InfoContext(ctx, "Changed password", "user_id", id)
+	c.Status(http.StatusOK)
+}
+
+// POST /password-resets
+func (le *LoginEndpoint) handleRequestReset(c *gin.Context) {
+	type ResetRequest struct {
+		Name string `json:"user_name"`
+	}
+
+	var req ResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to request password reset: %v", err))
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// Answer the same whether the user exists or not, so the route does not reveal the user names
+	user, err := le.Users.GetUserByName(ctx, req.Name)
+	if errors.Is(err, users.ErrNotFound) {
+		c.Error(err)
+		c.Status(http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		abortStore(c, err, "Failed to request password reset for %v", req.Name)
+		return
+	}
+
+	// Failures from here on happen only for known users, so they are logged but not reported
+	address, ok, err := le.contactAddress(ctx, user)
+	if err != nil {
+		c.Error(err)
+		c.Status(http.StatusAccepted)
+		return
+	}
+	if !ok {
+		slog.InfoContext(ctx, "No verified email to send password reset to", "user_id", user.ID)
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	token, err := le.Resets.Issue(ctx, strconv.FormatUint(user.ID, 10))
+	if err != nil {
+		c.Error(err)
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	msg := &notify.Message{
+		To:      address,
+		Subject: "Reset your password",
+		Body:    fmt.Sprintf("Someone asked to reset your password. If it was you, use this link:\n\n%v%v\n", le.ResetLink, token),
+	}
+	if err := le.Notifier.Notify(ctx, msg); err != nil {
+		c.Error(err)
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// POST /password-resets/confirm
+func (le *LoginEndpoint) handleConfirmReset(c *gin.Context) {
+	type ResetConfirmation struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+
+	var confirm ResetConfirmation
+	if err := c.ShouldBindJSON(&confirm); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to reset password: %v", err))
+		return
+	}
+
+	// Check the password first, so that a rejected one does not use up the token
+	if err := le.Validator.ValidatePassword(validation.FieldNewPassword, confirm.NewPassword); err != nil {
+		abortValidation(c, err, "Failed to reset password")
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	subject, err := le.Resets.Redeem(ctx, confirm.Token)
+	if errors.Is(err, onetime.ErrInvalid) {
+		c.Error(err)
+		p := problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "Failed to reset password")
+		p.InvalidParams = []problem.InvalidParam{{Name: validation.FieldToken, Code: validation.CodeInvalid, Reason: "is invalid or expired"}}
+		abort(c, p)
+		return
+	}
 	if err != nil {
-		c.Error(fmt.Errorf("Failed to parse uid %v: %v", idParam, err))
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to parse uid %v: %v", idParam, err)})
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to reset password"))
 		return
 	}
 
-	err = le.Users.DeleteUserByID(id)
+	id, err := strconv.ParseUint(subject, 10, 64)
 	if err != nil {
 		c.Error(err)
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Failed to delete user %v", id)})
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to reset password"))
 		return
 	}
 
+	if err := le.Users.UpdatePassword(ctx, id, confirm.NewPassword); err != nil {
+		abortStore(c, err, "Failed to reset password of user %v", id)
+		return
+	}
+
+	slog.InfoContext(ctx, "Reset password", "user_id", id)
 	c.Status(http.StatusOK)
 }
 
@@ -127,65 +452,273 @@ func (le *LoginEndpoint) handleLogin(c *gin.Context) {
 	if err := c.ShouldBindJSON(&userCreds); err != nil {
 		c.Error(err)
 		// Report full details when the REST API contract is violated
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to login: %v", err)})
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to login: %v", err))
 		return
 	}
 
-	user, err := le.Users.GetUserByName(userCreds.Name)
+	ctx := c.Request.Context()
+
+	// Count failures of all spellings of a name together
+	userKey := validation.CanonicalUsername(userCreds.Name)
+	clientIP := c.ClientIP()
+	attempt, err := le.Guard.Attempt(ctx, userKey, clientIP)
 	if err != nil {
+		abortThrottle(c, err, "Failed to login %v", userCreds.Name)
+		return
+	}
+
+	user, err := le.Users.GetUserByName(ctx, userCreds.Name)
+	if errors.Is(err, users.ErrNotFound) {
 		c.Error(err)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Bad user or password"})
+		le.failLogin(c, attempt)
+		return
+	}
+	if err != nil {
+		abortStore(c, err, "Failed to login %v", userCreds.Name)
 		return
 	}
 
 	if user.Password != userCreds.Password {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Bad user or password"})
+		le.failLogin(c, attempt)
 		return
 	}
 
-	token, err := le.AuthWriter.CreateToken(user.ID)
+	// Checked after the password, so the response does not reveal the state of other accounts
+	verified, err := le.checkVerified(ctx, user)
 	if err != nil {
-		c.Error(err)
-		c.JSON(
-			http.StatusInternalServerError,
-			gin.H{"error": fmt.Sprintf("Failed to create login token for %v", userCreds.Name)})
+		abortStore(c, err, "Failed to login %v", userCreds.Name)
+		return
+	}
+	if !verified {
+		if err := attempt.Release(ctx); err != nil {
+			c.Error(err)
+		}
+		abort(c, problem.New(http.StatusForbidden, problem.CodeEmailNotVerified, "User %v must verify its email address", user.Name))
+		return
+	}
+
+	// Users with two-factor authentication get a challenge instead of tokens
+	state, err := le.Users.GetTOTP(ctx, user.ID)
+	if err != nil && !errors.Is(err, users.ErrNotFound) {
+		abortStore(c, err, "Failed to login %v", userCreds.Name)
+		return
+	}
+	if err == nil && state.Confirmed {
+		// The failures are kept until the second factor is met too
+		if err := attempt.Release(ctx); err != nil {
+			c.Error(err)
+		}
+		le.challengeLogin(c, user)
 		return
 	}
 
-	err = le.AuthWriter.CreateAuth(token)
+	le.completeLogin(c, user, attempt, clientIP)
+}
+
+// completeLogin issues the tokens of an authenticated user
+func (le *LoginEndpoint) completeLogin(c *gin.Context, user *users.User, attempt *throttle.Attempt, clientIP string) {
+	ctx := c.Request.Context()
+
+	if err := attempt.Succeed(ctx); err != nil {
+		slog.WarnContext(ctx, "Failed to reset login failures", "user_name", user.Name, "error", err)
+	}
+
+	token, err := le.startSession(ctx, user, auth.Audience, "", c.Request.UserAgent(), clientIP)
 	if err != nil {
 		c.Error(err)
-		c.JSON(
-			http.StatusInternalServerError,
-			gin.H{"error": fmt.Sprintf("Failed to record authentication %v", token.AccessUUID)})
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to login %v", user.Name))
 		return
 	}
 
 	type LoginInfo struct {
 		UserID       uint64 `json:"user_id"`
 		LoginID      string `json:"login_id"`
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
+		AccessToken  string `json:"access_token,omitempty"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		CSRFToken    string `json:"csrf_token,omitempty"`
 	}
 
-	loginInfo := LoginInfo{
-		LoginID:      token.AccessUUID,
-		UserID:       user.ID,
-		AccessToken:  token.AccessToken,
-		RefreshToken: token.RefreshToken}
+	loginInfo := LoginInfo{LoginID: token.AccessUUID, UserID: user.ID}
+
+	// Tokens in cookies are out of reach of page scripts, so they must not be in the body too
+	if le.Cookies != nil {
+		loginInfo.CSRFToken, err = le.setLoginCookies(c, token)
+		if err != nil {
+			c.Error(err)
+			abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to login %v", user.Name))
+			return
+		}
+	} else {
+		loginInfo.AccessToken = token.AccessToken
+		loginInfo.RefreshToken = token.RefreshToken
+	}
 	c.JSON(http.StatusOK, &loginInfo)
 }
 
+// startSession creates the tokens of a login and records it
+func (le *LoginEndpoint) startSession(ctx context.Context, user *users.User, audience, scope, userAgent, clientIP string) (*auth.TokenDetails, error) {
+	token, err := le.AuthWriter.CreateClientToken(ctx, user.ID, audience, scope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create login token for %v: %w", user.Name, err)
+	}
+
+	err = le.AuthWriter.CreateAuth(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record authentication %v: %w", token.AccessUUID, err)
+	}
+
+	now := time.Now()
+	session := &sessions.Session{
+		ID:        token.AccessUUID,
+		RefreshID: token.RefreshUUID,
+		UserID:    user.ID,
+		Created:   now,
+		LastUsed:  now,
+		UserAgent: userAgent,
+		IP:        clientIP,
+	}
+	// The login lasts as long as it can be refreshed, so an expired access token can still end it
+	err = le.Sessions.Create(ctx, session, time.Unix(token.RefreshExpires, 0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to record session %v: %w", token.AccessUUID, err)
+	}
+	return token, nil
+}
+
+// failLogin records a failed login and rejects it without telling a bad user from a bad password
+func (le *LoginEndpoint) failLogin(c *gin.Context, attempt *throttle.Attempt) {
+	if err := attempt.Fail(c.Request.Context()); err != nil {
+		c.Error(err)
+	}
+	abort(c, problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "Bad user or password"))
+}
+
 // DELETE /logins/:uuid
 func (le *LoginEndpoint) handleLogout(c *gin.Context) {
 	atUUID := c.Param("uuid")
 
-	// TODO Check the kind of error: is the UUID missing or?
-	if _, err := le.AuthWriter.DeleteAuth(atUUID); err != nil {
+	// The token may be expired or revoked, so it proves no more than which login it belongs to. Other logins are
+	// ended through DELETE /users/:uid/logins/:uuid, which needs a live login.
+	if own, _ := sessionID(c); atUUID != own {
+		abort(c, problem.New(http.StatusForbidden, problem.CodeForbidden, "Not allowed to end authentication %v", atUUID))
+		return
+	}
+
+	deleted, err := le.Sessions.Revoke(c.Request.Context(), atUUID)
+	if err != nil {
 		c.Error(err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to delete authentication %v", atUUID)})
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to delete authentication %v", atUUID))
+		return
+	}
+	if !deleted {
+		abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, "No authentication %v", atUUID))
 		return
 	}
 
 	c.Status(http.StatusOK)
 }
+
+// GET /users/:uid/logins
+func (le *LoginEndpoint) handleListLogins(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	list, err := le.Sessions.List(c.Request.Context(), id)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to list logins of user %v", id))
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+
+	type LoginInfo struct {
+		LoginID   string    `json:"login_id"`
+		Created   time.Time `json:"created"`
+		LastUsed  time.Time `json:"last_used"`
+		UserAgent string    `json:"user_agent"`
+		IP        string    `json:"ip"`
+		Current   bool      `json:"current"`
+	}
+
+	type Logins struct {
+		Logins []LoginInfo `json:"logins"`
+	}
+
+	current, _ := sessionID(c)
+	logins := Logins{Logins: make([]LoginInfo, len(list))}
+	for i, s := range list {
+		logins.Logins[i] = LoginInfo{
+			LoginID:   s.ID,
+			Created:   s.Created.UTC(),
+			LastUsed:  s.LastUsed.UTC(),
+			UserAgent: s.UserAgent,
+			IP:        s.IP,
+			Current:   s.ID == current,
+		}
+	}
+	c.JSON(http.StatusOK, &logins)
+}
+
+// DELETE /users/:uid/logins
+func (le *LoginEndpoint) handleRevokeLogins(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	revoked, err := le.Sessions.RevokeAll(c.Request.Context(), id)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to revoke logins of user %v", id))
+		return
+	}
+
+	type Revoked struct {
+		Revoked int `json:"revoked"`
+	}
+
+	c.JSON(http.StatusOK, &Revoked{Revoked: revoked})
+}
+
+// DELETE /users/:uid/logins/:uuid
+func (le *LoginEndpoint) handleRevokeLogin(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+	atUUID := c.Param("uuid")
+
+	session, err := le.Sessions.Get(c.Request.Context(), atUUID)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to find login %v", atUUID))
+		return
+	}
+	// Do not reveal the logins of other users
+	if session == nil || session.UserID != id {
+		abort(c, problem.New(http.StatusNotFound, problem.CodeNotFound, "No login %v", atUUID))
+		return
+	}
+
+	if _, err := le.Sessions.Revoke(c.Request.Context(), atUUID); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to revoke login %v", atUUID))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// userIDParam parses the :uid path parameter, responding with an error if it is malformed
+func userIDParam(c *gin.Context) (uint64, bool) {
+	idParam := c.Param("uid")
+	id, err := strconv.ParseUint(idParam, 10, 64)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidParameter, "Failed to parse uid %v: %v", idParam, err))
+		return 0, false
+	}
+	return id, true
+}
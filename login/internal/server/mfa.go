@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/onetime"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+	"github.com/rinswind/distributed-greeter/login/internal/totp"
+	"github.com/rinswind/distributed-greeter/login/internal/users"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
+)
+
+const (
+	// recoveryCodeCount is the number of recovery codes handed out on enrollment
+	recoveryCodeCount = 10
+
+	// qrSize is the width and height of the provisioning QR code in pixels
+	qrSize = 256
+)
+
+// secondFactor is a TOTP code or, when the authenticator is lost, a recovery code
+type secondFactor struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// challengeLogin answers a correct password of a user with two-factor authentication
+func (le *LoginEndpoint) challengeLogin(c *gin.Context, user *users.User) {
+	mfaToken, err := le.Challenges.Issue(c.Request.Context(), strconv.FormatUint(user.ID, 10))
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to challenge login of %v", user.Name))
+		return
+	}
+
+	type Challenge struct {
+		UserID     uint64   `json:"user_id"`
+		MFAToken   string   `json:"mfa_token"`
+		MFAMethods []string `json:"mfa_methods"`
+	}
+
+	challenge := Challenge{UserID: user.ID, MFAToken: mfaToken, MFAMethods: []string{"totp", "recovery_code"}}
+	c.JSON(http.StatusAccepted, &challenge)
+}
+
+// POST /logins/mfa
+func (le *LoginEndpoint) handleLoginMFA(c *gin.Context) {
+	type ChallengeResponse struct {
+		MFAToken string `json:"mfa_token"`
+		secondFactor
+	}
+
+	var resp ChallengeResponse
+	if err := c.ShouldBindJSON(&resp); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to login: %v", err))
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// Keep the challenge until it is met, so a mistyped code can be retried
+	subject, err := le.Challenges.Peek(ctx, resp.MFAToken)
+	if errors.Is(err, onetime.ErrInvalid) {
+		c.Error(err)
+		abort(c, problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid or expired MFA token"))
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to login"))
+		return
+	}
+
+	id, err := strconv.ParseUint(subject, 10, 64)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to login"))
+		return
+	}
+
+	user, err := le.Users.GetUserByID(ctx, id)
+	if err != nil {
+		abortStore(c, err, "Failed to login %v", id)
+		return
+	}
+
+	// Codes are short, so guessing them must count against the same limits as guessing passwords
+	userKey := validation.CanonicalUsername(user.Name)
+	clientIP := c.ClientIP()
+	attempt, err := le.Guard.Attempt(ctx, userKey, clientIP)
+	if err != nil {
+		abortThrottle(c, err, "Failed to login %v", user.Name)
+		return
+	}
+
+	if !le.checkSecondFactor(c, user, attempt, &resp.secondFactor) {
+		return
+	}
+
+	if _, err := le.Challenges.Redeem(ctx, resp.MFAToken); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "Invalid or expired MFA token"))
+		return
+	}
+
+	le.completeLogin(c, user, attempt, clientIP)
+}
+
+// POST /users/:uid/totp
+func (le *LoginEndpoint) handleEnrollTOTP(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	user, err := le.Users.GetUserByID(ctx, id)
+	if err != nil {
+		abortStore(c, err, "Failed to enroll user %v", id)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to enroll user %v", id))
+		return
+	}
+
+	if err := le.Users.EnrollTOTP(ctx, id, secret); err != nil {
+		abortStore(c, err, "Failed to enroll user %v", id)
+		return
+	}
+
+	type Enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+		QRCode string `json:"qr_code"`
+	}
+
+	enrollment := Enrollment{
+		Secret: secret,
+		URI:    totp.URI(le.MFAIssuer, user.Name, secret),
+		QRCode: c.Request.URL.Path + "/qr",
+	}
+	c.JSON(http.StatusOK, &enrollment)
+}
+
+// GET /users/:uid/totp/qr
+func (le *LoginEndpoint) handleTOTPQR(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	user, err := le.Users.GetUserByID(ctx, id)
+	if err != nil {
+		abortStore(c, err, "Failed to find user %v", id)
+		return
+	}
+
+	state, err := le.Users.GetTOTP(ctx, id)
+	if err != nil {
+		abortStore(c, err, "No TOTP enrollment of user %v", id)
+		return
+	}
+	// Once confirmed, the secret is never shown again
+	if state.Confirmed {
+		abort(c, problem.New(http.StatusConflict, problem.CodeConflict, "TOTP of user %v already confirmed", id))
+		return
+	}
+
+	png, err := totp.QR(totp.URI(le.MFAIssuer, user.Name, state.Secret), qrSize)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to render QR code of user %v", id))
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+// POST /users/:uid/totp/confirm
+func (le *LoginEndpoint) handleConfirmTOTP(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	var factor secondFactor
+	if err := c.ShouldBindJSON(&factor); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to confirm TOTP of user %v: %v", id, err))
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	state, err := le.Users.GetTOTP(ctx, id)
+	if err != nil {
+		abortStore(c, err, "No TOTP enrollment of user %v", id)
+		return
+	}
+	if state.Confirmed {
+		abort(c, problem.New(http.StatusConflict, problem.CodeConflict, "TOTP of user %v already confirmed", id))
+		return
+	}
+
+	step, ok, err := totp.Verify(state.Secret, factor.Code, time.Now())
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to confirm TOTP of user %v", id))
+		return
+	}
+	if !ok {
+		p := problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "Failed to confirm TOTP of user %v", id)
+		p.InvalidParams = []problem.InvalidParam{{Name: "code", Code: validation.CodeIncorrect, Reason: "does not match"}}
+		abort(c, p)
+		return
+	}
+
+	codes, err := totp.RecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to confirm TOTP of user %v", id))
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = totp.HashRecoveryCode(code)
+	}
+
+	if err := le.Users.ConfirmTOTP(ctx, id, step, hashes); err != nil {
+		abortStore(c, err, "Failed to confirm TOTP of user %v", id)
+		return
+	}
+
+	type Recovery struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	c.JSON(http.StatusOK, &Recovery{RecoveryCodes: codes})
+}
+
+// DELETE /users/:uid/totp
+func (le *LoginEndpoint) handleDisableTOTP(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok || !authorizeUser(c, id) {
+		return
+	}
+
+	var factor secondFactor
+	if err := c.ShouldBindJSON(&factor); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Failed to disable TOTP of user %v: %v", id, err))
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	user, err := le.Users.GetUserByID(ctx, id)
+	if err != nil {
+		abortStore(c, err, "Failed to find user %v", id)
+		return
+	}
+
+	state, err := le.Users.GetTOTP(ctx, id)
+	if err != nil {
+		abortStore(c, err, "No TOTP enrollment of user %v", id)
+		return
+	}
+
+	// A stolen session must not be enough to remove the second factor
+	if state.Confirmed {
+		userKey := validation.CanonicalUsername(user.Name)
+		attempt, err := le.Guard.Attempt(ctx, userKey, c.ClientIP())
+		if err != nil {
+			abortThrottle(c, err, "Failed to disable TOTP of user %v", id)
+			return
+		}
+		if !le.checkSecondFactor(c, user, attempt, &factor) {
+			return
+		}
+		if err := attempt.Release(ctx); err != nil {
+			c.Error(err)
+		}
+	}
+
+	if err := le.Users.DisableTOTP(ctx, id); err != nil {
+		abortStore(c, err, "Failed to disable TOTP of user %v", id)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// checkSecondFactor verifies the second factor of a user with confirmed TOTP. It records failures with the Guard and
+// responds with an error unless the factor is valid.
+func (le *LoginEndpoint) checkSecondFactor(c *gin.Context, user *users.User, attempt *throttle.Attempt, factor *secondFactor) bool {
+	ctx := c.Request.Context()
+
+	ok, err := le.verifySecondFactor(ctx, user.ID, factor)
+	if err != nil {
+		abortStore(c, err, "Failed to verify second factor of user %v", user.ID)
+		return false
+	}
+	if !ok {
+		if err := attempt.Fail(ctx); err != nil {
+			c.Error(err)
+		}
+		abort(c, problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "Bad second factor"))
+		return false
+	}
+	return true
+}
+
+func (le *LoginEndpoint) verifySecondFactor(ctx context.Context, userID uint64, factor *secondFactor) (bool, error) {
+	if factor.RecoveryCode != "" {
+		err := le.Users.UseRecoveryCode(ctx, userID, totp.HashRecoveryCode(factor.RecoveryCode))
+		if errors.Is(err, users.ErrCodeUsed) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	state, err := le.Users.GetTOTP(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok, err := totp.Verify(state.Secret, factor.Code, time.Now())
+	if err != nil || !ok {
+		return false, err
+	}
+
+	// Each code works once, so an observed code cannot be replayed
+	err = le.Users.UseTOTPStep(ctx, userID, step)
+	if errors.Is(err, users.ErrCodeUsed) {
+		return false, nil
+	}
+	return err == nil, err
+}
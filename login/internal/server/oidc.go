@@ -0,0 +1,495 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/oidc"
+	"github.com/rinswind/distributed-greeter/login/internal/users"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
+)
+
+// authorizeRequest is an OpenID Connect authentication request
+type authorizeRequest struct {
+	ResponseType        string `form:"response_type"`
+	ClientID            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	Nonce               string `form:"nonce"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+}
+
+const (
+	// formCookie carries the nonce that binds a login form to the browser it was served to
+	formCookie = "oidc_form"
+	// formField is the hidden field of the login form that repeats the nonce
+	formField = "csrf_token"
+)
+
+// loginForm is the page on which users sign in to a client
+var loginForm = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Sign in to {{ .Client }}</title></head>
+<body>
+<h1>Sign in to {{ .Client }}</h1>
+{{ if .Message }}<p role="alert">{{ .Message }}</p>{{ end }}
+<form method="post">
+<input type="hidden" name="csrf_token" value="{{ .Nonce }}">
+{{ range $name, $value := .Params }}<input type="hidden" name="{{ $name }}" value="{{ $value }}">
+{{ end }}<label>User <input name="user_name" value="{{ .UserName }}" autocomplete="username" required></label>
+<label>Password <input name="user_password" type="password" autocomplete="current-password" required></label>
+<label>Authenticator code <input name="code" inputmode="numeric" autocomplete="one-time-code"></label>
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// GET /.well-known/openid-configuration
+func (le *LoginEndpoint) handleDiscovery(c *gin.Context) {
+	c.JSON(http.StatusOK, oidc.NewDiscovery(le.OIDCIssuer, []string{le.KeyRing.Alg()}))
+}
+
+// GET /oidc/authorize
+func (le *LoginEndpoint) handleAuthorize(c *gin.Context) {
+	var req authorizeRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Bad authentication request: %v", err))
+		return
+	}
+
+	client, ok := le.checkAuthorize(c, &req)
+	if !ok {
+		return
+	}
+
+	le.renderLoginForm(c, http.StatusOK, client, &req, "", "")
+}
+
+// POST /oidc/authorize
+func (le *LoginEndpoint) handleAuthorizeLogin(c *gin.Context) {
+	type Credentials struct {
+		Name     string `form:"user_name"`
+		Password string `form:"user_password"`
+		Code     string `form:"code"`
+	}
+
+	var req authorizeRequest
+	var creds Credentials
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Bad authentication request: %v", err))
+		return
+	}
+	if err := c.ShouldBind(&creds); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "Bad authentication request: %v", err))
+		return
+	}
+
+	client, ok := le.checkAuthorize(c, &req)
+	if !ok {
+		return
+	}
+
+	// Other sites must not be able to post the form and log the browser in to an account of their choosing
+	if !checkFormNonce(c.Request) {
+		le.renderLoginForm(c, http.StatusForbidden, client, &req, creds.Name, "The sign-in form expired, try again")
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// Same checks as POST /logins, but the failures are shown on the form
+	userKey := validation.CanonicalUsername(creds.Name)
+	clientIP := c.ClientIP()
+	attempt, err := le.Guard.Attempt(ctx, userKey, clientIP)
+	if err != nil {
+		c.Error(err)
+		le.renderLoginForm(c, http.StatusTooManyRequests, client, &req, creds.Name, "Too many failed attempts, try again later")
+		return
+	}
+
+	fail := func(message string) {
+		if err := attempt.Fail(ctx); err != nil {
+			c.Error(err)
+		}
+		le.renderLoginForm(c, http.StatusUnauthorized, client, &req, creds.Name, message)
+	}
+
+	user, err := le.Users.GetUserByName(ctx, creds.Name)
+	if errors.Is(err, users.ErrNotFound) {
+		c.Error(err)
+		fail("Bad user or password")
+		return
+	}
+	if err != nil {
+		abortStore(c, err, "Failed to login %v", creds.Name)
+		return
+	}
+	if user.Password != creds.Password {
+		fail("Bad user or password")
+		return
+	}
+
+	verified, err := le.checkVerified(ctx, user)
+	if err != nil {
+		abortStore(c, err, "Failed to login %v", creds.Name)
+		return
+	}
+	if !verified {
+		if err := attempt.Release(ctx); err != nil {
+			c.Error(err)
+		}
+		le.renderLoginForm(c, http.StatusForbidden, client, &req, creds.Name, "Verify your email address before logging in")
+		return
+	}
+
+	state, err := le.Users.GetTOTP(ctx, user.ID)
+	if err != nil && !errors.Is(err, users.ErrNotFound) {
+		abortStore(c, err, "Failed to login %v", creds.Name)
+		return
+	}
+	if err == nil && state.Confirmed {
+		if creds.Code == "" {
+			if err := attempt.Release(ctx); err != nil {
+				c.Error(err)
+			}
+			le.renderLoginForm(c, http.StatusUnauthorized, client, &req, creds.Name, "Enter the code from your authenticator app")
+			return
+		}
+		ok, err := le.verifySecondFactor(ctx, user.ID, &secondFactor{Code: creds.Code})
+		if err != nil {
+			abortStore(c, err, "Failed to verify second factor of user %v", user.ID)
+			return
+		}
+		if !ok {
+			fail("Bad authenticator code")
+			return
+		}
+	}
+
+	if err := attempt.Succeed(ctx); err != nil {
+		c.Error(err)
+	}
+
+	code, err := le.OIDCCodes.Issue(ctx, &oidc.Grant{
+		ClientID:      client.ID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         req.Scope,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		UserID:        user.ID,
+		UserName:      user.Name,
+		AuthTime:      time.Now().Unix(),
+		UserAgent:     c.Request.UserAgent(),
+		IP:            clientIP,
+	})
+	if err != nil {
+		c.Error(err)
+		redirectError(c, &req, oidc.CodeServerError, "Failed to issue authorization code")
+		return
+	}
+
+	redirect(c, req.RedirectURI, url.Values{"code": {code}, "state": {req.State}})
+}
+
+// checkAuthorize validates an authentication request. Errors are sent back to the client, except when the client or
+// the redirect URI are not trusted.
+func (le *LoginEndpoint) checkAuthorize(c *gin.Context, req *authorizeRequest) (*users.Client, bool) {
+	client, err := le.Users.GetClient(c.Request.Context(), req.ClientID)
+	if errors.Is(err, users.ErrClientNotFound) {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidParameter, "Unknown client %v", req.ClientID))
+		return nil, false
+	}
+	if err != nil {
+		abortStore(c, err, "Failed to read client %v", req.ClientID)
+		return nil, false
+	}
+
+	if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidParameter, "Redirect URI %v not registered for client %v", req.RedirectURI, client.ID))
+		return nil, false
+	}
+
+	if req.ResponseType != "code" {
+		redirectError(c, req, oidc.CodeUnsupportedResponseType, "Only the authorization code flow is supported")
+		return nil, false
+	}
+	if _, ok := oidc.ParseScope(req.Scope); !ok {
+		redirectError(c, req, oidc.CodeInvalidScope, "Scope must include openid and only known scopes")
+		return nil, false
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		redirectError(c, req, oidc.CodeInvalidRequest, "PKCE with S256 is required")
+		return nil, false
+	}
+	return client, true
+}
+
+func (le *LoginEndpoint) renderLoginForm(c *gin.Context, status int, client *users.Client, req *authorizeRequest, userName, message string) {
+	type Page struct {
+		Client   string
+		Message  string
+		UserName string
+		Nonce    string
+		Params   map[string]string
+	}
+
+	// Every rendering of the form gets a fresh nonce
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Failed to render the login form"))
+		return
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(raw)
+	le.setFormCookie(c, nonce)
+
+	page := Page{
+		Client:   client.Name,
+		Message:  message,
+		UserName: userName,
+		Nonce:    nonce,
+		Params: map[string]string{
+			"response_type":         req.ResponseType,
+			"client_id":             req.ClientID,
+			"redirect_uri":          req.RedirectURI,
+			"scope":                 req.Scope,
+			"state":                 req.State,
+			"nonce":                 req.Nonce,
+			"code_challenge":        req.CodeChallenge,
+			"code_challenge_method": req.CodeChallengeMethod,
+		},
+	}
+
+	// The form must not be framed by other sites, or its clicks could be hijacked
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Header("Cache-Control", "no-store")
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := loginForm.Execute(c.Writer, &page); err != nil {
+		c.Error(err)
+	}
+	c.Abort()
+}
+
+// setFormCookie hands the nonce of a login form to the browser. The cookie is sent back only to the form.
+func (le *LoginEndpoint) setFormCookie(c *gin.Context, nonce string) {
+	cookie := &http.Cookie{
+		Name:     formCookie,
+		Value:    nonce,
+		Path:     oidc.PathAuthorize,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if issuer, err := url.Parse(le.OIDCIssuer); err == nil {
+		cookie.Path = issuer.Path + oidc.PathAuthorize
+		cookie.Secure = issuer.Scheme == "https"
+	}
+	http.SetCookie(c.Writer, cookie)
+}
+
+// checkFormNonce reports whether a posted login form carries the nonce of the cookie set when it was served. Other
+// sites can make the browser send the cookie, but can not read the form to learn the nonce.
+func checkFormNonce(r *http.Request) bool {
+	cookie, err := r.Cookie(formCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.PostFormValue(formField)), []byte(cookie.Value)) == 1
+}
+
+// redirectError sends an authentication error back to the client
+func redirectError(c *gin.Context, req *authorizeRequest, code oidc.Code, description string) {
+	redirect(c, req.RedirectURI, url.Values{"error": {string(code)}, "error_description": {description}, "state": {req.State}})
+}
+
+func redirect(c *gin.Context, redirectURI string, params url.Values) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		c.Error(err)
+		abort(c, problem.New(http.StatusBadRequest, problem.CodeInvalidParameter, "Bad redirect URI %v", redirectURI))
+		return
+	}
+
+	query := target.Query()
+	for name, values := range params {
+		if values[0] != "" {
+			query[name] = values
+		}
+	}
+	target.RawQuery = query.Encode()
+
+	c.Redirect(http.StatusFound, target.String())
+	c.Abort()
+}
+
+// POST /oidc/token
+func (le *LoginEndpoint) handleToken(c *gin.Context) {
+	type TokenRequest struct {
+		GrantType    string `form:"grant_type"`
+		Code         string `form:"code"`
+		RedirectURI  string `form:"redirect_uri"`
+		ClientID     string `form:"client_id"`
+		ClientSecret string `form:"client_secret"`
+		CodeVerifier string `form:"code_verifier"`
+	}
+
+	// Token responses carry credentials
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	var req TokenRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err)
+		tokenError(c, http.StatusBadRequest, oidc.CodeInvalidRequest, err.Error())
+		return
+	}
+	if req.GrantType != "authorization_code" {
+		tokenError(c, http.StatusBadRequest, oidc.CodeUnsupportedGrantType, "Only authorization_code is supported")
+		return
+	}
+
+	// client_secret_basic form-encodes the credentials before putting them in the header
+	basicID, basicSecret, basic := c.Request.BasicAuth()
+	if basic {
+		var err1, err2 error
+		req.ClientID, err1 = url.QueryUnescape(basicID)
+		req.ClientSecret, err2 = url.QueryUnescape(basicSecret)
+		if err := errors.Join(err1, err2); err != nil {
+			c.Error(err)
+			tokenError(c, http.StatusBadRequest, oidc.CodeInvalidRequest, "Bad client credentials encoding")
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+
+	client, err := le.Users.GetClient(ctx, req.ClientID)
+	if err != nil && !errors.Is(err, users.ErrClientNotFound) {
+		c.Error(err)
+		tokenError(c, http.StatusInternalServerError, oidc.CodeServerError, "Failed to read client")
+		return
+	}
+	// Public clients have no secret and rely on PKCE alone
+	if err != nil || (client.SecretHash != "" && !oidc.SecretMatches(req.ClientSecret, client.SecretHash)) {
+		if basic {
+			c.Header("WWW-Authenticate", `Basic realm="oidc"`)
+		}
+		tokenError(c, http.StatusUnauthorized, oidc.CodeInvalidClient, "Client authentication failed")
+		return
+	}
+
+	grant, err := le.OIDCCodes.Redeem(ctx, req.Code)
+	if errors.Is(err, oidc.ErrInvalidCode) {
+		c.Error(err)
+		tokenError(c, http.StatusBadRequest, oidc.CodeInvalidGrant, "Invalid or expired code")
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		tokenError(c, http.StatusInternalServerError, oidc.CodeServerError, "Failed to redeem code")
+		return
+	}
+
+	if grant.ClientID != client.ID || grant.RedirectURI != req.RedirectURI {
+		tokenError(c, http.StatusBadRequest, oidc.CodeInvalidGrant, "Code was issued to another client or redirect URI")
+		return
+	}
+	if !oidc.VerifyPKCE(req.CodeVerifier, grant.CodeChallenge) {
+		tokenError(c, http.StatusBadRequest, oidc.CodeInvalidGrant, "Code verifier does not match the challenge")
+		return
+	}
+
+	// The user may be gone since the code was issued
+	user, err := le.Users.GetUserByID(ctx, grant.UserID)
+	if errors.Is(err, users.ErrNotFound) {
+		c.Error(err)
+		tokenError(c, http.StatusBadRequest, oidc.CodeInvalidGrant, "User no longer exists")
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		tokenError(c, http.StatusInternalServerError, oidc.CodeServerError, "Failed to read user")
+		return
+	}
+
+	// The access token is only good for the userinfo endpoint, not for the API that the users themselves call
+	token, err := le.startSession(ctx, user, client.ID, grant.Scope, grant.UserAgent, grant.IP)
+	if err != nil {
+		c.Error(err)
+		tokenError(c, http.StatusInternalServerError, oidc.CodeServerError, "Failed to login")
+		return
+	}
+
+	now := time.Now()
+	expires := time.Unix(token.AccessExpires, 0)
+	idToken, err := le.KeyRing.Sign(ctx, oidc.IDTokenClaims(le.OIDCIssuer, grant, now, expires))
+	if err != nil {
+		c.Error(err)
+		tokenError(c, http.StatusInternalServerError, oidc.CodeServerError, "Failed to sign ID token")
+		return
+	}
+
+	type TokenResponse struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		IDToken     string `json:"id_token"`
+		Scope       string `json:"scope"`
+	}
+
+	// The access token is handed out in the encoding the other services expect in the Authorization header
+	c.JSON(http.StatusOK, &TokenResponse{
+		AccessToken: base64.StdEncoding.EncodeToString([]byte(token.AccessToken)),
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(expires.Sub(now).Seconds()),
+		IDToken:     idToken,
+		Scope:       grant.Scope,
+	})
+}
+
+// tokenError sends an RFC 6749 error response from the token endpoint
+func tokenError(c *gin.Context, status int, code oidc.Code, description string) {
+	c.AbortWithStatusJSON(status, &oidc.Error{Code: code, Description: description})
+}
+
+// GET /oidc/userinfo
+func (le *LoginEndpoint) handleUserinfo(c *gin.Context) {
+	// JSON numbers decode as float64
+	userID, ok := claims(c)["user_id"].(float64)
+	if !ok {
+		abort(c, problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "No user in access token"))
+		return
+	}
+
+	user, err := le.Users.GetUserByID(c.Request.Context(), uint64(userID))
+	if err != nil {
+		abortStore(c, err, "Failed to get user %v", uint64(userID))
+		return
+	}
+
+	type Userinfo struct {
+		Subject  string `json:"sub"`
+		UserID   uint64 `json:"user_id"`
+		UserName string `json:"user_name"`
+	}
+
+	c.JSON(http.StatusOK, &Userinfo{Subject: strconv.FormatUint(user.ID, 10), UserID: user.ID, UserName: user.Name})
+}
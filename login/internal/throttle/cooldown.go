@@ -0,0 +1,51 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrTooSoon reports an action repeated before its cooldown ran out
+var ErrTooSoon = errors.New("too soon after the previous attempt")
+
+// Cooldown lets a subject repeat an action at most once per interval, e.g. a user asking for another mail
+type Cooldown struct {
+	redis    *redis.Client
+	prefix   string
+	interval time.Duration
+}
+
+// MakeCooldown creates a Cooldown. The prefix separates the Redis keys of different actions.
+func MakeCooldown(redis *redis.Client, prefix string, interval time.Duration) *Cooldown {
+	return &Cooldown{redis: redis, prefix: prefix, interval: interval}
+}
+
+// Take starts the cooldown of subject, or reports a *RetryError if it is still running
+func (cd *Cooldown) Take(ctx context.Context, subject string) error {
+	if cd.interval <= 0 {
+		return nil
+	}
+
+	key := cd.prefix + ":" + subject
+	started, err := cd.redis.SetNX(ctx, key, 1, cd.interval).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check %v cooldown of %v: %w", cd.prefix, subject, err)
+	}
+	if started {
+		return nil
+	}
+
+	left, err := cd.redis.PTTL(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check %v cooldown of %v: %w", cd.prefix, subject, err)
+	}
+	// The key may expire between the two calls
+	if left < time.Second {
+		left = time.Second
+	}
+	return &RetryError{Err: ErrTooSoon, RetryAfter: left}
+}
@@ -0,0 +1,234 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	userFailuresPrefix = "login-failures:user:"
+	ipFailuresPrefix   = "login-failures:ip:"
+	lockoutPrefix      = "login-lockout:"
+)
+
+var (
+	// ErrThrottled reports that a login attempt came too soon after previous failures
+	ErrThrottled = errors.New("too many login attempts")
+
+	// ErrLocked reports that an account is locked after too many failed logins
+	ErrLocked = errors.New("account locked")
+)
+
+// RetryError reports a rejected attempt and when the next one may be made
+type RetryError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+// Error implements error
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", e.Err, e.RetryAfter)
+}
+
+// Unwrap exposes ErrThrottled, ErrLocked or ErrTooSoon
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Limits configures the brute-force protection. Failures are counted in a sliding Window. Each failure for a user
+// doubles the Delay before the next attempt, up to MaxDelay. MaxUserFailures locks the user for Lockout, while
+// MaxIPFailures throttles the client until its failures slide out of the Window. Zero maximums or Lockout disable
+// the check.
+type Limits struct {
+	Window          time.Duration
+	Delay           time.Duration
+	MaxDelay        time.Duration
+	MaxUserFailures int
+	MaxIPFailures   int
+	Lockout         time.Duration
+}
+
+// Guard tracks failed logins by user and client IP in Redis. Every attempt is counted as a failure when it is
+// admitted, so concurrent attempts cannot all slip through the same check.
+type Guard struct {
+	redis  *redis.Client
+	limits Limits
+	now    func() time.Time
+}
+
+// Make creates a Guard
+func Make(redis *redis.Client, limits Limits) *Guard {
+	return &Guard{redis: redis, limits: limits, now: time.Now}
+}
+
+// WithClock makes a copy of the Guard that reads the time from now
+func (g *Guard) WithClock(now func() time.Time) *Guard {
+	return &Guard{redis: g.redis, limits: g.limits, now: now}
+}
+
+// Attempt is a login admitted by a Guard. It counts as a failure until it succeeds or is released.
+type Attempt struct {
+	guard  *Guard
+	user   string
+	ip     string
+	member string
+}
+
+// admitScript checks the lockout and both failure windows, and records the attempt in the windows if it may be made.
+// Failures are scored by their time in milliseconds.
+//
+// KEYS: lockout, user failures, ip failures
+// ARGV: now, window, delay, max delay, max user failures, max ip failures, lockout, member
+var admitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local delay = tonumber(ARGV[3])
+local maxDelay = tonumber(ARGV[4])
+local maxUser = tonumber(ARGV[5])
+local maxIP = tonumber(ARGV[6])
+local lockout = tonumber(ARGV[7])
+
+local locked = redis.call('PTTL', KEYS[1])
+if locked > 0 then
+  return {'locked', locked}
+end
+
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now - window)
+redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', now - window)
+
+local n = redis.call('ZCARD', KEYS[2])
+if maxUser > 0 and lockout > 0 and n >= maxUser then
+  redis.call('SET', KEYS[1], now, 'PX', lockout)
+  redis.call('DEL', KEYS[2])
+  return {'locked', lockout}
+end
+if n > 0 and delay > 0 then
+  -- Each failure doubles the delay before the next attempt
+  for i = 2, n do
+    if maxDelay > 0 and delay >= maxDelay then
+      break
+    end
+    delay = delay * 2
+  end
+  if maxDelay > 0 and delay > maxDelay then
+    delay = maxDelay
+  end
+
+  local last = redis.call('ZRANGE', KEYS[2], -1, -1, 'WITHSCORES')
+  local wait = tonumber(last[2]) + delay - now
+  if wait > 0 then
+    return {'throttled', wait}
+  end
+end
+
+if maxIP > 0 then
+  local m = redis.call('ZCARD', KEYS[3])
+  if m >= maxIP then
+    -- Wait until enough failures slide out of the window
+    local oldest = redis.call('ZRANGE', KEYS[3], m - maxIP, m - maxIP, 'WITHSCORES')
+    return {'throttled', tonumber(oldest[2]) + window - now}
+  end
+end
+
+redis.call('ZADD', KEYS[2], now, ARGV[8])
+redis.call('PEXPIRE', KEYS[2], window)
+redis.call('ZADD', KEYS[3], now, ARGV[8])
+redis.call('PEXPIRE', KEYS[3], window)
+return {'admitted', 0}
+`)
+
+// Attempt admits a login of user from ip, or reports a *RetryError if it must not be attempted now
+func (g *Guard) Attempt(ctx context.Context, user, ip string) (*Attempt, error) {
+	now := g.now()
+
+	// Simultaneous attempts need distinct members
+	member := fmt.Sprintf("%v-%x", now.UnixMilli(), rand.Uint32())
+
+	keys := []string{lockoutPrefix + user, userFailuresPrefix + user, ipFailuresPrefix + ip}
+	res, err := admitScript.Run(ctx, g.redis, keys,
+		now.UnixMilli(), g.limits.Window.Milliseconds(), g.limits.Delay.Milliseconds(), g.limits.MaxDelay.Milliseconds(),
+		g.limits.MaxUserFailures, g.limits.MaxIPFailures, g.limits.Lockout.Milliseconds(), member).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to admit login of %v from %v: %w", user, ip, err)
+	}
+
+	verdict, _ := res[0].(string)
+	wait, _ := res[1].(int64)
+	switch verdict {
+	case "locked":
+		return nil, &RetryError{Err: ErrLocked, RetryAfter: time.Duration(wait) * time.Millisecond}
+	case "throttled":
+		return nil, &RetryError{Err: ErrThrottled, RetryAfter: time.Duration(wait) * time.Millisecond}
+	}
+	return &Attempt{guard: g, user: user, ip: ip, member: member}, nil
+}
+
+// Fail keeps the attempt as a failure, locking the user when it has failed too often
+func (a *Attempt) Fail(ctx context.Context) error {
+	g := a.guard
+	if g.limits.MaxUserFailures <= 0 || g.limits.Lockout <= 0 {
+		return nil
+	}
+
+	now := g.now()
+	min := "(" + strconv.FormatInt(now.Add(-g.limits.Window).UnixMilli(), 10)
+	failures, err := g.redis.ZCount(ctx, userFailuresPrefix+a.user, min, "+inf").Result()
+	if err != nil {
+		return fmt.Errorf("failed to count login failures of %v: %w", a.user, err)
+	}
+	if failures < int64(g.limits.MaxUserFailures) {
+		return nil
+	}
+
+	_, err = g.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, lockoutPrefix+a.user, now.UnixMilli(), g.limits.Lockout)
+		pipe.Del(ctx, userFailuresPrefix+a.user)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to lock %v: %w", a.user, err)
+	}
+	return nil
+}
+
+// Succeed forgets the failed logins of the user, and the attempt itself
+func (a *Attempt) Succeed(ctx context.Context) error {
+	_, err := a.guard.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, userFailuresPrefix+a.user)
+		pipe.ZRem(ctx, ipFailuresPrefix+a.ip, a.member)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reset login failures of %v: %w", a.user, err)
+	}
+	return nil
+}
+
+// Release forgets the attempt without touching earlier failures, e.g. when the password was right but the login
+// needs another step
+func (a *Attempt) Release(ctx context.Context) error {
+	_, err := a.guard.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, userFailuresPrefix+a.user, a.member)
+		pipe.ZRem(ctx, ipFailuresPrefix+a.ip, a.member)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release login attempt of %v: %w", a.user, err)
+	}
+	return nil
+}
+
+// Unlock lifts the lockout of user and forgets its failed logins. It reports whether the user was locked.
+func (g *Guard) Unlock(ctx context.Context, user string) (bool, error) {
+	deleted, err := g.redis.Del(ctx, lockoutPrefix+user, userFailuresPrefix+user).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to unlock %v: %w", user, err)
+	}
+	return deleted > 0, nil
+}
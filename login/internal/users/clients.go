@@ -0,0 +1,101 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rinswind/distributed-greeter/common/tracing"
+)
+
+// Client is an OpenID Connect relying party, i.e. an app that signs its users in through the login service
+type Client struct {
+	ID   string
+	Name string
+
+	// SecretHash is the hash of the client secret. Empty for public clients, e.g. single page apps, that can not keep
+	// a secret.
+	SecretHash string
+
+	// RedirectURIs are the only URIs the authorization codes of the client are sent to
+	RedirectURIs []string
+}
+
+func (s *Store) initClients(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS oidc_clients (
+		id varchar(64) NOT NULL,
+		name varchar(100) NOT NULL,
+		secret_hash char(64) NOT NULL DEFAULT '',
+		redirect_uris text NOT NULL,
+		PRIMARY KEY (id))`)
+	if err != nil {
+		return fmt.Errorf("failed to init client schema: %w", err)
+	}
+	return nil
+}
+
+// CreateClient registers a client
+func (s *Store) CreateClient(ctx context.Context, client *Client) error {
+	ctx, span := tracing.StartDB(ctx, "users.CreateClient")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO oidc_clients (id, name, secret_hash, redirect_uris) VALUES (?, ?, ?, ?)",
+		client.ID, client.Name, client.SecretHash, strings.Join(client.RedirectURIs, "\n"))
+	if s.db.Dialect().IsDuplicate(err) {
+		return fmt.Errorf("failed to create client %v: %w", client.ID, ErrClientExists)
+	}
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to create client %v: %w", client.ID, dbError(ctx, err)))
+	}
+	return nil
+}
+
+// GetClient reads a registered client
+func (s *Store) GetClient(ctx context.Context, id string) (*Client, error) {
+	ctx, span := tracing.StartDB(ctx, "users.GetClient")
+	defer span.End()
+	ctx, cancel := s.read(ctx)
+	defer cancel()
+
+	client := Client{ID: id}
+	var redirectURIs string
+	err := s.db.QueryRowContext(ctx, "SELECT name, secret_hash, redirect_uris FROM oidc_clients WHERE id=?", id).
+		Scan(&client.Name, &client.SecretHash, &redirectURIs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get client %v: %w", id, ErrClientNotFound)
+	}
+	if err != nil {
+		return nil, tracing.Fail(span, fmt.Errorf("failed to get client %v: %w", id, dbError(ctx, err)))
+	}
+
+	client.RedirectURIs = strings.Split(redirectURIs, "\n")
+	return &client, nil
+}
+
+// DeleteClient unregisters a client. Tokens already issued to it stay valid until they expire.
+func (s *Store) DeleteClient(ctx context.Context, id string) error {
+	ctx, span := tracing.StartDB(ctx, "users.DeleteClient")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM oidc_clients WHERE id=?", id)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to delete client %v: %w", id, dbError(ctx, err)))
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to delete client %v: %w", id, dbError(ctx, err)))
+	}
+	if affected == 0 {
+		return fmt.Errorf("failed to delete client %v: %w", id, ErrClientNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/rinswind/distributed-greeter/common/tracing"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
+)
+
+// record is a user in a dump, one JSON object per line. Only the accounts are dumped, not their emails, MFA
+// enrolments or sessions.
+type record struct {
+	ID       uint64 `json:"id"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// Export writes all users as JSON lines, ordered by ID. The dump holds the passwords as they are stored.
+func (s *Store) Export(ctx context.Context, w io.Writer) (int, error) {
+	ctx, span := tracing.StartDB(ctx, "users.Export")
+	defer span.End()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, password FROM users ORDER BY id")
+	if err != nil {
+		return 0, tracing.Fail(span, fmt.Errorf("failed to export users: %w", dbError(ctx, err)))
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	count := 0
+	for rows.Next() {
+		var rec record
+		if err := rows.Scan(&rec.ID, &rec.Name, &rec.Password); err != nil {
+			return count, tracing.Fail(span, fmt.Errorf("failed to export users: %w", dbError(ctx, err)))
+		}
+		if err := enc.Encode(rec); err != nil {
+			return count, fmt.Errorf("failed to export user %v: %w", rec.ID, err)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, tracing.Fail(span, fmt.Errorf("failed to export users: %w", dbError(ctx, err)))
+	}
+	return count, nil
+}
+
+// Import adds the users of an Export, keeping their IDs. Users whose ID or name is taken already are skipped, so that
+// an import can be repeated after a failure. No user events are published: the greeter service imports its own dump.
+func (s *Store) Import(ctx context.Context, r io.Reader) (imported, skipped int, err error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	for line := 1; ; line++ {
+		var rec record
+		if err := dec.Decode(&rec); errors.Is(err, io.EOF) {
+			// Users that sign up next must not get the IDs of the imported ones
+			if err := s.db.Dialect().SyncKey(ctx, s.db, "users", "id"); err != nil {
+				return imported, skipped, fmt.Errorf("failed to sync the user IDs: %w", err)
+			}
+			return imported, skipped, nil
+		} else if err != nil {
+			return imported, skipped, fmt.Errorf("failed to import user %v: %w", line, err)
+		}
+		if rec.ID == 0 || rec.Name == "" || rec.Password == "" {
+			return imported, skipped, fmt.Errorf("failed to import user %v: id, name and password are required", line)
+		}
+
+		err := s.importUser(ctx, &User{ID: rec.ID, Name: rec.Name, Password: rec.Password})
+		switch {
+		case errors.Is(err, ErrUserExists):
+			skipped++
+		case err != nil:
+			return imported, skipped, err
+		default:
+			imported++
+		}
+	}
+}
+
+func (s *Store) importUser(ctx context.Context, user *User) error {
+	ctx, span := tracing.StartDB(ctx, "users.Import")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, "INSERT INTO users (id, name, name_key, password) VALUES (?, ?, ?, ?)",
+		user.ID, user.Name, validation.CanonicalUsername(user.Name), user.Password)
+	if s.db.Dialect().IsDuplicate(err) {
+		return fmt.Errorf("failed to import user %v: %w", user.ID, ErrUserExists)
+	}
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to import user %v: %w", user.ID, dbError(ctx, err)))
+	}
+	return nil
+}
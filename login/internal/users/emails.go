@@ -0,0 +1,97 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/rinswind/distributed-greeter/common/tracing"
+)
+
+// Email is the contact address of a user
+type Email struct {
+	Address  string
+	Verified bool
+}
+
+func (s *Store) initEmails(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS emails (
+		user_id int NOT NULL,
+		address varchar(254) NOT NULL,
+		verified boolean NOT NULL DEFAULT false,
+		PRIMARY KEY (user_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE)`)
+	if err != nil {
+		return fmt.Errorf("failed to init email schema: %w", err)
+	}
+	return nil
+}
+
+// GetEmail reads the address of a user. Users without one are ErrNotFound.
+func (s *Store) GetEmail(ctx context.Context, userID uint64) (*Email, error) {
+	ctx, span := tracing.StartDB(ctx, "users.GetEmail")
+	defer span.End()
+	ctx, cancel := s.read(ctx)
+	defer cancel()
+
+	var email Email
+	err := s.db.QueryRowContext(ctx, "SELECT address, verified FROM emails WHERE user_id=?", userID).
+		Scan(&email.Address, &email.Verified)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get email of user %v: %w", userID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, tracing.Fail(span, fmt.Errorf("failed to get email of user %v: %w", userID, dbError(ctx, err)))
+	}
+	return &email, nil
+}
+
+// SetEmail records a new, unverified address of a user, replacing the previous one
+func (s *Store) SetEmail(ctx context.Context, userID uint64, address string) error {
+	ctx, span := tracing.StartDB(ctx, "users.SetEmail")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO emails (user_id, address, verified) VALUES (?, ?, false) "+
+			s.db.Dialect().Upsert("user_id", []string{"address", "verified"}, ""), userID, address)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to set email of user %v: %w", userID, dbError(ctx, err)))
+	}
+	return nil
+}
+
+// VerifyEmail marks the address of a user as verified. It is ErrNotFound if the user has since changed the address.
+func (s *Store) VerifyEmail(ctx context.Context, userID uint64, address string) error {
+	ctx, span := tracing.StartDB(ctx, "users.VerifyEmail")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "UPDATE emails SET verified=true WHERE user_id=? AND address=?", userID, address)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to verify email of user %v: %w", userID, dbError(ctx, err)))
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to verify email of user %v: %w", userID, dbError(ctx, err)))
+	}
+	if updated > 0 {
+		return nil
+	}
+
+	// MySQL counts only the rows that actually changed, so tell an address verified before from a replaced one
+	var found int
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM emails WHERE user_id=? AND address=?", userID, address).Scan(&found)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to verify email of user %v: %w", userID, dbError(ctx, err)))
+	}
+	if found == 0 {
+		return fmt.Errorf("failed to verify email of user %v: %w", userID, ErrNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound reports that a user does not exist
+	ErrNotFound = errors.New("user not found")
+
+	// ErrConflict reports that a change clashes with the users already in the store
+	ErrConflict = errors.New("user conflict")
+
+	// ErrUserExists reports an attempt to add a user that is already in the store
+	ErrUserExists = fmt.Errorf("user exists: %w", ErrConflict)
+
+	// ErrTOTPEnabled reports an attempt to enroll a user whose two-factor authentication is already on
+	ErrTOTPEnabled = fmt.Errorf("two-factor authentication already enabled: %w", ErrConflict)
+
+	// ErrClientNotFound reports that an OpenID Connect client is not registered
+	ErrClientNotFound = fmt.Errorf("client not found: %w", ErrNotFound)
+
+	// ErrClientExists reports an attempt to register a client ID twice
+	ErrClientExists = fmt.Errorf("client exists: %w", ErrConflict)
+
+	// ErrCodeUsed reports a one-time code that was already used, or never issued
+	ErrCodeUsed = errors.New("code already used")
+)
+
+// dbError marks a failure of the DB as a timeout or a cancellation when the context of the operation is done, since
+// the drivers report that in their own terms
+func dbError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %w", ctxErr, err)
+	}
+	return err
+}
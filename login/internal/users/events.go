@@ -1,6 +1,21 @@
 package users
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	usersChannel = "/users"
+)
 
 // EventType is the type of user events
 type EventType int
@@ -17,6 +32,12 @@ type Event struct {
 	Type int    `json:"type"`
 	ID   uint64 `json:"user_id"`
 	Name string `json:"user_name"`
+
+	// RequestID is the ID of the request that caused the event
+	RequestID string `json:"request_id,omitempty"`
+
+	// Trace carries the trace context of the operation that caused the event
+	Trace map[string]string `json:"trace,omitempty"`
 }
 
 // func (e EventType) String() string {
@@ -32,3 +53,51 @@ func (e *Event) Marshal() string {
 	}
 	return string(res)
 }
+
+// Inject records the request ID and trace context of ctx in the Event
+func (e *Event) Inject(ctx context.Context) {
+	e.RequestID = logging.RequestID(ctx)
+	e.Trace = make(map[string]string)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(e.Trace))
+}
+
+// RedisPublisher publishes the user events on the Redis channel the greeter service listens to
+type RedisPublisher struct {
+	Redis *redis.Client
+}
+
+// Publish sends a user event, carrying along the current trace
+func (p *RedisPublisher) Publish(ctx context.Context, event *Event) error {
+	ctx, span := tracing.StartProducer(ctx, usersChannel)
+	defer span.End()
+
+	event.Inject(ctx)
+	err := p.Redis.Publish(ctx, usersChannel, event.Marshal()).Err()
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to publish to %v: %w", usersChannel, err))
+	}
+	return nil
+}
+
+// EventLog keeps the published user events in memory, e.g. for tests to check
+type EventLog struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// Publish appends an event to the log
+func (l *EventLog) Publish(ctx context.Context, event *Event) error {
+	event.Inject(ctx)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, *event)
+	return nil
+}
+
+// Events returns the events published so far, oldest first
+func (l *EventLog) Events() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Event(nil), l.events...)
+}
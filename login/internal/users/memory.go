@@ -0,0 +1,338 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
+)
+
+// Memory is a Repository that keeps everything in the process, for tests and demos. It is safe for concurrent use and
+// is lost on exit.
+type Memory struct {
+	events   EventPublisher
+	sessions Revoker
+	apiKeys  Revoker
+
+	mu      sync.RWMutex
+	lastID  uint64
+	users   map[uint64]User
+	byKey   map[string]uint64
+	emails  map[uint64]Email
+	totps   map[uint64]TOTP
+	codes   map[uint64]map[string]bool
+	clients map[string]Client
+}
+
+// MakeMemory creates an empty Memory. The user events go to events, and the sessions and API keys of changed users
+// are ended through the revokers. Any of them can be nil to leave that out.
+func MakeMemory(events EventPublisher, sessions, apiKeys Revoker) *Memory {
+	return &Memory{
+		events:   events,
+		sessions: sessions,
+		apiKeys:  apiKeys,
+		users:    make(map[uint64]User),
+		byKey:    make(map[string]uint64),
+		emails:   make(map[uint64]Email),
+		totps:    make(map[uint64]TOTP),
+		codes:    make(map[uint64]map[string]bool),
+		clients:  make(map[string]Client)}
+}
+
+// CreateUser adds a new user, see Store.CreateUser
+func (m *Memory) CreateUser(ctx context.Context, name, pass string) (uint64, error) {
+	id, err := m.insertUser(name, pass)
+	if err != nil {
+		return 0, err
+	}
+
+	userEvent := &Event{Type: int(Created), ID: id, Name: name}
+	if err := publish(ctx, m.events, userEvent, 0); err != nil {
+		return 0, fmt.Errorf("failed to publish user creation event %v: %w", userEvent, err)
+	}
+	return id, nil
+}
+
+func (m *Memory) insertUser(name, pass string) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := validation.CanonicalUsername(name)
+	if _, ok := m.byKey[key]; ok {
+		return 0, fmt.Errorf("failed to create user %v: %w", name, ErrUserExists)
+	}
+
+	m.lastID++
+	m.users[m.lastID] = User{ID: m.lastID, Name: name, Password: pass}
+	m.byKey[key] = m.lastID
+	return m.lastID, nil
+}
+
+// GetUserByName finds a user, see Store.GetUserByName
+func (m *Memory) GetUserByName(ctx context.Context, name string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, ok := m.byKey[validation.CanonicalUsername(name)]
+	if !ok {
+		return nil, fmt.Errorf("failed to get user %v: %w", name, ErrNotFound)
+	}
+	user := m.users[id]
+	return &user, nil
+}
+
+// GetUserByID finds a user
+func (m *Memory) GetUserByID(ctx context.Context, id uint64) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return nil, fmt.Errorf("failed to get user %v: %w", id, ErrNotFound)
+	}
+	return &user, nil
+}
+
+// UpdatePassword replaces the password of a user and ends all of its sessions
+func (m *Memory) UpdatePassword(ctx context.Context, id uint64, pass string) error {
+	m.mu.Lock()
+	user, ok := m.users[id]
+	if ok {
+		user.Password = pass
+		m.users[id] = user
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("failed to update password of user %v: %w", id, ErrNotFound)
+	}
+	if err := revokeAll(ctx, m.sessions, id); err != nil {
+		return fmt.Errorf("failed to revoke sessions of user %v: %w", id, err)
+	}
+	return nil
+}
+
+// DeleteUserByID deletes a user along with its email and two-factor authentication, and ends all of its sessions and
+// API keys
+func (m *Memory) DeleteUserByID(ctx context.Context, id uint64) error {
+	m.mu.Lock()
+	user, ok := m.users[id]
+	if ok {
+		delete(m.users, id)
+		delete(m.byKey, validation.CanonicalUsername(user.Name))
+		delete(m.emails, id)
+		delete(m.totps, id)
+		delete(m.codes, id)
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("failed to delete user %v: %w", id, ErrNotFound)
+	}
+	return finishDelete(ctx, &user, m.events, 0, m.sessions, m.apiKeys)
+}
+
+// GetEmail reads the address of a user. Users without one are ErrNotFound.
+func (m *Memory) GetEmail(ctx context.Context, userID uint64) (*Email, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	email, ok := m.emails[userID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get email of user %v: %w", userID, ErrNotFound)
+	}
+	return &email, nil
+}
+
+// SetEmail records a new, unverified address of a user, replacing the previous one
+func (m *Memory) SetEmail(ctx context.Context, userID uint64, address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The DB refers the email to the user with a foreign key
+	if _, ok := m.users[userID]; !ok {
+		return fmt.Errorf("failed to set email of user %v: %w", userID, ErrNotFound)
+	}
+	m.emails[userID] = Email{Address: address}
+	return nil
+}
+
+// VerifyEmail marks the address of a user as verified. It is ErrNotFound if the user has since changed the address.
+func (m *Memory) VerifyEmail(ctx context.Context, userID uint64, address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	email, ok := m.emails[userID]
+	if !ok || email.Address != address {
+		return fmt.Errorf("failed to verify email of user %v: %w", userID, ErrNotFound)
+	}
+	email.Verified = true
+	m.emails[userID] = email
+	return nil
+}
+
+// GetTOTP reads the two-factor authentication state of a user. Users that never enrolled are ErrNotFound.
+func (m *Memory) GetTOTP(ctx context.Context, userID uint64) (*TOTP, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	totp, ok := m.totps[userID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get TOTP of user %v: %w", userID, ErrNotFound)
+	}
+	return &totp, nil
+}
+
+// EnrollTOTP records a new, unconfirmed secret of a user, replacing a previous unconfirmed one
+func (m *Memory) EnrollTOTP(ctx context.Context, userID uint64, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return fmt.Errorf("failed to enroll TOTP of user %v: %w", userID, ErrNotFound)
+	}
+	if totp, ok := m.totps[userID]; ok && totp.Confirmed {
+		return fmt.Errorf("failed to enroll TOTP of user %v: %w", userID, ErrTOTPEnabled)
+	}
+	m.totps[userID] = TOTP{Secret: secret}
+	return nil
+}
+
+// ConfirmTOTP turns on the two-factor authentication of a user, replacing its recovery codes with the given hashes
+func (m *Memory) ConfirmTOTP(ctx context.Context, userID uint64, step int64, codeHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totp, ok := m.totps[userID]
+	if !ok || totp.Confirmed {
+		return fmt.Errorf("failed to confirm TOTP of user %v: %w", userID, ErrNotFound)
+	}
+	totp.Confirmed = true
+	totp.LastStep = step
+	m.totps[userID] = totp
+
+	codes := make(map[string]bool, len(codeHashes))
+	for _, hash := range codeHashes {
+		codes[hash] = true
+	}
+	m.codes[userID] = codes
+	return nil
+}
+
+// UseTOTPStep records that a code of the given time step was accepted. Steps up to the last accepted one are
+// ErrCodeUsed.
+func (m *Memory) UseTOTPStep(ctx context.Context, userID uint64, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totp, ok := m.totps[userID]
+	if !ok || !totp.Confirmed || totp.LastStep >= step {
+		return fmt.Errorf("failed to use TOTP code of user %v: %w", userID, ErrCodeUsed)
+	}
+	totp.LastStep = step
+	m.totps[userID] = totp
+	return nil
+}
+
+// UseRecoveryCode consumes a recovery code of a user. Unknown and consumed codes are ErrCodeUsed.
+func (m *Memory) UseRecoveryCode(ctx context.Context, userID uint64, codeHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.codes[userID][codeHash] {
+		return fmt.Errorf("failed to use recovery code of user %v: %w", userID, ErrCodeUsed)
+	}
+	delete(m.codes[userID], codeHash)
+	return nil
+}
+
+// DisableTOTP turns off the two-factor authentication of a user and drops its recovery codes
+func (m *Memory) DisableTOTP(ctx context.Context, userID uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.totps[userID]; !ok {
+		return fmt.Errorf("failed to disable TOTP of user %v: %w", userID, ErrNotFound)
+	}
+	delete(m.totps, userID)
+	delete(m.codes, userID)
+	return nil
+}
+
+// CreateClient registers a client
+func (m *Memory) CreateClient(ctx context.Context, client *Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.clients[client.ID]; ok {
+		return fmt.Errorf("failed to create client %v: %w", client.ID, ErrClientExists)
+	}
+	stored := *client
+	stored.RedirectURIs = append([]string(nil), client.RedirectURIs...)
+	m.clients[client.ID] = stored
+	return nil
+}
+
+// GetClient reads a registered client
+func (m *Memory) GetClient(ctx context.Context, id string) (*Client, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	client, ok := m.clients[id]
+	if !ok {
+		return nil, fmt.Errorf("failed to get client %v: %w", id, ErrClientNotFound)
+	}
+	client.RedirectURIs = append([]string(nil), client.RedirectURIs...)
+	return &client, nil
+}
+
+// DeleteClient unregisters a client. Tokens already issued to it stay valid until they expire.
+func (m *Memory) DeleteClient(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.clients[id]; !ok {
+		return fmt.Errorf("failed to delete client %v: %w", id, ErrClientNotFound)
+	}
+	delete(m.clients, id)
+	return nil
+}
+
+// finishDelete ends the sessions and API keys of a deleted user and publishes its deletion. The event goes out even
+// when the revokers fail, or the greeter service would keep the user. Their failures are logged, since the user is
+// deleted regardless.
+func finishDelete(ctx context.Context, user *User, events EventPublisher, timeout time.Duration, sessions, apiKeys Revoker) error {
+	revokeErr := errors.Join(
+		wrapRevoke(revokeAll(ctx, sessions, user.ID), "sessions", user.ID),
+		wrapRevoke(revokeAll(ctx, apiKeys, user.ID), "API keys", user.ID))
+
+	userEvent := &Event{Type: int(Deleted), ID: user.ID, Name: user.Name}
+	if err := publish(ctx, events, userEvent, timeout); err != nil {
+		return errors.Join(fmt.Errorf("failed to publish user deletion event: %w", err), revokeErr)
+	}
+
+	if revokeErr != nil {
+		slog.ErrorContext(ctx, "Failed to end the logins of a deleted user", "user_id", user.ID, "error", revokeErr)
+	}
+	return nil
+}
+
+func wrapRevoke(err error, what string, userID uint64) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("failed to revoke %v of deleted user %v: %w", what, userID, err)
+}
+
+// revokeAll ends what a user holds unless the Revoker is nil
+func revokeAll(ctx context.Context, revoker Revoker, userID uint64) error {
+	if revoker == nil {
+		return nil
+	}
+	_, err := revoker.RevokeAll(ctx, userID)
+	return err
+}
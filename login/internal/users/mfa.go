@@ -0,0 +1,208 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+	"github.com/rinswind/distributed-greeter/common/tracing"
+)
+
+// TOTP is the two-factor authentication state of a user
+type TOTP struct {
+	Secret    string
+	Confirmed bool
+
+	// LastStep is the time step of the last accepted code, which must not be accepted again
+	LastStep int64
+}
+
+func (s *Store) initMFA(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS totp (
+		user_id int NOT NULL,
+		secret varchar(64) NOT NULL,
+		confirmed boolean NOT NULL DEFAULT false,
+		last_step bigint NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE)`)
+	if err != nil {
+		return fmt.Errorf("failed to init TOTP schema: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id int NOT NULL,
+		code_hash char(64) NOT NULL,
+		PRIMARY KEY (user_id, code_hash),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE)`)
+	if err != nil {
+		return fmt.Errorf("failed to init recovery code schema: %w", err)
+	}
+	return nil
+}
+
+// GetTOTP reads the two-factor authentication state of a user. Users that never enrolled are ErrNotFound.
+func (s *Store) GetTOTP(ctx context.Context, userID uint64) (*TOTP, error) {
+	ctx, span := tracing.StartDB(ctx, "users.GetTOTP")
+	defer span.End()
+	ctx, cancel := s.read(ctx)
+	defer cancel()
+
+	var totp TOTP
+	err := s.db.QueryRowContext(ctx, "SELECT secret, confirmed, last_step FROM totp WHERE user_id=?", userID).
+		Scan(&totp.Secret, &totp.Confirmed, &totp.LastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get TOTP of user %v: %w", userID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, tracing.Fail(span, fmt.Errorf("failed to get TOTP of user %v: %w", userID, dbError(ctx, err)))
+	}
+	return &totp, nil
+}
+
+// EnrollTOTP records a new, unconfirmed secret of a user, replacing a previous unconfirmed one
+func (s *Store) EnrollTOTP(ctx context.Context, userID uint64, secret string) error {
+	ctx, span := tracing.StartDB(ctx, "users.EnrollTOTP")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	// Keep the secret of a confirmed enrollment
+	res, err := s.db.ExecContext(ctx,
+		"INSERT INTO totp (user_id, secret, confirmed, last_step) VALUES (?, ?, false, 0) "+
+			s.db.Dialect().Upsert("user_id", []string{"secret"}, "NOT totp.confirmed"), userID, secret)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to enroll TOTP of user %v: %w", userID, dbError(ctx, err)))
+	}
+
+	// No row is affected when the confirmed row is left as it was
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to enroll TOTP of user %v: %w", userID, dbError(ctx, err)))
+	}
+	if affected == 0 {
+		return fmt.Errorf("failed to enroll TOTP of user %v: %w", userID, ErrTOTPEnabled)
+	}
+	return nil
+}
+
+// ConfirmTOTP turns on the two-factor authentication of a user, replacing its recovery codes with the given hashes
+func (s *Store) ConfirmTOTP(ctx context.Context, userID uint64, step int64, codeHashes []string) error {
+	ctx, span := tracing.StartDB(ctx, "users.ConfirmTOTP")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to confirm TOTP of user %v: %w", userID, dbError(ctx, err)))
+	}
+
+	err = confirmTOTP(ctx, tx, userID, step, codeHashes)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return tracing.Fail(span, fmt.Errorf("failed to confirm TOTP of user %v: %w, unable to rollback: %v", userID, dbError(ctx, err), rollbackErr))
+		}
+		return tracing.Fail(span, fmt.Errorf("failed to confirm TOTP of user %v: %w", userID, dbError(ctx, err)))
+	}
+
+	if commitErr := tx.Commit(); commitErr != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to confirm TOTP of user %v: %w", userID, dbError(ctx, commitErr)))
+	}
+	return nil
+}
+
+func confirmTOTP(ctx context.Context, tx *sqldb.Tx, userID uint64, step int64, codeHashes []string) error {
+	res, err := tx.ExecContext(ctx, "UPDATE totp SET confirmed=true, last_step=? WHERE user_id=? AND NOT confirmed", step, userID)
+	if err != nil {
+		return err
+	}
+	if err := checkAffected(res); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id=?", userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseTOTPStep records that a code of the given time step was accepted. Steps up to the last accepted one are
+// ErrCodeUsed.
+func (s *Store) UseTOTPStep(ctx context.Context, userID uint64, step int64) error {
+	ctx, span := tracing.StartDB(ctx, "users.UseTOTPStep")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "UPDATE totp SET last_step=? WHERE user_id=? AND confirmed AND last_step<?", step, userID, step)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to use TOTP code of user %v: %w", userID, dbError(ctx, err)))
+	}
+	if err := checkAffected(res); errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to use TOTP code of user %v: %w", userID, ErrCodeUsed)
+	} else if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to use TOTP code of user %v: %w", userID, dbError(ctx, err)))
+	}
+	return nil
+}
+
+// UseRecoveryCode consumes a recovery code of a user. Unknown and consumed codes are ErrCodeUsed.
+func (s *Store) UseRecoveryCode(ctx context.Context, userID uint64, codeHash string) error {
+	ctx, span := tracing.StartDB(ctx, "users.UseRecoveryCode")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id=? AND code_hash=?", userID, codeHash)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to use recovery code of user %v: %w", userID, dbError(ctx, err)))
+	}
+	if err := checkAffected(res); errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to use recovery code of user %v: %w", userID, ErrCodeUsed)
+	} else if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to use recovery code of user %v: %w", userID, dbError(ctx, err)))
+	}
+	return nil
+}
+
+// DisableTOTP turns off the two-factor authentication of a user and drops its recovery codes
+func (s *Store) DisableTOTP(ctx context.Context, userID uint64) error {
+	ctx, span := tracing.StartDB(ctx, "users.DisableTOTP")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	// The recovery codes only cascade from the user, so drop them along
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to disable TOTP of user %v: %w", userID, dbError(ctx, err)))
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM totp WHERE user_id=?", userID)
+	if err == nil {
+		err = checkAffected(res)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id=?", userID)
+	}
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return tracing.Fail(span, fmt.Errorf("failed to disable TOTP of user %v: %w, unable to rollback: %v", userID, dbError(ctx, err), rollbackErr))
+		}
+		return tracing.Fail(span, fmt.Errorf("failed to disable TOTP of user %v: %w", userID, dbError(ctx, err)))
+	}
+
+	if commitErr := tx.Commit(); commitErr != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to disable TOTP of user %v: %w", userID, dbError(ctx, commitErr)))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package users
+
+import (
+	"context"
+)
+
+// Repository keeps the users with their emails and two-factor authentication, and the OpenID Connect clients. Store
+// keeps them in a SQL DB, Memory in the process.
+type Repository interface {
+	// CreateUser adds a new user and returns its ID. Names are unique up to case and Unicode compatibility.
+	CreateUser(ctx context.Context, name, pass string) (uint64, error)
+	GetUserByName(ctx context.Context, name string) (*User, error)
+	GetUserByID(ctx context.Context, id uint64) (*User, error)
+	// UpdatePassword replaces the password of a user and ends all of its sessions
+	UpdatePassword(ctx context.Context, id uint64, pass string) error
+	// DeleteUserByID deletes a user along with its email and two-factor authentication, and ends all of its sessions
+	// and API keys
+	DeleteUserByID(ctx context.Context, id uint64) error
+
+	GetEmail(ctx context.Context, userID uint64) (*Email, error)
+	SetEmail(ctx context.Context, userID uint64, address string) error
+	VerifyEmail(ctx context.Context, userID uint64, address string) error
+
+	GetTOTP(ctx context.Context, userID uint64) (*TOTP, error)
+	EnrollTOTP(ctx context.Context, userID uint64, secret string) error
+	ConfirmTOTP(ctx context.Context, userID uint64, step int64, codeHashes []string) error
+	UseTOTPStep(ctx context.Context, userID uint64, step int64) error
+	UseRecoveryCode(ctx context.Context, userID uint64, codeHash string) error
+	DisableTOTP(ctx context.Context, userID uint64) error
+
+	CreateClient(ctx context.Context, client *Client) error
+	GetClient(ctx context.Context, id string) (*Client, error)
+	DeleteClient(ctx context.Context, id string) error
+}
+
+// EventPublisher tells the other services about created and deleted users
+type EventPublisher interface {
+	Publish(ctx context.Context, event *Event) error
+}
+
+// Revoker ends everything of a kind that a user holds, e.g. a sessions.Store or an apikeys.Store
+type Revoker interface {
+	RevokeAll(ctx context.Context, userID uint64) (int, error)
+}
+
+var (
+	_ Repository = (*Store)(nil)
+	_ Repository = (*Memory)(nil)
+)
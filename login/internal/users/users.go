@@ -3,13 +3,16 @@ package users
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/go-redis/redis/v8"
-)
-
-const (
-	usersChannel = "/users"
+	"github.com/rinswind/distributed-greeter/common/apikeys"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+	"github.com/rinswind/distributed-greeter/common/tracing"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
 )
 
 // User models a user
@@ -19,139 +22,337 @@ type User struct {
 	Password string
 }
 
+// Timeouts bound the operations of a Store on top of the context they are called with. Zero leaves them bounded only
+// by that context.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+
+	// Publish bounds sending a user event. The event of a committed change is sent even if the request was cancelled
+	// meanwhile, so this is the only bound then.
+	Publish time.Duration
+}
+
 // Store is a User store
 type Store struct {
-	db    *sql.DB
-	redis *redis.Client
+	db       *sqldb.Queries
+	events   EventPublisher
+	sessions *sessions.Store
+	apiKeys  *apikeys.Store
+	timeouts Timeouts
 }
 
-// Make creates a Store client
-func Make(db *sql.DB, redis *redis.Client) *Store {
-	return &Store{db: db, redis: redis}
+// Make creates a Store client on a DB of the given dialect, publishing the user events to Redis
+func Make(db *sql.DB, dialect sqldb.Dialect, redis *redis.Client, timeouts Timeouts) *Store {
+	return &Store{
+		db:       sqldb.NewQueries(db, dialect),
+		events:   &RedisPublisher{Redis: redis},
+		sessions: sessions.Make(redis),
+		apiKeys:  apikeys.Make(redis),
+		timeouts: timeouts}
 }
 
-// Initialize the user store if needed
-func (s *Store) Init() error {
-	_, err := s.db.Exec(
+// Init creates the schema if needed. It is not bounded by the Timeouts, since a migration can take long.
+func (s *Store) Init(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx,
 		`CREATE TABLE IF NOT EXISTS users (
-		id int NOT NULL AUTO_INCREMENT,
-		name varchar(100) NOT NULL UNIQUE,
-		password varchar(40) NOT NULL,
-		PRIMARY KEY (id))`)
+		id `+s.db.Dialect().AutoIncrementKey()+`,
+		name varchar(100) NOT NULL,
+		name_key varchar(100) NOT NULL UNIQUE,
+		password varchar(40) NOT NULL)`)
 
 	if err != nil {
-		return fmt.Errorf("failed to init schema: %v", err)
+		return fmt.Errorf("failed to init schema: %w", err)
+	}
+	if err := s.migrateNameKeys(ctx); err != nil {
+		return err
 	}
-	return nil
-}
-
-// CreateUser adds a new user
-func (s *Store) CreateUser(name, pass string) (uint64, error) {
-	// if _, ok := s.byName[name]; ok {
-	// 	return 0, fmt.Errorf("User %v not available", name)
-	// }
 
-	var err error
+	if err := s.initMFA(ctx); err != nil {
+		return err
+	}
+	if err := s.initEmails(ctx); err != nil {
+		return err
+	}
+	return s.initClients(ctx)
+}
 
-	tx, err := s.db.Begin()
-	if err != nil {
-		return 0, fmt.Errorf("failed to create user %v: %v", name, err)
+// migrateNameKeys adds the name_key column to tables created before names were unique up to look-alikes, and keys the
+// users that have none. The UNIQUE of the name column stays, it is implied by the one of name_key.
+func (s *Store) migrateNameKeys(ctx context.Context) error {
+	// Not all DBs can add a column only if it is missing. A unique index allows any number of NULLs, so it can be
+	// added before the keys are filled in.
+	if _, err := s.db.ExecContext(ctx, "SELECT name_key FROM users WHERE 1=0"); err != nil {
+		if _, err := s.db.ExecContext(ctx, "ALTER TABLE users ADD COLUMN name_key varchar(100)"); err != nil {
+			return fmt.Errorf("failed to add user name keys to schema: %w", err)
+		}
+		if _, err := s.db.ExecContext(ctx, "CREATE UNIQUE INDEX users_name_key ON users (name_key)"); err != nil {
+			return fmt.Errorf("failed to index user name keys: %w", err)
+		}
 	}
 
-	// TODO Find a way to get the ID atomically with the INSERT
-	_, err = tx.Exec("INSERT INTO users (name, password) VALUES (?, ?)", name, pass)
+	// Keys left out by an interrupted migration are filled in on the next start
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name FROM users WHERE name_key IS NULL")
 	if err != nil {
-		if rollbackErr := tx.Rollback(); rollbackErr != nil {
-			return 0, fmt.Errorf("failed to create user %v: %v, rollback also failed: %v", name, err, rollbackErr)
+		return fmt.Errorf("failed to read users without name key: %w", err)
+	}
+	unkeyed := make(map[uint64]string)
+	for rows.Next() {
+		var id uint64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read users without name key: %w", err)
 		}
-		return 0, fmt.Errorf("failed to create user %v: %v", name, err)
+		unkeyed[id] = name
+	}
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return fmt.Errorf("failed to read users without name key: %w", err)
+	}
+	if len(unkeyed) == 0 {
+		return nil
 	}
 
-	var id uint64
-	err = tx.QueryRow("SELECT LAST_INSERT_ID() FROM users LIMIT 1;").Scan(&id)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		if rollbackErr := tx.Rollback(); rollbackErr != nil {
-			return 0, fmt.Errorf("failed to create user %v: %v, rollback also failed: %v", name, err, rollbackErr)
+		return fmt.Errorf("failed to key user names: %w", err)
+	}
+	for id, name := range unkeyed {
+		_, err := tx.ExecContext(ctx, "UPDATE users SET name_key=? WHERE id=?", validation.CanonicalUsername(name), id)
+		if s.db.Dialect().IsDuplicate(err) {
+			err = fmt.Errorf("%w, rename one of the look-alikes", ErrUserExists)
 		}
-		return 0, fmt.Errorf("failed to create user %v: %v", name, err)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to key user %v %v: %w", id, name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to key user names: %w", err)
 	}
+	return nil
+}
 
-	if commitErr := tx.Commit(); commitErr != nil {
-		return 0, fmt.Errorf("failed to create user %v: %v", name, commitErr)
+// CreateUser adds a new user. Names are unique up to case and Unicode compatibility, so look-alikes are ErrUserExists.
+func (s *Store) CreateUser(ctx context.Context, name, pass string) (uint64, error) {
+	id, err := s.insertUser(ctx, name, pass)
+	if err != nil {
+		return 0, err
 	}
 
 	// TODO Do this before tx.Commit() and if this fails do tx.Rollback()?
 	userEvent := &Event{Type: int(Created), ID: id, Name: name}
-	err = s.redis.Publish(context.Background(), usersChannel, userEvent.Marshal()).Err()
+	err = publish(ctx, s.events, userEvent, s.timeouts.Publish)
 	if err != nil {
-		return 0, fmt.Errorf("failed to publish user creation event %v: %v", userEvent, err)
+		return 0, fmt.Errorf("failed to publish user creation event %v: %w", userEvent, err)
 	}
 
 	return id, nil
 }
 
-// GetUserByName finds a user
-func (s *Store) GetUserByName(name string) (*User, error) {
+func (s *Store) insertUser(ctx context.Context, name, pass string) (uint64, error) {
+	ctx, span := tracing.StartDB(ctx, "users.CreateUser")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	var err error
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, tracing.Fail(span, fmt.Errorf("failed to create user %v: %w", name, dbError(ctx, err)))
+	}
+
+	id, err := tx.InsertID(ctx, "INSERT INTO users (name, name_key, password) VALUES (?, ?, ?)", "id", name, validation.CanonicalUsername(name), pass)
+	if s.db.Dialect().IsDuplicate(err) {
+		err = ErrUserExists
+	}
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return 0, tracing.Fail(span, fmt.Errorf("failed to create user %v: %w, rollback also failed: %v", name, dbError(ctx, err), rollbackErr))
+		}
+		return 0, tracing.Fail(span, fmt.Errorf("failed to create user %v: %w", name, dbError(ctx, err)))
+	}
+
+	if commitErr := tx.Commit(); commitErr != nil {
+		return 0, tracing.Fail(span, fmt.Errorf("failed to create user %v: %w", name, dbError(ctx, commitErr)))
+	}
+
+	return id, nil
+}
+
+// GetUserByName finds a user, matching the name the same way CreateUser checks uniqueness
+func (s *Store) GetUserByName(ctx context.Context, name string) (*User, error) {
+	ctx, span := tracing.StartDB(ctx, "users.GetUserByName")
+	defer span.End()
+	ctx, cancel := s.read(ctx)
+	defer cancel()
+
 	var user User
-	err := s.db.QueryRow("SELECT id, name, password FROM users WHERE name=?", name).Scan(&user.ID, &user.Name, &user.Password)
+	err := s.db.QueryRowContext(ctx, "SELECT id, name, password FROM users WHERE name_key=?", validation.CanonicalUsername(name)).Scan(&user.ID, &user.Name, &user.Password)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get user %v: %w", name, ErrNotFound)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user %v: %v", name, err)
+		return nil, tracing.Fail(span, fmt.Errorf("failed to get user %v: %w", name, dbError(ctx, err)))
 	}
 	return &user, nil
 }
 
 // GetUserByID finds a user
-func (s *Store) GetUserByID(id uint64) (*User, error) {
+func (s *Store) GetUserByID(ctx context.Context, id uint64) (*User, error) {
+	ctx, span := tracing.StartDB(ctx, "users.GetUserByID")
+	defer span.End()
+	ctx, cancel := s.read(ctx)
+	defer cancel()
+
 	var user User
-	err := s.db.QueryRow("SELECT id, name, password FROM users WHERE id=?", id).Scan(&user.ID, &user.Name, &user.Password)
+	err := s.db.QueryRowContext(ctx, "SELECT id, name, password FROM users WHERE id=?", id).Scan(&user.ID, &user.Name, &user.Password)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get user %v: %w", id, ErrNotFound)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user %v: %v", id, err)
+		return nil, tracing.Fail(span, fmt.Errorf("failed to get user %v: %w", id, dbError(ctx, err)))
 	}
 	return &user, nil
 }
 
-// DeleteUserByID deletes a used by ID
-func (s *Store) DeleteUserByID(id uint64) error {
-	// user, ok := s.byID[id]
-	// if !ok {
-	// 	return fmt.Errorf("User %v not available", id)
-	// }
+// UpdatePassword replaces the password of a user and ends all of its sessions
+func (s *Store) UpdatePassword(ctx context.Context, id uint64, pass string) error {
+	if err := s.updatePassword(ctx, id, pass); err != nil {
+		return err
+	}
+
+	if _, err := s.sessions.RevokeAll(ctx, id); err != nil {
+		return fmt.Errorf("failed to revoke sessions of user %v: %w", id, err)
+	}
+	return nil
+}
+
+func (s *Store) updatePassword(ctx context.Context, id uint64, pass string) error {
+	ctx, span := tracing.StartDB(ctx, "users.UpdatePassword")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET password=? WHERE id=?", pass, id)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to update password of user %v: %w", id, dbError(ctx, err)))
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to update password of user %v: %w", id, dbError(ctx, err)))
+	}
+	if updated > 0 {
+		return nil
+	}
+
+	// MySQL counts only the rows that actually changed, so tell an unchanged password from a missing user
+	var found int
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE id=?", id).Scan(&found)
+	if err != nil {
+		return tracing.Fail(span, fmt.Errorf("failed to update password of user %v: %w", id, dbError(ctx, err)))
+	}
+	if found == 0 {
+		return fmt.Errorf("failed to update password of user %v: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// DeleteUserByID deletes a user by ID and ends all of its sessions and API keys. The user is gone once the DB delete
+// commits, so the deletion event is published even when ending the sessions or API keys fails. Those failures are
+// logged rather than returned.
+func (s *Store) DeleteUserByID(ctx context.Context, id uint64) error {
+	user, err := s.deleteUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	return finishDelete(ctx, user, s.events, s.timeouts.Publish, s.sessions, s.apiKeys)
+}
+
+func (s *Store) deleteUser(ctx context.Context, id uint64) (*User, error) {
+	ctx, span := tracing.StartDB(ctx, "users.DeleteUserByID")
+	defer span.End()
+	ctx, cancel := s.write(ctx)
+	defer cancel()
 
 	var err error
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to delete user %v: %v", id, err)
+		return nil, tracing.Fail(span, fmt.Errorf("failed to delete user %v: %w", id, dbError(ctx, err)))
 	}
 
 	// TODO "SELECT FOR UPDATE"
 	var user User
-	err = tx.QueryRow("SELECT id, name, password FROM users WHERE id=?", id).Scan(&user.ID, &user.Name, &user.Password)
+	err = tx.QueryRowContext(ctx, "SELECT id, name, password FROM users WHERE id=?", id).Scan(&user.ID, &user.Name, &user.Password)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = ErrNotFound
+	}
 	if err != nil {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
-			return fmt.Errorf("failed to find user %v: %v, unable to rollback: %v", id, err, rollbackErr)
+			return nil, tracing.Fail(span, fmt.Errorf("failed to find user %v: %w, unable to rollback: %v", id, dbError(ctx, err), rollbackErr))
 		}
-		return fmt.Errorf("failed to find user %v: %v", id, err)
+		return nil, tracing.Fail(span, fmt.Errorf("failed to find user %v: %w", id, dbError(ctx, err)))
 	}
 
-	_, err = tx.Exec("DELETE FROM users WHERE id=?", user.ID)
+	res, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id=?", user.ID)
+	if err == nil {
+		err = checkAffected(res)
+	}
 	if err != nil {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
-			return fmt.Errorf("failed to delete user: %v, unable to rollback: %v", err, rollbackErr)
+			return nil, tracing.Fail(span, fmt.Errorf("failed to delete user %v: %w, unable to rollback: %v", id, dbError(ctx, err), rollbackErr))
 		}
-		return err
+		return nil, tracing.Fail(span, fmt.Errorf("failed to delete user %v: %w", id, dbError(ctx, err)))
 	}
 
 	if commitErr := tx.Commit(); commitErr != nil {
-		return fmt.Errorf("failed to delete user %v: %v", id, commitErr)
+		return nil, tracing.Fail(span, fmt.Errorf("failed to delete user %v: %w", id, dbError(ctx, commitErr)))
 	}
 
-	// TODO Do this before tx.Commit() and if this fails do tx.Rollback()?
-	userEvent := Event{Type: int(Deleted), ID: user.ID, Name: user.Name}
-	err = s.redis.Publish(context.Background(), usersChannel, userEvent.Marshal()).Err()
+	return &user, nil
+}
+
+// checkAffected reports ErrNotFound if a statement changed no rows
+func checkAffected(res sql.Result) error {
+	affected, err := res.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("failed to publish user deletion event: %v", err)
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
 	}
-
 	return nil
 }
+
+// read bounds a query by the Read timeout
+func (s *Store) read(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s.timeouts.Read)
+}
+
+// write bounds a change by the Write timeout
+func (s *Store) write(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s.timeouts.Write)
+}
+
+// withTimeout bounds ctx by a timeout, unless the timeout is zero
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// publish sends the event of a committed change. A cancelled request must not keep the other services from learning
+// about the change, so the event is sent on a context that carries the request and trace of ctx but not its
+// cancellation, bounded by the timeout instead.
+func publish(ctx context.Context, events EventPublisher, event *Event, timeout time.Duration) error {
+	if events == nil {
+		return nil
+	}
+	ctx, cancel := withTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+	return events.Publish(ctx, event)
+}
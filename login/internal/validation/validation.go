@@ -0,0 +1,261 @@
+package validation
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Stable codes of the individual field failures
+const (
+	CodeRequired          = "required"
+	CodeTooShort          = "too_short"
+	CodeTooLong           = "too_long"
+	CodeInvalidCharacters = "invalid_characters"
+	CodeReserved          = "reserved"
+	CodeBreached          = "breached"
+	CodeTaken             = "taken"
+	CodeIncorrect         = "incorrect"
+	CodeInvalid           = "invalid"
+)
+
+// Names of the validated fields as they appear in the REST API
+const (
+	FieldUserName        = "user_name"
+	FieldUserPassword    = "user_password"
+	FieldNewPassword     = "new_password"
+	FieldCurrentPassword = "current_password"
+	FieldToken           = "token"
+	FieldUserEmail       = "user_email"
+)
+
+// Defaults for rules left out of the configuration
+const (
+	defaultUsernameMinLength = 3
+	defaultUsernameMaxLength = 32
+	defaultUsernamePattern   = `^[\p{L}\p{N}._-]+$`
+	defaultPasswordMinLength = 8
+	defaultPasswordMaxLength = 40
+
+	// maxEmailLength is the longest address that fits in an SMTP path, per RFC 5321
+	maxEmailLength = 254
+)
+
+// The widths of the DB columns, which bound the configurable maximum lengths
+const (
+	ColumnUsernameLength = 100
+	ColumnPasswordLength = 40
+)
+
+//go:embed common-passwords.txt
+var commonPasswords string
+
+// UsernameRules configures which user names are accepted. Lengths count characters after normalization.
+type UsernameRules struct {
+	MinLength int
+	MaxLength int
+	Pattern   string
+	Reserved  []string
+}
+
+// PasswordRules configures which passwords are accepted. BreachedList names a file with one password per line,
+// extending the built-in list of common passwords.
+type PasswordRules struct {
+	MinLength    int
+	MaxLength    int
+	BreachedList string
+}
+
+// FieldError reports why a single field was rejected
+type FieldError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+// Errors collects all field failures of a request
+type Errors []FieldError
+
+// Error implements error
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = fmt.Sprintf("%v %v", e.Field, e.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validator checks user names and passwords at signup
+type Validator struct {
+	usernames UsernameRules
+	passwords PasswordRules
+	pattern   *regexp.Regexp
+	reserved  map[string]bool
+	breached  map[string]bool
+}
+
+// New creates a Validator, applying defaults to the unset rules and loading the breached password list
+func New(usernames UsernameRules, passwords PasswordRules) (*Validator, error) {
+	if usernames.MinLength == 0 {
+		usernames.MinLength = defaultUsernameMinLength
+	}
+	if usernames.MaxLength == 0 {
+		usernames.MaxLength = defaultUsernameMaxLength
+	}
+	if usernames.Pattern == "" {
+		usernames.Pattern = defaultUsernamePattern
+	}
+	if passwords.MinLength == 0 {
+		passwords.MinLength = defaultPasswordMinLength
+	}
+	if passwords.MaxLength == 0 {
+		passwords.MaxLength = defaultPasswordMaxLength
+	}
+
+	if usernames.MaxLength > ColumnUsernameLength {
+		return nil, fmt.Errorf("user names of %v characters do not fit in the DB, the most is %v", usernames.MaxLength, ColumnUsernameLength)
+	}
+	if passwords.MaxLength > ColumnPasswordLength {
+		return nil, fmt.Errorf("passwords of %v characters do not fit in the DB, the most is %v", passwords.MaxLength, ColumnPasswordLength)
+	}
+
+	pattern, err := regexp.Compile(usernames.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile user name pattern %q: %w", usernames.Pattern, err)
+	}
+
+	reserved := make(map[string]bool, len(usernames.Reserved))
+	for _, name := range usernames.Reserved {
+		reserved[CanonicalUsername(name)] = true
+	}
+
+	breached := make(map[string]bool)
+	if err := readList(strings.NewReader(commonPasswords), breached); err != nil {
+		return nil, fmt.Errorf("failed to read built-in password list: %w", err)
+	}
+	if passwords.BreachedList != "" {
+		f, err := os.Open(passwords.BreachedList)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open breached password list: %w", err)
+		}
+		defer f.Close()
+
+		if err := readList(f, breached); err != nil {
+			return nil, fmt.Errorf("failed to read breached password list %v: %w", passwords.BreachedList, err)
+		}
+	}
+
+	return &Validator{
+		usernames: usernames,
+		passwords: passwords,
+		pattern:   pattern,
+		reserved:  reserved,
+		breached:  breached,
+	}, nil
+}
+
+// NormalizeUsername returns the NFKC form in which a user name is stored and displayed
+func NormalizeUsername(name string) string {
+	return norm.NFKC.String(name)
+}
+
+// CanonicalUsername returns the case-folded key of a user name. Names with equal keys are the same user.
+func CanonicalUsername(name string) string {
+	// Folding may produce denormalized text, so normalize again
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(name)))
+}
+
+// Validate checks a signup request. It returns the normalized user name, or Errors listing every rejected field.
+func (v *Validator) Validate(name, password string) (string, error) {
+	name = NormalizeUsername(name)
+
+	var errs Errors
+	errs = append(errs, v.checkUsername(name)...)
+	errs = append(errs, v.checkPassword(FieldUserPassword, password)...)
+	if len(errs) > 0 {
+		return "", errs
+	}
+	return name, nil
+}
+
+// ValidatePassword checks a password chosen for an existing user, reporting Errors against the given field
+func (v *Validator) ValidatePassword(field, password string) error {
+	if errs := v.checkPassword(field, password); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateEmail checks a bare email address, e.g. "tobo@example.org", and returns it trimmed
+func (v *Validator) ValidateEmail(field, address string) (string, error) {
+	address = strings.TrimSpace(address)
+
+	switch parsed, err := mail.ParseAddress(address); {
+	case address == "":
+		return "", Errors{{field, CodeRequired, "is required"}}
+	case len(address) > maxEmailLength:
+		return "", Errors{{field, CodeTooLong, fmt.Sprintf("must have at most %v characters", maxEmailLength)}}
+	case err != nil || parsed.Address != address:
+		// Display names are for mail headers, not for account data
+		return "", Errors{{field, CodeInvalid, "is not an email address"}}
+	}
+	return address, nil
+}
+
+func (v *Validator) checkUsername(name string) Errors {
+	rules := v.usernames
+	length := utf8.RuneCountInString(name)
+
+	switch {
+	case length == 0:
+		return Errors{{FieldUserName, CodeRequired, "is required"}}
+	case length < rules.MinLength:
+		return Errors{{FieldUserName, CodeTooShort, fmt.Sprintf("must have at least %v characters", rules.MinLength)}}
+	case length > rules.MaxLength:
+		return Errors{{FieldUserName, CodeTooLong, fmt.Sprintf("must have at most %v characters", rules.MaxLength)}}
+	case !v.pattern.MatchString(name):
+		return Errors{{FieldUserName, CodeInvalidCharacters, "contains characters that are not allowed"}}
+	case v.reserved[CanonicalUsername(name)]:
+		return Errors{{FieldUserName, CodeReserved, "is reserved"}}
+	}
+	return nil
+}
+
+func (v *Validator) checkPassword(field, password string) Errors {
+	rules := v.passwords
+	length := utf8.RuneCountInString(password)
+
+	switch {
+	case length == 0:
+		return Errors{{field, CodeRequired, "is required"}}
+	case length < rules.MinLength:
+		return Errors{{field, CodeTooShort, fmt.Sprintf("must have at least %v characters", rules.MinLength)}}
+	case length > rules.MaxLength:
+		return Errors{{field, CodeTooLong, fmt.Sprintf("must have at most %v characters", rules.MaxLength)}}
+	case v.breached[strings.ToLower(password)]:
+		return Errors{{field, CodeBreached, "appears in a list of breached passwords"}}
+	}
+	return nil
+}
+
+// readList adds the lowercase lines of r to set, skipping blanks and # comments
+func readList(r io.Reader, set map[string]bool) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		set[strings.ToLower(line)] = true
+	}
+	return scanner.Err()
+}
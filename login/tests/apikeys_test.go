@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/apikeys"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+)
+
+func TestAPIKeys(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{})
+	token := lf.token.AccessToken
+
+	rdb := redis.NewClient(&redis.Options{Addr: lf.redis.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	store := apikeys.Make(rdb)
+
+	invalid := []string{
+		`{"name": "", "scopes": ["greetings"]}`,
+		`{"name": "batch", "scopes": []}`,
+		`{"name": "batch", "scopes": ["admin"]}`,
+		`{"name": "batch", "scopes": ["greetings"], "expires_at": "2001-01-01T00:00:00Z"}`,
+		`{"name": "batch", "scopes": ["greetings"], "expires_at": "` + time.Now().Add(48*time.Hour).Format(time.RFC3339) + `"}`,
+	}
+	for _, body := range invalid {
+		resp := serve(lf.router, http.MethodPost, "/users/7/api-keys", token, body)
+		assertProblem(t, resp, http.StatusBadRequest, problem.CodeValidationFailed)
+	}
+
+	resp := serve(lf.router, http.MethodPost, "/users/8/api-keys", token, `{"name": "batch", "scopes": ["greetings"]}`)
+	assertProblem(t, resp, http.StatusForbidden, problem.CodeForbidden)
+
+	type KeyInfo struct {
+		ID       string     `json:"api_key_id"`
+		Prefix   string     `json:"prefix"`
+		Name     string     `json:"name"`
+		Scopes   []string   `json:"scopes"`
+		Expires  *time.Time `json:"expires_at"`
+		LastUsed *time.Time `json:"last_used"`
+		Key      string     `json:"api_key"`
+	}
+
+	resp = serve(lf.router, http.MethodPost, "/users/7/api-keys", token, `{"name": "batch", "scopes": ["users:read", "greetings", "greetings"]}`)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status %v, got %v: %v", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+	var created KeyInfo
+	if err := json.Unmarshal(resp.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, created.Prefix+"_") || !strings.HasPrefix(created.Prefix, apikeys.Prefix) {
+		t.Fatalf("Expected the key to start with its prefix, got %+v", created)
+	}
+	if len(created.Scopes) != 2 || created.Expires == nil || time.Until(*created.Expires) > time.Hour {
+		t.Fatalf("Expected deduplicated scopes and the default expiry, got %+v", created)
+	}
+
+	// Only the hash is stored
+	stored := rdb.HGetAll(context.Background(), "api-key:"+created.ID).Val()
+	for field, value := range stored {
+		if strings.Contains(value, created.Key) {
+			t.Fatalf("Expected the key not to be stored, found it in %v", field)
+		}
+	}
+
+	key, err := store.Verify(context.Background(), created.Key, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.UserID != 7 || !key.HasScope(apikeys.ScopeGreetings) || key.HasScope(apikeys.ScopeUsersWrite) {
+		t.Fatalf("Unexpected key %+v", key)
+	}
+	if lf.redis.TTL("api-key:"+created.ID) <= 0 {
+		t.Fatal("Expected the recorded use to keep the expiry of the key")
+	}
+	if _, err := store.Verify(context.Background(), created.Key+"x", time.Now()); !errors.Is(err, apikeys.ErrInvalid) {
+		t.Fatalf("Expected %v, got %v", apikeys.ErrInvalid, err)
+	}
+	if _, err := store.Verify(context.Background(), created.Key, time.Now().Add(2*time.Hour)); !errors.Is(err, apikeys.ErrInvalid) {
+		t.Fatalf("Expected an expired key to be %v, got %v", apikeys.ErrInvalid, err)
+	}
+
+	// The listing shows the use, never the key
+	resp = serve(lf.router, http.MethodGet, "/users/7/api-keys", token, "")
+	if resp.Code != http.StatusOK || strings.Contains(resp.Body.String(), created.Key) {
+		t.Fatalf("Expected the keys without secrets, got %v: %v", resp.Code, resp.Body.String())
+	}
+	var list struct {
+		Keys []KeyInfo `json:"api_keys"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Keys) != 1 || list.Keys[0].ID != created.ID || list.Keys[0].LastUsed == nil {
+		t.Fatalf("Expected the used key, got %+v", list.Keys)
+	}
+
+	// Keys of other users can not be revoked
+	other := &apikeys.Key{UserID: 8, Name: "other", Scopes: []string{apikeys.ScopeGreetings}, Created: time.Now()}
+	if _, err := store.Create(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	resp = serve(lf.router, http.MethodDelete, "/users/7/api-keys/"+other.ID, token, "")
+	assertProblem(t, resp, http.StatusNotFound, problem.CodeNotFound)
+
+	resp = serve(lf.router, http.MethodDelete, "/users/7/api-keys/"+created.ID, token, "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, got %v: %v", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	if _, err := store.Verify(context.Background(), created.Key, time.Now()); !errors.Is(err, apikeys.ErrInvalid) {
+		t.Fatalf("Expected a revoked key to be %v, got %v", apikeys.ErrInvalid, err)
+	}
+	resp = serve(lf.router, http.MethodDelete, "/users/7/api-keys/"+created.ID, token, "")
+	assertProblem(t, resp, http.StatusNotFound, problem.CodeNotFound)
+}
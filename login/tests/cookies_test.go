@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/server"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+)
+
+func TestCookieLogin(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+
+	cookies, err := server.NewCookieSettings("", "/greeter", true, "Strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.endpoint.Cookies = cookies
+	router := lf.endpoint.Router()
+	lf.router = router
+
+	body := loginCookies(t, lf)
+
+	jar := map[string]*http.Cookie{}
+	for _, c := range body.cookies {
+		jar[c.Name] = c
+	}
+	for _, name := range []string{auth.AccessCookie, auth.RefreshCookie, auth.CSRFCookie} {
+		c, ok := jar[name]
+		if !ok {
+			t.Fatalf("Expected cookie %v, got %v", name, body.cookies)
+		}
+		if !c.Secure || c.SameSite != http.SameSiteStrictMode || c.Path != "/greeter" {
+			t.Fatalf("Unexpected attributes of cookie %v", c)
+		}
+		if c.HttpOnly != (name != auth.CSRFCookie) {
+			t.Fatalf("Expected only the token cookies to be HttpOnly, got %v", c)
+		}
+	}
+	if body.AccessToken != "" || body.RefreshToken != "" {
+		t.Fatalf("Expected no tokens in the body of a cookie login, got %+v", body)
+	}
+	if body.CSRFToken != jar[auth.CSRFCookie].Value {
+		t.Fatalf("Expected CSRF token %v in the body, got %v", jar[auth.CSRFCookie].Value, body.CSRFToken)
+	}
+
+	call := func(method, path, csrf string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(""))
+		for _, c := range body.cookies {
+			req.AddCookie(c)
+		}
+		if csrf != "" {
+			req.Header.Set(auth.CSRFHeader, csrf)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Safe requests need no CSRF token
+	if resp := call(http.MethodGet, "/users/7/logins", ""); resp.Code != http.StatusOK {
+		t.Fatalf("Expected cookie to authenticate, got %v: %v", resp.Code, resp.Body.String())
+	}
+
+	// Unsafe requests need a matching one
+	deleteLogin := "/users/7/logins/" + body.LoginID
+	if resp := call(http.MethodDelete, deleteLogin, ""); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected missing CSRF token to be rejected, got %v", resp.Code)
+	}
+	assertProblem(t, call(http.MethodDelete, deleteLogin, "forged"), http.StatusForbidden, problem.CodeForbidden)
+	assertProblem(t, call(http.MethodDelete, "/logins", "forged"), http.StatusForbidden, problem.CodeForbidden)
+	if resp := call(http.MethodDelete, deleteLogin, body.CSRFToken); resp.Code != http.StatusOK {
+		t.Fatalf("Expected matching CSRF token to pass, got %v: %v", resp.Code, resp.Body.String())
+	}
+}
+
+func TestCookieLogoutExpired(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+
+	cookies, err := server.NewCookieSettings("", "/", false, "Lax")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.endpoint.Cookies = cookies
+
+	// Issue access tokens that are already expired
+	lf.endpoint.AuthWriter.ATExpiry = -time.Minute
+	lf.router = lf.endpoint.Router()
+	body := loginCookies(t, lf)
+
+	call := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(""))
+		for _, c := range body.cookies {
+			req.AddCookie(c)
+		}
+		req.Header.Set(auth.CSRFHeader, body.CSRFToken)
+		resp := httptest.NewRecorder()
+		lf.router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	if resp := call(http.MethodGet, "/users/7/logins"); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected expired token to be rejected, got %v", resp.Code)
+	}
+
+	resp := call(http.MethodDelete, "/logins")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected logout to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+	cleared := map[string]bool{}
+	for _, c := range resp.Result().Cookies() {
+		cleared[c.Name] = c.MaxAge < 0 && c.Value == ""
+	}
+	for _, name := range []string{auth.AccessCookie, auth.RefreshCookie, auth.CSRFCookie} {
+		if !cleared[name] {
+			t.Fatalf("Expected cookie %v to be cleared, got %v", name, resp.Result().Cookies())
+		}
+	}
+	if lf.redis.Exists("session:" + body.LoginID) {
+		t.Fatalf("Expected logout to end the session")
+	}
+
+	// Without cookies there is nothing to end
+	if resp := serve(lf.router, http.MethodDelete, "/logins", "", ""); resp.Code != http.StatusOK {
+		t.Fatalf("Expected logout without cookies to succeed, got %v", resp.Code)
+	}
+}
+
+func TestCookieSettings(t *testing.T) {
+	if _, err := server.NewCookieSettings("", "/", false, "None"); err == nil {
+		t.Fatal("Expected SameSite None to require Secure")
+	}
+	if _, err := server.NewCookieSettings("", "/", true, "Sideways"); err == nil {
+		t.Fatal("Expected unknown SameSite mode to be rejected")
+	}
+}
+
+type cookieLogin struct {
+	LoginID      string `json:"login_id"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	CSRFToken    string `json:"csrf_token"`
+
+	cookies []*http.Cookie
+}
+
+// loginCookies logs in user 7 of the fixture DB on an endpoint set up for cookies
+func loginCookies(t *testing.T, lf *loginFixture) *cookieLogin {
+	t.Helper()
+
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password"}).AddRow(7, "tobo", "obot"))
+	expectNoTOTP(lf.mock, 7)
+	resp := serve(lf.router, http.MethodPost, "/logins", "", `{"user_name": "tobo", "user_password": "obot"}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+
+	var login cookieLogin
+	if err := json.Unmarshal(resp.Body.Bytes(), &login); err != nil {
+		t.Fatal(err)
+	}
+	login.cookies = resp.Result().Cookies()
+	return &login
+}
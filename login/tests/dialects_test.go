@@ -0,0 +1,213 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+	"github.com/rinswind/distributed-greeter/login/internal/users"
+)
+
+// The tables of the store, in the order they can be dropped
+var storeTables = []string{"recovery_codes", "totp", "emails", "oidc_clients", "users"}
+
+// forEachDialect runs a test against an empty DB of each dialect. SQLite always runs, MySQL and Postgres run when
+// TEST_MYSQL_DSN or TEST_POSTGRES_DSN name a DB whose tables the test may drop.
+func forEachDialect(t *testing.T, test func(t *testing.T, db *sql.DB, dialect sqldb.Dialect)) {
+	dsns := map[string]string{
+		"sqlite":   "file:" + filepath.Join(t.TempDir(), "login.db") + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)",
+		"mysql":    os.Getenv("TEST_MYSQL_DSN"),
+		"postgres": os.Getenv("TEST_POSTGRES_DSN"),
+	}
+
+	for _, driver := range []string{"sqlite", "mysql", "postgres"} {
+		t.Run(driver, func(t *testing.T) {
+			if dsns[driver] == "" {
+				t.Skipf("Set TEST_%v_DSN to run against %v", map[string]string{"mysql": "MYSQL", "postgres": "POSTGRES"}[driver], driver)
+			}
+
+			db, err := sqldb.Open(driver, dsns[driver], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.Close() })
+
+			for _, table := range storeTables {
+				if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+					t.Fatal(err)
+				}
+			}
+			test(t, db.DB, db.Dialect())
+		})
+	}
+}
+
+func TestStoreConformance(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, db *sql.DB, dialect sqldb.Dialect) {
+		ctx := context.Background()
+		rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+		t.Cleanup(func() { rdb.Close() })
+
+		store := users.Make(db, dialect, rdb, users.Timeouts{})
+		check := func(err error) {
+			t.Helper()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		expect := func(what string, err, target error) {
+			t.Helper()
+			if !errors.Is(err, target) {
+				t.Fatalf("Expected %v to be %v, got %v", what, target, err)
+			}
+		}
+
+		// The schema can be created again
+		check(store.Init(ctx))
+		check(store.Init(ctx))
+
+		// Users get generated IDs, and names are unique up to case
+		tobo, err := store.CreateUser(ctx, "Tobo", "obot")
+		check(err)
+		obot, err := store.CreateUser(ctx, "obot", "tobo")
+		check(err)
+		if tobo == 0 || obot <= tobo {
+			t.Fatalf("Expected increasing IDs, got %v and %v", tobo, obot)
+		}
+		_, err = store.CreateUser(ctx, "TOBO", "other")
+		expect("a look-alike name", err, users.ErrUserExists)
+
+		user, err := store.GetUserByName(ctx, "tobo")
+		check(err)
+		if user.ID != tobo || user.Name != "Tobo" || user.Password != "obot" {
+			t.Fatalf("Unexpected user %+v", user)
+		}
+		_, err = store.GetUserByID(ctx, obot+100)
+		expect("a missing user", err, users.ErrNotFound)
+
+		// An unchanged password is not a missing user
+		check(store.UpdatePassword(ctx, tobo, "obot"))
+		check(store.UpdatePassword(ctx, tobo, "new-obot"))
+		expect("a password of a missing user", store.UpdatePassword(ctx, obot+100, "x"), users.ErrNotFound)
+
+		// Setting an email again replaces it and drops the verification
+		check(store.SetEmail(ctx, tobo, "tobo@example.org"))
+		check(store.VerifyEmail(ctx, tobo, "tobo@example.org"))
+		check(store.SetEmail(ctx, tobo, "obot@example.org"))
+		email, err := store.GetEmail(ctx, tobo)
+		check(err)
+		if email.Address != "obot@example.org" || email.Verified {
+			t.Fatalf("Unexpected email %+v", email)
+		}
+		expect("a verification of a replaced address", store.VerifyEmail(ctx, tobo, "tobo@example.org"), users.ErrNotFound)
+
+		// An unconfirmed enrollment can be replaced, a confirmed one can not
+		check(store.EnrollTOTP(ctx, tobo, "first-secret"))
+		check(store.EnrollTOTP(ctx, tobo, "second-secret"))
+		check(store.ConfirmTOTP(ctx, tobo, 10, []string{"code-1", "code-2"}))
+		expect("an enrollment of a confirmed user", store.EnrollTOTP(ctx, tobo, "third-secret"), users.ErrTOTPEnabled)
+		totp, err := store.GetTOTP(ctx, tobo)
+		check(err)
+		if totp.Secret != "second-secret" || !totp.Confirmed || totp.LastStep != 10 {
+			t.Fatalf("Unexpected TOTP %+v", totp)
+		}
+		expect("a used step", store.UseTOTPStep(ctx, tobo, 10), users.ErrCodeUsed)
+		check(store.UseTOTPStep(ctx, tobo, 11))
+		check(store.UseRecoveryCode(ctx, tobo, "code-1"))
+		expect("a used recovery code", store.UseRecoveryCode(ctx, tobo, "code-1"), users.ErrCodeUsed)
+
+		// Clients
+		check(store.CreateClient(ctx, &users.Client{ID: "app", Name: "App", RedirectURIs: []string{"/callback"}}))
+		expect("a duplicate client", store.CreateClient(ctx, &users.Client{ID: "app", Name: "Other"}), users.ErrClientExists)
+
+		// A deleted user takes its email and TOTP along
+		check(store.DeleteUserByID(ctx, tobo))
+		expect("a deleted user", store.DeleteUserByID(ctx, tobo), users.ErrNotFound)
+		_, err = store.GetEmail(ctx, tobo)
+		expect("the email of a deleted user", err, users.ErrNotFound)
+		_, err = store.GetTOTP(ctx, tobo)
+		expect("the TOTP of a deleted user", err, users.ErrNotFound)
+
+		// An import keeps the IDs, and later users get new ones
+		var dump bytes.Buffer
+		dump.WriteString(`{"id":100,"name":"imported","password":"secret"}` + "\n")
+		imported, skipped, err := store.Import(ctx, &dump)
+		check(err)
+		if imported != 1 || skipped != 0 {
+			t.Fatalf("Expected 1 user imported, got %v and %v skipped", imported, skipped)
+		}
+		next, err := store.CreateUser(ctx, "next", "next")
+		check(err)
+		if next <= 100 {
+			t.Fatalf("Expected an ID after the imported one, got %v", next)
+		}
+
+		dump.Reset()
+		count, err := store.Export(ctx, &dump)
+		check(err)
+		if count != 3 {
+			t.Fatalf("Expected 3 users exported, got %v", count)
+		}
+		imported, skipped, err = store.Import(ctx, &dump)
+		check(err)
+		if imported != 0 || skipped != 3 {
+			t.Fatalf("Expected the existing users skipped, got %v imported and %v skipped", imported, skipped)
+		}
+	})
+}
+
+func TestStoreNameKeyMigration(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, db *sql.DB, dialect sqldb.Dialect) {
+		ctx := context.Background()
+		rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+		t.Cleanup(func() { rdb.Close() })
+
+		// A table from before names were unique up to look-alikes, which let two of them in
+		_, err := db.Exec(`CREATE TABLE users (
+			id ` + dialect.AutoIncrementKey() + `,
+			name varchar(100) NOT NULL UNIQUE,
+			password varchar(40) NOT NULL)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"Tobo", "tobo", "obot"} {
+			if _, err := db.Exec(dialect.Rebind("INSERT INTO users (name, password) VALUES (?, ?)"), name, "secret"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		store := users.Make(db, dialect, rdb, users.Timeouts{})
+		if err := store.Init(ctx); !errors.Is(err, users.ErrUserExists) {
+			t.Fatalf("Expected the look-alikes to stop the migration, got %v", err)
+		}
+
+		// Once they are told apart the migration picks up where it stopped
+		if _, err := db.Exec(dialect.Rebind("UPDATE users SET name=? WHERE name=?"), "tobo2", "tobo"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Init(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Init(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		user, err := store.GetUserByName(ctx, "TOBO")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Name != "Tobo" {
+			t.Fatalf("Expected Tobo, got %+v", user)
+		}
+		if _, err := store.CreateUser(ctx, "OBOT", "secret"); !errors.Is(err, users.ErrUserExists) {
+			t.Fatalf("Expected a look-alike of a migrated user to exist, got %v", err)
+		}
+	})
+}
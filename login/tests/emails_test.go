@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+)
+
+func TestEmailVerification(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+	token := lf.token.AccessToken
+
+	verifyToken := func(to string) string {
+		t.Helper()
+		mail := lastMail(t, lf.mails)
+		_, link, ok := strings.Cut(mail.Body, "https://example.org/#verify-email=")
+		if mail.To != to || !ok {
+			t.Fatalf("Expected verification mail to %v, got %+v", to, mail)
+		}
+		return strings.TrimSpace(link)
+	}
+
+	confirm := func(token string) int {
+		return serve(lf.router, http.MethodPost, "/email-verifications/confirm", "", `{"token": "`+token+`"}`).Code
+	}
+
+	// Signup mails the new address
+	assertProblem(t, serve(lf.router, http.MethodPost, "/users", "", `{"user_name": "tobo", "user_password": "obot-obot", "user_email": "Tobo <tobo@example.org>"}`),
+		http.StatusBadRequest, problem.CodeValidationFailed)
+
+	lf.mock.ExpectBegin()
+	lf.mock.ExpectExec("INSERT INTO users").WithArgs("tobo", "tobo", "obot-obot").WillReturnResult(sqlmock.NewResult(7, 1))
+	lf.mock.ExpectCommit()
+	lf.mock.ExpectExec("INSERT INTO emails").WithArgs(7, "tobo@example.org").WillReturnResult(sqlmock.NewResult(0, 1))
+	resp := serve(lf.router, http.MethodPost, "/users", "", `{"user_name": "tobo", "user_password": "obot-obot", "user_email": " tobo@example.org "}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected signup to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+	first := verifyToken("tobo@example.org")
+
+	// Resends are rate limited
+	expectEmail(lf.mock, 7, "tobo@example.org", false)
+	assertProblem(t, serve(lf.router, http.MethodPost, "/users/7/email/verification", token, ""), http.StatusTooManyRequests, problem.CodeRateLimited)
+
+	lf.redis.FastForward(31 * time.Second)
+
+	expectEmail(lf.mock, 7, "tobo@example.org", false)
+	if resp := serve(lf.router, http.MethodPost, "/users/7/email/verification", token, ""); resp.Code != http.StatusAccepted {
+		t.Fatalf("Expected resend to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+	second := verifyToken("tobo@example.org")
+
+	// A resend replaces the previous token
+	if code := confirm(first); code != http.StatusBadRequest {
+		t.Fatalf("Expected replaced token to be rejected, got %v", code)
+	}
+
+	lf.mock.ExpectExec("UPDATE emails SET verified=true").WithArgs(7, "tobo@example.org").WillReturnResult(sqlmock.NewResult(0, 1))
+	if code := confirm(second); code != http.StatusOK {
+		t.Fatalf("Expected verification to succeed, got %v", code)
+	}
+	if code := confirm(second); code != http.StatusBadRequest {
+		t.Fatalf("Expected token to be single use, got %v", code)
+	}
+
+	// Verified addresses are not mailed again
+	expectEmail(lf.mock, 7, "tobo@example.org", true)
+	assertProblem(t, serve(lf.router, http.MethodPost, "/users/7/email/verification", token, ""), http.StatusConflict, problem.CodeConflict)
+
+	if err := lf.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+	token := lf.token.AccessToken
+
+	assertProblem(t, serve(lf.router, http.MethodPut, "/users/7/email", token, `{"user_email": "nope"}`), http.StatusBadRequest, problem.CodeValidationFailed)
+	assertProblem(t, serve(lf.router, http.MethodPut, "/users/8/email", token, `{"user_email": "tobo@example.org"}`), http.StatusForbidden, problem.CodeForbidden)
+
+	lf.mock.ExpectExec("INSERT INTO emails").WithArgs(7, "old@example.org").WillReturnResult(sqlmock.NewResult(0, 1))
+	if resp := serve(lf.router, http.MethodPut, "/users/7/email", token, `{"user_email": "old@example.org"}`); resp.Code != http.StatusOK {
+		t.Fatalf("Expected email change to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+	mail := lastMail(t, lf.mails)
+	_, oldToken, _ := strings.Cut(mail.Body, "https://example.org/#verify-email=")
+
+	// Changes mail too, so they share the limit of the resends
+	assertProblem(t, serve(lf.router, http.MethodPut, "/users/7/email", token, `{"user_email": "new@example.org"}`), http.StatusTooManyRequests, problem.CodeRateLimited)
+
+	// A token of a replaced address does not verify the new one
+	lf.mock.ExpectExec("UPDATE emails SET verified=true").WithArgs(7, "old@example.org").WillReturnResult(sqlmock.NewResult(0, 0))
+	lf.mock.ExpectQuery("SELECT COUNT").WithArgs(7, "old@example.org").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	resp := serve(lf.router, http.MethodPost, "/email-verifications/confirm", "", `{"token": "`+strings.TrimSpace(oldToken)+`"}`)
+	assertProblem(t, resp, http.StatusBadRequest, problem.CodeValidationFailed)
+
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password"}).AddRow(7, "tobo", "obot"))
+	expectEmail(lf.mock, 7, "new@example.org", false)
+	resp = serve(lf.router, http.MethodGet, "/users/7", token, "")
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `"user_email":"new@example.org","email_verified":false`) {
+		t.Fatalf("Expected user info with the email, got %v: %v", resp.Code, resp.Body.String())
+	}
+
+	if err := lf.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+	lf.endpoint.RequireVerifiedEmail = true
+	lf.router = lf.endpoint.Router()
+	userCols := []string{"id", "name", "password"}
+
+	// The address becomes mandatory
+	assertProblem(t, serve(lf.router, http.MethodPost, "/users", "", `{"user_name": "tobo", "user_password": "obot-obot"}`),
+		http.StatusBadRequest, problem.CodeValidationFailed)
+
+	login := func() int {
+		return serve(lf.router, http.MethodPost, "/logins", "", `{"user_name": "tobo", "user_password": "obot"}`).Code
+	}
+
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	lf.mock.ExpectQuery("SELECT (.+) FROM emails WHERE user_id=?").WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"address", "verified"}))
+	resp := serve(lf.router, http.MethodPost, "/logins", "", `{"user_name": "tobo", "user_password": "obot"}`)
+	assertProblem(t, resp, http.StatusForbidden, problem.CodeEmailNotVerified)
+
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	expectEmail(lf.mock, 7, "tobo@example.org", false)
+	if code := login(); code != http.StatusForbidden {
+		t.Fatalf("Expected login with unverified email to be rejected, got %v", code)
+	}
+
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	expectEmail(lf.mock, 7, "tobo@example.org", true)
+	expectNoTOTP(lf.mock, 7)
+	if code := login(); code != http.StatusOK {
+		t.Fatalf("Expected login with verified email to succeed, got %v", code)
+	}
+
+	if err := lf.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectEmail(mock sqlmock.Sqlmock, userID uint64, address string, verified bool) {
+	mock.ExpectQuery("SELECT (.+) FROM emails WHERE user_id=?").WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"address", "verified"}).AddRow(address, verified))
+}
@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+)
+
+func TestJWKS(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{})
+
+	resp := serve(lf.router, http.MethodGet, "/.well-known/jwks.json", "", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, got %v: %v", http.StatusOK, resp.Code, resp.Body.String())
+	}
+
+	var set auth.JWKSet
+	if err := json.Unmarshal(resp.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("Expected 1 key, got %+v", set.Keys)
+	}
+	key := set.Keys[0]
+	if key.Kty != "OKP" || key.Crv != "Ed25519" || key.Alg != auth.AlgEdDSA || key.X == "" {
+		t.Fatalf("Unexpected key %+v", key)
+	}
+
+	token, _, err := jwt.NewParser().ParseUnverified(lf.token.AccessToken, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header["kid"] != key.Kid {
+		t.Fatalf("Expected token signed with %v, got %v", key.Kid, token.Header["kid"])
+	}
+
+	// Verify the way another service does, knowing only the published keys
+	jwks := httptest.NewServer(lf.router)
+	t.Cleanup(jwks.Close)
+
+	rdb := redis.NewClient(&redis.Options{Addr: lf.redis.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	reader := &auth.AuthReader{Redis: rdb, Keys: auth.MakeJWKSClient(jwks.URL+"/.well-known/jwks.json", time.Minute)}
+	claims, err := reader.ReadAuth(context.Background(), lf.token.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["user_id"] != float64(7) {
+		t.Fatalf("Expected user 7, got %v", claims["user_id"])
+	}
+
+	// A token that names the published key but is MACed with its public half must not pass
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"access_uuid": lf.token.AccessUUID, "user_id": 8})
+	forged.Header["kid"] = key.Kid
+	forgedStr, err := forged.SignedString([]byte(key.X))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadAuth(context.Background(), forgedStr); err == nil {
+		t.Fatal("Expected the HS256 token to be rejected")
+	}
+
+	// The same goes for keys that were never published
+	other, err := auth.MakeKeyRing(redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}), auth.AlgEdDSA, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownStr, err := other.Sign(context.Background(), jwt.MapClaims{"access_uuid": lf.token.AccessUUID, "user_id": 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadAuth(context.Background(), unknownStr); !errors.Is(err, auth.ErrUnknownKey) {
+		t.Fatalf("Expected %v, got %v", auth.ErrUnknownKey, err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	now := time.Now()
+	ring, err := auth.MakeKeyRing(rdb, auth.AlgRS256, time.Hour, 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring.WithClock(func() time.Time { return now })
+
+	sign := func() (string, string) {
+		t.Helper()
+		signed, err := ring.Sign(ctx, jwt.MapClaims{"user_id": 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, _, err := jwt.NewParser().ParseUnverified(signed, jwt.MapClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed, token.Header["kid"].(string)
+	}
+	verify := func(signed string) error {
+		_, err := jwt.Parse(signed, ring.Keyfunc(ctx), jwt.WithValidMethods(ring.Methods()))
+		return err
+	}
+	published := func() []string {
+		t.Helper()
+		set, err := ring.JWKS(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kids []string
+		for _, key := range set.Keys {
+			if key.Kty != "RSA" || key.N == "" || key.E == "" {
+				t.Fatalf("Unexpected key %+v", key)
+			}
+			kids = append(kids, key.Kid)
+		}
+		return kids
+	}
+
+	first, firstKid := sign()
+	if _, kid := sign(); kid != firstKid {
+		t.Fatalf("Expected no rotation before the period, got %v after %v", kid, firstKid)
+	}
+
+	// Past the rotation period a new key signs while the old one still verifies
+	now = now.Add(time.Hour + time.Second)
+	_, secondKid := sign()
+	if secondKid == firstKid {
+		t.Fatal("Expected the key to rotate")
+	}
+	if kids := published(); len(kids) != 2 || kids[0] != secondKid || kids[1] != firstKid {
+		t.Fatalf("Expected keys %v and %v published, got %v", secondKid, firstKid, kids)
+	}
+	if err := verify(first); err != nil {
+		t.Fatalf("Expected the old key to verify during the overlap, got %v", err)
+	}
+
+	// Past the overlap the old key is gone
+	now = now.Add(31 * time.Minute)
+	if kids := published(); len(kids) != 1 || kids[0] != secondKid {
+		t.Fatalf("Expected only %v published, got %v", secondKid, kids)
+	}
+	if err := verify(first); !errors.Is(err, auth.ErrUnknownKey) {
+		t.Fatalf("Expected %v, got %v", auth.ErrUnknownKey, err)
+	}
+
+	// The next rotation removes it from Redis too
+	now = now.Add(time.Hour)
+	sign()
+	if n := rdb.HLen(ctx, "signing:keys").Val(); n != 2 {
+		t.Fatalf("Expected 2 stored keys, got %v", n)
+	}
+}
+
+func TestDropSharedKeys(t *testing.T) {
+	ctx := context.Background()
+
+	mr := miniredis.RunT(t)
+	shared := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { shared.Close() })
+
+	// Earlier releases kept the private keys where the greeter could read them
+	mr.HSet("jwks:keys", "old-kid", `{"alg":"EdDSA"}`)
+	mr.Set("sessions:7", "x")
+
+	dropped, err := auth.DropSharedKeys(ctx, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dropped || mr.Exists("jwks:keys") {
+		t.Fatal("Expected the shared keys to be dropped")
+	}
+	if !mr.Exists("sessions:7") {
+		t.Fatal("Expected the other keys to stay")
+	}
+
+	if dropped, err = auth.DropSharedKeys(ctx, shared); err != nil || dropped {
+		t.Fatalf("Expected nothing left to drop, got %v, %v", dropped, err)
+	}
+}
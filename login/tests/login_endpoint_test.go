@@ -0,0 +1,291 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-sql-driver/mysql"
+	"github.com/rinswind/distributed-greeter/common/apikeys"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/common/sessions"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+	"github.com/rinswind/distributed-greeter/login/internal/notify"
+	"github.com/rinswind/distributed-greeter/login/internal/onetime"
+	"github.com/rinswind/distributed-greeter/login/internal/server"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+	"github.com/rinswind/distributed-greeter/login/internal/users"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
+)
+
+func TestLoginRoutes(t *testing.T) {
+	userCols := []string{"id", "name", "password"}
+	selectByID := "SELECT (.+) FROM users WHERE id=?"
+	selectByName := "SELECT (.+) FROM users WHERE name_key=?"
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		anon   bool
+		expect func(mock sqlmock.Sqlmock)
+		status int
+		code   problem.Code
+	}{
+		{name: "create user bad body", method: http.MethodPost, path: "/users", body: `{"user_name": 1}`,
+			status: http.StatusBadRequest, code: problem.CodeInvalidRequest},
+		{name: "create user invalid", method: http.MethodPost, path: "/users", body: `{"user_name": "", "user_password": "obot"}`,
+			status: http.StatusBadRequest, code: problem.CodeValidationFailed},
+		{name: "create user db failure", method: http.MethodPost, path: "/users", body: `{"user_name": "tobo", "user_password": "obot-obot"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin().WillReturnError(errors.New("connection lost"))
+			},
+			status: http.StatusInternalServerError, code: problem.CodeInternal},
+		{name: "create user taken", method: http.MethodPost, path: "/users", body: `{"user_name": "Tobo", "user_password": "obot-obot"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO users").WithArgs("Tobo", "tobo", "obot-obot").WillReturnError(&mysql.MySQLError{Number: 1062})
+				mock.ExpectRollback()
+			},
+			status: http.StatusConflict, code: problem.CodeConflict},
+		{name: "create user", method: http.MethodPost, path: "/users", body: `{"user_name": "tobo", "user_password": "obot-obot"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO users").WithArgs("tobo", "tobo", "obot-obot").WillReturnResult(sqlmock.NewResult(7, 1))
+				mock.ExpectCommit()
+			},
+			status: http.StatusOK},
+
+		{name: "unauthenticated", method: http.MethodGet, path: "/users/7", anon: true, status: http.StatusUnauthorized},
+		{name: "user info bad id", method: http.MethodGet, path: "/users/abc",
+			status: http.StatusBadRequest, code: problem.CodeInvalidParameter},
+		{name: "user info missing user", method: http.MethodGet, path: "/users/7",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectByID).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols))
+			},
+			status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "user info other user", method: http.MethodGet, path: "/users/8",
+			status: http.StatusForbidden, code: problem.CodeForbidden},
+		{name: "user info", method: http.MethodGet, path: "/users/7",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectByID).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+				mock.ExpectQuery("SELECT (.+) FROM emails WHERE user_id=?").WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"address", "verified"}))
+			},
+			status: http.StatusOK},
+
+		{name: "delete user bad id", method: http.MethodDelete, path: "/users/abc",
+			status: http.StatusBadRequest, code: problem.CodeInvalidParameter},
+		{name: "delete user missing user", method: http.MethodDelete, path: "/users/7",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(selectByID).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols))
+				mock.ExpectRollback()
+			},
+			status: http.StatusNotFound, code: problem.CodeNotFound},
+		{name: "delete user db failure", method: http.MethodDelete, path: "/users/7",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin().WillReturnError(errors.New("connection lost"))
+			},
+			status: http.StatusInternalServerError, code: problem.CodeInternal},
+		{name: "delete user other user", method: http.MethodDelete, path: "/users/8",
+			status: http.StatusForbidden, code: problem.CodeForbidden},
+		{name: "delete user", method: http.MethodDelete, path: "/users/7",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(selectByID).WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+				mock.ExpectExec("DELETE FROM users").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			status: http.StatusOK},
+
+		{name: "login bad body", method: http.MethodPost, path: "/logins", body: `nope`,
+			status: http.StatusBadRequest, code: problem.CodeInvalidRequest},
+		{name: "login unknown user", method: http.MethodPost, path: "/logins", body: `{"user_name": "tobo", "user_password": "obot"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectByName).WithArgs("tobo").WillReturnRows(sqlmock.NewRows(userCols))
+			},
+			status: http.StatusUnauthorized, code: problem.CodeUnauthorized},
+		{name: "login bad password", method: http.MethodPost, path: "/logins", body: `{"user_name": "tobo", "user_password": "bad"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectByName).WithArgs("tobo").WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+			},
+			status: http.StatusUnauthorized, code: problem.CodeUnauthorized},
+		{name: "login db failure", method: http.MethodPost, path: "/logins", body: `{"user_name": "tobo", "user_password": "obot"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectByName).WithArgs("tobo").WillReturnError(errors.New("connection lost"))
+			},
+			status: http.StatusInternalServerError, code: problem.CodeInternal},
+		{name: "login", method: http.MethodPost, path: "/logins", body: `{"user_name": "tobo", "user_password": "obot"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectByName).WithArgs("tobo").WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+				expectNoTOTP(mock, 7)
+			},
+			status: http.StatusOK},
+
+		{name: "logout other login", method: http.MethodDelete, path: "/logins/nope",
+			status: http.StatusForbidden, code: problem.CodeForbidden},
+		{name: "logout", method: http.MethodDelete, path: "/logins/{login}", status: http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			router, mock, token := setupLogin(t)
+			if tc.expect != nil {
+				tc.expect(mock)
+			}
+
+			path := strings.ReplaceAll(tc.path, "{login}", token.AccessUUID)
+			req := httptest.NewRequest(tc.method, path, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			if !tc.anon {
+				req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(token.AccessToken)))
+			}
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			if resp.Code != tc.status {
+				t.Fatalf("Expected status %v, got %v: %v", tc.status, resp.Code, resp.Body.String())
+			}
+			if tc.code != "" {
+				assertProblem(t, resp, tc.status, tc.code)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func setupLogin(t *testing.T) (http.Handler, sqlmock.Sqlmock, *auth.TokenDetails) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+	return lf.router, lf.mock, lf.token
+}
+
+// loginFixture is a LoginEndpoint on top of a mock DB and an in-memory Redis
+type loginFixture struct {
+	router http.Handler
+	mock   sqlmock.Sqlmock
+	redis  *miniredis.Miniredis
+	guard  *throttle.Guard
+	mails  string
+	ring   *auth.KeyRing
+
+	// endpoint builds router, for tests that need to change its setup
+	endpoint *server.LoginEndpoint
+
+	// token is a login of user 7
+	token *auth.TokenDetails
+}
+
+func setupLoginWith(t *testing.T, limits throttle.Limits) *loginFixture {
+	gin.SetMode(gin.TestMode)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	// The signing keys are kept apart from the Redis the greeter shares
+	keysRdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { keysRdb.Close() })
+	ring, err := auth.MakeKeyRing(keysRdb, auth.AlgEdDSA, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authWriter := &auth.AuthWriter{
+		Redis:    rdb,
+		ATSigner: ring,
+		ATExpiry: time.Minute,
+		RTSigner: &auth.HMACKey{Secret: "rt"},
+		RTExpiry: time.Minute}
+	token, err := authWriter.CreateToken(context.Background(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authWriter.CreateAuth(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+
+	guard := throttle.Make(rdb, limits)
+
+	validator, err := validation.New(validation.UsernameRules{}, validation.PasswordRules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mails := path.Join(t.TempDir(), "mails.jsonl")
+
+	le := &server.LoginEndpoint{
+		AuthReader: &auth.AuthReader{Redis: rdb, Keys: ring},
+		AuthWriter: authWriter,
+		Users:      users.Make(db, sqldb.MySQL, rdb, users.Timeouts{}),
+		Sessions:   sessions.Make(rdb),
+		Validator:  validator,
+		Guard:      guard,
+		Notifier:   &notify.FileNotifier{Path: mails},
+		Resets:     onetime.Make(rdb, "password-reset", time.Minute),
+		ResetLink:  "https://example.org/#reset=",
+		Challenges: onetime.Make(rdb, "mfa-challenge", time.Minute),
+		MFAIssuer:  "greeter",
+		KeyRing:    ring,
+
+		APIKeys:         apikeys.Make(rdb),
+		APIKeyExpiry:    time.Hour,
+		APIKeyMaxExpiry: 24 * time.Hour,
+
+		Verifications:    onetime.Make(rdb, "email-verification", time.Minute),
+		VerificationLink: "https://example.org/#verify-email=",
+		Resends:          throttle.MakeCooldown(rdb, "email-resend", 30*time.Second)}
+
+	return &loginFixture{
+		router:   le.Router(),
+		mock:     mock,
+		redis:    mr,
+		guard:    guard,
+		mails:    mails,
+		ring:     ring,
+		endpoint: le,
+		token:    token}
+}
+
+// expectNoTOTP expects a lookup of the two-factor authentication of a user that never enrolled
+func expectNoTOTP(mock sqlmock.Sqlmock, userID uint64) {
+	mock.ExpectQuery("SELECT (.+) FROM totp WHERE user_id=?").WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "confirmed", "last_step"}))
+}
+
+func assertProblem(t *testing.T, resp *httptest.ResponseRecorder, status int, code problem.Code) {
+	if ct := resp.Header().Get("Content-Type"); ct != problem.ContentType {
+		t.Fatalf("Expected content type %v, got %v", problem.ContentType, ct)
+	}
+
+	var p problem.Problem
+	if err := json.Unmarshal(resp.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != status || p.Code != code || p.Type != problem.TypeURI(code) {
+		t.Fatalf("Expected problem %v %v, got %+v", status, code, p)
+	}
+	if p.RequestID == "" || p.RequestID != resp.Header().Get("X-Request-ID") {
+		t.Fatalf("Expected problem to carry request ID %v, got %+v", resp.Header().Get("X-Request-ID"), p)
+	}
+}
@@ -0,0 +1,239 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rinswind/distributed-greeter/common/logging"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+	"github.com/rinswind/distributed-greeter/login/internal/users"
+)
+
+// setupMemoryLogin is a loginFixture whose users are kept in a users.Memory instead of the mock DB
+func setupMemoryLogin(t *testing.T) (*loginFixture, *users.EventLog) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+
+	events := &users.EventLog{}
+	lf.endpoint.Users = users.MakeMemory(events, lf.endpoint.Sessions, lf.endpoint.APIKeys)
+	lf.router = lf.endpoint.Router()
+	return lf, events
+}
+
+func TestMemoryUserLifecycle(t *testing.T) {
+	lf, events := setupMemoryLogin(t)
+
+	resp := serve(lf.router, http.MethodPost, "/users", "", `{"user_name": "tobo", "user_password": "obot-obot"}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected signup to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+	var created struct {
+		ID uint64 `json:"user_id"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	userPath := "/users/" + strconv.FormatUint(created.ID, 10)
+
+	resp = serve(lf.router, http.MethodPost, "/users", "", `{"user_name": "TOBO", "user_password": "obot-obot"}`)
+	assertProblem(t, resp, http.StatusConflict, problem.CodeConflict)
+
+	token := loginMemory(t, lf, "tobo", "obot-obot")
+	resp = serve(lf.router, http.MethodGet, userPath, token, "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected user info, got %v: %v", resp.Code, resp.Body.String())
+	}
+
+	// A password change ends the sessions of the user
+	resp = serve(lf.router, http.MethodPut, userPath+"/password", token, `{"current_password": "wrong", "new_password": "new-obot-obot"}`)
+	assertProblem(t, resp, http.StatusForbidden, problem.CodeForbidden)
+	resp = serve(lf.router, http.MethodPut, userPath+"/password", token, `{"current_password": "obot-obot", "new_password": "new-obot-obot"}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected password change, got %v: %v", resp.Code, resp.Body.String())
+	}
+	if resp = serve(lf.router, http.MethodGet, userPath, token, ""); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the session to end, got %v", resp.Code)
+	}
+
+	token = loginMemory(t, lf, "tobo", "new-obot-obot")
+	resp = serve(lf.router, http.MethodDelete, userPath, token, "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected user deletion, got %v: %v", resp.Code, resp.Body.String())
+	}
+	resp = serve(lf.router, http.MethodPost, "/logins", "", `{"user_name": "tobo", "user_password": "new-obot-obot"}`)
+	assertProblem(t, resp, http.StatusUnauthorized, problem.CodeUnauthorized)
+
+	published := events.Events()
+	if len(published) != 2 ||
+		published[0].Type != int(users.Created) || published[0].ID != created.ID || published[0].Name != "tobo" ||
+		published[1].Type != int(users.Deleted) || published[1].ID != created.ID {
+		t.Fatalf("Expected a created and a deleted event, got %+v", published)
+	}
+	if published[0].RequestID == "" {
+		t.Fatal("Expected the events to carry the request ID")
+	}
+}
+
+func TestMemoryErrors(t *testing.T) {
+	ctx := context.Background()
+	store := users.MakeMemory(nil, nil, nil)
+
+	id, err := store.CreateUser(ctx, "tobo", "obot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		err    error
+		expect error
+	}{
+		{name: "look-alike name", err: second(store.CreateUser(ctx, "Tobo", "x")), expect: users.ErrUserExists},
+		{name: "missing user", err: second(store.GetUserByID(ctx, id+1)), expect: users.ErrNotFound},
+		{name: "password of missing user", err: store.UpdatePassword(ctx, id+1, "x"), expect: users.ErrNotFound},
+		{name: "email of missing user", err: store.SetEmail(ctx, id+1, "tobo@example.org"), expect: users.ErrNotFound},
+		{name: "verification of unset email", err: store.VerifyEmail(ctx, id, "tobo@example.org"), expect: users.ErrNotFound},
+		{name: "unused recovery code", err: store.UseRecoveryCode(ctx, id, "code"), expect: users.ErrCodeUsed},
+		{name: "step of unconfirmed TOTP", err: store.UseTOTPStep(ctx, id, 1), expect: users.ErrCodeUsed},
+		{name: "missing client", err: second(store.GetClient(ctx, "app")), expect: users.ErrClientNotFound},
+	}
+	for _, tc := range cases {
+		if !errors.Is(tc.err, tc.expect) {
+			t.Errorf("Expected %v to be %v, got %v", tc.name, tc.expect, tc.err)
+		}
+	}
+
+	if err := store.EnrollTOTP(ctx, id, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ConfirmTOTP(ctx, id, 10, []string{"code"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnrollTOTP(ctx, id, "other"); !errors.Is(err, users.ErrTOTPEnabled) {
+		t.Fatalf("Expected a confirmed enrollment to be kept, got %v", err)
+	}
+	if err := store.UseTOTPStep(ctx, id, 10); !errors.Is(err, users.ErrCodeUsed) {
+		t.Fatalf("Expected the confirming step to be used, got %v", err)
+	}
+}
+
+func TestMemoryConcurrency(t *testing.T) {
+	ctx := context.Background()
+	store := users.MakeMemory(&users.EventLog{}, nil, nil)
+
+	var wg sync.WaitGroup
+	ids := make([]uint64, 50)
+	errs := make([]error, len(ids))
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids[i], errs[i] = store.CreateUser(ctx, fmt.Sprintf("user-%v", i), "secret")
+			if errs[i] == nil {
+				_, errs[i] = store.GetUserByID(ctx, ids[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]bool)
+	for i, id := range ids {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if seen[id] {
+			t.Fatalf("Expected unique IDs, got %v twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+// contextRecorder is an EventPublisher that records the state of the contexts it publishes on
+type contextRecorder struct {
+	errs       []error
+	requestIDs []string
+}
+
+func (r *contextRecorder) Publish(ctx context.Context, event *users.Event) error {
+	r.errs = append(r.errs, ctx.Err())
+	r.requestIDs = append(r.requestIDs, logging.RequestID(ctx))
+	return nil
+}
+
+func TestPublishCancelledRequest(t *testing.T) {
+	recorder := &contextRecorder{}
+	store := users.MakeMemory(recorder, nil, nil)
+
+	// The user is created by the time the request is cancelled, so the greeter service must still learn about it
+	ctx, cancel := context.WithCancel(logging.WithRequestID(context.Background(), "request-1"))
+	cancel()
+	if _, err := store.CreateUser(ctx, "tobo", "obot"); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.errs) != 1 || recorder.errs[0] != nil {
+		t.Fatalf("Expected the event published on a live context, got %v", recorder.errs)
+	}
+	if recorder.requestIDs[0] != "request-1" {
+		t.Fatalf("Expected the event to keep the request ID, got %q", recorder.requestIDs[0])
+	}
+}
+
+// loginMemory logs in a user of a setupMemoryLogin fixture and returns the access token
+func loginMemory(t *testing.T, lf *loginFixture, name, password string) string {
+	t.Helper()
+
+	resp := serve(lf.router, http.MethodPost, "/logins", "", `{"user_name": "`+name+`", "user_password": "`+password+`"}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+
+	var login struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &login); err != nil {
+		t.Fatal(err)
+	}
+	return login.AccessToken
+}
+
+// second drops the result of a call that returns one and an error
+func second[T any](_ T, err error) error {
+	return err
+}
+
+// failingRevoker is a Revoker whose store is down
+type failingRevoker struct{}
+
+func (failingRevoker) RevokeAll(ctx context.Context, userID uint64) (int, error) {
+	return 0, errors.New("connection lost")
+}
+
+func TestDeleteRevokeFailure(t *testing.T) {
+	ctx := context.Background()
+	events := &users.EventLog{}
+	store := users.MakeMemory(events, failingRevoker{}, failingRevoker{})
+
+	id, err := store.CreateUser(ctx, "tobo", "obot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The user is gone once deleted, so the greeter service must learn about it whatever happens to its logins
+	if err := store.DeleteUserByID(ctx, id); err != nil {
+		t.Fatalf("Expected the delete to succeed, got %v", err)
+	}
+	published := events.Events()
+	if len(published) != 2 || published[1].Type != int(users.Deleted) || published[1].ID != id {
+		t.Fatalf("Expected a deleted event, got %+v", published)
+	}
+	if _, err := store.GetUserByID(ctx, id); !errors.Is(err, users.ErrNotFound) {
+		t.Fatalf("Expected the user to be gone, got %v", err)
+	}
+}
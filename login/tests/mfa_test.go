@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+	"github.com/rinswind/distributed-greeter/login/internal/totp"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"}
+	for unix, expected := range vectors {
+		code, err := totp.Code(secret, totp.Step(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expected {
+			t.Fatalf("Expected code %v at %v, got %v", expected, unix, code)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	for _, drift := range []time.Duration{-30 * time.Second, 0, 30 * time.Second} {
+		code, _ := totp.Code(secret, totp.Step(now.Add(drift)))
+		if step, ok, err := totp.Verify(secret, code, now); err != nil || !ok || step != totp.Step(now.Add(drift)) {
+			t.Fatalf("Expected code drifted by %v to verify, got %v %v %v", drift, step, ok, err)
+		}
+	}
+	code, _ := totp.Code(secret, totp.Step(now.Add(-2*time.Minute)))
+	if _, ok, _ := totp.Verify(secret, code, now); ok {
+		t.Fatal("Expected stale code to be rejected")
+	}
+
+	uri := totp.URI("greeter", "tobo", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/greeter:tobo?") || !strings.Contains(uri, "secret="+secret) {
+		t.Fatalf("Unexpected provisioning URI %v", uri)
+	}
+
+	png, err := totp.QR(uri, 128)
+	if err != nil || !bytes.HasPrefix(png, []byte("\x89PNG")) {
+		t.Fatalf("Expected a PNG, got %v", err)
+	}
+
+	codes, err := totp.RecoveryCodes(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totp.HashRecoveryCode(codes[0]) != totp.HashRecoveryCode(" "+strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))) {
+		t.Fatal("Expected recovery codes to match regardless of case and dashes")
+	}
+}
+
+func TestLoginMFA(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+	mock := lf.mock
+	bearer := lf.token.AccessToken
+	userCols := []string{"id", "name", "password"}
+	totpCols := []string{"secret", "confirmed", "last_step"}
+
+	expectUser := func() {
+		mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	}
+
+	// Enroll
+	expectUser()
+	mock.ExpectExec("INSERT INTO totp").WillReturnResult(sqlmock.NewResult(0, 1))
+	resp := serve(lf.router, http.MethodPost, "/users/7/totp", bearer, "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected enrollment to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+		QRCode string `json:"qr_code"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &enrollment); err != nil {
+		t.Fatal(err)
+	}
+	secret := enrollment.Secret
+	pending := sqlmock.NewRows(totpCols).AddRow(secret, false, 0)
+
+	expectUser()
+	mock.ExpectQuery("SELECT (.+) FROM totp").WithArgs(7).WillReturnRows(pending)
+	resp = serve(lf.router, http.MethodGet, enrollment.QRCode, bearer, "")
+	if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected QR code, got %v: %v", resp.Code, resp.Header())
+	}
+
+	// Confirm
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+	wrong := code[:5] + string('0'+(code[5]-'0'+1)%10)
+
+	mock.ExpectQuery("SELECT (.+) FROM totp").WithArgs(7).WillReturnRows(sqlmock.NewRows(totpCols).AddRow(secret, false, 0))
+	resp = serve(lf.router, http.MethodPost, "/users/7/totp/confirm", bearer, `{"code": "`+wrong+`"}`)
+	assertProblem(t, resp, http.StatusBadRequest, problem.CodeValidationFailed)
+
+	mock.ExpectQuery("SELECT (.+) FROM totp").WithArgs(7).WillReturnRows(sqlmock.NewRows(totpCols).AddRow(secret, false, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE totp SET confirmed=true").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM recovery_codes").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < 10; i++ {
+		mock.ExpectExec("INSERT INTO recovery_codes").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+	resp = serve(lf.router, http.MethodPost, "/users/7/totp/confirm", bearer, `{"code": "`+code+`"}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected confirmation to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+	var recovery struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &recovery); err != nil || len(recovery.RecoveryCodes) != 10 {
+		t.Fatalf("Expected 10 recovery codes, got %v %v", recovery, err)
+	}
+
+	// Enrolling again keeps the confirmed secret
+	expectUser()
+	mock.ExpectExec("INSERT INTO totp").WillReturnResult(sqlmock.NewResult(0, 0))
+	assertProblem(t, serve(lf.router, http.MethodPost, "/users/7/totp", bearer, ""), http.StatusConflict, problem.CodeConflict)
+
+	challenge := func() string {
+		t.Helper()
+		mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+		mock.ExpectQuery("SELECT (.+) FROM totp").WithArgs(7).WillReturnRows(sqlmock.NewRows(totpCols).AddRow(secret, true, 0))
+		resp := serve(lf.router, http.MethodPost, "/logins", "", `{"user_name": "tobo", "user_password": "obot"}`)
+		if resp.Code != http.StatusAccepted || strings.Contains(resp.Body.String(), "access_token") {
+			t.Fatalf("Expected MFA challenge, got %v: %v", resp.Code, resp.Body.String())
+		}
+		var challenge struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		if err := json.Unmarshal(resp.Body.Bytes(), &challenge); err != nil {
+			t.Fatal(err)
+		}
+		return challenge.MFAToken
+	}
+
+	// Login with a TOTP code, retrying a mistyped one
+	mfaToken := challenge()
+
+	expectUser()
+	mock.ExpectQuery("SELECT (.+) FROM totp").WithArgs(7).WillReturnRows(sqlmock.NewRows(totpCols).AddRow(secret, true, 0))
+	resp = serve(lf.router, http.MethodPost, "/logins/mfa", "", `{"mfa_token": "`+mfaToken+`", "code": "`+wrong+`"}`)
+	assertProblem(t, resp, http.StatusUnauthorized, problem.CodeUnauthorized)
+
+	expectUser()
+	mock.ExpectQuery("SELECT (.+) FROM totp").WithArgs(7).WillReturnRows(sqlmock.NewRows(totpCols).AddRow(secret, true, 0))
+	mock.ExpectExec("UPDATE totp SET last_step").WillReturnResult(sqlmock.NewResult(0, 1))
+	resp = serve(lf.router, http.MethodPost, "/logins/mfa", "", `{"mfa_token": "`+mfaToken+`", "code": "`+code+`"}`)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "access_token") {
+		t.Fatalf("Expected login to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+
+	// Challenges are single use
+	resp = serve(lf.router, http.MethodPost, "/logins/mfa", "", `{"mfa_token": "`+mfaToken+`", "code": "`+code+`"}`)
+	assertProblem(t, resp, http.StatusUnauthorized, problem.CodeUnauthorized)
+
+	// Codes are single use
+	mfaToken = challenge()
+	expectUser()
+	mock.ExpectQuery("SELECT (.+) FROM totp").WithArgs(7).WillReturnRows(sqlmock.NewRows(totpCols).AddRow(secret, true, totp.Step(time.Now())))
+	mock.ExpectExec("UPDATE totp SET last_step").WillReturnResult(sqlmock.NewResult(0, 0))
+	resp = serve(lf.router, http.MethodPost, "/logins/mfa", "", `{"mfa_token": "`+mfaToken+`", "code": "`+code+`"}`)
+	assertProblem(t, resp, http.StatusUnauthorized, problem.CodeUnauthorized)
+
+	// Login with a recovery code
+	expectUser()
+	mock.ExpectExec("DELETE FROM recovery_codes").WithArgs(7, totp.HashRecoveryCode(recovery.RecoveryCodes[0])).WillReturnResult(sqlmock.NewResult(0, 1))
+	resp = serve(lf.router, http.MethodPost, "/logins/mfa", "", `{"mfa_token": "`+mfaToken+`", "recovery_code": "`+recovery.RecoveryCodes[0]+`"}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected recovery login to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
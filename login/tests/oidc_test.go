@@ -0,0 +1,361 @@
+package tests
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+	"github.com/rinswind/distributed-greeter/login/internal/oidc"
+	"github.com/rinswind/distributed-greeter/login/internal/server"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+	"github.com/rinswind/distributed-greeter/login/internal/users"
+	"golang.org/x/oauth2"
+)
+
+const callbackURL = "https://app.example.org/callback"
+
+// formNonce finds the nonce in a rendered login form
+var formNonce = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// readForm reads a login form page and returns its nonce
+func readForm(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := formNonce.FindSubmatch(body)
+	if m == nil {
+		t.Fatalf("Expected a login form with a nonce, got %s", body)
+	}
+	return string(m[1])
+}
+
+// captured is a sqlmock argument that matches anything and remembers it
+type captured struct {
+	value driver.Value
+}
+
+func (ca *captured) Match(v driver.Value) bool {
+	ca.value = v
+	return true
+}
+
+func TestRegisterClient(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{})
+	rdb := redis.NewClient(&redis.Options{Addr: lf.redis.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	admin := (&server.AdminEndpoint{Users: users.Make(db, sqldb.MySQL, rdb, users.Timeouts{})}).Router()
+
+	resp := serve(admin, http.MethodPost, "/oidc/clients", "", `{"name": "app", "redirect_uris": ["/callback"]}`)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a relative redirect URI to be rejected, got %v", resp.Code)
+	}
+
+	id, hash := &captured{}, &captured{}
+	mock.ExpectExec("INSERT INTO oidc_clients").WithArgs(id, "app", hash, callbackURL).WillReturnResult(sqlmock.NewResult(0, 1))
+	resp = serve(admin, http.MethodPost, "/oidc/clients", "", `{"name": "app", "redirect_uris": ["`+callbackURL+`"]}`)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status %v, got %v: %v", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+
+	var info struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ClientID != id.value || info.ClientSecret == "" || hash.value != oidc.HashSecret(info.ClientSecret) {
+		t.Fatalf("Expected the secret to be stored hashed, got %+v and hash %v", info, hash.value)
+	}
+
+	// Public clients have no secret
+	mock.ExpectExec("INSERT INTO oidc_clients").WithArgs(sqlmock.AnyArg(), "spa", "", callbackURL).WillReturnResult(sqlmock.NewResult(0, 1))
+	resp = serve(admin, http.MethodPost, "/oidc/clients", "", `{"name": "spa", "redirect_uris": ["`+callbackURL+`"], "public": true}`)
+	if resp.Code != http.StatusCreated || strings.Contains(resp.Body.String(), "client_secret") {
+		t.Fatalf("Expected a public client without secret, got %v: %v", resp.Code, resp.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCFlow(t *testing.T) {
+	ctx := context.Background()
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+
+	rdb := redis.NewClient(&redis.Options{Addr: lf.redis.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	// The issuer is the URL of the server, which is known only once it runs
+	var router http.Handler
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(provider.Close)
+
+	lf.endpoint.OIDCIssuer = provider.URL
+	lf.endpoint.OIDCCodes = oidc.Make(rdb, time.Minute)
+	router = lf.endpoint.Router()
+
+	clientSecret := "app-secret"
+	expectClient := func() {
+		lf.mock.ExpectQuery("SELECT (.+) FROM oidc_clients WHERE id=?").WithArgs("app").
+			WillReturnRows(sqlmock.NewRows([]string{"name", "secret_hash", "redirect_uris"}).
+				AddRow("App", oidc.HashSecret(clientSecret), callbackURL))
+	}
+	userCols := []string{"id", "name", "password"}
+
+	// The relying party discovers the provider
+	rp, err := gooidc.NewProvider(ctx, provider.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := oauth2.Config{
+		ClientID:     "app",
+		ClientSecret: clientSecret,
+		Endpoint:     rp.Endpoint(),
+		RedirectURL:  callbackURL,
+		Scopes:       []string{gooidc.ScopeOpenID, "profile"},
+	}
+
+	verifier := oauth2.GenerateVerifier()
+	authURL, err := url.Parse(cfg.AuthCodeURL("xyz", oauth2.S256ChallengeOption(verifier), gooidc.Nonce("n-0S6")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The browser gets the login form...
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	expectClient()
+	resp, err := browser.Get(authURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected the login form, got %v %v", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	nonce := readForm(t, resp)
+
+	// A form posted by another site lacks the nonce, and is shown again
+	form := authURL.Query()
+	form.Set("user_name", "tobo")
+	form.Set("user_password", "obot")
+
+	expectClient()
+	resp, err = browser.PostForm(provider.URL+oidc.PathAuthorize, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a form without the nonce to be rejected, got %v", resp.StatusCode)
+	}
+	again := readForm(t, resp)
+	if again == nonce {
+		t.Fatal("Expected a fresh nonce for the form shown again")
+	}
+
+	// ...and the browser posts it back with the credentials
+	form.Set("csrf_token", again)
+
+	expectClient()
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").
+		WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	expectNoTOTP(lf.mock, 7)
+	resp, err = browser.PostForm(provider.URL+oidc.PathAuthorize, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected a redirect to the client, got %v", resp.StatusCode)
+	}
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := callback.Query().Get("code")
+	if !strings.HasPrefix(callback.String(), callbackURL) || code == "" || callback.Query().Get("state") != "xyz" {
+		t.Fatalf("Unexpected redirect %v", callback)
+	}
+
+	// The relying party redeems the code without the verifier...
+	expectClient()
+	if _, err := cfg.Exchange(ctx, code); err == nil {
+		t.Fatal("Expected the exchange without a code verifier to fail")
+	}
+
+	// ...which burned the code, so the flow starts over
+	expectClient()
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").
+		WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	expectNoTOTP(lf.mock, 7)
+	resp, err = browser.PostForm(provider.URL+oidc.PathAuthorize, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ = url.Parse(resp.Header.Get("Location"))
+	code = callback.Query().Get("code")
+
+	expectClient()
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	token, err := cfg.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		t.Fatal("Expected an ID token")
+	}
+	idToken, err := rp.Verifier(&gooidc.Config{ClientID: "app"}).Verify(ctx, rawIDToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var idClaims struct {
+		UserID   uint64 `json:"user_id"`
+		UserName string `json:"user_name"`
+	}
+	if err := idToken.Claims(&idClaims); err != nil {
+		t.Fatal(err)
+	}
+	if idToken.Subject != "7" || idToken.Nonce != "n-0S6" || idClaims.UserID != 7 || idClaims.UserName != "tobo" {
+		t.Fatalf("Unexpected ID token %+v with claims %+v", idToken, idClaims)
+	}
+
+	// The access token works at the userinfo endpoint
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	userinfo, err := rp.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var infoClaims struct {
+		UserName string `json:"user_name"`
+	}
+	if err := userinfo.Claims(&infoClaims); err != nil {
+		t.Fatal(err)
+	}
+	if userinfo.Subject != "7" || infoClaims.UserName != "tobo" {
+		t.Fatalf("Unexpected userinfo %+v", userinfo)
+	}
+
+	// ...but not at the API the users call themselves
+	raw, err := base64.StdEncoding.DecodeString(token.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/users/7", "/users/7/api-keys"} {
+		resp := serve(lf.router, http.MethodGet, path, string(raw), "")
+		if resp.Code != http.StatusUnauthorized || !strings.Contains(resp.Header().Get("WWW-Authenticate"), "invalid_audience") {
+			t.Fatalf("Expected the client token to be rejected at %v, got %v", path, resp.Code)
+		}
+	}
+
+	// Codes work once
+	expectClient()
+	if _, err := cfg.Exchange(ctx, code, oauth2.VerifierOption(verifier)); err == nil {
+		t.Fatal("Expected a replayed code to fail")
+	}
+
+	if err := lf.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCAuthorizeErrors(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{})
+	lf.endpoint.OIDCIssuer = "https://example.org"
+	router := lf.endpoint.Router()
+
+	expectClient := func() {
+		lf.mock.ExpectQuery("SELECT (.+) FROM oidc_clients WHERE id=?").WithArgs("app").
+			WillReturnRows(sqlmock.NewRows([]string{"name", "secret_hash", "redirect_uris"}).AddRow("App", "", callbackURL))
+	}
+
+	query := func(change func(url.Values)) string {
+		params := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {"app"},
+			"redirect_uri":          {callbackURL},
+			"scope":                 {"openid"},
+			"state":                 {"xyz"},
+			"code_challenge":        {"E9Melhoe2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+			"code_challenge_method": {"S256"},
+		}
+		change(params)
+		return oidc.PathAuthorize + "?" + params.Encode()
+	}
+
+	// Untrusted redirect URIs get no redirect
+	expectClient()
+	resp := serve(router, http.MethodGet, query(func(p url.Values) { p.Set("redirect_uri", "https://evil.example.org/") }), "", "")
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %v, got %v", http.StatusBadRequest, resp.Code)
+	}
+
+	cases := []struct {
+		name   string
+		change func(url.Values)
+		code   oidc.Code
+	}{
+		{"implicit flow", func(p url.Values) { p.Set("response_type", "token") }, oidc.CodeUnsupportedResponseType},
+		{"no openid scope", func(p url.Values) { p.Set("scope", "profile") }, oidc.CodeInvalidScope},
+		{"no PKCE", func(p url.Values) { p.Del("code_challenge") }, oidc.CodeInvalidRequest},
+		{"plain PKCE", func(p url.Values) { p.Set("code_challenge_method", "plain") }, oidc.CodeInvalidRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectClient()
+			resp := serve(router, http.MethodGet, query(tc.change), "", "")
+			if resp.Code != http.StatusFound {
+				t.Fatalf("Expected status %v, got %v", http.StatusFound, resp.Code)
+			}
+			location, err := url.Parse(resp.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if location.Query().Get("error") != string(tc.code) || location.Query().Get("state") != "xyz" {
+				t.Fatalf("Expected error %v, got %v", tc.code, location)
+			}
+		})
+	}
+
+	if err := lf.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,226 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/notify"
+	"github.com/rinswind/distributed-greeter/login/internal/onetime"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+)
+
+func TestChangePassword(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+	userCols := []string{"id", "name", "password"}
+
+	token := loginAs(t, lf, "tobo", "obot")
+
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	resp := serve(lf.router, http.MethodPut, "/users/7/password", token, `{"current_password": "nope", "new_password": "obot-obot"}`)
+	assertProblem(t, resp, http.StatusForbidden, problem.CodeForbidden)
+
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	resp = serve(lf.router, http.MethodPut, "/users/7/password", token, `{"current_password": "obot", "new_password": "password"}`)
+	assertProblem(t, resp, http.StatusBadRequest, problem.CodeValidationFailed)
+
+	resp = serve(lf.router, http.MethodPut, "/users/8/password", token, `{"current_password": "obot", "new_password": "obot-obot"}`)
+	assertProblem(t, resp, http.StatusForbidden, problem.CodeForbidden)
+
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	lf.mock.ExpectExec("UPDATE users SET password").WithArgs("obot-obot", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	resp = serve(lf.router, http.MethodPut, "/users/7/password", token, `{"current_password": "obot", "new_password": "obot-obot"}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected password change to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+
+	// The change ends all sessions
+	if resp := serve(lf.router, http.MethodGet, "/users/7/logins", token, ""); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected session to end with the password change, got %v", resp.Code)
+	}
+
+	if err := lf.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+	userCols := []string{"id", "name", "password"}
+
+	// Unknown users are not revealed
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("nobody").WillReturnRows(sqlmock.NewRows(userCols))
+	if resp := serve(lf.router, http.MethodPost, "/password-resets", "", `{"user_name": "nobody"}`); resp.Code != http.StatusAccepted {
+		t.Fatalf("Expected reset request to be accepted, got %v: %v", resp.Code, resp.Body.String())
+	}
+	if _, err := os.Stat(lf.mails); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected no mail to unknown user, got %v", err)
+	}
+
+	// Users without a verified address can not be reached
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	expectEmail(lf.mock, 7, "tobo@example.org", false)
+	if resp := serve(lf.router, http.MethodPost, "/password-resets", "", `{"user_name": "tobo"}`); resp.Code != http.StatusAccepted {
+		t.Fatalf("Expected reset request to be accepted, got %v: %v", resp.Code, resp.Body.String())
+	}
+	if _, err := os.Stat(lf.mails); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected no mail to unverified address, got %v", err)
+	}
+
+	// A failure to notify a known user looks the same as an unknown user
+	notifier := lf.endpoint.Notifier
+	lf.endpoint.Notifier = &notify.FileNotifier{Path: filepath.Join(t.TempDir(), "missing", "mails")}
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	expectEmail(lf.mock, 7, "tobo@example.org", true)
+	if resp := serve(lf.router, http.MethodPost, "/password-resets", "", `{"user_name": "tobo"}`); resp.Code != http.StatusAccepted {
+		t.Fatalf("Expected reset request to be accepted despite the notifier, got %v: %v", resp.Code, resp.Body.String())
+	}
+	lf.endpoint.Notifier = notifier
+
+	requestReset := func() string {
+		t.Helper()
+		lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+		expectEmail(lf.mock, 7, "tobo@example.org", true)
+		if resp := serve(lf.router, http.MethodPost, "/password-resets", "", `{"user_name": "tobo"}`); resp.Code != http.StatusAccepted {
+			t.Fatalf("Expected reset request to be accepted, got %v: %v", resp.Code, resp.Body.String())
+		}
+
+		mail := lastMail(t, lf.mails)
+		if mail.To != "tobo@example.org" {
+			t.Fatalf("Expected mail to tobo, got %+v", mail)
+		}
+		_, token, ok := strings.Cut(mail.Body, "https://example.org/#reset=")
+		if !ok {
+			t.Fatalf("Expected reset link in mail, got %+v", mail)
+		}
+		return strings.TrimSpace(token)
+	}
+
+	confirm := func(token, password string) *httptest.ResponseRecorder {
+		return serve(lf.router, http.MethodPost, "/password-resets/confirm", "", `{"token": "`+token+`", "new_password": "`+password+`"}`)
+	}
+
+	resetToken := requestReset()
+
+	// A rejected password does not use up the token
+	assertProblem(t, confirm(resetToken, "short"), http.StatusBadRequest, problem.CodeValidationFailed)
+	assertProblem(t, confirm("forged", "obot-obot"), http.StatusBadRequest, problem.CodeValidationFailed)
+
+	session := loginAs(t, lf, "tobo", "obot")
+
+	lf.mock.ExpectExec("UPDATE users SET password").WithArgs("obot-obot", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	if resp := confirm(resetToken, "obot-obot"); resp.Code != http.StatusOK {
+		t.Fatalf("Expected reset to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+	if resp := serve(lf.router, http.MethodGet, "/users/7/logins", session, ""); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected session to end with the reset, got %v", resp.Code)
+	}
+
+	// Tokens are single use
+	assertProblem(t, confirm(resetToken, "obot-obot"), http.StatusBadRequest, problem.CodeValidationFailed)
+
+	// Tokens expire
+	resetToken = requestReset()
+	lf.redis.FastForward(2 * time.Minute)
+	assertProblem(t, confirm(resetToken, "obot-obot"), http.StatusBadRequest, problem.CodeValidationFailed)
+
+	if err := lf.mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOneTimeTokens(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	tokens := onetime.Make(rdb, "test", time.Minute)
+
+	first, err := tokens.Issue(ctx, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tokens.Issue(ctx, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tokens.Redeem(ctx, first); !errors.Is(err, onetime.ErrInvalid) {
+		t.Fatalf("Expected reissue to invalidate the previous token, got %v", err)
+	}
+	if subject, err := tokens.Redeem(ctx, second); err != nil || subject != "7" {
+		t.Fatalf("Expected token of 7, got %v, %v", subject, err)
+	}
+	if _, err := tokens.Redeem(ctx, second); !errors.Is(err, onetime.ErrInvalid) {
+		t.Fatalf("Expected token to be single use, got %v", err)
+	}
+}
+
+// loginAs logs in a user of the fixture DB as user 7 and returns the access token
+func loginAs(t *testing.T, lf *loginFixture, name, password string) string {
+	t.Helper()
+
+	lf.mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs(name).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password"}).AddRow(7, name, password))
+	expectNoTOTP(lf.mock, 7)
+	resp := serve(lf.router, http.MethodPost, "/logins", "", `{"user_name": "`+name+`", "user_password": "`+password+`"}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected login to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+
+	var login struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &login); err != nil {
+		t.Fatal(err)
+	}
+	return login.AccessToken
+}
+
+// serve sends a JSON request, authenticated with the access token if one is given
+func serve(router http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(token)))
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+// lastMail reads the latest message written by a notify.FileNotifier
+func lastMail(t *testing.T, file string) *notify.Message {
+	t.Helper()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var msg notify.Message
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
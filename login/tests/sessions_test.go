@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rinswind/distributed-greeter/common/problem"
+)
+
+func TestSessions(t *testing.T) {
+	router, mock, _ := setupLogin(t)
+	userCols := []string{"id", "name", "password"}
+
+	call := func(method, path, bearer, userAgent string) *httptest.ResponseRecorder {
+		var body string
+		if method == http.MethodPost {
+			body = `{"user_name": "tobo", "user_password": "obot"}`
+		}
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", userAgent)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(bearer)))
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	type LoginInfo struct {
+		UserID      uint64 `json:"user_id"`
+		LoginID     string `json:"login_id"`
+		AccessToken string `json:"access_token"`
+	}
+
+	login := func(userAgent string) LoginInfo {
+		t.Helper()
+		mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").
+			WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+		expectNoTOTP(mock, 7)
+		resp := call(http.MethodPost, "/logins", "", userAgent)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected login to succeed, got %v: %v", resp.Code, resp.Body.String())
+		}
+		var info LoginInfo
+		if err := json.Unmarshal(resp.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	type Logins struct {
+		Logins []struct {
+			LoginID   string `json:"login_id"`
+			UserAgent string `json:"user_agent"`
+			IP        string `json:"ip"`
+			Current   bool   `json:"current"`
+		} `json:"logins"`
+	}
+
+	list := func(bearer string) Logins {
+		t.Helper()
+		resp := call(http.MethodGet, "/users/7/logins", bearer, "")
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected list to succeed, got %v: %v", resp.Code, resp.Body.String())
+		}
+		var logins Logins
+		if err := json.Unmarshal(resp.Body.Bytes(), &logins); err != nil {
+			t.Fatal(err)
+		}
+		return logins
+	}
+
+	laptop := login("laptop")
+	phone := login("phone")
+	tablet := login("tablet")
+
+	logins := list(laptop.AccessToken)
+	if len(logins.Logins) != 3 {
+		t.Fatalf("Expected 3 logins, got %+v", logins)
+	}
+	for _, l := range logins.Logins {
+		if l.Current != (l.LoginID == laptop.LoginID) || l.IP == "" || l.UserAgent == "" {
+			t.Fatalf("Unexpected login %+v", l)
+		}
+	}
+
+	// Other users are off limits
+	assertProblem(t, call(http.MethodGet, "/users/8/logins", laptop.AccessToken, ""), http.StatusForbidden, problem.CodeForbidden)
+
+	// Revoke a single login
+	if resp := call(http.MethodDelete, "/users/7/logins/"+phone.LoginID, laptop.AccessToken, ""); resp.Code != http.StatusOK {
+		t.Fatalf("Expected revoke to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+	assertProblem(t, call(http.MethodDelete, "/users/7/logins/"+phone.LoginID, laptop.AccessToken, ""), http.StatusNotFound, problem.CodeNotFound)
+	if resp := call(http.MethodGet, "/users/7/logins", phone.AccessToken, ""); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected revoked login to be rejected, got %v", resp.Code)
+	}
+	if logins := list(tablet.AccessToken); len(logins.Logins) != 2 {
+		t.Fatalf("Expected 2 logins, got %+v", logins)
+	}
+
+	// Log out everywhere
+	if resp := call(http.MethodDelete, "/users/7/logins", tablet.AccessToken, ""); resp.Code != http.StatusOK || resp.Body.String() != `{"revoked":2}` {
+		t.Fatalf("Expected 2 revoked logins, got %v: %v", resp.Code, resp.Body.String())
+	}
+	for _, token := range []string{laptop.AccessToken, tablet.AccessToken} {
+		if resp := call(http.MethodGet, "/users/7/logins", token, ""); resp.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected revoked login to be rejected, got %v", resp.Code)
+		}
+	}
+
+	// Deleting the user ends its sessions
+	desktop := login("desktop")
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WithArgs(7).WillReturnRows(sqlmock.NewRows(userCols).AddRow(7, "tobo", "obot"))
+	mock.ExpectExec("DELETE FROM users").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if resp := call(http.MethodDelete, "/users/7", desktop.AccessToken, ""); resp.Code != http.StatusOK {
+		t.Fatalf("Expected delete to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+	if resp := call(http.MethodGet, "/users/7/logins", desktop.AccessToken, ""); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected login of deleted user to be rejected, got %v", resp.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,213 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/server"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+)
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	now := time.Unix(1000, 0)
+	guard := throttle.Make(rdb, throttle.Limits{
+		Window:          time.Minute,
+		Delay:           time.Second,
+		MaxDelay:        4 * time.Second,
+		MaxUserFailures: 5,
+		MaxIPFailures:   8,
+		Lockout:         10 * time.Minute,
+	}).WithClock(func() time.Time { return now })
+
+	expectRetry := func(err error, target error, after time.Duration) {
+		t.Helper()
+		var retryErr *throttle.RetryError
+		if !errors.Is(err, target) || !errors.As(err, &retryErr) || retryErr.RetryAfter != after {
+			t.Fatalf("Expected %v with retry after %v, got %v", target, after, err)
+		}
+	}
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	attempt := func(user, ip string) *throttle.Attempt {
+		t.Helper()
+		a, err := guard.Attempt(ctx, user, ip)
+		check(err)
+		return a
+	}
+	fail := func(user, ip string) {
+		t.Helper()
+		check(attempt(user, ip).Fail(ctx))
+	}
+
+	// Delays grow with every failure
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		fail("tobo", "10.0.0.1")
+		_, err := guard.Attempt(ctx, "tobo", "10.0.0.1")
+		expectRetry(err, throttle.ErrThrottled, delay)
+		now = now.Add(delay)
+		t.Logf("Failure %v delayed by %v", i+1, delay)
+	}
+
+	// The last failure locks the user out
+	fail("tobo", "10.0.0.1")
+	_, err := guard.Attempt(ctx, "tobo", "10.0.0.2")
+	expectRetry(err, throttle.ErrLocked, 10*time.Minute)
+	mr.FastForward(10 * time.Minute)
+	attempt("tobo", "10.0.0.2")
+
+	// Failures of many users from one client throttle the client
+	for _, name := range []string{"u1", "u2", "u3", "u4", "u5", "u6", "u7"} {
+		fail(name, "10.0.0.9")
+	}
+	now = now.Add(10 * time.Second)
+	fail("u8", "10.0.0.9")
+	_, err = guard.Attempt(ctx, "anna", "10.0.0.9")
+	expectRetry(err, throttle.ErrThrottled, 50*time.Second)
+
+	// Success forgets the failures of a user
+	now = now.Add(time.Minute)
+	fail("anna", "10.0.0.3")
+	now = now.Add(time.Second)
+	check(attempt("anna", "10.0.0.3").Succeed(ctx))
+	check(attempt("anna", "10.0.0.3").Release(ctx))
+	attempt("anna", "10.0.0.3")
+}
+
+func TestGuardUnboundedDelay(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	now := time.Unix(1000, 0)
+	guard := throttle.Make(rdb, throttle.Limits{Window: time.Hour, Delay: time.Second}).
+		WithClock(func() time.Time { return now })
+
+	// Without a MaxDelay the delay keeps doubling
+	for _, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second} {
+		attempt, err := guard.Attempt(ctx, "tobo", "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := attempt.Fail(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		var retryErr *throttle.RetryError
+		if _, err := guard.Attempt(ctx, "tobo", "10.0.0.1"); !errors.As(err, &retryErr) || retryErr.RetryAfter != delay {
+			t.Fatalf("Expected retry after %v, got %v", delay, err)
+		}
+		now = now.Add(delay)
+	}
+}
+
+func TestGuardConcurrentAttempts(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	guard := throttle.Make(rdb, throttle.Limits{Window: time.Minute, MaxUserFailures: 3, Lockout: time.Minute})
+
+	// Attempts in flight count as failures, so no more than the maximum get past the check
+	var wg sync.WaitGroup
+	var admitted atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := guard.Attempt(ctx, "tobo", "10.0.0.1"); err == nil {
+				admitted.Add(1)
+			} else if !errors.Is(err, throttle.ErrLocked) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := admitted.Load(); n != 3 {
+		t.Fatalf("Expected 3 attempts to be admitted, got %v", n)
+	}
+
+	// A released attempt does not count
+	unlocked, err := guard.Unlock(ctx, "tobo")
+	if err != nil || !unlocked {
+		t.Fatalf("Expected tobo to be locked, got %v, %v", unlocked, err)
+	}
+	for i := 0; i < 5; i++ {
+		a, err := guard.Attempt(ctx, "tobo", "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Release(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 2, Lockout: time.Minute})
+	router, mock := lf.router, lf.mock
+	admin := (&server.AdminEndpoint{Guard: lf.guard}).Router()
+
+	login := func(name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/logins", strings.NewReader(`{"user_name": "`+name+`", "user_password": "bad"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for _, name := range []string{"tobo", "TOBO"} {
+		mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password"}).AddRow(7, "tobo", "obot"))
+		if resp := login(name); resp.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status %v, got %v: %v", http.StatusUnauthorized, resp.Code, resp.Body.String())
+		}
+	}
+
+	resp := login("Tobo")
+	assertProblem(t, resp, http.StatusTooManyRequests, problem.CodeAccountLocked)
+	if resp.Header().Get("Retry-After") != "60" {
+		t.Fatalf("Expected Retry-After 60, got %q", resp.Header().Get("Retry-After"))
+	}
+
+	unlock := func() int {
+		resp := httptest.NewRecorder()
+		admin.ServeHTTP(resp, httptest.NewRequest(http.MethodDelete, "/lockouts/Tobo", nil))
+		return resp.Code
+	}
+	if code := unlock(); code != http.StatusOK {
+		t.Fatalf("Expected unlock to succeed, got %v", code)
+	}
+	if code := unlock(); code != http.StatusNotFound {
+		t.Fatalf("Expected second unlock to find no lockout, got %v", code)
+	}
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WithArgs("tobo").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password"}).AddRow(7, "tobo", "obot"))
+	if resp := login("tobo"); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected unlocked login to be attempted, got %v: %v", resp.Code, resp.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
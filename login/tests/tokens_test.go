@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rinswind/distributed-greeter/common/auth"
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/throttle"
+)
+
+func TestTokenErrors(t *testing.T) {
+	lf := setupLoginWith(t, throttle.Limits{Window: time.Minute, MaxUserFailures: 3})
+	ctx := context.Background()
+
+	forger := &auth.AuthWriter{ATSigner: &auth.HMACKey{Secret: "forged"}, RTSigner: &auth.HMACKey{Secret: "forged"}}
+	forged, err := forger.CreateToken(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoked := loginAs(t, lf, "tobo", "obot")
+	if resp := serve(lf.router, http.MethodDelete, "/users/7/logins", revoked, ""); resp.Code != http.StatusOK {
+		t.Fatalf("Expected logout everywhere to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+
+	// Log in with an access token that is born expired
+	lf.endpoint.AuthWriter.ATExpiry = -time.Minute
+	expired := loginAs(t, lf, "tobo", "obot")
+	lf.endpoint.AuthWriter.ATExpiry = time.Minute
+
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(expired, claims); err != nil {
+		t.Fatal(err)
+	}
+	expiredID := claims["access_uuid"].(string)
+	if !lf.redis.Exists("session:" + expiredID) {
+		t.Fatal("Expected login with expired token to be recorded")
+	}
+
+	cases := []struct {
+		name   string
+		authz  string
+		header string
+	}{
+		{name: "missing", authz: "", header: `Bearer`},
+		{name: "bad encoding", authz: "Bearer %%%", header: `Bearer error="malformed_token"`},
+		{name: "malformed", authz: bearer("not.a.jwt"), header: `Bearer error="malformed_token"`},
+		{name: "bad signature", authz: bearer(forged.AccessToken), header: `Bearer error="invalid_signature"`},
+		{name: "expired", authz: bearer(expired), header: `Bearer error="expired_token"`},
+		{name: "revoked", authz: bearer(revoked), header: `Bearer error="revoked_token"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/users/7/logins", nil)
+			if tc.authz != "" {
+				req.Header.Set("Authorization", tc.authz)
+			}
+			resp := httptest.NewRecorder()
+			lf.router.ServeHTTP(resp, req)
+
+			if resp.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected 401, got %v", resp.Code)
+			}
+			if header := resp.Header().Get("WWW-Authenticate"); !strings.HasPrefix(header, tc.header) {
+				t.Fatalf("Expected WWW-Authenticate %v, got %v", tc.header, header)
+			}
+		})
+	}
+
+	// Logout accepts the expired token, but no other
+	if resp := serve(lf.router, http.MethodDelete, "/logins/"+forged.AccessUUID, forged.AccessToken, ""); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected logout with forged token to be rejected, got %v", resp.Code)
+	}
+	if resp := serve(lf.router, http.MethodDelete, "/logins/"+expiredID, expired, ""); resp.Code != http.StatusOK {
+		t.Fatalf("Expected logout with expired token to succeed, got %v: %v", resp.Code, resp.Body.String())
+	}
+	if lf.redis.Exists("session:" + expiredID) {
+		t.Fatal("Expected logout to end the login")
+	}
+
+	// An expired token of a client of the OIDC provider is not a first-party login
+	lf.endpoint.AuthWriter.ATExpiry = -time.Minute
+	client, err := lf.endpoint.AuthWriter.CreateClientToken(ctx, 7, "app", "openid")
+	lf.endpoint.AuthWriter.ATExpiry = time.Minute
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := serve(lf.router, http.MethodDelete, "/logins/"+client.AccessUUID, client.AccessToken, "")
+	if resp.Code != http.StatusUnauthorized || !strings.Contains(resp.Header().Get("WWW-Authenticate"), "invalid_audience") {
+		t.Fatalf("Expected logout with a client token to be rejected, got %v %v", resp.Code, resp.Header().Get("WWW-Authenticate"))
+	}
+
+	// Logins of other users are not revealed
+	other := *lf.endpoint.AuthWriter
+	stranger, err := other.CreateToken(ctx, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.CreateAuth(ctx, stranger); err != nil {
+		t.Fatal(err)
+	}
+	session := loginAs(t, lf, "tobo", "obot")
+	var logins struct {
+		Logins []struct {
+			LoginID string `json:"login_id"`
+		} `json:"logins"`
+	}
+	resp = serve(lf.router, http.MethodGet, "/users/7/logins", session, "")
+	if err := json.Unmarshal(resp.Body.Bytes(), &logins); err != nil || len(logins.Logins) != 1 {
+		t.Fatalf("Expected a single login, got %v: %v", err, resp.Body.String())
+	}
+	resp = serve(lf.router, http.MethodDelete, "/logins/"+logins.Logins[0].LoginID, stranger.AccessToken, "")
+	assertProblem(t, resp, http.StatusForbidden, problem.CodeForbidden)
+
+	// A revoked token of the same user can end only its own login
+	if resp := serve(lf.router, http.MethodDelete, "/logins/"+logins.Logins[0].LoginID, revoked, ""); resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected logout of another login with a revoked token to be rejected, got %v", resp.Code)
+	}
+	if !lf.redis.Exists("session:" + logins.Logins[0].LoginID) {
+		t.Fatal("Expected the other login to stay")
+	}
+}
+
+func bearer(token string) string {
+	return "Bearer " + base64.StdEncoding.EncodeToString([]byte(token))
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/rinswind/distributed-greeter/common/sqldb"
+	"github.com/rinswind/distributed-greeter/login/internal/users"
+)
+
+func TestStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	ioErr := errors.New("connection lost")
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := users.Make(db, sqldb.MySQL, nil, users.Timeouts{})
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO users").WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	mock.ExpectRollback()
+	_, err = store.CreateUser(ctx, "tobo", "obot")
+	if !errors.Is(err, users.ErrUserExists) || !errors.Is(err, users.ErrConflict) {
+		t.Fatalf("Expected duplicate user to be ErrUserExists, got %v", err)
+	}
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE name_key=?").WillReturnError(ioErr)
+	_, err = store.GetUserByName(ctx, "tobo")
+	if !errors.Is(err, ioErr) || errors.Is(err, users.ErrNotFound) {
+		t.Fatalf("Expected I/O failure to be reported as such, got %v", err)
+	}
+
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password"}))
+	_, err = store.GetUserByID(ctx, 7)
+	if !errors.Is(err, users.ErrNotFound) {
+		t.Fatalf("Expected missing user to be ErrNotFound, got %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE id=?").WillReturnRows(sqlmock.NewRows([]string{"id", "name", "password"}).AddRow(7, "tobo", "obot"))
+	mock.ExpectExec("DELETE FROM users").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	err = store.DeleteUserByID(ctx, 7)
+	if !errors.Is(err, users.ErrNotFound) {
+		t.Fatalf("Expected delete of a vanished user to be ErrNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreDump(t *testing.T) {
+	ctx := context.Background()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := users.Make(db, sqldb.MySQL, nil, users.Timeouts{})
+
+	mock.ExpectQuery("SELECT id, name, password FROM users ORDER BY id").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "name", "password"}).AddRow(3, "Tobo", "obot").AddRow(5, "obot", "tobo"))
+	var dump bytes.Buffer
+	count, err := store.Export(ctx, &dump)
+	if err != nil || count != 2 {
+		t.Fatalf("Expected 2 users exported, got %v, %v", count, err)
+	}
+
+	// Users keep their IDs, and names are canonical the same way as at signup
+	mock.ExpectExec("INSERT INTO users").WithArgs(3, "Tobo", "tobo", "obot").WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectExec("INSERT INTO users").WithArgs(5, "obot", "obot", "tobo").WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	imported, skipped, err := store.Import(ctx, &dump)
+	if err != nil || imported != 1 || skipped != 1 {
+		t.Fatalf("Expected 1 user imported and 1 skipped, got %v, %v, %v", imported, skipped, err)
+	}
+
+	if _, _, err := store.Import(ctx, strings.NewReader(`{"id":7,"name":"tobo","password":"obot","admin":true}`)); err == nil {
+		t.Fatal("Expected an unknown field to be rejected")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/rinswind/distributed-greeter/common/problem"
+	"github.com/rinswind/distributed-greeter/login/internal/validation"
+)
+
+func TestValidateSignup(t *testing.T) {
+	breachedList := path.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(breachedList, []byte("# leaked\ncorrect-horse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := validation.New(
+		validation.UsernameRules{Reserved: []string{"admin"}},
+		validation.PasswordRules{BreachedList: breachedList})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		user      string
+		password  string
+		expect    string
+		userErr   string
+		passwdErr string
+	}{
+		{name: "valid", user: "tobo", password: "obot-obot", expect: "tobo"},
+		{name: "unicode letters", user: "Тобо", password: "obot-obot", expect: "Тобо"},
+		{name: "compatibility forms", user: "ｔｏｂｏ", password: "obot-obot", expect: "tobo"},
+		{name: "empty", userErr: validation.CodeRequired, passwdErr: validation.CodeRequired},
+		{name: "short", user: "to", password: "obot", userErr: validation.CodeTooShort, passwdErr: validation.CodeTooShort},
+		{name: "long", user: strings.Repeat("t", 33), password: strings.Repeat("o", 41), userErr: validation.CodeTooLong, passwdErr: validation.CodeTooLong},
+		{name: "bad characters", user: "to bo", password: "obot-obot", userErr: validation.CodeInvalidCharacters},
+		{name: "reserved", user: "Admin", password: "obot-obot", userErr: validation.CodeReserved},
+		{name: "reserved look-alike", user: "ＡＤＭＩＮ", password: "obot-obot", userErr: validation.CodeReserved},
+		{name: "common password", user: "tobo", password: "Password1", passwdErr: validation.CodeBreached},
+		{name: "listed password", user: "tobo", password: "correct-horse", passwdErr: validation.CodeBreached},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			name, err := v.Validate(tc.user, tc.password)
+
+			var errs validation.Errors
+			errors.As(err, &errs)
+			codes := map[string]string{}
+			for _, fe := range errs {
+				codes[fe.Field] = fe.Code
+			}
+
+			if codes[validation.FieldUserName] != tc.userErr || codes[validation.FieldUserPassword] != tc.passwdErr {
+				t.Fatalf("Expected errors %q/%q, got %v", tc.userErr, tc.passwdErr, err)
+			}
+			if err == nil && name != tc.expect {
+				t.Fatalf("Expected name %q, got %q", tc.expect, name)
+			}
+		})
+	}
+}
+
+func TestValidatorColumnLengths(t *testing.T) {
+	if _, err := validation.New(validation.UsernameRules{}, validation.PasswordRules{MaxLength: validation.ColumnPasswordLength + 1}); err == nil {
+		t.Fatal("Expected passwords longer than their column to be rejected")
+	}
+	if _, err := validation.New(validation.UsernameRules{MaxLength: validation.ColumnUsernameLength + 1}, validation.PasswordRules{}); err == nil {
+		t.Fatal("Expected user names longer than their column to be rejected")
+	}
+}
+
+func TestCanonicalUsername(t *testing.T) {
+	for _, name := range []string{"Tobo", "TOBO", "ｔｏｂｏ", "Ｔｏｂｏ"} {
+		if key := validation.CanonicalUsername(name); key != "tobo" {
+			t.Fatalf("Expected %q to fold to tobo, got %q", name, key)
+		}
+	}
+	if validation.CanonicalUsername("Straße") != validation.CanonicalUsername("STRASSE") {
+		t.Fatal("Expected full case folding")
+	}
+}
+
+func TestSignupFieldErrors(t *testing.T) {
+	router, _, _ := setupLogin(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"user_name": "root!", "user_password": ""}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assertProblem(t, resp, http.StatusBadRequest, problem.CodeValidationFailed)
+
+	var p problem.Problem
+	if err := json.Unmarshal(resp.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	codes := map[string]string{}
+	for _, ip := range p.InvalidParams {
+		codes[ip.Name] = ip.Code
+	}
+	if codes["user_name"] != validation.CodeInvalidCharacters || codes["user_password"] != validation.CodeRequired {
+		t.Fatalf("Expected field errors for both fields, got %+v", p.InvalidParams)
+	}
+}
@@ -6,12 +6,22 @@ function isLoggedIn() {
     return !(typeof window.login === "undefined")
 }
 
-// Authenticate requests if login token is available
+function readCookie(name) {
+    var match = document.cookie.match(new RegExp(`(?:^|; )${name}=([^;]*)`));
+    return match ? decodeURIComponent(match[1]) : undefined;
+}
+
+// Authenticate requests if login token is available. Cookie logins keep the token out of reach, so only echo the
+// CSRF cookie instead.
 $.ajaxPrefilter(function(options, originalOptions, jqXHR) {
-    if (isLoggedIn()) {
+    if (isLoggedIn() && window.login.access_token) {
         options.headers = {
             "Authorization": `Bearer ${btoa(window.login.access_token)}`
         };
+    } else if (readCookie("csrf_token")) {
+        options.headers = {
+            "X-CSRF-Token": readCookie("csrf_token")
+        };
     }
 })
 
@@ -68,7 +78,8 @@ $(document).ready(function() {
     $("#logoutBox").submit(function(event) {
         $.ajax({
             type: "DELETE",
-            url: toAppPath(`auth/logins/${window.login.login_id}`),
+            // Cookie logins are ended even if their access token has expired
+            url: window.login.access_token ? toAppPath(`auth/logins/${window.login.login_id}`) : toAppPath("auth/logins"),
          }).fail(function(resp) {
             $("#logoutMessage").text(`Logout failure: ${resp.status}`);
         }).done(function(resp) {
@@ -164,6 +175,17 @@ $(document).ready(function() {
         // Clear the current prefs content
         $("#prefsLanguages").find("option").remove();
         $("#prefsMessage").text("");
+        delete window.prefsVersion;
+
+        // The preferences are saved against the version they were read at
+        $.ajax({
+            type: "GET",
+            url: toAppPath(`messages/users/${window.login.user_id}`),
+        }).fail(function(resp) {
+            $("#prefsMessage").text(`Failed to retrieve preferences: ${resp.status}`);
+        }).done(function(resp, status, xhr) {
+            window.prefsVersion = xhr.getResponseHeader("ETag");
+        });
 
         $.ajax({
             type: "GET",
@@ -194,12 +216,20 @@ $(document).ready(function() {
             type: "PUT",
             url: toAppPath(`messages/users/${window.login.user_id}`),
             contentType: "application/json",
+            headers: {
+                "If-Match": window.prefsVersion || ""
+            },
             data: JSON.stringify({
                 user_language: language
             })
         }).fail(function(resp) {
-            $("#prefsMessage").text(`Failed to save preferences: ${resp.status}`);
-        }).done(function(resp) {
+            if (resp.status == 412) {
+                $("#prefsMessage").text("Preferences changed elsewhere, reopen to see them");
+            } else {
+                $("#prefsMessage").text(`Failed to save preferences: ${resp.status}`);
+            }
+        }).done(function(resp, status, xhr) {
+            window.prefsVersion = xhr.getResponseHeader("ETag");
             $("#prefsMessage").text("Saved preferences");
         });
     });